@@ -17,6 +17,11 @@ import (
 
 var protectionTime = time.Second * 10
 
+//Chunks are compacted by the defragmenter (see defrag.go), not by the PMaps: a compaction
+//in the middle of a Core.Iterate callback would invalidate the iteration.
+//They keep their chunkSize, the defragmentation heuristic of Core.Delete relies on it
+var chunkOptions = pmap.Options{CompactionThreshold: -1, NoAutoGrow: true}
+
 //Core provides an interface to access local stored chunks
 type Core struct {
 	dbpath        string
@@ -57,6 +62,15 @@ func New(dbpath string, chunkSize uint64, numChunks int) *Core {
 	return c
 }
 
+//Returns a new chunk PMap stored in path
+func (c *Core) newChunk(path string) *pmap.PMap {
+	pm, err := pmap.NewWithOptions(path, c.chunkSize, chunkOptions)
+	if err != nil {
+		panic(err)
+	}
+	return pm
+}
+
 //Returns the filesystem path given the chunk ID and its revision number
 func (c *Core) chunkPath(chunkID int, revision int64) string {
 	if c.dbpath == "" {
@@ -88,8 +102,13 @@ func (c *Core) Open() {
 		path := c.findChunk(i)
 		if path != "" {
 			log.Println("Opening", path)
-			chunk.pm = pmap.Open(path)
-			chunk.present = true
+			pm, err := pmap.OpenWithOptions(path, chunkOptions)
+			if err != nil {
+				log.Println("Could not open", path, err)
+			} else {
+				chunk.pm = pm
+				chunk.present = true
+			}
 		}
 		chunk.Unlock()
 	}
@@ -162,7 +181,7 @@ func (c *Core) ChunkSetPresent(cid int) {
 	defer chunk.Unlock()
 	defer c.mutex.Unlock()
 	if !chunk.present {
-		chunk.pm = pmap.New(c.chunkPath(cid, 0), c.chunkSize)
+		chunk.pm = c.newChunk(c.chunkPath(cid, 0))
 		c.knownChunks++
 		chunk.present = true
 	}
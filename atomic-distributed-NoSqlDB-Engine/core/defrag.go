@@ -2,7 +2,6 @@ package core
 
 import (
 	"log"
-	"github.com/dv343/treeless/core/pmap"
 	"github.com/dv343/treeless/hashing"
 )
 
@@ -26,9 +25,9 @@ func newDefragmenter(c *Core) chan<- defragOp {
 			old := chunk.pm
 			chunk.revision++
 			if c.dbpath == "" {
-				chunk.pm = pmap.New("", c.chunkSize)
+				chunk.pm = c.newChunk("")
 			} else {
-				chunk.pm = pmap.New(c.chunkPath(op.chunkID, chunk.revision), c.chunkSize)
+				chunk.pm = c.newChunk(c.chunkPath(op.chunkID, chunk.revision))
 			}
 
 			old.Iterate(func(key, value []byte) bool {
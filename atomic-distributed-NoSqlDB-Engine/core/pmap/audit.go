@@ -0,0 +1,87 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+	The audit log is an optional in-memory ring buffer with the last mutations applied to a PMap,
+	it helps to debug a corrupted state without external logging.
+	It is disabled by default (Options.AuditCapacity = 0), a disabled audit log has no overhead.
+*/
+
+//AuditOp is the type of an audited mutation
+type AuditOp int
+
+//Audited mutations
+const (
+	AuditSet AuditOp = iota + 1
+	AuditDel
+	AuditCAS
+	AuditTouch
+)
+
+func (op AuditOp) String() string {
+	switch op {
+	case AuditSet:
+		return "Set"
+	case AuditDel:
+		return "Del"
+	case AuditCAS:
+		return "CAS"
+	case AuditTouch:
+		return "Touch"
+	}
+	return "Unknown"
+}
+
+//AuditEntry is a mutation recorded in the audit log
+type AuditEntry struct {
+	Op        AuditOp
+	KeyHash   uint64    //h64 provided to the operation
+	Timestamp time.Time //Timestamp header of the provided value (the new timestamp for CAS)
+	Err       error     //Returned error, nil if the operation didn't fail
+}
+
+type auditLog struct {
+	entries []AuditEntry
+	next    int  //Index of the next entry
+	full    bool //The ring buffer has wrapped
+}
+
+func newAuditLog(capacity int) *auditLog {
+	return &auditLog{entries: make([]AuditEntry, capacity)}
+}
+
+//Records an operation, the timestamp is read from value[tsOffset:tsOffset+8]
+func (a *auditLog) add(op AuditOp, h64 uint64, value []byte, tsOffset int, err error) {
+	e := AuditEntry{Op: op, KeyHash: h64, Err: err}
+	if len(value) >= tsOffset+8 {
+		e.Timestamp = time.Unix(0, int64(binary.LittleEndian.Uint64(value[tsOffset:])))
+	}
+	a.entries[a.next] = e
+	a.next++
+	if a.next == len(a.entries) {
+		a.next = 0
+		a.full = true
+	}
+}
+
+//Returns a copy of the log entries, oldest first
+func (a *auditLog) list() []AuditEntry {
+	if !a.full {
+		return append([]AuditEntry(nil), a.entries[:a.next]...)
+	}
+	l := make([]AuditEntry, 0, len(a.entries))
+	l = append(l, a.entries[a.next:]...)
+	return append(l, a.entries[:a.next]...)
+}
+
+//AuditLog returns the last recorded mutations, oldest first. It returns nil if the audit log is disabled
+func (c *PMap) AuditLog() []AuditEntry {
+	if c.audit == nil {
+		return nil
+	}
+	return c.audit.list()
+}
@@ -0,0 +1,58 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestAuditLog(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{AuditCapacity: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k")
+	h := hashing.FNV1a64(key)
+	c.Set(h, key, testValue(1, "a"))
+	c.Set(h, key, []byte("short"))
+	casValue := make([]byte, 24, 25)
+	binary.LittleEndian.PutUint64(casValue, 1)
+	binary.LittleEndian.PutUint64(casValue[8:], hashing.FNV1a64([]byte("a")))
+	binary.LittleEndian.PutUint64(casValue[16:], 2)
+	casValue = append(casValue, 'b')
+	c.CAS(h, key, casValue)
+	c.CAS(h, key, casValue)
+	c.Del(h, key, testValue(3, ""))
+
+	log := c.AuditLog()
+	expected := []struct {
+		op     AuditOp
+		ts     int64
+		failed bool
+	}{
+		//The first Set was evicted from the ring buffer
+		{AuditSet, 0, true},
+		{AuditCAS, 2, false},
+		{AuditCAS, 2, true},
+		{AuditDel, 3, false},
+	}
+	if len(log) != len(expected) {
+		t.Fatal("audit log has", len(log), "entries:", log)
+	}
+	for i, e := range expected {
+		l := log[i]
+		if l.Op != e.op || l.KeyHash != h || (l.Err != nil) != e.failed || (e.ts != 0 && l.Timestamp.UnixNano() != e.ts) {
+			t.Errorf("entry %d: %v %v %v, expected %v", i, l.Op, l.Timestamp.UnixNano(), l.Err, e)
+		}
+	}
+	if !errors.Is(log[0].Err, ErrValueTooShort) || !errors.Is(log[2].Err, ErrCASTimestampMismatch) {
+		t.Fatal("unexpected errors", log[0].Err, log[2].Err)
+	}
+
+	if New("", 1024).AuditLog() != nil {
+		t.Fatal("audit log enabled by default")
+	}
+}
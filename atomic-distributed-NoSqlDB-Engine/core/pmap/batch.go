@@ -0,0 +1,200 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	A WriteBatch groups Set and Del operations that ApplyBatch applies as a single unit: either every operation
+	is applied or the PMap is left exactly as it was, checksum included.
+
+	Before applying the operations ApplyBatch takes a snapshot of the RAM state: a copy of the hashmap,
+	the store length, deleted bytes and tombstones, the checksum windows, the deduplication state and the secondary index.
+	The store is append-only, a rollback restores the snapshot and zeroes the store region written by the batch,
+	so the rolled back pairs are not found by a scan on Open. The only in-place modification, a deduplicated
+	blob freed by the batch, is undone too.
+
+	Copying the hashmap costs O(hashmap size), batches should group many operations.
+	Automatic compaction is suspended while a batch is applied.
+	The change events of the operations (see cdc.go) are held in the snapshot and published once the whole batch
+	is applied, a rollback drops them.
+	The audit log keeps the entries of rolled back operations, they were applied before the rollback.
+
+	ApplyBatch is not supported with Options.WAL (rolled back operations would be replayed from the WAL)
+	nor with Options.ReuseSpace (pairs are overwritten in place).
+*/
+
+var (
+	errBatchWAL        = errors.New("WriteBatch is not supported with the WAL")
+	errBatchReuseSpace = errors.New("WriteBatch is not supported with ReuseSpace")
+)
+
+//WriteBatch is a group of Set and Del operations, see ApplyBatch. Its zero value is an empty batch
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	del        bool
+	h64        uint64
+	key, value []byte
+}
+
+//Set adds a Set operation to the batch, key and value are copied
+func (b *WriteBatch) Set(h64 uint64, key, value []byte) {
+	b.add(false, h64, key, value)
+}
+
+//Del adds a Del operation to the batch, key and value are copied
+func (b *WriteBatch) Del(h64 uint64, key, value []byte) {
+	b.add(true, h64, key, value)
+}
+
+func (b *WriteBatch) add(del bool, h64 uint64, key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		del:   del,
+		h64:   h64,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+//Len returns the number of operations of the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+//Reset removes every operation of the batch
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+//pmapSnapshot is the RAM state of a PMap before a batch
+type pmapSnapshot struct {
+	hm          hashmap
+	length      uint64
+	deleted     uint64
+	tombstones  uint64
+	checksum    checksumWindows
+	dedup       dedupStore
+	maxSequence uint64
+	index       *secondaryIndex
+	indexState  *pmapSnapshot
+	freedBlobs  []uint64      //Blobs freed during the batch
+	events      []ChangeEvent //Change events of the batch, published if it is applied
+}
+
+//ApplyBatch applies the operations of b in order, like calling Set and Del.
+//If an operation fails (e.g. the store is full) the operations already applied are rolled back
+//and its error is returned, the PMap and its checksum are left exactly as they were.
+//Operations discarded by last-write-wins are not errors.
+func (c *PMap) ApplyBatch(b *WriteBatch) error {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	if c.wal != nil {
+		return errBatchWAL
+	}
+	if c.st.reuse {
+		return errBatchReuseSpace
+	}
+	c.beginBatch()
+	var err error
+	for _, op := range b.ops {
+		if op.del {
+			err = c.Del(op.h64, op.key, op.value)
+		} else {
+			err = c.Set(op.h64, op.key, op.value)
+		}
+		if err != nil {
+			break
+		}
+	}
+	s := c.batch
+	c.endBatch()
+	if err != nil {
+		if rbErr := c.rollback(s); rbErr != nil {
+			return fmt.Errorf("%w, rollback: %v", err, rbErr)
+		}
+		return err
+	}
+	for _, e := range s.events {
+		c.deliver(e)
+	}
+	c.autoCompact()
+	return nil
+}
+
+//Takes a snapshot of c and of its secondary index
+func (c *PMap) beginBatch() {
+	s := &pmapSnapshot{
+		hm:          *c.hm,
+		length:      c.st.length,
+		deleted:     c.st.deleted,
+		tombstones:  c.st.tombstones,
+		checksum:    c.checksum.windows(),
+		dedup:       c.dedup.clone(),
+		maxSequence: c.maxSequence,
+		index:       c.index,
+	}
+	s.hm.mem = append([]uint64(nil), c.hm.mem...)
+	if c.index != nil {
+		c.index.pm.beginBatch()
+		s.indexState = c.index.pm.batch
+	}
+	c.batch = s
+}
+
+func (c *PMap) endBatch() {
+	if c.index != nil {
+		c.index.pm.endBatch()
+	}
+	c.batch = nil
+}
+
+//Restores the snapshot s taken by beginBatch
+func (c *PMap) rollback(s *pmapSnapshot) error {
+	for _, blob := range s.freedBlobs {
+		//Blobs written by the batch are zeroed below
+		if blob < s.length {
+			c.st.setKeyLen(blob, blobFlag)
+		}
+	}
+	zero(c.st.file[s.length:c.st.length])
+	c.st.length = s.length
+	c.st.deleted = s.deleted
+	c.st.tombstones = s.tombstones
+	*c.hm = s.hm
+	c.checksum.setWindows(s.checksum)
+	c.dedup = s.dedup
+	c.maxSequence = s.maxSequence
+	if c.shared != nil {
+		//The owner mark may have been rolled back
+		c.shared.owner = noOwner
+	}
+	if c.index == s.index {
+		if c.index != nil {
+			return c.index.pm.rollback(s.indexState)
+		}
+		return nil
+	}
+	//The secondary index was rebuilt during the batch, it is rebuilt again from the restored pairs
+	c.index.pm.Close()
+	c.index = nil
+	return c.attachIndex(s.index.fn)
+}
+
+func (d dedupStore) clone() dedupStore {
+	if d.blobs == nil {
+		return d
+	}
+	n := dedupStore{blobs: make(map[uint64]uint64, len(d.blobs)), refs: make(map[uint64]int, len(d.refs))}
+	for h, blob := range d.blobs {
+		n.blobs[h] = blob
+	}
+	for blob, refs := range d.refs {
+		n.refs[blob] = refs
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Returns every live pair of c
+func testPairs(c *PMap) map[string]string {
+	pairs := make(map[string]string)
+	c.Iterate(func(key, value []byte) bool {
+		pairs[string(key)] = string(value)
+		return true
+	})
+	return pairs
+}
+
+func TestApplyBatch(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	var b WriteBatch
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		b.Set(hashing.FNV1a64(key), key, testValue(2, fmt.Sprint("new value", i)))
+		key = []byte(fmt.Sprint("key", 50+i))
+		b.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+	}
+	if b.Len() != 20 {
+		t.Fatal("batch length", b.Len())
+	}
+	if err := c.ApplyBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	pairs := testPairs(c)
+	if len(pairs) != 90 {
+		t.Fatalf("%d pairs after the batch, expected 90", len(pairs))
+	}
+	for i := 0; i < 10; i++ {
+		if pairs[fmt.Sprint("key", i)] != string(testValue(2, fmt.Sprint("new value", i))) {
+			t.Fatal("batch Set not applied", i)
+		}
+	}
+}
+
+func TestApplyBatchRollback(t *testing.T) {
+	for _, opts := range []Options{{}, {DedupValues: true}, {Index: indexTestFunc}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			//The batch must fill the store
+			opts.NoAutoGrow = true
+			c, err := NewWithOptions(path, 64*1024, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("shared value body ", i%2))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pairs, used, deleted, total := testPairs(c), c.Used(), c.Deleted(), c.checksum.total()
+			blobs := testCountBlobs(c)
+			var index string
+			if opts.Index != nil {
+				index = indexTestLookup(t, c, "s")
+			}
+
+			var b WriteBatch
+			for i := 0; i < 100; i++ {
+				//Overwrites and deletes free the shared blobs
+				key := []byte(fmt.Sprint("key", i))
+				if i%2 == 0 {
+					b.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+				} else {
+					b.Set(hashing.FNV1a64(key), key, testValue(2, fmt.Sprint("updated value ", i)))
+				}
+			}
+			//The store is full before the batch ends
+			for i := 0; i < 5000; i++ {
+				key := []byte(fmt.Sprint("new key", i))
+				b.Set(hashing.FNV1a64(key), key, testValue(2, fmt.Sprint("new value body of pair ", i)))
+			}
+			if err := c.ApplyBatch(&b); !errors.Is(err, ErrStoreFull) {
+				t.Fatal("batch applied on a full store")
+			}
+			if !reflect.DeepEqual(testPairs(c), pairs) || c.Used() != used || c.Deleted() != deleted || c.checksum.total() != total {
+				t.Fatal("the batch was not rolled back", c.Used(), used, c.Deleted(), deleted)
+			}
+			if testCountBlobs(c) != blobs {
+				t.Fatal("blobs not restored", testCountBlobs(c), blobs)
+			}
+			if opts.Index != nil && indexTestLookup(t, c, "s") != index {
+				t.Fatal("secondary index not rolled back")
+			}
+
+			//Crash: rolled back pairs must not be found by the recovery scan
+			c.st.close()
+			c, err = OpenWithOptions(path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if !reflect.DeepEqual(testPairs(c), pairs) || c.Used() != used || c.checksum.total() != total {
+				t.Fatal("rolled back pairs recovered", c.Used(), used)
+			}
+		})
+	}
+}
+
+func TestApplyBatchUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	for _, opts := range []Options{{WAL: true}, {ReuseSpace: true}} {
+		c, err := NewWithOptions(path, 1024*1024, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b WriteBatch
+		b.Set(1, []byte("k"), testValue(1, "v"))
+		if err := c.ApplyBatch(&b); err == nil {
+			t.Fatalf("%+v: batch applied", opts)
+		}
+		c.CloseAndDelete()
+	}
+}
@@ -0,0 +1,104 @@
+package pmap
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+/*
+	The Bloom filter (Options.BloomKeys) is an in-memory set of the key hashes written to the PMap,
+	checked by Get, GetInto, Has, MultiGet and the read-modify-write primitives before probing the hashmap:
+	a definite miss returns without touching the hashmap nor the store. It pays off when the hashmap doesn't fit
+	in the CPU caches or its probe chains are long, small hashmaps answer misses as fast (see BenchmarkGetMiss).
+
+	Keys are added by Set, CAS and Open, but Del can't remove them: the filter only yields false positives
+	(a key that is absent but may be present, the hashmap is probed) and never false negatives.
+	Compact rebuilds it from the live keys, dropping the deleted ones, and Clear empties it.
+
+	It is sized for BloomKeys keys and a BloomFPRate rate. Since keys are given by their
+	32-bit hash (h32) the k bit positions are derived from a 64-bit mix of it (double hashing): keys with the
+	same h32 always collide. With more keys than expected the false-positive rate grows, it is resized
+	for the live keys on the next Compact.
+*/
+
+const defaultBloomFPRate = 0.01
+
+type bloomFilter struct {
+	bits []uint64
+	mask uint64 //Number of bits - 1, it is a power of 2
+	k    int    //Number of bit positions of each key
+}
+
+//Returns an empty filter sized for n keys with a false-positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	//Rounded up to a power of 2, bit positions are masked instead of divided
+	if m < 64 {
+		m = 64
+	}
+	m = 1 << bits.Len64(m-1)
+	return &bloomFilter{bits: make([]uint64, m/64), mask: m - 1, k: k}
+}
+
+//Returns the two hashes used to derive the bit positions of h32
+func bloomHashes(h32 uint32) (uint64, uint64) {
+	//splitmix64 finalizer
+	x := uint64(h32) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return x, bits.RotateLeft64(x, 32) | 1
+}
+
+func (b *bloomFilter) add(h32 uint32) {
+	h1, h2 := bloomHashes(h32)
+	for i := 0; i < b.k; i++ {
+		pos := (h1 + uint64(i)*h2) & b.mask
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+//Returns false if the key with hash h32 was never added
+func (b *bloomFilter) mayContain(h32 uint32) bool {
+	h1, h2 := bloomHashes(h32)
+	for i := 0; i < b.k; i++ {
+		pos := (h1 + uint64(i)*h2) & b.mask
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns an error if the Bloom filter options are not valid
+func checkBloomOptions(opts Options) error {
+	if opts.BloomKeys < 0 {
+		return fmt.Errorf("BloomKeys %d is negative", opts.BloomKeys)
+	}
+	if opts.BloomFPRate < 0 || opts.BloomFPRate >= 1 {
+		return fmt.Errorf("BloomFPRate %v is not in (0, 1)", opts.BloomFPRate)
+	}
+	return nil
+}
+
+//Rebuilds the Bloom filter from the live keys, sized for the expected keys or the live ones if there are more
+func (c *PMap) rebuildBloom() {
+	n := c.bloomKeys
+	if live := int(c.hm.numStoredKeys); live > n {
+		n = live
+	}
+	c.bloom = newBloomFilter(n, c.bloomFPRate)
+	for i := uint32(0); i < c.hm.size; i++ {
+		if c.hm.getHash(i) > deletedBucket {
+			c.bloom.add(uint32(c.hasher.Hash64(c.st.key(c.hm.getStoreIndex(i)))))
+		}
+	}
+}
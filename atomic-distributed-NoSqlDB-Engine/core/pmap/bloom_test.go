@@ -0,0 +1,113 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	const n, p = 10000, 0.01
+	b := newBloomFilter(n, p)
+	for i := uint32(0); i < n; i++ {
+		b.add(i * 7919)
+	}
+	for i := uint32(0); i < n; i++ {
+		if !b.mayContain(i * 7919) {
+			t.Fatal("false negative", i)
+		}
+	}
+	positives := 0
+	for i := uint32(0); i < 100000; i++ {
+		if b.mayContain(i*7919 + 1) {
+			positives++
+		}
+	}
+	if rate := float64(positives) / 100000; rate > 2*p {
+		t.Fatal("false-positive rate", rate, "expected", p)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	if _, err := NewWithOptions("", 1024, Options{BloomKeys: 10, BloomFPRate: 1}); err == nil {
+		t.Fatal("false-positive rate 1 accepted")
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	opts := Options{BloomKeys: 1000}
+	c, err := NewWithOptions(path, 1024*1024, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, "v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Del(c.Hash(key), key, testValue(2, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Deleted keys stay in the filter until the next Compact
+	key := []byte("key0")
+	if !c.bloom.mayContain(uint32(c.Hash(key))) || c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("wrong state of a deleted key")
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	positives := 0
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if c.bloom.mayContain(uint32(c.Hash(key))) {
+			positives++
+		}
+	}
+	if positives > 25 {
+		t.Fatal("Compact didn't drop the deleted keys", positives)
+	}
+	c.Close()
+
+	//Open rebuilds the filter, without false negatives
+	c, err = OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 500; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if v, _ := c.Get(uint32(c.Hash(key)), key); v == nil || !c.Has(uint32(c.Hash(key)), key) {
+			t.Fatal("false negative after Open", string(key))
+		}
+	}
+	if v, _ := c.Get(uint32(c.Hash(key)), key); v != nil {
+		t.Fatal("deleted key found", v)
+	}
+}
+
+func BenchmarkGetMiss(b *testing.B) {
+	for _, bloom := range []int{0, 2000000} {
+		b.Run(fmt.Sprint("BloomKeys", bloom), func(b *testing.B) {
+			c, err := NewWithOptions("", 256*1024*1024, Options{BloomKeys: bloom})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			for i := 0; i < 2000000; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				c.Set(c.Hash(key), key, testValue(1, "value"))
+			}
+			misses := make([]uint32, 1<<16)
+			for i := range misses {
+				misses[i] = uint32(c.Hash([]byte(fmt.Sprint("missing", i))))
+			}
+			key := []byte("missing")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Get(misses[i&(len(misses)-1)], key)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package pmap
+
+import "fmt"
+
+/*
+	Bulk loading
+
+	BulkSet writes a group of pairs like calling Set for each one, for bulk loads like restoring a replica.
+	It makes room for every key once, expanding the hashmap (and growing the store) before the first write
+	instead of in the middle of the load, and it sets the pairs sorted by their first probed bucket: the hashmap
+	is written region by region instead of at random. The store writes are appends either way. The pairs are read
+	out of their order instead: the sort pays off when the hashmap is much larger than the CPU caches and the
+	pairs are compact, BenchmarkBulkSet and BenchmarkBulkSetLoop compare it with a Set loop.
+
+	The sort is stable, pairs of the same key are set in their order in the group: the usual last-write-wins
+	rules apply between them like between separate Sets (the newest timestamp wins, the first pair wins a tie).
+	Like MultiCAS it is not atomic, see ApplyBatch for atomic groups of writes.
+*/
+
+//Log2 of the maximum number of hashmap regions sorted by BulkSet, the regions of a hashmap that doesn't fit
+//in the CPU caches still do (256 regions of a 32MiB hashmap are 128KiB long)
+const bulkMaxGroupsLog2 = 8
+
+//KV is a BulkSet pair: a key and its value, timestamp header included
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+//BulkSet sets pairs like calling Set for each one in order, keys are hashed with the PMap Hasher, see bulk.go.
+//It stops at the first error and returns it with the index of its pair, the pairs set before it (in bucket order,
+//not in the order of pairs) remain
+func (c *PMap) BulkSet(pairs []KV) error {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	//Room for the worst case, every key being new. It is a hint like in MultiCAS: if the hashmap limit or the store
+	//size don't allow it, each Set still makes its own room
+	c.hm.reserve(uint64(len(pairs)))
+	needed := uint64(0)
+	for _, p := range pairs {
+		needed += c.st.overhead() + uint64(len(p.Key)+len(p.Value))
+	}
+	if c.st.grow && c.st.length+needed >= c.st.limit() {
+		c.st.expand(c.st.length + needed + footerSize)
+	}
+
+	//Stable counting sort by the most significant bits of the first probed bucket, one group per pair at most.
+	//The groups are hashmap regions, with few groups the sort itself doesn't scatter its writes
+	groupsLog2 := uint32(0)
+	for groupsLog2 < c.hm.sizelog2 && groupsLog2 < bulkMaxGroupsLog2 && 1<<(groupsLog2+1) <= len(pairs) {
+		groupsLog2++
+	}
+	shift := c.hm.sizelog2 - groupsLog2
+	hashes := make([]uint64, len(pairs))
+	starts := make([]int, 1<<groupsLog2+1)
+	for i, p := range pairs {
+		hashes[i] = c.hasher.Hash64(p.Key)
+		starts[(hashReMap(uint32(hashes[i]))&c.hm.sizeMask)>>shift+1]++
+	}
+	for g := 1; g < len(starts); g++ {
+		starts[g] += starts[g-1]
+	}
+	order := make([]int, len(pairs))
+	for i, h64 := range hashes {
+		g := (hashReMap(uint32(h64)) & c.hm.sizeMask) >> shift
+		order[starts[g]] = i
+		starts[g]++
+	}
+	for _, i := range order {
+		if err := c.Set(hashes[i], pairs[i].Key, pairs[i].Value); err != nil {
+			return fmt.Errorf("BulkSet pair %d: %w", i, err)
+		}
+	}
+	return nil
+}
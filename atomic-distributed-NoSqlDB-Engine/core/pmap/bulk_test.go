@@ -0,0 +1,93 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBulkSet(t *testing.T) {
+	const n = 10000
+	var pairs []KV
+	for i := 0; i < n; i++ {
+		pairs = append(pairs, KV{Key: []byte(fmt.Sprint("key", i)), Value: testValue(2, fmt.Sprint("value", i))})
+	}
+	//Duplicates: older, newer and same timestamp
+	pairs = append(pairs,
+		KV{Key: []byte("key1"), Value: testValue(1, "older")},
+		KV{Key: []byte("key2"), Value: testValue(3, "newer")},
+		KV{Key: []byte("key3"), Value: testValue(2, "tie")},
+	)
+	c, err := NewWithOptions("", 16*1024*1024, Options{InitialLog2Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.BulkSet(pairs); err != nil {
+		t.Fatal(err)
+	}
+	//Same result as a Set loop
+	loop := New("", 16*1024*1024)
+	defer loop.Close()
+	for _, p := range pairs {
+		if err := loop.Set(loop.Hash(p.Key), p.Key, p.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, expected := testPairs(c), testPairs(loop)
+	if len(got) != n || fmt.Sprint(got) != fmt.Sprint(expected) || c.checksum.total() != loop.checksum.total() {
+		t.Fatal("BulkSet pairs differ from the Set loop ones", len(got), len(expected))
+	}
+	if got["key1"][8:] != "value1" || got["key2"][8:] != "newer" || got["key3"][8:] != "value3" {
+		t.Fatal("last write wins not honored", got["key1"], got["key2"], got["key3"])
+	}
+	//The hashmap was expanded once, before the writes
+	if c.hm.size != 1<<14 || c.Stats().Tombstones != 0 {
+		t.Fatal("hashmap of", c.hm.size, "buckets")
+	}
+
+	//Errors report the failed pair
+	err = c.BulkSet([]KV{{Key: []byte("a"), Value: testValue(1, "")}, {Key: []byte("b"), Value: []byte("short")}})
+	if !errors.Is(err, ErrValueTooShort) || err.Error()[:12] != "BulkSet pair" {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkBulkSet(b *testing.B, bulk bool) {
+	const n = 1 << 20
+	pairs := make([]KV, n)
+	value := testValue(1, "value")
+	for i := range pairs {
+		pairs[i] = KV{Key: []byte(fmt.Sprint("key", i)), Value: value}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := New("", 64*1024*1024)
+		b.StartTimer()
+		if bulk {
+			if err := c.BulkSet(pairs); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			for _, p := range pairs {
+				if err := c.Set(c.Hash(p.Key), p.Key, p.Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.StopTimer()
+		c.Close()
+		b.StartTimer()
+	}
+}
+
+//BulkSet of a million pairs
+func BenchmarkBulkSet(b *testing.B) {
+	benchmarkBulkSet(b, true)
+}
+
+//Set loop over the pairs of BenchmarkBulkSet
+func BenchmarkBulkSetLoop(b *testing.B) {
+	benchmarkBulkSet(b, false)
+}
@@ -0,0 +1,123 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+	Change events (change data capture)
+
+	Subscribe returns a channel that receives an event for each Set, Del and CAS applied to the PMap:
+	writes discarded by the timestamp rules, failed CASes and deletions of missing keys are not published.
+	The operations built on them (SetWithTTL, MultiCAS...) publish the events of their Set, Del and CAS.
+	ApplyBatch holds the events of its operations until the batch is applied, they are published together
+	once it succeeds; a rolled back batch publishes nothing.
+
+	Events are sent without blocking the writer: each subscriber has a buffer of changeBufferSize events,
+	when it is full the events are dropped. The next delivered event counts them (ChangeEvent.Dropped),
+	a subscriber that needs every change must resynchronize, for example by iterating the PMap.
+	There is no overhead without subscribers.
+*/
+
+//Events buffered for each subscriber, later events are dropped until it catches up
+const changeBufferSize = 1024
+
+//ChangeOp is the type of a published mutation
+type ChangeOp int
+
+//Published mutations
+const (
+	ChangeSet ChangeOp = iota + 1
+	ChangeDel
+	ChangeCAS
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeSet:
+		return "Set"
+	case ChangeDel:
+		return "Del"
+	case ChangeCAS:
+		return "CAS"
+	}
+	return "Unknown"
+}
+
+//ChangeEvent is a mutation applied to a PMap, see Subscribe
+//Key and Value are shared by every subscriber, they must not be modified
+type ChangeEvent struct {
+	Op        ChangeOp
+	Key       []byte
+	Value     []byte    //Written value, timestamp header included. nil for Del
+	Timestamp time.Time //Timestamp of the written value, or of the value provided to Del
+	Dropped   uint64    //Events dropped before this one because the subscriber fell behind
+}
+
+type subscriber struct {
+	events  chan ChangeEvent
+	dropped uint64 //Events dropped since the last delivered one
+}
+
+//Subscribe returns a channel that receives the mutations applied to the PMap after the call, and
+//a function that unsubscribes and closes the channel. Slow subscribers lose events, see cdc.go.
+//Close and CloseAndDelete close the channels of every subscriber, unsubscribing later does nothing
+func (c *PMap) Subscribe() (<-chan ChangeEvent, func()) {
+	s := &subscriber{events: make(chan ChangeEvent, changeBufferSize)}
+	c.subscribers = append(c.subscribers, s)
+	return s.events, func() { c.unsubscribe(s) }
+}
+
+func (c *PMap) unsubscribe(s *subscriber) {
+	for i, sub := range c.subscribers {
+		if sub == s {
+			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+			close(s.events)
+			return
+		}
+	}
+}
+
+//Closes the channels of every subscriber
+func (c *PMap) closeSubscribers() {
+	for _, s := range c.subscribers {
+		close(s.events)
+	}
+	c.subscribers = nil
+}
+
+//Publishes an applied mutation, header is the timestamp header of the event.
+//key and value are copied, they can be slices of the store.
+//During a batch the event is held in the batch snapshot, see ApplyBatch
+func (c *PMap) publish(op ChangeOp, key, value, header []byte) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	e := ChangeEvent{
+		Op:        op,
+		Key:       append([]byte(nil), key...),
+		Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(header))),
+	}
+	if value != nil {
+		e.Value = append([]byte(nil), value...)
+	}
+	if c.batch != nil {
+		c.batch.events = append(c.batch.events, e)
+		return
+	}
+	c.deliver(e)
+}
+
+//Sends e to every subscriber, without blocking
+func (c *PMap) deliver(e ChangeEvent) {
+	for _, s := range c.subscribers {
+		e.Dropped = s.dropped
+		select {
+		case s.events <- e:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+	}
+}
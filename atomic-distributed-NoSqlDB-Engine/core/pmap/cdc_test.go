@@ -0,0 +1,117 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.CloseAndDelete()
+	events, unsubscribe := c.Subscribe()
+	key := []byte("key")
+	h := c.Hash(key)
+	c.Set(h, key, testValue(2, "a"))
+	//Discarded by the timestamp rules
+	c.Set(h, key, testValue(1, "old"))
+	c.CAS(h, key, testCASValue(1, "a", 3, "b"))
+	c.CAS(h, key, testCASValue(2, "a", 3, "b"))
+	c.Del(h, []byte("missing"), testValue(4, ""))
+	c.Del(h, key, testValue(4, ""))
+	expected := []ChangeEvent{
+		{Op: ChangeSet, Key: key, Value: testValue(2, "a"), Timestamp: time.Unix(0, 2)},
+		{Op: ChangeCAS, Key: key, Value: testValue(3, "b"), Timestamp: time.Unix(0, 3)},
+		{Op: ChangeDel, Key: key, Timestamp: time.Unix(0, 4)},
+	}
+	for _, e := range expected {
+		got := <-events
+		if got.Op != e.Op || !bytes.Equal(got.Key, e.Key) || !bytes.Equal(got.Value, e.Value) ||
+			!got.Timestamp.Equal(e.Timestamp) || got.Dropped != 0 {
+			t.Fatalf("got event %v %q %q %v, expected %v", got.Op, got.Key, got.Value, got.Timestamp, e)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatal("unexpected events", len(events))
+	}
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Fatal("the channel is open after unsubscribing")
+	}
+	unsubscribe()
+	c.Set(h, key, testValue(5, "c"))
+}
+
+func TestSubscribeSlow(t *testing.T) {
+	c := New("", 1024*1024)
+	events, _ := c.Subscribe()
+	fast, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range fast {
+			n++
+		}
+		done <- n
+	}()
+	n := changeBufferSize + 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(c.Hash(key), key, testValue(1, ""))
+	}
+	//The slow subscriber gets the buffered events, the next one counts the dropped ones
+	for i := 0; i < changeBufferSize; i++ {
+		if e := <-events; e.Dropped != 0 || string(e.Key) != fmt.Sprint("key", i) {
+			t.Fatal("wrong buffered event", i, string(e.Key), e.Dropped)
+		}
+	}
+	key := []byte("last")
+	c.Set(c.Hash(key), key, testValue(1, ""))
+	if e := <-events; e.Dropped != 10 || string(e.Key) != "last" {
+		t.Fatal("wrong event after the dropped ones", string(e.Key), e.Dropped)
+	}
+	c.CloseAndDelete()
+	if _, ok := <-events; ok {
+		t.Fatal("CloseAndDelete didn't close the channel")
+	}
+	if got := <-done; got > n+1 {
+		t.Fatal("the fast subscriber got", got, "events")
+	}
+}
+
+func TestSubscribeBatch(t *testing.T) {
+	c := New("", 4096)
+	defer c.CloseAndDelete()
+	events, _ := c.Subscribe()
+	//The store is full before the end of the batch, it is rolled back
+	var b WriteBatch
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		b.Set(c.Hash(key), key, testValue(1, string(make([]byte, 1024))))
+	}
+	if err := c.ApplyBatch(&b); err == nil || c.Len() != 0 {
+		t.Fatal("the batch was applied", err, c.Len())
+	}
+	if len(events) != 0 {
+		t.Fatal("events published by a rolled back batch", len(events))
+	}
+	//The events of an applied batch are published in order
+	b.Reset()
+	key := []byte("key")
+	b.Set(c.Hash(key), key, testValue(1, "a"))
+	b.Del(c.Hash(key), key, testValue(2, ""))
+	if err := c.ApplyBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatal("wrong number of events", len(events))
+	}
+	if e := <-events; e.Op != ChangeSet || !bytes.Equal(e.Value, testValue(1, "a")) {
+		t.Fatal("wrong event", e)
+	}
+	if e := <-events; e.Op != ChangeDel || !e.Timestamp.Equal(time.Unix(0, 2)) {
+		t.Fatal("wrong event", e)
+	}
+}
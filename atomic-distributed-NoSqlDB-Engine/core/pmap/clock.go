@@ -0,0 +1,14 @@
+package pmap
+
+import "time"
+
+//Clock is the time source used by a PMap, it can be replaced to control time in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
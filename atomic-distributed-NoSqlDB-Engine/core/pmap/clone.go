@@ -0,0 +1,81 @@
+package pmap
+
+/*
+	Clones
+
+	CloneTo copies the live pairs of a PMap to a new store, like Compact does, and opens it as a new PMap:
+	its hashmap is rebuilt from the new store like Open does. The source (file-backed or anonymous) is only read.
+*/
+
+//CloneTo returns a new PMap stored in path, with an initial store size like New, holding a copy of the live pairs.
+//The copy is compact: like Compact it only keeps the tombstones of Options.TombstoneRetention, Deleted only counts
+//them. The clone has the checksum of the source and its options, except the WAL and the audit log (see Options.WAL
+//and Options.AuditCapacity) which start disabled. Set path to "" to clone into an anonymous PMap, size is then its
+//maximum size.
+//The source is left untouched, it can be used and closed independently of the clone
+func (c *PMap) CloneTo(path string, size uint64) (*PMap, error) {
+	ns, err := createStore(path, size, c.filePerms)
+	if err != nil {
+		return nil, err
+	}
+	ns.reuse = c.st.reuse
+	ns.grow = path != "" && c.st.grow
+	if c.st.crc {
+		ns.enableCRC()
+	}
+	if _, _, err := c.copyLive(ns); err != nil {
+		ns.close()
+		ns.deleteStore()
+		return nil, err
+	}
+	//They are counted again by restore
+	ns.deleted, ns.tombstones = 0, 0
+	clone := newPMap(path, Options{
+		NoReadAhead:         c.noReadAhead,
+		DedupValues:         c.dedupValues,
+		SequenceNumbers:     c.sequence,
+		CompactionThreshold: c.compactionThreshold,
+		CompactionInterval:  c.compactionInterval,
+		Clock:               c.clock,
+		Hasher:              c.hasher,
+		InitialLog2Size:     c.hmInitialLog2Size,
+		SizeLimit:           c.hmSizeLimit,
+		LoadFactor:          c.hmLoadFactor,
+		MinLoadFactor:       c.hmMinLoadFactor,
+		MaxAvgProbeLength:   c.hmMaxAvgProbe,
+		Durability:          c.durability,
+		SyncInterval:        c.syncer.interval,
+		BloomKeys:           c.bloomKeys,
+		BloomFPRate:         c.bloomFPRate,
+		Resolver:            c.resolver,
+		MaxKeySize:          c.maxKeySize,
+		MaxValueSize:        c.maxValueSize,
+		CompactOnClose:      c.compactOnClose,
+		FilePerms:           c.filePerms,
+		Codec:               c.codec,
+		EncryptionKey:       c.encryptionKey,
+		VerifyReads:         c.verifyReads,
+		TombstoneRetention:  c.tombstoneRetention,
+	})
+	clone.aead = c.aead
+	clone.st = ns
+	if err := clone.restore(ns.length); err != nil {
+		ns.close()
+		ns.deleteStore()
+		return nil, err
+	}
+	if c.index != nil {
+		if err := clone.attachIndex(c.index.fn); err != nil {
+			clone.CloseAndDelete()
+			return nil, err
+		}
+	}
+	//Same pairs, same sums: the time windows are copied to return the same Checksum
+	c.checksum.mutex.Lock()
+	interval := c.checksum.interval
+	c.checksum.mutex.Unlock()
+	clone.checksum.SetInterval(interval)
+	clone.checksum.setWindows(c.checksum.windows())
+	clone.startPeriodicSync()
+	return clone, nil
+}
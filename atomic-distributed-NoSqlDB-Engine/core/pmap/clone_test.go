@@ -0,0 +1,62 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloneTo(t *testing.T) {
+	dir := t.TempDir()
+	for _, source := range []string{"", filepath.Join(dir, "source")} {
+		for _, dedup := range []bool{false, true} {
+			c, err := NewWithOptions(source, 1024*1024, Options{DedupValues: dedup, Checksums: source != ""})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				c.Set(c.Hash(key), key, testValue(1, fmt.Sprint("a shared value ", i%10)))
+			}
+			for i := 0; i < 20; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				c.Del(c.Hash(key), key, testValue(2, ""))
+			}
+			c.SetChecksumInterval(10 * time.Millisecond)
+			pairs := testPairs(c)
+
+			path := filepath.Join(dir, fmt.Sprint("clone", dedup))
+			clone, err := c.CloneTo(path, 64*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clone.Deleted() != testTombstoneBytes(clone) || clone.Len() != 80 || clone.Used() >= c.Used() {
+				t.Fatal("the clone is not compact", clone.Deleted(), clone.Len(), clone.Used(), c.Used())
+			}
+			if clone.Checksum() != c.Checksum() || clone.checksum.total() != c.checksum.total() {
+				t.Fatal("the clone checksum differs")
+			}
+			//Modifying the clone leaves the source untouched
+			key := []byte("key50")
+			clone.Set(clone.Hash(key), key, testValue(3, "clone"))
+			clone.Del(clone.Hash([]byte("key51")), []byte("key51"), testValue(3, ""))
+			if got := testPairs(c); fmt.Sprint(got) != fmt.Sprint(pairs) {
+				t.Fatal("the source was modified")
+			}
+			c.Close()
+			if v, _ := clone.Get(uint32(clone.Hash(key)), key); string(v) != string(testValue(3, "clone")) {
+				t.Fatal("wrong clone value", v)
+			}
+			clone.Close()
+			clone, err = Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clone.Recovered() || clone.Len() != 79 {
+				t.Fatal("wrong reopened clone", clone.Recovered(), clone.Len())
+			}
+			clone.CloseAndDelete()
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+	"launchpad.net/gommap"
+)
+
+const (
+	defaultCompactionThreshold = 0.5
+	defaultCompactionInterval  = time.Minute
+	//Smaller stores are not compacted automatically
+	compactionMinLength = 1024 * 1024
+)
+
+//Compact reclaims the space used by deleted and overwritten pairs.
+//The live pairs are copied to a new store (path + ".compact") that atomically replaces the old file,
+//the hashmap is updated with the new store indexes and the checksum is preserved.
+//The tombstones kept by Options.TombstoneRetention are copied too, PurgeTombstones reclaims them.
+//After it Deleted only counts them. If it fails the PMap and its file are left untouched.
+//Compaction invalidates any in-flight iteration, it returns errIterationInvalidated (see cursor.go).
+func (c *PMap) Compact() error {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	if c.shared != nil {
+		return errSharedStore
+	}
+	if c.wal != nil {
+		//Nothing is pending to be replayed on the old store
+		if err := c.checkpoint(); err != nil {
+			return err
+		}
+	}
+	tmpPath := ""
+	if c.path != "" {
+		tmpPath = c.path + ".compact"
+	}
+	//The compacted file replaces the current one, it keeps its permission bits
+	ns, err := createStore(tmpPath, c.st.size, c.st.perm)
+	if err != nil {
+		return err
+	}
+	ns.reuse = c.st.reuse
+	ns.grow = c.st.grow
+	if c.st.crc {
+		ns.enableCRC()
+	}
+	moved, dedup, err := c.copyLive(ns)
+	if err == nil && ns.osFile != nil {
+		err = ns.file.Sync(gommap.MS_SYNC)
+		if err == nil {
+			err = os.Rename(tmpPath, c.path)
+		}
+	}
+	if err != nil {
+		ns.close()
+		ns.deleteStore()
+		return err
+	}
+	ns.path = c.path
+
+	for i := uint32(0); i < c.hm.size; i++ {
+		if c.hm.getHash(i) > deletedBucket {
+			c.hm.setStoreIndex(i, moved[c.hm.getStoreIndex(i)])
+		}
+	}
+	c.dedup = dedup
+	c.stopPeriodicSync()
+	c.st.close()
+	c.st = ns
+	c.startPeriodicSync()
+	if c.bloom != nil {
+		c.rebuildBloom()
+	}
+	if c.wal != nil {
+		return c.checkpoint()
+	}
+	return nil
+}
+
+//Returns true if Compact copies the tombstone at index, see Options.TombstoneRetention
+func (c *PMap) keepTombstone(index uint64) bool {
+	t := c.st.expiry(index)
+	if t == 0 || c.tombstoneRetention < 0 {
+		//Tombstones without a deletion timestamp can't be purged, they are always dropped
+		return false
+	}
+	key := c.st.key(index)
+	if _, found := c.lookup(uint32(c.hasher.Hash64(key)), key); found {
+		//The key was set again after the deletion, the tombstone deletes nothing
+		return false
+	}
+	return c.tombstoneRetention == 0 || t >= uint64(c.clock.Now().Add(-c.tombstoneRetention).UnixNano())
+}
+
+//Copies every live pair (and the blobs they reference) and the kept tombstones to ns
+//It returns the new store index of each copied pair and the deduplication state of ns
+func (c *PMap) copyLive(ns *store) (map[uint64]uint64, dedupStore, error) {
+	moved := make(map[uint64]uint64)
+	var dedup dedupStore
+	blobs := make(map[uint64]uint64) //Old blob index => new blob index
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) {
+			if !c.st.isFree(index) && !c.st.isBlob(index) && c.st.valLen(index) == 0 && c.keepTombstone(index) {
+				tombstone, err := ns.putExpiring(c.st.key(index), nil, c.st.expiry(index))
+				if err != nil {
+					return nil, dedup, err
+				}
+				ns.deleted += ns.recordSize(tombstone)
+				ns.tombstones++
+			}
+			continue
+		}
+		key := c.st.key(index)
+		val := c.st.val(index)
+		if !c.st.isRef(index) {
+			newIndex, err := ns.putExpiring(key, val, c.st.expiry(index))
+			if err != nil {
+				return nil, dedup, err
+			}
+			//The sealed bodies keep their key, they are still valid
+			ns.setKeyFlags(newIndex, binary.LittleEndian.Uint32(c.st.file[index+headerKeyOffset:])&(compressedFlag|encryptedFlag))
+			moved[index] = newIndex
+			continue
+		}
+		old := c.st.refBlob(index)
+		blob, ok := blobs[old]
+		if !ok {
+			body := c.st.val(old)
+			var err error
+			blob, err = ns.put(nil, body)
+			if err != nil {
+				return nil, dedup, err
+			}
+			ns.setKeyLen(blob, blobFlag)
+			blobs[old] = blob
+			if dedup.blobs == nil {
+				dedup.blobs = make(map[uint64]uint64)
+				dedup.refs = make(map[uint64]int)
+			}
+			dedup.blobs[hashing.FNV1a64(body)] = blob
+		}
+		ref := make([]byte, 16)
+		copy(ref, val[:8])
+		binary.LittleEndian.PutUint64(ref[8:], blob)
+		newIndex, err := ns.put(key, ref)
+		if err != nil {
+			return nil, dedup, err
+		}
+		ns.setValLen(newIndex, 16|refFlag)
+		dedup.refs[blob]++
+		moved[index] = newIndex
+	}
+	return moved, dedup, nil
+}
+
+//SetCompactionThreshold sets the deleted bytes ratio (Deleted / Used) that triggers an automatic compaction
+//after a Set or a Del, ratio <= 0 disables automatic compaction
+func (c *PMap) SetCompactionThreshold(ratio float64) {
+	c.compactionThreshold = ratio
+}
+
+//SetCompactionInterval sets the minimum time between automatic compactions
+func (c *PMap) SetCompactionInterval(d time.Duration) {
+	c.compactionInterval = d
+}
+
+//Compacts the PMap if the deleted bytes ratio exceeds the threshold and the last automatic compaction
+//is older than the compaction interval
+func (c *PMap) autoCompact() {
+	if c.batch != nil || c.compactionThreshold <= 0 || c.st.length < compactionMinLength ||
+		float64(c.st.deleted) <= c.compactionThreshold*float64(c.st.length) {
+		return
+	}
+	now := c.clock.Now()
+	if !c.lastCompaction.IsZero() && now.Sub(c.lastCompaction) < c.compactionInterval {
+		return
+	}
+	c.lastCompaction = now
+	if err := c.Compact(); err != nil {
+		log.Println("Automatic compaction failed:", err, c.path)
+	}
+}
@@ -0,0 +1,400 @@
+package pmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Writes, overwrites and deletes pairs, returning the expected live pairs
+func testFragmented(t *testing.T, c *PMap) map[string][]byte {
+	expected := make(map[string][]byte)
+	for ts := uint64(1); ts <= 3; ts++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			value := testValue(ts, fmt.Sprint("value", ts, "-", i))
+			if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[string(key)] = value
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Del(hashing.FNV1a64(key), key, testValue(4, "")); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, string(key))
+	}
+	return expected
+}
+
+//Returns the bytes of the tombstones of c, the only deleted bytes left by a compaction
+func testTombstoneBytes(c *PMap) int {
+	size := 0
+	c.RawScan(func(offset uint64, key, rawValue []byte, isTombstone bool) bool {
+		if isTombstone {
+			size += int(c.st.recordSize(offset))
+		}
+		return true
+	})
+	return size
+}
+
+func testCheckPairs(t *testing.T, c *PMap, expected map[string][]byte) {
+	for k, v := range expected {
+		key := []byte(k)
+		got, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if !bytes.Equal(got, v) {
+			t.Fatalf("key %s: got %v, expected %v", k, got, v)
+		}
+	}
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if count != len(expected) {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, len(expected))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, anonymous := range []bool{false, true} {
+		t.Run(fmt.Sprint("anonymous=", anonymous), func(t *testing.T) {
+			path := ""
+			if !anonymous {
+				path = filepath.Join(t.TempDir(), "pmap")
+			}
+			c := New(path, 1024*1024)
+			expected := testFragmented(t, c)
+			used, checksum, total := c.Used(), c.Checksum(), c.checksum.total()
+			if err := c.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Deleted() != testTombstoneBytes(c) || c.Used() >= used/2 {
+				t.Fatal("compacted store: deleted", c.Deleted(), "used", c.Used(), "of", used)
+			}
+			if c.Checksum() != checksum || c.checksum.total() != total {
+				t.Fatal("checksum changed")
+			}
+			testCheckPairs(t, c, expected)
+			//The compacted PMap keeps working
+			key := []byte("new")
+			value := testValue(5, "new value")
+			if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected["new"] = value
+			testCheckPairs(t, c, expected)
+			if anonymous {
+				c.Close()
+				return
+			}
+			c.Close()
+			if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+				t.Fatal("temporary compaction file left", err)
+			}
+			c = testOpen(t, path)
+			defer c.CloseAndDelete()
+			if c.Recovered() {
+				t.Fatal("compacted store was not closed cleanly")
+			}
+			testCheckPairs(t, c, expected)
+		})
+	}
+}
+
+func TestCompactDedupValues(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{DedupValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	body := "a shared value body"
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := testValue(1, body)
+		if i%2 == 0 {
+			value = testValue(1, fmt.Sprint("a unique value body ", i))
+		}
+		c.Set(hashing.FNV1a64(key), key, value)
+		expected[string(key)] = value
+	}
+	for i := 0; i < 100; i += 4 {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+		delete(expected, string(key))
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	testCheckPairs(t, c, expected)
+	if b := testCountBlobs(c); b != len(c.dedup.blobs) || b != 26 {
+		t.Fatal(b, "blobs after compacting", len(c.dedup.blobs), "tracked")
+	}
+}
+
+func TestCompactFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 1024*1024)
+	defer c.Close()
+	expected := testFragmented(t, c)
+	used, deleted := c.Used(), c.Deleted()
+	//The temporary file can't be created
+	if err := os.Mkdir(path+".compact", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Compact(); err == nil {
+		t.Fatal("Compact didn't fail")
+	}
+	if c.Used() != used || c.Deleted() != deleted {
+		t.Fatal("failed compaction modified the PMap")
+	}
+	testCheckPairs(t, c, expected)
+}
+
+func TestCompactOnClose(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "pmap")
+		c, err := NewWithOptions(path, 1024*1024, Options{CompactOnClose: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := testFragmented(t, c)
+		used, deleted := c.Used(), c.Deleted()
+		if fail {
+			//The temporary file can't be created
+			if err := os.Mkdir(path+".compact", 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Close()
+		c, err = Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Recovered() {
+			t.Fatal("the store was not closed cleanly, failed compaction", fail)
+		}
+		if fail && (c.Used() != used || c.Deleted() != deleted) || !fail && (c.Used() >= used || c.Deleted() != testTombstoneBytes(c)) {
+			t.Fatal("wrong store after a close with compaction", fail, c.Used(), used, c.Deleted())
+		}
+		testCheckPairs(t, c, expected)
+		c.Close()
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	c, err := NewWithOptions("", 16*1024*1024, Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	body := string(bytes.Repeat([]byte("v"), 100))
+	expected := make(map[string][]byte)
+	round := func(ts uint64) {
+		for i := 0; i < 20000; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			value := testValue(ts, body)
+			if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[string(key)] = value
+		}
+	}
+	round(1)
+	used := c.Used()
+	round(2)
+	//Overwriting the pairs again crosses the default threshold
+	round(3)
+	if c.lastCompaction.IsZero() || c.Used() > 2*used+used/10 {
+		t.Fatal("no automatic compaction: used", c.Used(), "deleted", c.Deleted())
+	}
+	testCheckPairs(t, c, expected)
+
+	//Debounced: no compaction until the interval elapses
+	round(4)
+	round(5)
+	if c.Deleted() <= c.Used()/2 {
+		t.Fatal("compacted before the compaction interval: used", c.Used(), "deleted", c.Deleted())
+	}
+	clock.advance(defaultCompactionInterval)
+	key := []byte("key0")
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(6, "")); err != nil {
+		t.Fatal(err)
+	}
+	delete(expected, "key0")
+	if c.Deleted() != testTombstoneBytes(c) {
+		t.Fatal("Del didn't compact after the compaction interval, deleted", c.Deleted())
+	}
+	testCheckPairs(t, c, expected)
+
+	//Disabled
+	c.SetCompactionThreshold(0)
+	clock.advance(defaultCompactionInterval)
+	round(7)
+	round(8)
+	if c.Deleted() <= c.Used()/2 {
+		t.Fatal("compacted with automatic compaction disabled")
+	}
+}
+
+//Counts the live pairs and the tombstones of c by scanning its store
+func testScanRecordCounts(c *PMap) (live, tombstones int) {
+	last := make(map[string]bool) //Key => its last record is a pair
+	c.RawScan(func(offset uint64, key, rawValue []byte, isTombstone bool) bool {
+		if isTombstone {
+			tombstones++
+		}
+		last[string(key)] = !isTombstone
+		return true
+	})
+	for _, present := range last {
+		if present {
+			live++
+		}
+	}
+	return live, tombstones
+}
+
+func testCheckRecordCounts(t *testing.T, c *PMap, live, tombstones int) {
+	t.Helper()
+	l, ts := c.RecordCounts()
+	sl, sts := testScanRecordCounts(c)
+	if l != live || ts != tombstones || sl != live || sts != tombstones {
+		t.Fatalf("RecordCounts %d, %d, scan %d, %d, expected %d, %d", l, ts, sl, sts, live, tombstones)
+	}
+}
+
+func TestRecordCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 1024*1024)
+	testCheckRecordCounts(t, c, 0, 0)
+	testFragmented(t, c)
+	testCheckRecordCounts(t, c, 666, 334)
+	//Deletions of missing keys and discarded deletions don't write tombstones
+	for _, k := range []string{"key0", "missing"} {
+		key := []byte(k)
+		if err := c.Del(hashing.FNV1a64(key), key, testValue(4, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := []byte("key1")
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	testCheckRecordCounts(t, c, 666, 334)
+
+	c.Close()
+	c = testOpen(t, path)
+	testCheckRecordCounts(t, c, 666, 334)
+	//Not closed cleanly
+	c.st.close()
+	c = testOpen(t, path)
+	if !c.Recovered() {
+		t.Fatal("not recovered")
+	}
+	testCheckRecordCounts(t, c, 666, 334)
+	//Compaction keeps the tombstones
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	testCheckRecordCounts(t, c, 666, 334)
+	c.CloseAndDelete()
+
+	//Rolled back batches leave them unchanged
+	c = New("", 1024*1024)
+	testFragmented(t, c)
+	var b WriteBatch
+	b.Del(hashing.FNV1a64(key), key, testValue(5, ""))
+	b.Set(hashing.FNV1a64(key), key, testValue(5, string(make([]byte, 1024*1024))))
+	if err := c.ApplyBatch(&b); !errors.Is(err, ErrStoreFull) {
+		t.Fatal("the batch fits", err)
+	}
+	testCheckRecordCounts(t, c, 666, 334)
+	c.Close()
+
+	//Space reuse frees the deleted pairs instead of writing tombstones
+	c, err := NewWithOptions("", 1024*1024, Options{ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testFragmented(t, c)
+	testCheckRecordCounts(t, c, 666, 0)
+}
+
+func TestIterateInvalidatedByCompaction(t *testing.T) {
+	iterations := map[string]func(c *PMap, f func() bool) error{
+		"Iterate":          func(c *PMap, f func() bool) error { return c.Iterate(func(k, v []byte) bool { return f() }) },
+		"BackwardsIterate": func(c *PMap, f func() bool) error { return c.BackwardsIterate(func(k, v []byte) bool { return f() }) },
+		"IterateReuse":     func(c *PMap, f func() bool) error { return c.IterateReuse(func(k, v []byte) bool { return f() }) },
+		"IterateKeys":      func(c *PMap, f func() bool) error { return c.IterateKeys(func(k []byte) bool { return f() }) },
+		"ScanPrefix":       func(c *PMap, f func() bool) error { return c.ScanPrefix(nil, func(k, v []byte) bool { return f() }) },
+		"IterateProject": func(c *PMap, f func() bool) error {
+			return c.IterateProject(0, 1, func(k, v []byte) bool { return f() })
+		},
+		"RawScan": func(c *PMap, f func() bool) error {
+			return c.RawScan(func(offset uint64, k, v []byte, isTombstone bool) bool { return f() })
+		},
+		"IterateContext": func(c *PMap, f func() bool) error {
+			return c.IterateContext(context.Background(), func(k, v []byte) error { f(); return nil })
+		},
+		"ScanFrom": func(c *PMap, f func() bool) error {
+			_, err := c.ScanFrom(0, 1000, func(k, v []byte) bool { return f() })
+			return err
+		},
+	}
+	for name, iterate := range iterations {
+		t.Run(name, func(t *testing.T) {
+			c := New("", 1024*1024)
+			defer c.Close()
+			testFragmented(t, c)
+			calls := 0
+			err := iterate(c, func() bool {
+				calls++
+				if calls == 1 {
+					if err := c.Compact(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return true
+			})
+			if err != errIterationInvalidated || calls != 1 {
+				t.Fatal("the iteration went on after a compaction", err, calls)
+			}
+		})
+	}
+	//An automatic compaction triggered by the callback stops the iteration too
+	c := New("", 16*1024*1024)
+	defer c.Close()
+	body := string(bytes.Repeat([]byte("v"), 100))
+	for i := 0; i < 20000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(hashing.FNV1a64(key), key, testValue(1, body))
+	}
+	ts := uint64(2)
+	err := c.Iterate(func(key, value []byte) bool {
+		for i := 0; i < 20000; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(ts, body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ts++
+		return true
+	})
+	if err != errIterationInvalidated || c.lastCompaction.IsZero() {
+		t.Fatal("the iteration went on after an automatic compaction", err)
+	}
+}
@@ -0,0 +1,134 @@
+package pmap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+	Value compression (Options.Codec) compresses the value bodies written by Set, CAS and the other writes,
+	the timestamp header is stored uncompressed. Get, the iterations and every other read return the
+	decompressed values.
+
+	A compressed pair is flagged with compressedFlag on its key length word (it halves the maximum key length),
+	its stored value is:
+		8 bytes: timestamp
+		1 byte:  Codec
+		Compressed body
+	Each pair records its codec: pairs written with any Codec, or without compression, are read by every PMap
+	regardless of its Options.Codec, changing the codec of a store only changes how the new pairs are written.
+	Only bodies of compressMinBody bytes or more are compressed, and only if it saves space.
+	Compressed bodies are never deduplicated (see dedup.go).
+
+	The PMap checksum covers the key hashes and the timestamps, it doesn't depend on the compression.
+	Record checksums (Options.Checksums) are computed over the stored, compressed, bytes on Set and checked
+	on Open and Verify. A compressed body that can't be decompressed is a corrupt record: reading it fails
+	with ErrCorruptRecord, Verify reports it if the store has record checksums and Repair stops at it.
+
+	Tradeoff: compression saves store space (and the disk and page cache used by it) at the cost of CPU time
+	on every write and on every read of the value, including the iterations. It pays off with large and
+	redundant values, like JSON documents; small or already compressed values are stored as they are, after
+	a wasted compression attempt on each write. BenchmarkCodec measures both sides.
+*/
+
+//Codec selects the compression of the value bodies, see Options.Codec
+type Codec uint8
+
+const (
+	CodecNone  Codec = iota //Store the value bodies uncompressed
+	CodecFlate              //DEFLATE (compress/flate) at the default level
+	CodecGzip               //gzip (compress/gzip), DEFLATE with a header and a CRC-32 of the body
+)
+
+const compressedFlag = 1 << 28 //Set on the key length word of pairs with a compressed body
+
+//Bodies smaller than this are not compressed, the codec overhead would exceed the savings
+const compressMinBody = 64
+
+//Returns an error if k is not a known Codec
+func (k Codec) check() error {
+	if k > CodecGzip {
+		return fmt.Errorf("Unknown Codec %d", k)
+	}
+	return nil
+}
+
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+//Returns the stored form of body: the codec followed by the compressed body
+func (k Codec) compress(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(k))
+	switch k {
+	case CodecFlate:
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		w.Write(body)
+		w.Close()
+		flateWriters.Put(w)
+	case CodecGzip:
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&buf)
+		w.Write(body)
+		w.Close()
+		gzipWriters.Put(w)
+	}
+	return buf.Bytes()
+}
+
+//Decompresses a body stored by compress
+func decompress(stored []byte) ([]byte, error) {
+	var r io.Reader
+	switch Codec(stored[0]) {
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(stored[1:]))
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		return nil, fmt.Errorf("unknown Codec %d", stored[0])
+	}
+	return io.ReadAll(r)
+}
+
+func (st *store) isCompressed(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&compressedFlag != 0
+}
+
+//Sets flags (compressedFlag and encryptedFlag) on the key length word of the pair at index
+func (st *store) setKeyFlags(index uint64, flags uint32) {
+	binary.LittleEndian.PutUint32(st.file[index+headerKeyOffset:], binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])|flags)
+}
+
+//Returns the value to store instead of value (timestamp header and compressed body) and true if the body
+//is compressed with the PMap codec, false if it is stored uncompressed
+func (c *PMap) compressValue(value []byte) ([]byte, bool) {
+	body := value[8:]
+	if c.codec == CodecNone || len(body) < compressMinBody {
+		return nil, false
+	}
+	stored := c.codec.compress(body)
+	if len(stored) >= len(body) {
+		return nil, false
+	}
+	return append(value[:8:8], stored...), true
+}
+
+//NewWithCodec returns an initialized PMap like New does, compressing the value bodies with codec
+func NewWithCodec(path string, size uint64, codec Codec) (*PMap, error) {
+	return NewWithOptions(path, size, Options{Codec: codec})
+}
@@ -0,0 +1,154 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//A redundant JSON document of about 1KB
+func testDocument(i int) string {
+	return fmt.Sprintf(`{"id":%d,"tags":[%s],"text":%q}`, i, strings.Repeat(`"tag",`, 50)+`"last"`, strings.Repeat("lorem ipsum ", 60))
+}
+
+func TestCodec(t *testing.T) {
+	for _, codec := range []Codec{CodecFlate, CodecGzip} {
+		t.Run(fmt.Sprint("Codec=", codec), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			c, err := NewWithOptions(path, 1024*1024, Options{Codec: codec, Checksums: true, DedupValues: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				body := testDocument(i)
+				if i%10 == 0 {
+					//Too small to be compressed
+					body = fmt.Sprint("value", i)
+				}
+				if err := c.Set(c.Hash(key), key, testValue(1, body)); err != nil {
+					t.Fatal(err)
+				}
+				stIndex, _ := c.lookup(uint32(c.Hash(key)), key)
+				if c.st.isCompressed(stIndex) != (i%10 != 0) {
+					t.Fatal("wrong compression of", string(key))
+				}
+			}
+			if c.Used() > 100*len(testDocument(0))/4 {
+				t.Fatal("the compressed store uses", c.Used(), "bytes")
+			}
+			expected := testPairs(c)
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				v, _ := c.Get(uint32(c.Hash(key)), key)
+				if string(v) != expected[string(key)] || (i%10 != 0 && string(v[8:]) != testDocument(i)) {
+					t.Fatal("wrong value", string(key), string(v))
+				}
+			}
+			//CAS compares the decompressed body
+			key := []byte("key1")
+			if err := c.CAS(c.Hash(key), key, testCASValue(1, testDocument(1), 2, testDocument(-1))); err != nil {
+				t.Fatal(err)
+			}
+			expected["key1"] = string(testValue(2, testDocument(-1)))
+			if err := c.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			//Compressed pairs are read without codec, the new pairs are stored uncompressed
+			c = testOpen(t, path)
+			defer c.CloseAndDelete()
+			if err := c.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			key = []byte("new")
+			c.Set(c.Hash(key), key, testValue(1, testDocument(100)))
+			if stIndex, _ := c.lookup(uint32(c.Hash(key)), key); c.st.isCompressed(stIndex) {
+				t.Fatal("a PMap without codec compressed a body")
+			}
+			expected["new"] = string(testValue(1, testDocument(100)))
+			pairs := testPairs(c)
+			if len(pairs) != len(expected) {
+				t.Fatal("reopened PMap with", len(pairs), "pairs, expected", len(expected))
+			}
+			for k, v := range expected {
+				if pairs[k] != v {
+					t.Fatalf("reopened %s = %q, expected %q", k, pairs[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecCorrupt(t *testing.T) {
+	if _, err := NewWithCodec("", 1024*1024, CodecGzip+1); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithCodec(path, 1024*1024, CodecFlate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	c.Set(c.Hash(key), key, testValue(1, testDocument(0)))
+	stIndex, _ := c.lookup(uint32(c.Hash(key)), key)
+	c.st.val(stIndex)[8] = byte(CodecGzip + 1)
+	c.Close()
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "invalid compressed body") {
+		t.Fatal("opened a store with an unknown codec:", err)
+	}
+
+	//A damaged compressed body is only detected when it is read
+	c, err = NewWithCodec(path, 1024*1024, CodecFlate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	c.Set(c.Hash(key), key, testValue(1, testDocument(0)))
+	stIndex, _ = c.lookup(uint32(c.Hash(key)), key)
+	for i := range c.st.val(stIndex)[9:] {
+		c.st.val(stIndex)[9+i] = 0xff
+	}
+	if _, err := c.Get(uint32(c.Hash(key)), key); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("Get of a corrupt body:", err)
+	}
+	if err := c.Iterate(func(key, value []byte) bool { return true }); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("Iterate over a corrupt body:", err)
+	}
+	cur := c.Cursor()
+	if cur.Next() || !errors.Is(cur.Err(), ErrCorruptRecord) {
+		t.Fatal("Cursor over a corrupt body:", cur.Err())
+	}
+}
+
+//Set and Get throughput of 1KB JSON documents with each codec, the store space is reported as bytes/pair
+func BenchmarkCodec(b *testing.B) {
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecGzip} {
+		b.Run(fmt.Sprint("Codec=", codec), func(b *testing.B) {
+			c, err := NewWithCodec("", 64*1024*1024, codec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.CloseAndDelete()
+			keys := make([][]byte, 1000)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprint("key", i))
+				c.Set(c.Hash(keys[i]), keys[i], testValue(1, testDocument(i)))
+			}
+			used := c.Used()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%len(keys)]
+				c.Set(c.Hash(key), key, testValue(uint64(i+2), testDocument(i)))
+				c.Get(uint32(c.Hash(key)), key)
+			}
+			b.ReportMetric(float64(used)/float64(len(keys)), "bytes/pair")
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+	Conflict resolution
+
+	By default every primitive resolves conflicts with last-write-wins on the timestamp header: Set only replaces
+	an older pair, Del only deletes a pair that isn't newer than the tombstone.
+	Options.Resolver replaces that rule with an application-level one, like merging CRDT counters or sets.
+
+	The resolver is consulted when Set, Del or CAS (once its tests pass) find a stored pair for the key.
+	It is not consulted on Open: the store only holds resolved values, so the last stored pair is the winner.
+	WAL replays go through Set, Del and CAS, they consult it again with the same inputs.
+*/
+
+//ConflictResolver returns the winner of a conflict between the stored value of key and the incoming one,
+//both with their timestamp header. Returning stored keeps the stored pair; any other value, incoming or a merge of
+//both, is written. Del passes its 8 byte tombstone header as incoming, the pair is deleted unless stored is
+//returned.
+//Replicas only converge if the resolver is deterministic: it must only depend on its arguments, and merges must not
+//depend on the order of the writes (a merged timestamp like max(stored, incoming) + 1 does).
+//A merged value shouldn't be older than stored nor incoming, Options.ReuseSpace uses timestamps to order pairs on Open.
+//The resolver must not modify stored nor incoming, and it must not use the PMap
+type ConflictResolver func(key, stored, incoming []byte) (winner []byte)
+
+//Resolves the conflict between the pair at stIndex and incoming, keep is true if the stored pair wins
+func (c *PMap) resolve(key []byte, stIndex uint64, incoming []byte) (winner []byte, keep bool, err error) {
+	stored, err := c.appendValue(nil, stIndex)
+	if err != nil {
+		return nil, false, err
+	}
+	winner = c.resolver(key, stored, incoming)
+	if bytes.Equal(winner, stored) {
+		return nil, true, nil
+	}
+	if len(winner) < 8 {
+		return nil, false, fmt.Errorf("%w: resolved value len < 8", ErrValueTooShort)
+	}
+	c.observe(winner[:8])
+	return winner, false, nil
+}
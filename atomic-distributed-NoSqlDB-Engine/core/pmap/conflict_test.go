@@ -0,0 +1,108 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Merges two sets of comma separated elements, the merged timestamp is the newest one
+func testUnionResolver(key, stored, incoming []byte) []byte {
+	if len(incoming) == 8 {
+		//Deletions of non-empty sets are ignored
+		return stored
+	}
+	elems := make(map[string]bool)
+	for _, v := range [][]byte{stored, incoming} {
+		for _, e := range strings.Split(string(v[8:]), ",") {
+			elems[e] = true
+		}
+	}
+	var union []string
+	for e := range elems {
+		union = append(union, e)
+	}
+	sort.Strings(union)
+	ts := binary.LittleEndian.Uint64(stored)
+	if t := binary.LittleEndian.Uint64(incoming); t > ts {
+		ts = t
+	}
+	return testValue(ts, strings.Join(union, ","))
+}
+
+func TestConflictResolver(t *testing.T) {
+	writes := [][]byte{testValue(10, "a"), testValue(10, "b"), testValue(5, "c"), testValue(12, "a")}
+	key := []byte("set")
+	var replicas []*PMap
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		c, err := NewWithOptions("", 1024*1024, Options{Resolver: testUnionResolver})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for _, i := range order {
+			if err := c.Set(c.Hash(key), key, writes[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		replicas = append(replicas, c)
+	}
+	//Concurrent writes with equal timestamps are merged and replicas converge to the same pair
+	for _, c := range replicas {
+		v, _ := c.Get(uint32(c.Hash(key)), key)
+		if string(v[8:]) != "a,b,c" {
+			t.Fatal("wrong merged value", string(v[8:]))
+		}
+		if c.checksum.total() != replicas[0].checksum.total() {
+			t.Fatal("replicas didn't converge")
+		}
+	}
+
+	c := replicas[0]
+	v, _ := c.Get(uint32(c.Hash(key)), key)
+	//The resolver keeps the stored pair
+	c.Del(c.Hash(key), key, testValue(100, ""))
+	if got, _ := c.Get(uint32(c.Hash(key)), key); string(got) != string(v) {
+		t.Fatal("the resolver didn't keep the stored pair", string(got))
+	}
+	//Rewriting the stored value is a no-op
+	used := c.Used()
+	c.Set(c.Hash(key), key, v)
+	if c.Used() != used {
+		t.Fatal("the stored winner was written again")
+	}
+	//CAS writes the merged value
+	cas := make([]byte, 16)
+	copy(cas, v[:8])
+	binary.LittleEndian.PutUint64(cas[8:], hashing.FNV1a64(v[8:]))
+	cas = append(cas, testValue(200, "d")...)
+	if err := c.CAS(c.Hash(key), key, cas); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Get(uint32(c.Hash(key)), key); string(got[8:]) != "a,b,c,d" || binary.LittleEndian.Uint64(got) != 200 {
+		t.Fatal("wrong CAS value", string(got))
+	}
+}
+
+func TestConflictResolverDelError(t *testing.T) {
+	//A resolved value without timestamp is rejected, the pair is kept
+	c, err := NewWithOptions("", 1024*1024, Options{Resolver: func(key, stored, incoming []byte) []byte { return nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("key")
+	if err := c.Set(c.Hash(key), key, testValue(1, "v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del(c.Hash(key), key, testValue(2, "")); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("the resolver error was dropped", err)
+	}
+	if !c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("the pair was deleted")
+	}
+}
@@ -0,0 +1,125 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+	Record checksums (Options.Checksums) detect silent corruption of the memory-mapped file, like a bit-flip
+	caused by disk rot, before it produces wrong values or spreads to the anti-entropy checksums.
+
+	Every record stores a CRC32 (Castagnoli) of its key and value bytes, placed before the record trailer.
+	The length words are not covered, their flags are set after the record is written, but inconsistent
+	lengths are detected by the structural checks of Open and Verify.
+	Checksums are checked by Verify, and by Get, GetInto, GetIfNewer and MultiGet with Options.VerifyReads:
+	they return ErrCorruptRecord instead of a corrupt value, at the cost of a CRC of each read record.
+	Iterate and Open don't pay their cost.
+
+	The record layout changes, so a store with checksums starts with a store header:
+		8 bytes: storeMagic
+		1 byte:  format version (storeFormatCRC)
+		7 bytes: reserved
+	Stores created without checksums keep the legacy format: no store header and records without CRC.
+	The magic can't be mistaken for the first record of a legacy store, its key length word would be
+	a deduplicated value blob with a key, which put never writes.
+	The format is selected when the store is created, Open reads it from the store header.
+*/
+
+const (
+	storeFormatLegacy = 0 //No store header, records without CRC
+	storeFormatCRC    = 1 //Store header, records with a CRC32C
+)
+
+const storeHeaderSize = 16
+
+const storeMagic = 0x726f745370614d50 //"PMapStor"
+
+const crcSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//Returns the number of bytes of a record that are not part of its key or its value
+func (st *store) overhead() uint64 {
+	if st.crc {
+		return headerSize + crcSize + 4
+	}
+	return headerSize + 4
+}
+
+//Writes the store header of an empty store, its records will have a CRC
+func (st *store) enableCRC() {
+	binary.LittleEndian.PutUint64(st.file, storeMagic)
+	st.file[8] = storeFormatCRC
+	st.crc = true
+	st.first = storeHeaderSize
+	st.length = st.first
+}
+
+//Reads the format version from the store header of an opened store, legacy stores have no header
+func (st *store) readHeader() error {
+	if st.size < storeHeaderSize+footerSize || binary.LittleEndian.Uint64(st.file) != storeMagic {
+		return nil
+	}
+	if version := st.file[8]; version != storeFormatCRC {
+		return fmt.Errorf("Unsupported store format version %d", version)
+	}
+	st.crc = true
+	st.first = storeHeaderSize
+	st.length = st.first
+	return nil
+}
+
+//Returns the CRC of the key, the value and the expiry (if any) of the record at index
+func (st *store) recordCRC(index uint64) uint32 {
+	start := index + headerSize
+	return crc32.Checksum(st.file[start:start+uint64(st.totalLen(index))], crcTable)
+}
+
+//Rewrites the CRC of the record at index after its key or value bytes were modified in place
+func (st *store) updateCRC(index uint64) {
+	binary.LittleEndian.PutUint32(st.file[index+headerSize+uint64(st.totalLen(index)):], st.recordCRC(index))
+}
+
+//Returns the CRC written with the record at index
+func (st *store) storedCRC(index uint64) uint32 {
+	return binary.LittleEndian.Uint32(st.file[index+headerSize+uint64(st.totalLen(index)):])
+}
+
+var errVerifyReadsCRC = errors.New("VerifyReads needs a store with record checksums (Options.Checksums)")
+
+//Returns ErrCorruptRecord if Options.VerifyReads is set and the CRC of the pair at index, or of the blob
+//that holds its body (see dedup.go), doesn't match
+func (c *PMap) verifyRead(index uint64) error {
+	if !c.verifyReads {
+		return nil
+	}
+	if c.st.recordCRC(index) != c.st.storedCRC(index) {
+		return fmt.Errorf("%w at offset %d: CRC mismatch", ErrCorruptRecord, index)
+	}
+	if c.st.isRef(index) {
+		if blob := c.st.refBlob(index); c.st.recordCRC(blob) != c.st.storedCRC(blob) {
+			return fmt.Errorf("%w at offset %d: CRC mismatch of the blob at offset %d", ErrCorruptRecord, index, blob)
+		}
+	}
+	return nil
+}
+
+//Verify checks every record of the store, including overwritten pairs and tombstones, and returns
+//an error with the offset of the first corrupt one.
+//Records are checked against their CRC if the store was created with Options.Checksums,
+//legacy stores only get the structural checks done by Open.
+//Free regions (see Options.ReuseSpace) are not checked against their CRC, split regions don't have one
+func (c *PMap) Verify() error {
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if err := c.st.checkRecord(index, c.st.length); err != nil {
+			return err
+		}
+		if c.st.crc && !c.st.isFree(index) && c.st.recordCRC(index) != c.st.storedCRC(index) {
+			return fmt.Errorf("Corrupt store record at offset %d: CRC mismatch", index)
+		}
+	}
+	return nil
+}
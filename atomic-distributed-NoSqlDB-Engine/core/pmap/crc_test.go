@@ -0,0 +1,154 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 4*1024*1024, Options{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testFragmented(t, c)
+	if c.st.first != storeHeaderSize {
+		t.Fatal("the first pair is placed at", c.st.first)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c = testOpen(t, path)
+	if !c.st.crc {
+		t.Fatal("the store format was not read from the store header")
+	}
+	testCheckPairs(t, c, expected)
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	//Pairs written after reopening keep the format
+	key := []byte("new key")
+	if err := c.Set(hashing.FNV1a64(key), key, testValue(5, "new value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Bit-flip on a stored value
+	stIndex, _ := c.lookup(uint32(hashing.FNV1a64(key)), key)
+	c.st.val(stIndex)[9] ^= 4
+	err = c.Verify()
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint("offset ", stIndex, ":")) {
+		t.Fatal("the corrupt record at", stIndex, "was not reported:", err)
+	}
+	c.Close()
+}
+
+func TestVerifyChecksumsReuseSpace(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{Checksums: true, ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testChurn(t, c, 100, 20)
+	testCheckChurned(t, c, 100, 20)
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyStoreFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 10)
+	c.Close()
+
+	c = testOpen(t, path)
+	defer c.Close()
+	if c.st.crc || c.st.first != 0 {
+		t.Fatal("legacy store opened with the store header format")
+	}
+	if c.st.keyLen(0) != uint32(len("key0")) {
+		t.Fatal("the first pair of a legacy store is not placed at index 0")
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsupportedStoreFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.st.file[8] = storeFormatCRC + 1
+	c.Close()
+	c, err = Open(path)
+	if err == nil {
+		c.Close()
+		t.Fatal("store with an unknown format version opened")
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	if _, err := NewWithOptions("", 1024*1024, Options{VerifyReads: true}); err == nil {
+		t.Fatal("VerifyReads accepted without record checksums")
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{Checksums: true, VerifyReads: true, DedupValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	key, shared := []byte("key"), []byte("shared")
+	c.Set(c.Hash(key), key, testValue(1, "value"))
+	body := strings.Repeat("deduplicated body ", 4)
+	c.Set(c.Hash(shared), shared, testValue(1, body))
+	if v, err := c.Get(uint32(c.Hash(key)), key); err != nil || string(v[8:]) != "value" {
+		t.Fatal("wrong value", v, err)
+	}
+
+	//Bit-flip on the stored value
+	stIndex, _ := c.lookup(uint32(c.Hash(key)), key)
+	c.st.val(stIndex)[9] ^= 4
+	if v, err := c.Get(uint32(c.Hash(key)), key); !errors.Is(err, ErrCorruptRecord) || v != nil {
+		t.Fatal("Get returned a corrupt value:", v, err)
+	}
+	if _, _, err := c.GetInto(uint32(c.Hash(key)), key, nil); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("GetInto returned a corrupt value:", err)
+	}
+	if _, _, err := c.GetIfNewer(uint32(c.Hash(key)), key, time.Unix(0, 0)); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("GetIfNewer returned a corrupt value:", err)
+	}
+	if _, err := c.MultiGet([][]byte{shared, key}); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("MultiGet returned a corrupt value:", err)
+	}
+	//Bit-flip on the blob of a deduplicated value
+	stIndex, _ = c.lookup(uint32(c.Hash(shared)), shared)
+	if !c.st.isRef(stIndex) {
+		t.Fatal("the value was not deduplicated")
+	}
+	c.st.val(c.st.refBlob(stIndex))[0] ^= 1
+	if v, err := c.Get(uint32(c.Hash(shared)), shared); !errors.Is(err, ErrCorruptRecord) || v != nil {
+		t.Fatal("Get returned a corrupt deduplicated value:", v, err)
+	}
+	c.Close()
+
+	legacy := filepath.Join(t.TempDir(), "legacy")
+	testFilledFile(t, legacy, 10).Close()
+	if _, err := OpenWithOptions(legacy, Options{VerifyReads: true}); err == nil {
+		t.Fatal("VerifyReads accepted on a store without record checksums")
+	}
+}
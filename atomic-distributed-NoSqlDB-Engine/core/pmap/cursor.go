@@ -0,0 +1,130 @@
+package pmap
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+	Cursors
+
+	A Cursor visits the live pairs in the order of Iterate (store order), but the caller drives it:
+		cur := c.Cursor()
+		for cur.Next() {
+			process(cur.Key(), cur.Value())
+		}
+		if err := cur.Err(); err != nil {
+			...
+		}
+	It can be stopped and resumed at any time, and several cursors can be advanced together, to merge PMaps for example.
+
+	A cursor walks the store up to its length when Cursor was called, pairs appended later are never visited.
+	It is a point-in-time bound, not a snapshot: the interaction with mutations made while the cursor is in use is
+	undefined, an overwritten, deleted or expired pair may or may not be visited. Compact, Clear and Close
+	invalidate the cursor, its next Next returns false and Err returns errCursorInvalidated.
+
+	SyncPMap.Cursor returns a cursor whose Next holds the read lock while it advances, writers can run between
+	two Next calls with the same undefined interaction.
+
+	The callback iterations (Iterate, IterateContext, BackwardsIterate, ScanPrefix...) check the same conditions
+	after each callback: if it compacted, cleared or closed the PMap, directly or through an automatic compaction
+	of Set or Del, they stop and return errIterationInvalidated instead of reading stale store indexes.
+*/
+
+var (
+	errCursorInvalidated    = errors.New("Error: the cursor was invalidated by Compact, Clear or Close")
+	errIterationInvalidated = errors.New("Error: the iteration was invalidated by Compact, Clear or Close")
+)
+
+//Store walked by an iteration, Compact replaces it and Clear empties it
+type iterStore struct {
+	st     *store
+	clears uint64
+}
+
+func (c *PMap) iterStore() iterStore {
+	return iterStore{st: c.st, clears: c.st.clears}
+}
+
+//Returns errIterationInvalidated if the store walked by the iteration was replaced, cleared or closed
+func (c *PMap) checkIter(it iterStore) error {
+	if c.closed || c.st != it.st || c.st.clears != it.clears {
+		return errIterationInvalidated
+	}
+	return nil
+}
+
+//A Cursor iterates the live pairs of a PMap one at a time, see cursor.go
+//Like PMap it is *not* thread-safe, even if it was returned by SyncPMap.Cursor
+type Cursor struct {
+	c      *PMap
+	st     *store        //Store walked by the cursor, Compact replaces it
+	clears uint64        //st.clears when the cursor was created
+	index  uint64        //Store index of the next record
+	end    uint64        //Store length when the cursor was created
+	ra     *readAhead    //nil if it is disabled
+	mutex  *sync.RWMutex //Read locked by Next, only for SyncPMap cursors
+	key    []byte
+	value  []byte
+	err    error
+}
+
+//Cursor returns a Cursor positioned before the first live pair
+func (c *PMap) Cursor() *Cursor {
+	return &Cursor{
+		c:      c,
+		st:     c.st,
+		clears: c.st.clears,
+		index:  c.st.first,
+		end:    c.st.length,
+		ra:     c.newReadAhead(),
+	}
+}
+
+//Next advances the cursor to the next live pair. It returns false when there are no more pairs or if
+//the cursor was invalidated, see Err
+func (cur *Cursor) Next() bool {
+	if cur.mutex != nil {
+		cur.mutex.RLock()
+		defer cur.mutex.RUnlock()
+	}
+	cur.key, cur.value = nil, nil
+	if cur.err != nil {
+		return false
+	}
+	c := cur.c
+	if c.closed || c.st != cur.st || c.st.clears != cur.clears {
+		cur.err = errCursorInvalidated
+		return false
+	}
+	for cur.index < cur.end && cur.index < c.st.length {
+		index := cur.index
+		cur.ra.advance(index)
+		cur.index += c.st.recordSize(index)
+		if c.isPresent(index) {
+			cur.key = append([]byte(nil), c.st.key(index)...)
+			if cur.value, cur.err = c.appendValue(nil, index); cur.err != nil {
+				cur.key, cur.value = nil, nil
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+//Key returns a copy of the key of the current pair, nil if Next returned false
+func (cur *Cursor) Key() []byte {
+	return cur.key
+}
+
+//Value returns a copy of the value of the current pair (timestamp header included) like Iterate,
+//nil if Next returned false
+func (cur *Cursor) Value() []byte {
+	return cur.value
+}
+
+//Err returns the error that stopped the cursor, nil if it visited every pair or it wasn't exhausted yet
+func (cur *Cursor) Err() error {
+	return cur.err
+}
@@ -0,0 +1,114 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestCursor(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	testFragmented(t, c)
+	var keys, values [][]byte
+	c.Iterate(func(key, value []byte) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	//Two cursors advanced together visit the pairs of Iterate in the same order
+	a, b := c.Cursor(), c.Cursor()
+	for i := range keys {
+		for _, cur := range []*Cursor{a, b} {
+			if !cur.Next() {
+				t.Fatal("cursor exhausted at pair", i, cur.Err())
+			}
+			if !bytes.Equal(cur.Key(), keys[i]) || !bytes.Equal(cur.Value(), values[i]) {
+				t.Fatalf("pair %d: got %s %v, expected %s %v", i, cur.Key(), cur.Value(), keys[i], values[i])
+			}
+		}
+		if i == len(keys)/2 {
+			//Pairs appended after Cursor are not visited
+			key := []byte("new")
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(5, "new value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, cur := range []*Cursor{a, b} {
+		if cur.Next() || cur.Err() != nil || cur.Key() != nil || cur.Value() != nil {
+			t.Fatal("cursor not exhausted", string(cur.Key()), cur.Err())
+		}
+	}
+	empty := New("", 1024*1024)
+	defer empty.Close()
+	if cur := empty.Cursor(); cur.Next() || cur.Err() != nil {
+		t.Fatal("cursor of an empty PMap", cur.Err())
+	}
+}
+
+func TestCursorInvalidated(t *testing.T) {
+	for _, op := range []string{"Compact", "Clear", "Close"} {
+		t.Run(op, func(t *testing.T) {
+			c := New("", 1024*1024)
+			defer c.Close()
+			testFragmented(t, c)
+			cur := c.Cursor()
+			if !cur.Next() {
+				t.Fatal(cur.Err())
+			}
+			switch op {
+			case "Compact":
+				if err := c.Compact(); err != nil {
+					t.Fatal(err)
+				}
+			case "Clear":
+				if err := c.Clear(); err != nil {
+					t.Fatal(err)
+				}
+				testFragmented(t, c)
+			case "Close":
+				c.Close()
+			}
+			if cur.Next() || cur.Err() != errCursorInvalidated {
+				t.Fatal("cursor not invalidated", cur.Err())
+			}
+			//New cursors work
+			if op != "Close" {
+				if cur := c.Cursor(); !cur.Next() {
+					t.Fatal(cur.Err())
+				}
+			}
+		})
+	}
+}
+
+func TestSyncCursor(t *testing.T) {
+	c := NewSync("", 16*1024*1024)
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i)))
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			c.Set(hashing.FNV1a64(key), key, testValue(2, fmt.Sprint("value", i)))
+		}
+	}()
+	//Overwritten pairs may or may not be visited, the cursor never visits a pair twice
+	seen := make(map[string]bool)
+	for cur := c.Cursor(); cur.Next(); {
+		if seen[string(cur.Key())] {
+			t.Fatal("pair visited twice", string(cur.Key()))
+		}
+		seen[string(cur.Key())] = true
+	}
+	wg.Wait()
+}
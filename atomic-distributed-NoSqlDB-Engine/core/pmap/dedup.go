@@ -0,0 +1,225 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+/*
+	Value deduplication (Options.DedupValues) stores identical value bodies (values without their timestamp
+	header) once.
+
+	A deduplicated body is stored on a blob: a store record flagged with blobFlag on its key length word,
+	with an empty key and the body as value. Pairs reference it with a value flagged with refFlag on its value
+	length word:
+		8 bytes: timestamp
+		8 bytes: store index of the blob
+
+	Blobs are indexed by the FNV1a64 hash of their body, a body whose hash is used by a different blob
+	is stored without deduplication. Blob reference counting is RAM-only, it is rebuilt on Open; a blob is
+	freed (like a pair freed by Options.ReuseSpace) when the last pair referencing it is overwritten or deleted.
+
+	Reading references is always supported, Options.DedupValues only selects whether new values are deduplicated.
+*/
+
+const (
+	blobFlag = 1 << 30 //Set on the key length word of blobs
+	refFlag  = 1 << 31 //Set on the value length word of pairs that reference a blob
+)
+
+//Bodies of this size or smaller are not deduplicated, they are not bigger than a reference
+const dedupMinBody = 8
+
+type dedupStore struct {
+	blobs map[uint64]uint64 //Body hash => blob store index
+	refs  map[uint64]int    //Blob store index => number of live pairs referencing it
+}
+
+func (st *store) isBlob(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&(freeFlag|blobFlag) == blobFlag
+}
+func (st *store) isRef(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:])&refFlag != 0
+}
+
+//Returns the store index of the blob referenced by the pair at index
+func (st *store) refBlob(index uint64) uint64 {
+	return binary.LittleEndian.Uint64(st.val(index)[8:])
+}
+
+//Returns the value body (the value without the timestamp header) of the pair at index
+//Compressed and encrypted bodies are decoded into a new slice (see compress.go and encryption.go),
+//it returns ErrCorruptRecord if they can't be decoded
+func (c *PMap) body(index uint64) ([]byte, error) {
+	if c.st.isRef(index) {
+		return c.st.val(c.st.refBlob(index)), nil
+	}
+	if c.st.isCompressed(index) || c.st.isEncrypted(index) {
+		body, err := c.decodeBody(index)
+		if err != nil {
+			return nil, fmt.Errorf("%w at offset %d: %w", ErrCorruptRecord, index, err)
+		}
+		return body, nil
+	}
+	return c.st.val(index)[8:], nil
+}
+
+//Appends the value of the pair at index to dst, see body
+func (c *PMap) appendValue(dst []byte, index uint64) ([]byte, error) {
+	if c.st.isRef(index) || c.st.isCompressed(index) || c.st.isEncrypted(index) {
+		body, err := c.body(index)
+		if err != nil {
+			return dst, err
+		}
+		return append(append(dst, c.st.val(index)[:8]...), body...), nil
+	}
+	return append(dst, c.st.val(index)...), nil
+}
+
+//Returns the maximum number of store bytes written by putValue
+func (c *PMap) putSize(key, value []byte, expiry uint64) uint64 {
+	size := c.st.overhead() + uint64(len(key)+len(value))
+	if expiry != 0 {
+		size += ttlSize
+	}
+	if c.aead != nil {
+		size += sealSize
+	}
+	if c.dedupValues {
+		//A new blob with the body and a 16 byte reference
+		size += c.st.overhead() + 8
+	}
+	if c.shared != nil {
+		size += c.st.overhead() + ownerMarkSize
+	}
+	return size
+}
+
+//Puts a new pair on the store, compressing, encrypting or deduplicating its value body if it is enabled
+//Expiring pairs (expiry != 0), compressed and encrypted bodies are never deduplicated
+func (c *PMap) putValue(key, value []byte, expiry uint64) (uint64, error) {
+	if err := c.markOwner(); err != nil {
+		return 0, err
+	}
+	stored, flags := value, uint32(0)
+	if compressed, ok := c.compressValue(value); ok {
+		stored, flags = compressed, compressedFlag
+	}
+	if c.aead != nil {
+		var err error
+		if stored, err = c.encryptValue(key, stored); err != nil {
+			return 0, err
+		}
+		flags |= encryptedFlag
+	}
+	if flags != 0 {
+		index, err := c.st.putExpiring(key, stored, expiry)
+		if err != nil {
+			return 0, err
+		}
+		c.st.setKeyFlags(index, flags)
+		return index, nil
+	}
+	body := value[8:]
+	if expiry != 0 {
+		return c.st.putExpiring(key, value, expiry)
+	}
+	if !c.dedupValues || len(body) <= dedupMinBody {
+		return c.st.put(key, value)
+	}
+	h := hashing.FNV1a64(body)
+	blob, ok := c.dedup.blobs[h]
+	if ok && !bytes.Equal(c.st.val(blob), body) {
+		//Hash collision
+		return c.st.put(key, value)
+	}
+	if !ok {
+		var err error
+		blob, err = c.st.put(nil, body)
+		if err != nil {
+			return 0, err
+		}
+		c.st.setKeyLen(blob, blobFlag)
+		c.addBlob(h, blob)
+	}
+	ref := make([]byte, 16)
+	copy(ref, value[:8])
+	binary.LittleEndian.PutUint64(ref[8:], blob)
+	index, err := c.st.put(key, ref)
+	if err != nil {
+		if !ok {
+			c.freeBlob(blob)
+		}
+		return 0, err
+	}
+	c.st.setValLen(index, 16|refFlag)
+	c.dedup.refs[blob]++
+	return index, nil
+}
+
+func (c *PMap) addBlob(h, blob uint64) {
+	if c.dedup.blobs == nil {
+		c.dedup.blobs = make(map[uint64]uint64)
+		c.dedup.refs = make(map[uint64]int)
+	}
+	c.dedup.blobs[h] = blob
+}
+
+//Registers the pair at index as a live reference, it is used on Open
+func (c *PMap) restoreRef(index uint64) {
+	if c.st.isRef(index) {
+		if c.dedup.refs == nil {
+			c.dedup.refs = make(map[uint64]int)
+		}
+		c.dedup.refs[c.st.refBlob(index)]++
+	}
+}
+
+//Drops the reference of the pair at index, it must be called when a live pair is overwritten or deleted
+//The blob is freed when its last reference is dropped, except on Open (see finishRestoreBlobs) and in shared stores
+func (c *PMap) dropRef(index uint64, restoring bool) {
+	if !c.st.isRef(index) {
+		return
+	}
+	blob := c.st.refBlob(index)
+	c.dedup.refs[blob]--
+	if c.dedup.refs[blob] <= 0 {
+		delete(c.dedup.refs, blob)
+		if !restoring && c.shared == nil {
+			c.freeBlob(blob)
+		}
+	}
+}
+
+func (c *PMap) freeBlob(blob uint64) {
+	if c.batch != nil {
+		c.batch.freedBlobs = append(c.batch.freedBlobs, blob)
+	}
+	delete(c.dedup.blobs, hashing.FNV1a64(c.st.val(blob)))
+	c.st.deleted += c.st.recordSize(blob)
+	c.st.release(blob)
+}
+
+//Frees the blobs without live references once every pair is restored
+//Store order is not the write order with Options.ReuseSpace, so references can be restored before their blob
+//It returns an error if a live pair references a missing blob
+func (c *PMap) finishRestoreBlobs() error {
+	live := make(map[uint64]bool, len(c.dedup.blobs))
+	for _, blob := range c.dedup.blobs {
+		live[blob] = true
+	}
+	for blob := range c.dedup.refs {
+		if !live[blob] {
+			return fmt.Errorf("Corrupt store: reference to a missing blob at offset %d", blob)
+		}
+	}
+	for _, blob := range c.dedup.blobs {
+		if c.dedup.refs[blob] <= 0 && !c.st.readOnly && c.shared == nil {
+			c.freeBlob(blob)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Returns the number of live blobs on the store
+func testCountBlobs(c *PMap) int {
+	n := 0
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if c.st.isBlob(index) {
+			n++
+		}
+	}
+	return n
+}
+
+func testCheckDedup(t *testing.T, c *PMap, n int, body string) {
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		v, err := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if err != nil || !bytes.Equal(v, testValue(uint64(i+1), body)) {
+			t.Fatal("wrong value", string(key), v, err)
+		}
+	}
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		if string(value[8:]) != body {
+			t.Fatal("wrong iterated value", string(key), value)
+		}
+		return true
+	})
+	if count != n {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, n)
+	}
+}
+
+func TestDedupValues(t *testing.T) {
+	const n = 1000
+	body := string(bytes.Repeat([]byte("default document "), 10))
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{DedupValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(uint64(i+1), body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b := testCountBlobs(c); b != 1 {
+		t.Fatalf("%d physical copies of the value, expected 1", b)
+	}
+	if c.Used() > len(body)+n*40 {
+		t.Fatal("deduplicated pairs use", c.Used(), "bytes")
+	}
+	testCheckDedup(t, c, n, body)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+
+	//Opened without DedupValues: references are still read
+	c = testOpen(t, path)
+	if c.Recovered() || c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum {
+		t.Fatal("inconsistent reopened store", c.Recovered(), c.Used(), c.Deleted(), c.checksum.total())
+	}
+	testCheckDedup(t, c, n, body)
+	c.Close()
+
+	c, err = OpenWithOptions(path, Options{DedupValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//CAS compares the hash of the deduplicated body, its short value is not deduplicated
+	key := []byte("key0")
+	cas := make([]byte, 24)
+	binary.LittleEndian.PutUint64(cas, 1)
+	binary.LittleEndian.PutUint64(cas[8:], hashing.FNV1a64([]byte(body)))
+	binary.LittleEndian.PutUint64(cas[16:], 2)
+	if err := c.CAS(hashing.FNV1a64(key), key, append(cas, "new"...)); err != nil {
+		t.Fatal(err)
+	}
+	//The blob is freed once no pair references it
+	for i := 1; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Del(hashing.FNV1a64(key), key, testValue(uint64(n+1), "")); err != nil {
+			t.Fatal(err)
+		}
+		if b := testCountBlobs(c); b != 1 && i < n-1 {
+			t.Fatalf("%d blobs after deleting %d referencing pairs", b, i)
+		}
+	}
+	if b := testCountBlobs(c); b != 0 {
+		t.Fatalf("%d blobs without references", b)
+	}
+	if len(c.dedup.blobs) != 0 || len(c.dedup.refs) != 0 {
+		t.Fatal("blobs still tracked", c.dedup.blobs, c.dedup.refs)
+	}
+}
+
+func TestDedupValuesRecovery(t *testing.T) {
+	body := "shared value body"
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{DedupValues: true, ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(0, "unique value "+fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		//Overwrite: the unique body is freed and reused
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(uint64(i+1), body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//A blob whose referencing pair was never written
+	blob, _ := c.st.put(nil, []byte("orphan blob body"))
+	c.st.setKeyLen(blob, blobFlag)
+	used := c.Used()
+	//Crash: the store is released without writing the footer
+	c.st.close()
+
+	c, err = OpenWithOptions(path, Options{DedupValues: true, ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Recovered() || c.Used() != used {
+		t.Fatal("unexpected recovered store", c.Recovered(), c.Used(), used)
+	}
+	testCheckDedup(t, c, 10, body)
+	if b := testCountBlobs(c); b != 1 {
+		t.Fatalf("%d blobs after recovering, expected 1", b)
+	}
+}
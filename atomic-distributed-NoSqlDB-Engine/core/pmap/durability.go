@@ -0,0 +1,108 @@
+package pmap
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+	Durability (Options.Durability) selects when the store is synced to disk (msync), the pairs written
+	before a sync survive a crash of the machine:
+	- DurabilityNone: the kernel flushes the dirty pages when it decides, a crash of the process is safe
+	  but a crash of the machine can lose the recent writes. It is the default.
+	- DurabilityOnClose: Close syncs the store after writing the footer.
+	- DurabilityPeriodic: a background goroutine syncs the store every Options.SyncInterval, and Close syncs it too.
+	  A crash of the machine loses at most the writes of the last interval.
+	Sync flushes the store explicitly in every mode. The periodic goroutine syncs the whole mapping while
+	the PMap keeps writing (msync doesn't block writers), the store mapMutex prevents it from syncing a
+	mapping being replaced by a grow. Anonymous and read-only PMaps have nothing to sync.
+
+	Throughput cost: run BenchmarkSetDurability on the target disk. Set never waits for a sync, so None and OnClose
+	have the same Set throughput (OnClose only makes Close slower) and Periodic competes with the writers for I/O:
+	each sync writes back every page dirtied since the previous one, short intervals rewrite hot pages many times.
+	On memory-backed file systems (tmpfs) the three modes are within the benchmark noise.
+*/
+
+//Durability selects when the store is synced to disk, see Options.Durability
+type Durability int
+
+const (
+	DurabilityNone     Durability = iota //Rely on the kernel to flush the store
+	DurabilityOnClose                    //Sync the store on Close
+	DurabilityPeriodic                   //Sync the store every Options.SyncInterval and on Close
+)
+
+const defaultSyncInterval = time.Second
+
+//Returns an error if d is not a known Durability mode
+func (d Durability) check() error {
+	if d < DurabilityNone || d > DurabilityPeriodic {
+		return fmt.Errorf("Unknown Durability mode %d", d)
+	}
+	return nil
+}
+
+//periodicSync runs the background goroutine of DurabilityPeriodic
+type periodicSync struct {
+	interval time.Duration
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+//Sync flushes the store to disk, when it returns without error every pair written before will be found after a crash.
+//With DurabilityNone it is the only way to make the writes durable, anonymous and read-only PMaps have nothing to sync.
+//With the WAL enabled it is a checkpoint: the WAL is truncated once the store is synced.
+func (c *PMap) Sync() error {
+	if c.wal != nil {
+		return c.checkpoint()
+	}
+	return c.st.sync(c.st.length)
+}
+
+//Starts the periodic sync of the store if it is enabled
+func (c *PMap) startPeriodicSync() {
+	if c.durability != DurabilityPeriodic || c.st.osFile == nil || c.st.readOnly {
+		return
+	}
+	c.syncer.stopSync = make(chan struct{})
+	c.syncer.syncDone = make(chan struct{})
+	go c.syncer.run(c.st, c.syncer.stopSync, c.syncer.syncDone)
+}
+
+func (p *periodicSync) run(st *store, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := st.syncMapping(); err != nil {
+				log.Println("Periodic store sync failed:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Stops the periodic sync and waits for it, if it is running
+func (c *PMap) stopPeriodicSync() {
+	if c.syncer.stopSync == nil {
+		return
+	}
+	close(c.syncer.stopSync)
+	<-c.syncer.syncDone
+	c.syncer.stopSync = nil
+	c.syncer.syncDone = nil
+}
+
+//Syncs the store on Close if the durability mode requires it
+func (c *PMap) syncOnClose() {
+	if c.durability == DurabilityNone {
+		return
+	}
+	if err := c.st.syncMapping(); err != nil {
+		log.Println("Store sync failed on close:", err)
+	}
+}
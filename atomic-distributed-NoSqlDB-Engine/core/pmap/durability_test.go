@@ -0,0 +1,78 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	if _, err := NewWithOptions("", 1024, Options{Durability: DurabilityPeriodic + 1}); err == nil {
+		t.Fatal("unknown Durability mode accepted")
+	}
+	goroutines := runtime.NumGoroutine()
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 64*1024, Options{Durability: DurabilityPeriodic, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The store grows and it is compacted while the periodic sync runs
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprint("key", i%2500))
+		if err := c.Set(c.Hash(key), key, testValue(uint64(i+1), fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+	testEventually(t, "Close leaked the periodic sync goroutine", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+
+	c, err = OpenWithOptions(path, Options{Durability: DurabilityOnClose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Recovered() || c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum {
+		t.Fatal("wrong store after reopening", c.Used(), c.Deleted())
+	}
+}
+
+func BenchmarkSetDurability(b *testing.B) {
+	modes := []struct {
+		name string
+		opts Options
+	}{
+		{"None", Options{}},
+		{"OnClose", Options{Durability: DurabilityOnClose}},
+		{"Periodic1s", Options{Durability: DurabilityPeriodic}},
+		{"Periodic10ms", Options{Durability: DurabilityPeriodic, SyncInterval: 10 * time.Millisecond}},
+	}
+	value := testValue(1, string(make([]byte, 100)))
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			c, err := NewWithOptions(filepath.Join(b.TempDir(), "pmap"), 64*1024*1024, mode.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(value)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := []byte(fmt.Sprint("key", i%100000))
+				if err := c.Set(c.Hash(key), key, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			c.Close()
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package pmap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+	At-rest encryption (Options.EncryptionKey) encrypts the value bodies of the new pairs with AES-GCM.
+
+	An encrypted pair is flagged with encryptedFlag on its key length word (it halves the maximum key length,
+	see maxKeySize), its stored value is:
+		8  bytes: timestamp
+		12 bytes: nonce, random for each record
+		Sealed body: the body (compressed first if Options.Codec is set, see compress.go) and a 16 byte tag
+	The key of the pair is the additional data of the seal: a sealed body moved to another key doesn't open.
+
+	Keys and timestamps are stored in plaintext: the hashmap, the lookups, the checksum and Open work on them
+	without decrypting anything, and Touch rewrites the timestamp in place. Only the values are confidential.
+	Open authenticates every encrypted record during its restore scan, it fails with ErrNoEncryptionKey if the
+	store has encrypted pairs and no key was provided, and with errDecryption if the key is wrong or a sealed
+	body was modified. A sealed body modified after Open fails its reads with ErrCorruptRecord. Pairs written
+	without encryption are read as usual, the key only selects how the new pairs are written. Encrypted bodies
+	are never deduplicated (see dedup.go).
+
+	Cost: every write of a value and every read of it (Get, the iterations...) runs AES-GCM, and Open
+	authenticates the whole store; each pair uses 28 more bytes.
+*/
+
+const encryptedFlag = 1 << 27 //Set on the key length word of pairs with an encrypted body
+
+const (
+	nonceSize = 12
+	sealSize  = nonceSize + 16 //Nonce and GCM tag
+)
+
+var errDecryption = errors.New("Error: the encrypted body can't be decrypted, wrong EncryptionKey or corrupt store")
+
+//Returns the AES-GCM AEAD of key, nil if it is nil. It returns an error if key is not a valid AES key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("EncryptionKey: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("EncryptionKey: %v", err)
+	}
+	return aead, nil
+}
+
+func (st *store) isEncrypted(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&encryptedFlag != 0
+}
+
+//Returns the value to store instead of value: its timestamp header, a new nonce and the sealed body
+func (c *PMap) encryptValue(key, value []byte) ([]byte, error) {
+	stored := make([]byte, 8+nonceSize, len(value)+sealSize)
+	copy(stored, value[:8])
+	if _, err := rand.Read(stored[8:]); err != nil {
+		return nil, fmt.Errorf("encryption nonce: %w", err)
+	}
+	return c.aead.Seal(stored, stored[8:], value[8:], key), nil
+}
+
+//Returns the decrypted body of the encrypted pair at index, compressed bodies are returned compressed
+func (c *PMap) decrypt(index uint64) ([]byte, error) {
+	if c.aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	sealed := c.st.val(index)[8:]
+	body, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], c.st.key(index))
+	if err != nil {
+		return nil, errDecryption
+	}
+	return body, nil
+}
+
+//Returns the body of the pair at index stored compressed or encrypted
+func (c *PMap) decodeBody(index uint64) ([]byte, error) {
+	body := c.st.val(index)[8:]
+	if c.st.isEncrypted(index) {
+		var err error
+		if body, err = c.decrypt(index); err != nil {
+			return nil, err
+		}
+	}
+	if c.st.isCompressed(index) {
+		return decompress(body)
+	}
+	return body, nil
+}
+
+//Authenticates the encrypted pair at index, it is used by the restore scan
+func (c *PMap) checkEncrypted(index uint64) error {
+	body, err := c.decrypt(index)
+	if err != nil {
+		return err
+	}
+	if c.st.isCompressed(index) && (len(body) == 0 || Codec(body[0]).check() != nil) {
+		return fmt.Errorf("Corrupt store record at offset %d: invalid compressed body", index)
+	}
+	return nil
+}
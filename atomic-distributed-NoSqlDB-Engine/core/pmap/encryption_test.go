@@ -0,0 +1,112 @@
+package pmap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryption(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecFlate} {
+		t.Run(fmt.Sprint("Codec=", codec), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			opts := Options{EncryptionKey: testEncryptionKey, Codec: codec, Checksums: true, DedupValues: true}
+			c, err := NewWithOptions(path, 1024*1024, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				if err := c.Set(c.Hash(key), key, testValue(1, testDocument(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key := []byte("key1")
+			c.Del(c.Hash(key), key, testValue(2, ""))
+			key = []byte("key2")
+			if err := c.CAS(c.Hash(key), key, testCASValue(1, testDocument(2), 2, "new")); err != nil {
+				t.Fatal(err)
+			}
+			expected := testPairs(c)
+			if len(expected) != 99 || expected["key2"] != string(testValue(2, "new")) || expected["key3"] != string(testValue(1, testDocument(3))) {
+				t.Fatal("wrong pairs", len(expected), expected["key2"])
+			}
+			if err := c.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			//No plaintext body on disk
+			stored, err := os.ReadFile(path)
+			if err != nil || bytes.Contains(stored, []byte("lorem")) || bytes.Contains(stored, []byte("new")) {
+				t.Fatal("plaintext body found on the store file", err)
+			}
+			if _, err := Open(path); !errors.Is(err, ErrNoEncryptionKey) {
+				t.Fatal("opened an encrypted store without key:", err)
+			}
+			wrong := append([]byte(nil), testEncryptionKey...)
+			wrong[0] ^= 1
+			if _, err := OpenWithOptions(path, Options{EncryptionKey: wrong}); !errors.Is(err, errDecryption) {
+				t.Fatal("opened an encrypted store with a wrong key:", err)
+			}
+			c, err = OpenWithOptions(path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.CloseAndDelete()
+			if err := c.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			pairs := testPairs(c)
+			for k, v := range expected {
+				if pairs[k] != v {
+					t.Fatalf("reopened %s = %q, expected %q", k, pairs[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptionTampered(t *testing.T) {
+	if _, err := NewWithOptions("", 1024*1024, Options{EncryptionKey: []byte("short")}); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	opts := Options{EncryptionKey: testEncryptionKey}
+	c, err := NewWithOptions(path, 1024*1024, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := []byte("a"), []byte("b")
+	c.Set(c.Hash(a), a, testValue(1, "value a"))
+	c.Set(c.Hash(b), b, testValue(1, "value b"))
+	//The sealed body of a is moved to b
+	ia, _ := c.lookup(uint32(c.Hash(a)), a)
+	ib, _ := c.lookup(uint32(c.Hash(b)), b)
+	copy(c.st.val(ib), c.st.val(ia))
+	c.Close()
+	if _, err := OpenWithOptions(path, opts); !errors.Is(err, errDecryption) {
+		t.Fatal("opened a store with a moved sealed body:", err)
+	}
+
+	//A sealed body modified after Open fails the reads
+	c, err = NewWithOptions(path, 1024*1024, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	c.Set(c.Hash(a), a, testValue(1, "value a"))
+	ia, _ = c.lookup(uint32(c.Hash(a)), a)
+	c.st.val(ia)[8+nonceSize] ^= 1
+	if _, err := c.Get(uint32(c.Hash(a)), a); !errors.Is(err, errDecryption) || !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("Get of a modified sealed body:", err)
+	}
+	if err := c.Iterate(func(key, value []byte) bool { return true }); !errors.Is(err, errDecryption) {
+		t.Fatal("Iterate over a modified sealed body:", err)
+	}
+}
@@ -0,0 +1,17 @@
+package pmap
+
+import "errors"
+
+//Errors returned by the PMap primitives, they can be wrapped with more context: use errors.Is to check them
+var (
+	ErrValueTooShort        = errors.New("Error: value too short")         //The value doesn't have the header required by the operation
+	ErrStoreFull            = errors.New("store size limit reached")       //The store has no room for the pair
+	ErrCASTimestampMismatch = errors.New("CAS failed: timestamp mismatch") //The stored timestamp is not the CAS one
+	ErrCASHashMismatch      = errors.New("CAS failed: hash mismatch")      //The stored value hash is not the CAS one
+	ErrReadOnly             = errors.New("PMap is read-only")              //The PMap was opened by OpenReadOnly
+	ErrKeyNotFound          = errors.New("key not found")                  //The key doesn't exist or was deleted
+	ErrKeyTooLarge          = errors.New("key too large")                  //The key exceeds Options.MaxKeySize
+	ErrValueTooLarge        = errors.New("value too large")                //The value exceeds Options.MaxValueSize
+	ErrNoEncryptionKey      = errors.New("no encryption key")              //The store has encrypted pairs and Options.EncryptionKey is not set
+	ErrCorruptRecord        = errors.New("corrupt record")                 //The record CRC doesn't match (see Options.VerifyReads) or its body can't be decompressed or decrypted
+)
@@ -0,0 +1,98 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	Space reuse (Options.ReuseSpace) keeps a free list with the store regions of overwritten and
+	deleted pairs, put reuses them before appending to the end of the store.
+
+	Free regions are marked on the store with the MSB of the key length, they keep their length fields
+	and trailer so the store can still be walked in both directions. The free list is rebuilt on Open.
+
+	Since a reused region can be placed before newer pairs the store order is not the write order anymore:
+	every overwritten pair, tombstone included, is freed so that each key has at most one pair in the store,
+	and Del frees the pair instead of appending a tombstone.
+
+	Fragmentation tradeoffs: regions are split but never coalesced, a region is only reused by a pair that
+	fits exactly or that leaves room for the header of the remaining free region (12 bytes, 16 with record checksums).
+	Exact fits are found at once, regions to split are searched on a few region sizes only (freeListMaxScan).
+	Workloads with stable pair sizes keep the store size stable, workloads whose pair sizes grow over time
+	leave free regions too small to be reused, those are only reclaimed by rebuilding the PMap.
+*/
+
+const freeFlag = 1 << 31
+
+//Maximum number of region sizes examined to find a region that can be split
+const freeListMaxScan = 8
+
+//freeList stores the indexes of the free regions by region size
+type freeList map[uint64][]uint64
+
+//Returns the size of the region used by the pair (or free region) at index
+func (st *store) recordSize(index uint64) uint64 {
+	return st.overhead() + uint64(st.totalLen(index))
+}
+
+//Marks the pair at index as free and makes its region available to put (with reuse)
+func (st *store) release(index uint64) {
+	//The expiry flag is kept, the region size includes the expiry
+	flags := binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:]) & ttlFlag
+	binary.LittleEndian.PutUint32(st.file[index+headerKeyOffset:], st.keyLen(index)|flags|freeFlag)
+	if st.reuse {
+		st.addFree(index)
+	}
+}
+
+//Adds the free region at index to the free list
+func (st *store) addFree(index uint64) {
+	if st.free == nil {
+		st.free = make(freeList)
+	}
+	size := st.recordSize(index)
+	st.free[size] = append(st.free[size], index)
+}
+
+//Removes and returns the last region of size bytes of the free list
+func (st *store) popFree(size uint64) uint64 {
+	l := st.free[size]
+	index := l[len(l)-1]
+	if len(l) == 1 {
+		delete(st.free, size)
+	} else {
+		st.free[size] = l[:len(l)-1]
+	}
+	return index
+}
+
+//Takes a free region and prepares it to hold a pair of size bytes, the rest of the region remains free
+//It returns false if there isn't any region that fits
+func (st *store) takeFree(size uint64) (uint64, bool) {
+	if _, ok := st.free[size]; ok {
+		st.deleted -= size
+		return st.popFree(size), true
+	}
+	scanned := 0
+	for region := range st.free {
+		if scanned == freeListMaxScan {
+			break
+		}
+		scanned++
+		if region < size+st.overhead() {
+			continue
+		}
+		index := st.popFree(region)
+		rest := index + size
+		st.setKeyLen(rest, freeFlag)
+		st.setValLen(rest, uint32(region-size-st.overhead()))
+		binary.LittleEndian.PutUint32(st.file[index+region-4:], uint32(region-size-st.overhead()))
+		st.addFree(rest)
+		st.deleted -= size
+		return index, true
+	}
+	return 0, false
+}
+
+var errReuseSpaceWAL = errors.New("ReuseSpace cannot be used with the WAL")
@@ -0,0 +1,155 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Overwrites and deletes n keys during several rounds
+func testChurn(t *testing.T, c *PMap, n, rounds int) {
+	ts := uint64(c.clock.Now().UnixNano())
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			ts++
+			if i%4 == 0 {
+				if err := c.Del(hashing.FNV1a64(key), key, testValue(ts, "")); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(ts, fmt.Sprint("value", r%10, "-", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//Deleted keys are written again on the next round
+		for i := 0; i < n; i += 4 {
+			key := []byte(fmt.Sprint("key", i))
+			ts++
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(ts, fmt.Sprint("value", r%10, "-", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func testCheckChurned(t *testing.T, c *PMap, n, rounds int) {
+	r := rounds - 1
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		v, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if v == nil || string(v[8:]) != fmt.Sprint("value", r%10, "-", i) {
+			t.Fatal("wrong value", string(key), v)
+		}
+	}
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if count != n {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, n)
+	}
+}
+
+func TestReuseSpaceStableSize(t *testing.T) {
+	const n = 1000
+	c, err := NewWithOptions("", 4*1024*1024, Options{ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	testChurn(t, c, n, 1)
+	used := c.Used()
+	testChurn(t, c, n, 50)
+	//Without reuse 50 rounds would need ~50 times the space
+	if c.Used() > used+used/10 {
+		t.Fatalf("store grew from %d to %d bytes", used, c.Used())
+	}
+	testCheckChurned(t, c, n, 50)
+}
+
+func TestReuseSpaceReopen(t *testing.T) {
+	const n = 500
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 4*1024*1024, Options{ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChurn(t, c, n, 20)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+
+	for _, crash := range []bool{false, true} {
+		c, err = OpenWithOptions(path, Options{ReuseSpace: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Recovered() != crash {
+			t.Fatal("Recovered", c.Recovered(), "expected", crash)
+		}
+		if c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum {
+			t.Fatalf("reopened store: used %d, deleted %d, checksum %d, expected %d %d %d",
+				c.Used(), c.Deleted(), c.checksum.total(), used, deleted, checksum)
+		}
+		testCheckChurned(t, c, n, 20)
+		//Crash: the store is released without writing the footer
+		c.st.close()
+	}
+
+	//The free list is rebuilt on Open, freed regions keep being reused
+	c, err = OpenWithOptions(path, Options{ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testChurn(t, c, n, 20)
+	if c.Used() > used+used/10 {
+		t.Fatalf("store grew from %d to %d bytes after reopening", used, c.Used())
+	}
+	testCheckChurned(t, c, n, 20)
+}
+
+func TestReuseSpaceSplit(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{ReuseSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	big := []byte("big")
+	if err := c.Set(hashing.FNV1a64(big), big, testValue(1, string(make([]byte, 200)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del(hashing.FNV1a64(big), big, testValue(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	used := c.Used()
+	//Small pairs are placed on the region freed by the big one
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprint("k", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(3, "small")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Used() != used {
+		t.Fatalf("store grew from %d to %d bytes", used, c.Used())
+	}
+	count := 0
+	c.RawScan(func(offset uint64, key, rawValue []byte, isTombstone bool) bool {
+		count++
+		return true
+	})
+	if count != 5 {
+		t.Fatalf("RawScan found %d pairs, expected 5", count)
+	}
+}
+
+func TestReuseSpaceWALRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	if _, err := NewWithOptions(path, 1024*1024, Options{WAL: true, ReuseSpace: true}); err != errReuseSpaceWAL {
+		t.Fatal("expected errReuseSpaceWAL, got", err)
+	}
+}
@@ -1,12 +1,36 @@
 package pmap
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 /*
 	These are some hashmap utility functions.
 
 	Real primitives (Get,Set and Del) are written in pmap.go since
 	these primitives needs to use this file and store.go.
+
+	New keys are inserted with Robin Hood hashing (see insert): linear probing where an inserted key
+	takes the bucket of any key closer to its ideal bucket, which moves forward. It bounds the probe
+	length of clustered hashes, the longest probe chains are shortened at the expense of the shortest ones.
+	Lookups are plain linear probing, they stop at an empty bucket: deleted buckets keep the chains connected.
+
+	Resizes are atomic: the new bucket array is allocated and filled before it replaces the old one, a failed
+	resize leaves the hashmap unchanged. Set and CAS make room before writing anything (WAL included), the
+	failed operation can be retried.
+
+	The hashmap is halved by Del when the live keys drop below the low-water load factor (Options.MinLoadFactor),
+	down to its initial size. The low-water mark must be under half the load factor: a halved hashmap, at twice
+	the load, is not expanded again by the next Set, and an expanded one is not halved by the next Del.
+
+	Adaptive expansion (Options.MaxAvgProbeLength): the hashmap keeps the sum of the probe distances of its live
+	keys, updated by insert and remove, and Set expands it before it reaches the load factor when the average
+	probe length (the one of Stats) exceeds the target. Hashes that cluster more than expected spread over twice
+	the buckets. Early expansions only happen above the adaptive floor, half the load factor (or twice the
+	low-water mark if it is higher): they at most halve the load factor, when the keys share their hashes
+	expanding doesn't shorten the probes and it would only waste memory. A failed early expansion is ignored,
+	the hashmap still has room.
 */
 
 //hashmap stores an open-addressed hashmap and all its meta-data
@@ -16,9 +40,14 @@ type hashmap struct {
 	sizeMask        uint32   //SizeMask must have its log2(Size) least significant bits set to one
 	sizelog2        uint32   //Log2(Size)
 	numKeysToExpand uint32   //Maximum number of keys until a expand operation is forced
-	numStoredKeys   uint32   //Number of stored keys, included deleted, but not freed keys
-	numDeletedKeys  uint32   //Number of non freed deleted keys
-	mem             []uint32 //Hashmap memory
+	numStoredKeys   uint32   //Number of stored live keys
+	numDeletedKeys  uint32   //Number of deleted buckets, they are reused by new keys and freed on resize
+	loadFactor      float64  //Maximum ratio of used buckets, the map is expanded when it is reached
+	minLoadFactor   float64  //Ratio of live keys under which the map is halved by shrink, not positive disables it
+	minLog2Size     uint32   //Initial Log2(Size), the map is never halved below it
+	maxAvgProbe     float64  //Average probe length of the live keys that triggers an early expansion, 0 disables it
+	displacement    uint64   //Sum of the probe distances of the live keys
+	mem             []uint64 //Hashmap memory
 }
 
 const defaultHashMapInitialLog2Size = 16
@@ -30,18 +59,27 @@ const (
 	deletedBucket = 1
 )
 
+var errHashMapFull = errors.New("HashMap full: no empty bucket")
+
 //create a new hashmap initializing its metadata and allocating an initial memory region
-func newHashMap(initialLog2Size, sizeLimit uint32) *hashmap {
+func newHashMap(initialLog2Size, sizeLimit uint32, loadFactor float64) *hashmap {
 	m := new(hashmap)
 	m.sizeLimit = sizeLimit
+	m.loadFactor = loadFactor
 	m.sizelog2 = initialLog2Size
+	m.minLog2Size = initialLog2Size
 	m.alloc()
 	return m
 }
 
 func (m *hashmap) alloc() {
 	m.setSize(m.sizelog2)
-	m.mem = make([]uint32, m.size*8)
+	m.mem = make([]uint64, m.size*2)
+}
+
+//Allocates the bucket array of a hashmap resized to size buckets, tests replace it to inject failures
+var allocBuckets = func(size uint32) ([]uint64, error) {
+	return make([]uint64, 2*uint64(size)), nil
 }
 
 //Sets sizelog2, size, sizeMask & numKeysToExpand
@@ -52,59 +90,169 @@ func (m *hashmap) setSize(log2Size uint32) {
 	for i := uint32(0); i < log2Size; i++ {
 		m.sizeMask |= 1 << i
 	}
-	m.numKeysToExpand = uint32(float64(m.size) * defaultHashMapMaxLoadFactor)
+	m.numKeysToExpand = uint32(float64(m.size) * m.loadFactor)
 }
 
 //Expand the hashmap by creating a new hashmap with twice its memory. It will copy the old data into the new hashmap.
 func (m *hashmap) expand() error {
-	if m.size*2 > m.sizeLimit {
+	return m.resize(m.sizelog2 + 1)
+}
+
+//Halves the hashmap if the live keys are below the low-water load factor and it is bigger than its initial size.
+//It returns true if it was halved
+func (m *hashmap) shrink() bool {
+	if m.sizelog2 <= m.minLog2Size || float64(m.numStoredKeys) >= float64(m.size)*m.minLoadFactor {
+		return false
+	}
+	//A failed resize leaves the hashmap unchanged, a later Del halves it
+	return m.resize(m.sizelog2-1) == nil
+}
+
+//Makes room for a new key: the hashmap is expanded when the live keys reach the load factor,
+//or rehashed at the same size to free the deleted buckets when they reach it together with the live keys.
+//It is expanded early if the probes are too long, see hashmap.go
+func (m *hashmap) makeRoom() error {
+	if m.numStoredKeys >= m.numKeysToExpand {
+		return m.expand()
+	}
+	if m.numStoredKeys+m.numDeletedKeys >= m.numKeysToExpand {
+		return m.resize(m.sizelog2)
+	}
+	if m.probesTooLong() {
+		m.expand()
+	}
+	return nil
+}
+
+//Returns true if the average probe length exceeds maxAvgProbe and the load is above the adaptive floor
+func (m *hashmap) probesTooLong() bool {
+	if m.maxAvgProbe == 0 || uint64(m.size)*2 > uint64(m.sizeLimit) {
+		return false
+	}
+	floor := m.loadFactor / 2
+	if 2*m.minLoadFactor > floor {
+		floor = 2 * m.minLoadFactor
+	}
+	return float64(m.numStoredKeys) >= float64(m.size)*floor && m.avgProbeLength() > m.maxAvgProbe
+}
+
+//Returns the average number of buckets probed to find a live key, like Stats
+func (m *hashmap) avgProbeLength() float64 {
+	if m.numStoredKeys == 0 {
+		return 0
+	}
+	return 1 + float64(m.displacement)/float64(m.numStoredKeys)
+}
+
+//Makes room for n more keys without expanding
+func (m *hashmap) reserve(n uint64) error {
+	log2Size := m.sizelog2
+	for uint64(float64(uint64(1)<<log2Size)*m.loadFactor) < uint64(m.numStoredKeys)+n {
+		log2Size++
+		if log2Size >= 32 {
+			return errors.New("HashMap size limit reached")
+		}
+	}
+	if log2Size == m.sizelog2 {
+		return nil
+	}
+	return m.resize(log2Size)
+}
+
+//Resize the hashmap by creating a new hashmap with 2^log2Size buckets. It will copy the old data into the new hashmap.
+//If it fails the hashmap is left unchanged.
+func (m *hashmap) resize(log2Size uint32) error {
+	if uint64(1)<<log2Size > uint64(m.sizeLimit) {
 		err := errors.New("HashMap size limit reached")
 		return err
 	}
-	newHM := newHashMap(m.sizelog2+1, m.sizeLimit)
+	mem, err := allocBuckets(uint32(1) << log2Size)
+	if err != nil {
+		return fmt.Errorf("HashMap resize to %d buckets failed: %w", uint64(1)<<log2Size, err)
+	}
+	newHM := &hashmap{
+		sizeLimit:     m.sizeLimit,
+		loadFactor:    m.loadFactor,
+		minLoadFactor: m.minLoadFactor,
+		minLog2Size:   m.minLog2Size,
+		maxAvgProbe:   m.maxAvgProbe,
+		mem:           mem,
+	}
+	newHM.setSize(log2Size)
 	for i := uint32(0); i < m.size; i++ {
-		h := m.getHash(i)
-		if h > deletedBucket {
-			//Put it in the new hashmap
-			storeIndex := m.getStoreIndex(i)
-			index := h & newHM.sizeMask
-			for {
-				storedHash := newHM.getHash(index)
-				if storedHash == emptyBucket {
-					//Empty bucket: put the pair
-					newHM.setHash(index, h)
-					newHM.setStoreIndex(index, storeIndex)
-					newHM.numStoredKeys++
-					break
-				}
-				//If the hash is the same there is a collision,
-				//just look in the next bucket
-				index = (index + 1) & newHM.sizeMask
-			}
+		if h := m.getHash(i); h > deletedBucket {
+			newHM.insert(h, m.getStoreIndex(i))
 		}
 	}
 	*m = *newHM
 	return nil
 }
 
+//Inserts a key that is not present, h is its remapped hash. There must be an empty or deleted bucket.
+//Robin Hood hashing: when a probed bucket holds a key closer to its ideal bucket than the inserted one,
+//the inserted key takes the bucket and the displaced key is inserted from there on.
+//The key (or the last displaced one) takes the first empty or deleted bucket found.
+func (m *hashmap) insert(h uint32, storeIndex uint64) {
+	index := h & m.sizeMask
+	dist := uint32(0)
+	for {
+		storedHash := m.getHash(index)
+		if storedHash <= deletedBucket {
+			if storedHash == deletedBucket {
+				m.numDeletedKeys--
+			}
+			m.setHash(index, h)
+			m.setStoreIndex(index, storeIndex)
+			m.numStoredKeys++
+			m.displacement += uint64(dist)
+			return
+		}
+		if storedDist := m.probeDistance(index, storedHash); storedDist < dist {
+			storedIndex := m.getStoreIndex(index)
+			m.setHash(index, h)
+			m.setStoreIndex(index, storeIndex)
+			m.displacement += uint64(dist - storedDist)
+			h, storeIndex, dist = storedHash, storedIndex, storedDist
+		}
+		index = (index + 1) & m.sizeMask
+		dist++
+	}
+}
+
+//Removes the live key of the bucket at index, the bucket is marked as deleted
+func (m *hashmap) remove(index uint32) {
+	m.displacement -= uint64(m.probeDistance(index, m.getHash(index)))
+	m.setHash(index, deletedBucket)
+	m.numStoredKeys--
+	m.numDeletedKeys++
+}
+
+//Returns the distance between the bucket at index, holding the remapped hash h, and its ideal bucket
+func (m *hashmap) probeDistance(index, h uint32) uint32 {
+	return (index - h) & m.sizeMask
+}
+
 /*
-	Each hashmap bucket has 2 32-bit registers: the hash and the store index
+	Each hashmap bucket has 2 64-bit registers: the hash (only 32 bits are used) and the store index
+	The store index is 64 bits long, stores are not limited to 4GB
 */
 
 func (m *hashmap) getHash(index uint32) uint32 {
-	return m.mem[2*index]
+	return uint32(m.mem[2*index])
 }
-func (m *hashmap) getStoreIndex(index uint32) uint32 {
+func (m *hashmap) getStoreIndex(index uint32) uint64 {
 	return m.mem[2*index+1]
 }
 func (m *hashmap) setHash(index, hash uint32) {
-	m.mem[2*index] = hash
+	m.mem[2*index] = uint64(hash)
 }
-func (m *hashmap) setStoreIndex(index, storeIndex uint32) {
+func (m *hashmap) setStoreIndex(index uint32, storeIndex uint64) {
 	m.mem[2*index+1] = storeIndex
 }
 
 //Hash values 0 and 1 are used to represent special cases, remap those hashes to valid hashes
+//Every hashmap access (Get, Set, Del, CAS, restorePair and lookup) must remap the key hash before probing,
+//a sentinel can never be stored nor matched as a real hash
 func hashReMap(h uint32) uint32 {
 	if h < 2 {
 		h += 2
@@ -0,0 +1,263 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//Inserts h with plain linear probing, the insertion used before Robin Hood hashing
+func testLinearInsert(m *hashmap, h uint32, storeIndex uint64) {
+	index := h & m.sizeMask
+	for m.getHash(index) > deletedBucket {
+		index = (index + 1) & m.sizeMask
+	}
+	m.setHash(index, h)
+	m.setStoreIndex(index, storeIndex)
+	m.numStoredKeys++
+}
+
+//Returns the maximum and the average probe length of the keys of m
+func testProbeLengths(m *hashmap) (int, float64) {
+	max, total := 0, 0
+	for i := uint32(0); i < m.size; i++ {
+		if h := m.getHash(i); h > deletedBucket {
+			probe := int(m.probeDistance(i, h)) + 1
+			total += probe
+			if probe > max {
+				max = probe
+			}
+		}
+	}
+	return max, float64(total) / float64(m.numStoredKeys)
+}
+
+func TestRobinHoodProbeLength(t *testing.T) {
+	const log2Size = 12
+	r := rand.New(rand.NewSource(1))
+	//Adversarial hashes: every other key lands on the first 1/16 of the buckets
+	hashes := make([]uint32, 7*(1<<log2Size)/10)
+	for i := range hashes {
+		if i%2 == 0 {
+			hashes[i] = hashReMap(uint32(r.Intn(1 << (log2Size - 4))))
+		} else {
+			hashes[i] = hashReMap(r.Uint32())
+		}
+	}
+	linear := newHashMap(log2Size, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	robinHood := newHashMap(log2Size, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	for i, h := range hashes {
+		testLinearInsert(linear, h, uint64(i))
+		robinHood.insert(h, uint64(i))
+	}
+	linearMax, linearAvg := testProbeLengths(linear)
+	robinHoodMax, robinHoodAvg := testProbeLengths(robinHood)
+	t.Logf("max probe length: linear %d, Robin Hood %d. Average: linear %.2f, Robin Hood %.2f",
+		linearMax, robinHoodMax, linearAvg, robinHoodAvg)
+	//The average is the same, the insertion order doesn't change the total displacement
+	if robinHoodMax >= linearMax || robinHoodAvg > linearAvg+0.001 {
+		t.Fatal("Robin Hood hashing didn't bound the probe length")
+	}
+	//Every key is found by linear probing from its ideal bucket
+	for i, h := range hashes {
+		index := h & robinHood.sizeMask
+		for robinHood.getStoreIndex(index) != uint64(i) {
+			if robinHood.getHash(index) == emptyBucket {
+				t.Fatal("key not found", i)
+			}
+			index = (index + 1) & robinHood.sizeMask
+		}
+	}
+}
+
+func TestHashMapShrink(t *testing.T) {
+	c, err := NewWithOptions("", 16*1024*1024, Options{InitialLog2Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	const n = 100000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := c.hm.size
+	if grown < n {
+		t.Fatal("the hashmap didn't grow", grown)
+	}
+	//Mass delete, the 1000 last keys are kept
+	for i := 0; i < n-1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Del(c.Hash(key), key, testValue(2, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.hm.size > grown/32 || c.hm.sizelog2 < 10 || float64(c.hm.numStoredKeys) < float64(c.hm.size)*defaultHashMapMaxLoadFactor/4 {
+		t.Fatal("the hashmap of", c.Len(), "keys has", c.hm.size, "buckets, it had", grown)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if c.Has(uint32(c.Hash(key)), key) != (i >= n-1000) {
+			t.Fatal("wrong presence of", string(key))
+		}
+	}
+	//Never below the initial size
+	for i := n - 1000; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(c.Hash(key), key, testValue(2, ""))
+	}
+	if c.hm.sizelog2 != 10 || c.Len() != 0 {
+		t.Fatal("empty hashmap of", c.hm.size, "buckets")
+	}
+}
+
+func TestHashMapShrinkOptions(t *testing.T) {
+	if _, err := NewWithOptions("", 1024*1024, Options{MinLoadFactor: 0.35}); err == nil {
+		t.Fatal("MinLoadFactor accepted over half the LoadFactor")
+	}
+	if _, err := NewWithOptions("", 1024*1024, Options{LoadFactor: 0.15}); err != nil {
+		t.Fatal("the default MinLoadFactor doesn't follow the LoadFactor:", err)
+	}
+	c, err := NewWithOptions("", 16*1024*1024, Options{InitialLog2Size: 10, MinLoadFactor: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(c.Hash(key), key, testValue(1, ""))
+	}
+	grown := c.hm.size
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(c.Hash(key), key, testValue(2, ""))
+	}
+	if c.hm.size != grown {
+		t.Fatal("the hashmap was shrunk with MinLoadFactor < 0")
+	}
+}
+
+func TestHashMapResizeFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{InitialLog2Size: 4, WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The next new key expands the hashmap
+	n := int(c.hm.numKeysToExpand)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hm := *c.hm
+	mem := append([]uint64(nil), c.hm.mem...)
+	checksum := c.checksum.total()
+
+	injected := errors.New("injected allocation failure")
+	alloc := allocBuckets
+	allocBuckets = func(size uint32) ([]uint64, error) { return nil, injected }
+	key := []byte("new")
+	err = c.Set(c.Hash(key), key, testValue(1, "new"))
+	if !errors.Is(err, injected) {
+		t.Fatal("the Set that expands the hashmap returned", err)
+	}
+	if err := c.CAS(c.Hash(key), key, testCASValue(0, "", 1, "new")); !errors.Is(err, injected) {
+		t.Fatal("the CAS that expands the hashmap returned", err)
+	}
+	allocBuckets = alloc
+	if c.hm.size != hm.size || c.hm.numStoredKeys != hm.numStoredKeys || c.checksum.total() != checksum ||
+		!reflect.DeepEqual(c.hm.mem, mem) {
+		t.Fatal("the failed expansion changed the hashmap")
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if v, err := c.Get(uint32(c.Hash(key)), key); err != nil || string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatal("wrong value after the failed expansion", string(key), v, err)
+		}
+	}
+	//The failed operations were not logged
+	walTestCrash(c)
+	c, err = OpenWithOptions(path, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	if c.Len() != n || c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("the failed operations were replayed from the WAL", c.Len())
+	}
+	//Retry
+	if err := c.Set(c.Hash(key), key, testValue(1, "new")); err != nil || !c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("the retried Set failed", err)
+	}
+}
+
+func TestAdaptiveLoadFactor(t *testing.T) {
+	if _, err := NewWithOptions("", 1024*1024, Options{MaxAvgProbeLength: 1}); err == nil {
+		t.Fatal("MaxAvgProbeLength of 1 accepted")
+	}
+	//Clustering keys: their hashes are multiples of 8, a single bucket out of 8 is the ideal one of any key
+	const target = 2.5
+	run := func(maxAvgProbe float64) (firstExpansion int, maxAvg float64, c *PMap) {
+		c, err := NewWithOptions("", 16*1024*1024, Options{InitialLog2Size: 10, MaxAvgProbeLength: maxAvgProbe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4000; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(uint64(i)*8, key, testValue(1, "")); err != nil {
+				t.Fatal(err)
+			}
+			if firstExpansion == 0 && c.hm.sizelog2 > 10 {
+				firstExpansion = i + 1
+			}
+			if avg := c.hm.avgProbeLength(); avg > maxAvg {
+				maxAvg = avg
+			}
+		}
+		return firstExpansion, maxAvg, c
+	}
+	staticExpansion, staticMax, static := run(0)
+	defer static.Close()
+	adaptiveExpansion, adaptiveMax, adaptive := run(target)
+	defer adaptive.Close()
+	t.Logf("first expansion after %d keys (static %d), maximum average probe length %.2f (static %.2f)",
+		adaptiveExpansion, staticExpansion, adaptiveMax, staticMax)
+	if adaptiveExpansion >= staticExpansion || staticMax <= target || adaptiveMax > target+0.01 {
+		t.Fatal("the adaptive expansion didn't bound the average probe length")
+	}
+	if adaptive.hm.size > 2*static.hm.size {
+		t.Fatal("the adaptive hashmap has", adaptive.hm.size, "buckets, the static one", static.hm.size)
+	}
+
+	//The probe distances are kept up to date by insert and remove
+	for i := 0; i < 4000; i += 3 {
+		key := []byte(fmt.Sprint("key", i))
+		if err := adaptive.Del(uint64(i)*8, key, testValue(2, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, avg := testProbeLengths(adaptive.hm); avg != adaptive.hm.avgProbeLength() || avg != adaptive.Stats().AvgProbeLength {
+		t.Fatal("average probe length", adaptive.hm.avgProbeLength(), "of", avg)
+	}
+	//Keys that share their hash can't be spread: the hashmap of 1000 keys is expanded to 2048 buckets by the
+	//load factor, and once more by the probe length, the next expansion would leave it under the adaptive floor
+	c, err := NewWithOptions("", 16*1024*1024, Options{InitialLog2Size: 10, MaxAvgProbeLength: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(2, key, testValue(1, ""))
+	}
+	if c.hm.size != 4096 {
+		t.Fatal("shared hashes expanded the hashmap to", c.hm.size, "buckets")
+	}
+}
@@ -0,0 +1,241 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+	A secondary index is an optional second, anonymous, PMap maintained by the primary one.
+	It maps index keys, extracted from the primary values by an IndexFunc, to the list of
+	primary keys whose value has that index key.
+
+	It is updated on every applied Set, Del and CAS, and it is rebuilt from the primary pairs on Open.
+	The space of the index update is reserved before the primary pair is changed: an operation whose index
+	update doesn't fit fails with ErrStoreFull (or the index key is too large) and leaves both PMaps unchanged.
+	SecondaryIndex (see secondaryindex.go) is the alternative maintained by the caller.
+*/
+
+/*
+Binary structure of the index values
+	8 bytes: timestamp (indexTimestamp, incremented on every update of the index pair)
+	List of primary keys, each one represented this way:
+		4 bytes: primary key len
+		Primary key len bytes: primary key
+*/
+
+//IndexFunc extracts the index key of a value (without its timestamp header), nil means the pair is not indexed
+type IndexFunc func(value []byte) []byte
+
+var errNoIndex = errors.New("PMap has no secondary index")
+
+//Timestamp of the new lists of the automatic index
+const indexTimestamp = 1
+
+type secondaryIndex struct {
+	fn IndexFunc
+	pm *PMap
+}
+
+//Creates the secondary index of c and indexes every stored pair
+func (c *PMap) attachIndex(fn IndexFunc) error {
+	idx := &secondaryIndex{fn: fn, pm: New("", c.st.size)}
+	err := c.Iterate(func(key, value []byte) bool {
+		return idx.add(idx.fn(value[8:]), key, indexTimestamp) == nil
+	})
+	if err == nil && idx.pm.st.length >= idx.pm.st.size-footerSize {
+		err = fmt.Errorf("%w: secondary index doesn't fit", ErrStoreFull)
+	}
+	if err != nil {
+		idx.pm.Close()
+		return err
+	}
+	c.index = idx
+	return nil
+}
+
+//Returns the primary keys of an index pair value
+func indexDecode(v []byte) [][]byte {
+	var keys [][]byte
+	for i := 8; i+4 <= len(v); {
+		n := int(binary.LittleEndian.Uint32(v[i:]))
+		keys = append(keys, v[i+4:i+4+n])
+		i += 4 + n
+	}
+	return keys
+}
+
+//Returns the index pair value of a list of primary keys with timestamp ts
+func indexEncode(ts uint64, keys [][]byte) []byte {
+	size := 8
+	for _, k := range keys {
+		size += 4 + len(k)
+	}
+	v := make([]byte, 8, size)
+	binary.LittleEndian.PutUint64(v, ts)
+	for _, k := range keys {
+		v = append(v, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(v[len(v)-4:], uint32(len(k)))
+		v = append(v, k...)
+	}
+	return v
+}
+
+//Adds primaryKey to the list of indexKey, it does nothing if it is already there or if indexKey is nil.
+//The list is written with timestamp ts, or with the stored one incremented if it isn't older
+func (idx *secondaryIndex) add(indexKey, primaryKey []byte, ts uint64) error {
+	return idx.update(indexKey, ts, func(keys [][]byte) ([][]byte, bool) {
+		for _, k := range keys {
+			if bytes.Equal(k, primaryKey) {
+				return keys, false
+			}
+		}
+		return append(keys, primaryKey), true
+	})
+}
+
+//Removes primaryKey from the list of indexKey like add, the index pair is deleted with its last primary key
+func (idx *secondaryIndex) remove(indexKey, primaryKey []byte, ts uint64) error {
+	return idx.update(indexKey, ts, func(keys [][]byte) ([][]byte, bool) {
+		for i, k := range keys {
+			if bytes.Equal(k, primaryKey) {
+				return append(keys[:i], keys[i+1:]...), true
+			}
+		}
+		return keys, false
+	})
+}
+
+//Applies fn to the list of indexKey, fn returns the new list and false if it is unchanged
+func (idx *secondaryIndex) update(indexKey []byte, ts uint64, fn func(keys [][]byte) ([][]byte, bool)) error {
+	if indexKey == nil {
+		return nil
+	}
+	h64 := idx.pm.Hash(indexKey)
+	v, err := idx.pm.Get(uint32(h64), indexKey)
+	if err != nil {
+		return err
+	}
+	keys, changed := fn(indexDecode(v))
+	if !changed {
+		return nil
+	}
+	if v != nil && binary.LittleEndian.Uint64(v) >= ts {
+		ts = binary.LittleEndian.Uint64(v) + 1
+	}
+	if len(keys) == 0 {
+		return idx.pm.Del(h64, indexKey, indexEncode(ts, nil))
+	}
+	return idx.pm.Set(h64, indexKey, indexEncode(ts, keys))
+}
+
+//Returns the primary keys of indexKey
+func (idx *secondaryIndex) lookup(indexKey []byte) ([][]byte, error) {
+	v, err := idx.pm.Get(uint32(idx.pm.Hash(indexKey)), indexKey)
+	if err != nil {
+		return nil, err
+	}
+	return indexDecode(v), nil
+}
+
+//Returns the store bytes written by moving primaryKey from the list of oldIndexKey to the list of newIndexKey,
+//or an error if the new list can't be stored
+func (idx *secondaryIndex) updateSize(oldIndexKey, newIndexKey, primaryKey []byte) (uint64, error) {
+	var size uint64
+	if oldIndexKey != nil {
+		//The shorter list or the tombstone is never bigger than the current list
+		v, err := idx.pm.Get(uint32(idx.pm.Hash(oldIndexKey)), oldIndexKey)
+		if err != nil {
+			return 0, err
+		}
+		size += idx.pm.putSize(oldIndexKey, v, 0) + ttlSize
+	}
+	if newIndexKey != nil {
+		v, err := idx.pm.Get(uint32(idx.pm.Hash(newIndexKey)), newIndexKey)
+		if err != nil {
+			return 0, err
+		}
+		list := indexEncode(0, append(indexDecode(v), primaryKey))
+		if err := idx.pm.checkSize(newIndexKey, list); err != nil {
+			return 0, err
+		}
+		size += idx.pm.putSize(newIndexKey, list, 0)
+	}
+	return size, nil
+}
+
+//Checks that the index update of an operation over key fits in the index store, it must be called before
+//the operation is applied. The index is rebuilt from the primary pairs when its store is full of overwritten lists.
+//prev and existed are the result of c.lookup before the operation, newIndexKey the index key of the new value
+func (c *PMap) reserveIndex(key []byte, prev uint64, existed bool, newIndexKey []byte) error {
+	var oldIndexKey []byte
+	if existed {
+		body, err := c.body(prev)
+		if err != nil {
+			return err
+		}
+		oldIndexKey = c.index.fn(body)
+	}
+	if bytes.Equal(oldIndexKey, newIndexKey) && (oldIndexKey == nil) == (newIndexKey == nil) {
+		return nil
+	}
+	size, err := c.index.updateSize(oldIndexKey, newIndexKey, key)
+	if err != nil {
+		return err
+	}
+	if c.index.pm.st.length+size >= c.index.pm.st.limit() {
+		old := c.index
+		if err := c.attachIndex(old.fn); err != nil {
+			return err
+		}
+		old.pm.Close()
+		if c.index.pm.st.length+size >= c.index.pm.st.limit() {
+			return fmt.Errorf("%w: secondary index doesn't fit", ErrStoreFull)
+		}
+	}
+	return c.index.pm.hm.makeRoom()
+}
+
+//Updates the index after an operation over key, reserveIndex must have been called before it
+//prev and existed are the result of c.lookup before the operation
+func (c *PMap) updateIndex(h64 uint64, key []byte, prev uint64, existed bool) error {
+	cur, exists := c.lookup(uint32(h64), key)
+	if cur == prev && exists == existed {
+		//The operation didn't modify the pair
+		return nil
+	}
+	var oldIndexKey, newIndexKey []byte
+	if existed {
+		//Old pairs are never overwritten, it is still in the store
+		body, err := c.body(prev)
+		if err != nil {
+			return err
+		}
+		oldIndexKey = c.index.fn(body)
+	}
+	if exists {
+		body, err := c.body(cur)
+		if err != nil {
+			return err
+		}
+		newIndexKey = c.index.fn(body)
+	}
+	if bytes.Equal(oldIndexKey, newIndexKey) && (oldIndexKey == nil) == (newIndexKey == nil) {
+		return nil
+	}
+	if err := c.index.remove(oldIndexKey, key, indexTimestamp); err != nil {
+		return err
+	}
+	return c.index.add(newIndexKey, key, indexTimestamp)
+}
+
+//LookupByIndex returns the keys of the pairs whose value has indexKey as index key
+//It returns an error if the PMap was not created with a secondary index
+func (c *PMap) LookupByIndex(indexKey []byte) ([][]byte, error) {
+	if c.index == nil {
+		return nil, errNoIndex
+	}
+	return c.index.lookup(indexKey)
+}
@@ -0,0 +1,209 @@
+package pmap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Index values by their first byte
+func indexTestFunc(value []byte) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+	return value[:1]
+}
+
+func indexTestLookup(t *testing.T, c *PMap, indexKey string) string {
+	keys, err := c.LookupByIndex([]byte(indexKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = string(k)
+	}
+	sort.Strings(s)
+	return fmt.Sprint(s)
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{Index: indexTestFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(key string, ts uint64, value string) {
+		if err := c.Set(hashing.FNV1a64([]byte(key)), []byte(key), testValue(ts, value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("k1", 1, "apple")
+	set("k2", 1, "avocado")
+	set("k3", 1, "banana")
+	set("k4", 1, "")
+	if got := indexTestLookup(t, c, "a"); got != "[k1 k2]" {
+		t.Fatal("index a:", got)
+	}
+	//Index key change
+	set("k2", 2, "blueberry")
+	//Same index key
+	set("k1", 2, "apricot")
+	//Discarded by last-write-wins, the index must not change
+	set("k3", 0, "cherry")
+	if got := indexTestLookup(t, c, "a"); got != "[k1]" {
+		t.Fatal("index a after update:", got)
+	}
+	if got := indexTestLookup(t, c, "b"); got != "[k2 k3]" {
+		t.Fatal("index b after update:", got)
+	}
+	if got := indexTestLookup(t, c, "c"); got != "[]" {
+		t.Fatal("index c after discarded update:", got)
+	}
+	key := []byte("k3")
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(3, "")); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexTestLookup(t, c, "b"); got != "[k2]" {
+		t.Fatal("index b after delete:", got)
+	}
+	c.Close()
+
+	//The index is rebuilt on Open
+	c, err = OpenWithOptions(path, Options{Index: indexTestFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := indexTestLookup(t, c, "a") + indexTestLookup(t, c, "b"); got != "[k1][k2]" {
+		t.Fatal("index after reopening:", got)
+	}
+	if _, err := New("", 1024).LookupByIndex([]byte("a")); err == nil {
+		t.Fatal("LookupByIndex without index didn't fail")
+	}
+}
+
+func TestSecondaryIndexRebuild(t *testing.T) {
+	c, err := NewWithOptions("", 64*1024, Options{Index: indexTestFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//Rewriting the same keys fills the index store with overwritten lists, forcing index rebuilds
+	for ts := uint64(1); ; ts++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprint("k", i))
+			value := testValue(ts, string(rune('a'+i%2)))
+			if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.st.length > c.st.size/2 {
+			break
+		}
+	}
+	a, _ := c.LookupByIndex([]byte("a"))
+	b, _ := c.LookupByIndex([]byte("b"))
+	if len(a) != 5 || len(b) != 5 {
+		t.Fatal("index lists:", len(a), len(b))
+	}
+	for _, k := range append(a, b...) {
+		v, _ := c.Get(uint32(hashing.FNV1a64(k)), k)
+		if !bytes.Equal(indexTestFunc(v[8:]), []byte{byte('a' + (k[1]-'0')%2)}) {
+			t.Fatal("index points to a pair with another index key", string(k))
+		}
+	}
+}
+
+func TestSecondaryIndexFull(t *testing.T) {
+	c, err := NewWithOptions("", 64*1024, Options{Index: indexTestFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//Every pair has the same index key, its list ends up not fitting in the index store
+	n := 0
+	for ; ; n++ {
+		key := []byte(fmt.Sprintf("%01000d", n))
+		err = c.Set(hashing.FNV1a64(key), key, testValue(1, "x"))
+		if err != nil {
+			if !errors.Is(err, ErrStoreFull) {
+				t.Fatal(err)
+			}
+			if c.Has(uint32(hashing.FNV1a64(key)), key) {
+				t.Fatal("the pair was stored without its index update")
+			}
+			break
+		}
+	}
+	if keys, _ := c.LookupByIndex([]byte("x")); c.Len() != n || len(keys) != n {
+		t.Fatal("the index doesn't match the pairs", c.Len(), len(keys), n)
+	}
+}
+
+func secondaryIndexTestLookup(t *testing.T, idx *SecondaryIndex, fieldValue string) string {
+	keys, err := idx.Lookup([]byte(fieldValue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s", keys)
+}
+
+func TestSecondaryIndexHelper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	pm := New(path, 1024*1024)
+	idx := NewSecondaryIndex(pm)
+	add := func(primaryKey, fieldValue string, ts int64) {
+		if err := idx.Add([]byte(primaryKey), []byte(fieldValue), time.Unix(0, ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(primaryKey, fieldValue string, ts int64) {
+		if err := idx.Remove([]byte(primaryKey), []byte(fieldValue), time.Unix(0, ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("k1", "paris", 1)
+	add("k2", "paris", 1)
+	add("k3", "rome", 1)
+	//Already there
+	add("k1", "paris", 2)
+	if got := secondaryIndexTestLookup(t, idx, "paris") + secondaryIndexTestLookup(t, idx, "rome"); got != "[k1 k2][k3]" {
+		t.Fatal("lookups:", got)
+	}
+	if keys, err := idx.Lookup([]byte("oslo")); keys != nil || err != nil {
+		t.Fatal("lookup of a missing field value:", keys, err)
+	}
+	//k2 moves to rome, with timestamps older than the stored lists
+	remove("k2", "paris", 0)
+	add("k2", "rome", 0)
+	//Not there
+	remove("k3", "paris", 3)
+	if got := secondaryIndexTestLookup(t, idx, "paris") + secondaryIndexTestLookup(t, idx, "rome"); got != "[k1][k3 k2]" {
+		t.Fatal("lookups after the updates:", got)
+	}
+	//The pair of a field value is deleted with its last primary key
+	remove("k1", "paris", 4)
+	if got := secondaryIndexTestLookup(t, idx, "paris"); got != "[]" || pm.Len() != 1 {
+		t.Fatal("lookup after removing every key:", got, pm.Len())
+	}
+	pm.Close()
+
+	//File-backed indexes persist
+	pm = testOpen(t, path)
+	defer pm.CloseAndDelete()
+	idx = NewSecondaryIndex(pm)
+	if got := secondaryIndexTestLookup(t, idx, "rome"); got != "[k3 k2]" {
+		t.Fatal("lookup after reopening:", got)
+	}
+	add("k1", "paris", 5)
+	if got := secondaryIndexTestLookup(t, idx, "paris"); got != "[k1]" {
+		t.Fatal("lookup of a deleted field value added again:", got)
+	}
+}
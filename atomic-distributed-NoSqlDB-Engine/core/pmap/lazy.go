@@ -0,0 +1,128 @@
+package pmap
+
+import "bytes"
+
+/*
+	Lazy open
+
+	Open rebuilds the hashmap by scanning every pair of the store before returning. OpenLazy maps the store
+	and returns at once, the PMap is opened by Open in a background goroutine.
+
+	Until it is ready Get scans the store for the key (see scanGet), using a second read-only mapping of the file:
+	the background Open never modifies the records, only the footer, which is read before it starts.
+	A scan costs about as much as the whole Open, it only pays off when a few keys are read before the
+	PMap is ready. The scans follow the rules of Open: the last pair written with the key wins and its tombstone
+	deletes it.
+*/
+
+//A LazyPMap is a PMap opened in the background, see OpenLazy
+//Like PMap it is *not* thread-safe, the background Open is synchronized internally
+type LazyPMap struct {
+	view  *PMap         //PMap without hashmap over a read-only mapping of the store, used by scanGet
+	limit uint64        //End of the pairs scanned by scanGet
+	ready chan struct{} //Closed when the background Open finishes
+	pm    *PMap
+	err   error
+}
+
+//OpenLazy opens a previous closed pmap like Open does, without waiting for its hashmap:
+//it maps the store and returns, the hashmap is built by a background goroutine.
+//Get works at once, the other operations are available through PMap, which waits for the hashmap
+func OpenLazy(path string) (*LazyPMap, error) {
+	st, err := openStore(path, true, false)
+	if err != nil {
+		return nil, err
+	}
+	l := &LazyPMap{view: newPMap(path, Options{}), ready: make(chan struct{})}
+	l.view.st = st
+	if f, clean := st.readFooter(); clean {
+		l.limit = f.length
+	} else {
+		//Not closed cleanly, the scans stop at the end of the pairs like the recovery
+		l.limit = st.size
+	}
+	go func() {
+		l.pm, l.err = Open(path)
+		close(l.ready)
+	}()
+	return l, nil
+}
+
+//Ready returns true if the background Open finished, PMap won't block
+func (l *LazyPMap) Ready() bool {
+	select {
+	case <-l.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+//PMap waits for the background Open and returns the opened PMap or its error.
+//The PMap is owned by l, it is closed by LazyPMap.Close
+func (l *LazyPMap) PMap() (*PMap, error) {
+	<-l.ready
+	return l.pm, l.err
+}
+
+//Get returns the key's associated value like PMap.Get. Until the PMap is ready the value is found
+//by a store scan, see OpenLazy
+func (l *LazyPMap) Get(h32 uint32, key []byte) ([]byte, error) {
+	if !l.Ready() {
+		if value, ok := l.scanGet(key); ok {
+			return value, nil
+		}
+	}
+	c, err := l.PMap()
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(h32, key)
+}
+
+//Returns a copy of the value of key read from the store, ok is false if a record is corrupt:
+//the caller must wait for the background Open, which reports it
+func (l *LazyPMap) scanGet(key []byte) (value []byte, ok bool) {
+	c := l.view
+	found, last := false, uint64(0)
+	for index := c.st.first; index < l.limit; index += c.st.recordSize(index) {
+		if !c.st.isRecord(index, l.limit) {
+			break
+		}
+		if c.st.checkRecord(index, l.limit) != nil {
+			return nil, false
+		}
+		if c.st.isFree(index) || c.st.isBlob(index) || !bytes.Equal(c.st.key(index), key) {
+			continue
+		}
+		//Tombstones delete the previous pairs
+		found, last = len(c.st.val(index)) > 0, index
+	}
+	if !found || c.expired(last) {
+		return nil, true
+	}
+	if c.st.isEncrypted(last) {
+		//The view has no key, the background Open fails with ErrNoEncryptionKey
+		return nil, false
+	}
+	value, err := c.appendValue(nil, last)
+	if err != nil {
+		//Left to the background Open
+		return nil, false
+	}
+	return value, true
+}
+
+//Close waits for the background Open and closes the opened PMap, like PMap.Close, and the read-only mapping.
+//It returns the error of the background Open, if any. Calling it again does nothing
+func (l *LazyPMap) Close() error {
+	<-l.ready
+	if l.view.st.file == nil {
+		return l.err
+	}
+	l.view.st.close()
+	if l.pm != nil {
+		l.pm.Close()
+	}
+	return l.err
+}
@@ -0,0 +1,84 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestOpenLazy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 1000)
+	key := []byte("key1")
+	c.Set(c.Hash(key), key, testValue(3, "overwritten"))
+	pairs := testPairs(c)
+	c.Close()
+
+	l, err := OpenLazy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Concurrent with the background Open
+	for k, v := range pairs {
+		key := []byte(k)
+		got, err := l.Get(uint32(hashing.FNV1a64(key)), key)
+		if err != nil || string(got) != v {
+			t.Fatal("wrong value", k, got, err)
+		}
+	}
+	//The scans
+	for k, v := range pairs {
+		if got, ok := l.scanGet([]byte(k)); !ok || string(got) != v {
+			t.Fatal("wrong scanned value", k, got, ok)
+		}
+	}
+	for _, k := range []string{"key0", "missing"} {
+		if got, ok := l.scanGet([]byte(k)); !ok || got != nil {
+			t.Fatal("scanned a deleted or missing key", k, got, ok)
+		}
+	}
+	c, err = l.PMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Ready() || c.Len() != len(pairs) {
+		t.Fatal("wrong opened PMap", l.Ready(), c.Len(), len(pairs))
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal("second close:", err)
+	}
+	c, err = Open(path)
+	if err != nil || c.Recovered() {
+		t.Fatal("the lazy PMap wasn't closed cleanly", err)
+	}
+	c.CloseAndDelete()
+}
+
+func TestOpenLazyErrors(t *testing.T) {
+	if _, err := OpenLazy(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("opened a missing store")
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 10)
+	c.st.setValLen(c.st.first, 3)
+	c.Close()
+	l, err := OpenLazy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte(fmt.Sprint("key", 1))
+	if _, err := l.Get(uint32(c.Hash(key)), key); err == nil {
+		t.Fatal("Get didn't return the error of the corrupt store")
+	}
+	if _, err := l.PMap(); err == nil {
+		t.Fatal("opened a corrupt store")
+	}
+	if err := l.Close(); err == nil {
+		t.Fatal("Close didn't return the error")
+	}
+}
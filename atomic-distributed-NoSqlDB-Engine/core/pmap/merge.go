@@ -0,0 +1,44 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+//MergeError is returned by Merge when a pair can't be set, the pairs applied before it remain set
+type MergeError struct {
+	Applied int   //Number of pairs of the other PMap set before the error
+	Err     error //Set error
+}
+
+func (e *MergeError) Error() string {
+	return fmt.Sprintf("Merge failed after applying %d pairs: %v", e.Applied, e.Err)
+}
+
+//Unwrap returns the Set error
+func (e *MergeError) Unwrap() error {
+	return e.Err
+}
+
+//Merge sets every live pair of other, like calling Set for each one: last-write-wins decides the conflicts and
+//the checksum is the one obtained by those Sets. Keys are hashed with the PMap Hasher.
+//If a Set fails (for example because the store is full) it returns a *MergeError.
+//other must not be modified until it returns
+func (c *PMap) Merge(other *PMap) error {
+	if other == c {
+		return errors.New("Error: a PMap can't be merged into itself")
+	}
+	applied := 0
+	var err error
+	other.Iterate(func(key, value []byte) bool {
+		if err = c.Set(c.hasher.Hash64(key), key, value); err != nil {
+			return false
+		}
+		applied++
+		return true
+	})
+	if err != nil {
+		return &MergeError{Applied: applied, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	other := New("", 1024*1024)
+	defer other.Close()
+	expected := New("", 1024*1024)
+	defer expected.Close()
+	c.Iterate(func(key, value []byte) bool {
+		expected.Set(expected.Hash(key), key, value)
+		return true
+	})
+	//Newer, older and new pairs
+	for i, ts := range []uint64{5, 0, 5} {
+		key := []byte(fmt.Sprint("key", i))
+		if i == 2 {
+			key = []byte("new")
+		}
+		other.Set(other.Hash(key), key, testValue(ts, "other"))
+		expected.Set(expected.Hash(key), key, testValue(ts, "other"))
+	}
+	if err := c.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	pairs, want := testPairs(c), testPairs(expected)
+	if len(pairs) != 101 || len(pairs) != len(want) || c.checksum.total() != expected.checksum.total() {
+		t.Fatal("wrong merged PMap", len(pairs), len(want))
+	}
+	for k, v := range want {
+		if pairs[k] != v {
+			t.Fatal("wrong merged pair", k)
+		}
+	}
+	if pairs["key0"] != string(testValue(5, "other")) || pairs["key1"] != string(testValue(1, "value1")) {
+		t.Fatal("last write doesn't win")
+	}
+	if c.Merge(c) == nil {
+		t.Fatal("PMap merged into itself")
+	}
+}
+
+func TestMergeStoreFull(t *testing.T) {
+	c := New("", 4096)
+	defer c.Close()
+	other := testFilled(t, 1000)
+	defer other.Close()
+	err := c.Merge(other)
+	merr, ok := err.(*MergeError)
+	if !ok || !errors.Is(err, ErrStoreFull) || merr.Applied == 0 || merr.Applied != c.Len() {
+		t.Fatal("expected a MergeError with the applied pairs, got", err, c.Len())
+	}
+}
@@ -0,0 +1,125 @@
+package pmap
+
+import "encoding/binary"
+
+/*
+	Merkle trees
+
+	A Merkle tree partitions the keyspace into buckets by key hash, like GetChunkID partitions it into chunks,
+	and sums the pair checksums (hash(key) ^ timestamp, see Checksum) of each bucket.
+	Inner nodes sum the checksums of their children: two replicas compare their trees top-down and only
+	descend into the subtrees whose checksums differ, then exchange the keys of the differing leaves
+	(see MerkleBucketKeys) instead of every key.
+
+	The tree shape only depends on the fanout: it has the depth needed to reach merkleMinLeaves leaves.
+	Building a tree scans the whole store.
+*/
+
+//Trees have at least this number of leaves
+const merkleMinLeaves = 4096
+
+//MerkleNode is a node of a Merkle tree, see MerkleTree
+type MerkleNode struct {
+	Checksum uint64        //Sum of the checksums of the pairs of the subtree buckets
+	Children []*MerkleNode //fanout children, nil for leaves
+	Bucket   int           //Bucket of a leaf, first bucket of the subtree for inner nodes
+}
+
+//Returns the fanout used by MerkleTree and the number of leaves of its trees
+func merkleShape(fanout int) (int, int) {
+	if fanout < 2 {
+		fanout = 2
+	}
+	leaves := 1
+	for leaves < merkleMinLeaves {
+		leaves *= fanout
+	}
+	return fanout, leaves
+}
+
+//Returns the bucket of a key hash, the GetChunkID of the key for a numBuckets DB
+func merkleBucket(h64 uint64, numBuckets int) int {
+	return int((h64 >> 32) % uint64(numBuckets))
+}
+
+//ChunkChecksum returns the checksum of the live pairs whose key belongs to chunkID under GetChunkID (computed with
+//the PMap Hasher, see hashing.GetChunkIDWithHasher): replicas compare chunk by chunk and only exchange the pairs
+//of the differing chunks. The checksums of every chunk sum to the checksum of every pair, like Checksum with
+//Options.SequenceNumbers; unlike Checksum it has no time windows.
+//It scans the whole store
+func (c *PMap) ChunkChecksum(chunkID, numChunks int) uint64 {
+	var sum uint64
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) {
+			continue
+		}
+		h64 := c.hasher.Hash64(c.st.key(index))
+		if merkleBucket(h64, numChunks) == chunkID {
+			sum += h64 ^ binary.LittleEndian.Uint64(c.st.val(index)[:8])
+		}
+	}
+	return sum
+}
+
+//MerkleTree returns the Merkle tree of the live pairs with fanout children per inner node (at least 2).
+//Replicas must build their trees with the same fanout to compare them
+func (c *PMap) MerkleTree(fanout int) *MerkleNode {
+	fanout, numLeaves := merkleShape(fanout)
+	sums := make([]uint64, numLeaves)
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) {
+			continue
+		}
+		h64 := c.hasher.Hash64(c.st.key(index))
+		sums[merkleBucket(h64, numLeaves)] += h64 ^ binary.LittleEndian.Uint64(c.st.val(index)[:8])
+	}
+	return merkleBuild(sums, 0, numLeaves, fanout)
+}
+
+//Builds the subtree of the buckets [first, first+n)
+func merkleBuild(sums []uint64, first, n, fanout int) *MerkleNode {
+	node := &MerkleNode{Bucket: first}
+	if n == 1 {
+		node.Checksum = sums[first]
+		return node
+	}
+	node.Children = make([]*MerkleNode, fanout)
+	for i := range node.Children {
+		child := merkleBuild(sums, first+i*n/fanout, n/fanout, fanout)
+		node.Children[i] = child
+		node.Checksum += child.Checksum
+	}
+	return node
+}
+
+//Diff returns the buckets whose checksums differ in n and other, in increasing order.
+//It only visits the subtrees with different checksums, both trees must have the same fanout
+func (n *MerkleNode) Diff(other *MerkleNode) []int {
+	if n.Checksum == other.Checksum {
+		return nil
+	}
+	if n.Children == nil {
+		return []int{n.Bucket}
+	}
+	var buckets []int
+	for i, child := range n.Children {
+		buckets = append(buckets, child.Diff(other.Children[i])...)
+	}
+	return buckets
+}
+
+//MerkleBucketKeys returns copies of the live keys of a bucket of the Merkle trees built with fanout
+func (c *PMap) MerkleBucketKeys(fanout, bucket int) [][]byte {
+	_, numLeaves := merkleShape(fanout)
+	var keys [][]byte
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) {
+			continue
+		}
+		key := c.st.key(index)
+		if merkleBucket(c.hasher.Hash64(key), numLeaves) == bucket {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,86 @@
+package pmap
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a, b := New("", 16*1024*1024), New("", 16*1024*1024)
+	defer a.Close()
+	defer b.Close()
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		a.Set(a.Hash(key), key, testValue(10, fmt.Sprint("value", i)))
+		b.Set(b.Hash(key), key, testValue(10, fmt.Sprint("value", i)))
+	}
+	for _, fanout := range []int{2, 16} {
+		if diff := a.MerkleTree(fanout).Diff(b.MerkleTree(fanout)); diff != nil {
+			t.Fatal("equal replicas differ", fanout, diff)
+		}
+	}
+
+	//A newer pair, a deleted pair and a missing pair
+	changed := []string{"key1", "key2", "key10001"}
+	b.Set(b.Hash([]byte("key1")), []byte("key1"), testValue(20, "newer"))
+	b.Del(b.Hash([]byte("key2")), []byte("key2"), testValue(20, ""))
+	a.Set(a.Hash([]byte("key10001")), []byte("key10001"), testValue(10, "missing"))
+	for _, fanout := range []int{2, 16} {
+		ta, tb := a.MerkleTree(fanout), b.MerkleTree(fanout)
+		if len(ta.Children) != fanout {
+			t.Fatal("wrong fanout", len(ta.Children))
+		}
+		diff := ta.Diff(tb)
+		if len(diff) == 0 || len(diff) > len(changed) {
+			t.Fatal("wrong differing buckets", diff)
+		}
+		keys := make(map[string]bool)
+		for _, bucket := range diff {
+			for _, k := range a.MerkleBucketKeys(fanout, bucket) {
+				keys[string(k)] = true
+			}
+			if n := len(a.MerkleBucketKeys(fanout, bucket)); n > 20 {
+				t.Fatal("too many keys in a leaf bucket", n)
+			}
+		}
+		for _, k := range changed {
+			if !keys[k] {
+				t.Fatal("changed key not found in the differing buckets", k)
+			}
+		}
+	}
+}
+
+func TestChunkChecksum(t *testing.T) {
+	c := New("", 16*1024*1024)
+	defer c.Close()
+	chunks := make([]map[string]bool, 8)
+	for i := range chunks {
+		chunks[i] = make(map[string]bool)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(c.Hash(key), key, testValue(10, fmt.Sprint("value", i)))
+		chunks[hashing.GetChunkID(key, 8)][string(key)] = true
+	}
+	c.Del(c.Hash([]byte("key0")), []byte("key0"), testValue(20, ""))
+	delete(chunks[hashing.GetChunkID([]byte("key0"), 8)], "key0")
+
+	var sum uint64
+	for id, keys := range chunks {
+		var expected uint64
+		for k := range keys {
+			expected += c.Hash([]byte(k)) ^ 10
+		}
+		checksum := c.ChunkChecksum(id, 8)
+		if checksum != expected {
+			t.Fatal("wrong chunk checksum", id)
+		}
+		sum += checksum
+	}
+	if sum != c.checksum.total() {
+		t.Fatal("the chunk checksums don't sum to the PMap checksum")
+	}
+}
@@ -0,0 +1,49 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	MultiCAS applies a group of CAS operations, like calling CAS for each one in order.
+
+	Unlike ApplyBatch it is not atomic: CAS preconditions are per key, a failed precondition only skips its
+	operation and is reported in the per-operation errors. The hashmap room for every operation is reserved
+	once, before applying them, instead of being checked by each CAS.
+*/
+
+//CASOp is a MultiCAS operation: a key and its CAS value (see CAS for the format)
+type CASOp struct {
+	Key   []byte
+	Value []byte
+}
+
+//Returns true if err only concerns its operation: the next operations of a MultiCAS can be applied
+func isCASOpError(err error) bool {
+	return errors.Is(err, ErrCASTimestampMismatch) || errors.Is(err, ErrCASHashMismatch) ||
+		errors.Is(err, ErrValueTooShort) || errors.Is(err, ErrKeyTooLarge) || errors.Is(err, ErrValueTooLarge)
+}
+
+//MultiCAS applies ops in order like calling CAS for each one, keys are hashed with the PMap Hasher.
+//errs[i] is the error of ops[i], nil if its value was written: failed preconditions (ErrCASTimestampMismatch,
+//ErrCASHashMismatch) and invalid operations don't stop the others.
+//Other errors (e.g. the store is full) stop MultiCAS: it returns nil errs and the error, the operations before
+//the failed one were applied
+func (c *PMap) MultiCAS(ops []CASOp) (errs []error, err error) {
+	if c.st.readOnly {
+		return nil, ErrReadOnly
+	}
+	//Room for the worst case, every key being new. It is a hint: if the hashmap limit doesn't allow it,
+	//each CAS still makes its own room
+	c.hm.reserve(uint64(len(ops)))
+	errs = make([]error, len(ops))
+	for i, op := range ops {
+		err := c.CAS(c.hasher.Hash64(op.Key), op.Key, op.Value)
+		if err != nil && !isCASOpError(err) {
+			return nil, fmt.Errorf("MultiCAS operation %d: %w", i, err)
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
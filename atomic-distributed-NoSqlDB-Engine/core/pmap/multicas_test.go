@@ -0,0 +1,64 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Returns a CAS value that replaces the pair (oldTs, oldBody) by (newTs, newBody)
+func testCASValue(oldTs uint64, oldBody string, newTs uint64, newBody string) []byte {
+	v := make([]byte, 16)
+	binary.LittleEndian.PutUint64(v, oldTs)
+	if oldTs == 0 {
+		binary.LittleEndian.PutUint64(v[8:], hashing.FNV1a64(nil))
+	} else {
+		binary.LittleEndian.PutUint64(v[8:], hashing.FNV1a64([]byte(oldBody)))
+	}
+	return append(v, testValue(newTs, newBody)...)
+}
+
+func TestMultiCAS(t *testing.T) {
+	c := testFilled(t, 10)
+	defer c.Close()
+	ops := []CASOp{
+		{Key: []byte("key0"), Value: testCASValue(1, "value0", 2, "new0")},
+		{Key: []byte("key1"), Value: testCASValue(5, "value1", 2, "new1")},
+		{Key: []byte("key2"), Value: testCASValue(1, "wrong", 2, "new2")},
+		{Key: []byte("key3"), Value: []byte("short")},
+		{Key: []byte("new"), Value: testCASValue(0, "", 2, "created")},
+		{Key: []byte("key0"), Value: testCASValue(2, "new0", 3, "newer0")},
+	}
+	errs, err := c.MultiCAS(ops)
+	if err != nil || len(errs) != len(ops) {
+		t.Fatal("MultiCAS failed", errs, err)
+	}
+	expected := []error{nil, ErrCASTimestampMismatch, ErrCASHashMismatch, ErrValueTooShort, nil, nil}
+	for i, e := range expected {
+		if !errors.Is(errs[i], e) || (e == nil) != (errs[i] == nil) {
+			t.Fatal("wrong error of operation", i, errs[i])
+		}
+	}
+	values := map[string][]byte{"key0": testValue(3, "newer0"), "key1": testValue(1, "value1"),
+		"key2": testValue(1, "value2"), "new": testValue(2, "created")}
+	for k, v := range values {
+		if got, _ := c.Get(uint32(c.Hash([]byte(k))), []byte(k)); string(got) != string(v) {
+			t.Fatal("wrong value of", k, got)
+		}
+	}
+
+	//A full store stops MultiCAS after the applied operations
+	small := New("", 4096)
+	defer small.Close()
+	ops = ops[:0]
+	for i := 0; i < 200; i++ {
+		ops = append(ops, CASOp{Key: []byte(fmt.Sprint("key", i)), Value: testCASValue(0, "", 1, "value")})
+	}
+	errs, err = small.MultiCAS(ops)
+	if !errors.Is(err, ErrStoreFull) || errs != nil || small.Len() == 0 || small.Len() == 200 {
+		t.Fatal("MultiCAS of a full store returned", err, small.Len())
+	}
+}
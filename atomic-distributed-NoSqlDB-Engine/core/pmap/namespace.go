@@ -0,0 +1,105 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+	Namespaces
+
+	A namespace is a logical keyspace stored in the same PMap (and store file) as the other ones.
+	Its keys are stored prefixed with 0x00, the uvarint length of the namespace name and the name itself,
+	the length makes namespaces prefix-free: "a" never sees the keys of "ab".
+	Keys starting with 0x00 are reserved for namespaces, they must not be set directly in a PMap
+	that uses namespaces.
+*/
+
+//A Namespace is a handle that scopes Get, Set, Del and Iterate to the keys of a namespace, see PMap.Namespace.
+//Keys passed to and returned by a Namespace don't include the prefix, values keep the timestamp header.
+//Handles are cheap and hold no state besides the prefix, any number of them can be used for the same name.
+//Like PMap, Namespace is *not* thread-safe, except the handles returned by SyncPMap.Namespace
+type Namespace struct {
+	c      namespaceMap
+	name   string
+	prefix []byte
+}
+
+//The PMap methods used by Namespace, SyncPMap implements them under its lock
+type namespaceMap interface {
+	Get(h32 uint32, key []byte) ([]byte, error)
+	Set(h64 uint64, key, value []byte) error
+	Del(h64 uint64, key, value []byte) error
+	ScanPrefix(prefix []byte, foreach func(key, value []byte) (Continue bool)) error
+	Hash(key []byte) uint64
+}
+
+//Returns the prefix of the keys stored in the namespace name
+func namespacePrefix(name string) []byte {
+	prefix := make([]byte, 1, 1+binary.MaxVarintLen64+len(name))
+	prefix = binary.AppendUvarint(prefix, uint64(len(name)))
+	return append(prefix, name...)
+}
+
+//Namespace returns a handle to the namespace name, namespaces don't need to be created
+func (c *PMap) Namespace(name string) *Namespace {
+	return &Namespace{c: c, name: name, prefix: namespacePrefix(name)}
+}
+
+//DeleteNamespace deletes every live key of the namespace name like DeleteRange, and returns the number of deleted keys
+func (c *PMap) DeleteNamespace(name string, timestamp time.Time) (int, error) {
+	return c.DeleteRange(namespacePrefix(name), timestamp)
+}
+
+//Name returns the name of the namespace
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+//Returns the key as stored in the PMap
+func (n *Namespace) key(key []byte) []byte {
+	k := make([]byte, len(n.prefix)+len(key))
+	copy(k, n.prefix)
+	copy(k[len(n.prefix):], key)
+	return k
+}
+
+//Get returns the value associated with key in the namespace, like PMap.Get
+func (n *Namespace) Get(key []byte) ([]byte, error) {
+	k := n.key(key)
+	return n.c.Get(uint32(n.c.Hash(k)), k)
+}
+
+//Set sets the value associated with key in the namespace, like PMap.Set
+func (n *Namespace) Set(key, value []byte) error {
+	k := n.key(key)
+	return n.c.Set(n.c.Hash(k), k, value)
+}
+
+//Del deletes key from the namespace, like PMap.Del
+func (n *Namespace) Del(key, value []byte) error {
+	k := n.key(key)
+	return n.c.Del(n.c.Hash(k), k, value)
+}
+
+//Iterate calls foreach for each pair of the namespace, with copies of the key (without the prefix) and the value.
+//Like ScanPrefix it scans the whole store, its cost doesn't depend on the namespace size
+func (n *Namespace) Iterate(foreach func(key, value []byte) (Continue bool)) error {
+	return n.c.ScanPrefix(n.prefix, func(key, value []byte) bool {
+		return foreach(key[len(n.prefix):], value)
+	})
+}
+
+//Checksum returns the checksum of the namespace pairs: the sum of hash(key) ^ timestamp of every live pair,
+//with the hash of the stored (prefixed) key. Two replicas with the same namespace pairs have the same checksum,
+//whatever the contents of the other namespaces.
+//Unlike PMap.Checksum it is computed by scanning the store, and it ignores the checksum interval
+func (n *Namespace) Checksum() uint64 {
+	var sum uint64
+	n.c.ScanPrefix(n.prefix, func(key, value []byte) bool {
+		sum += n.c.Hash(key) ^ binary.LittleEndian.Uint64(value[:8])
+		return true
+	})
+	return sum
+}
+
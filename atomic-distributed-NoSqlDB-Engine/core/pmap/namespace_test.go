@@ -0,0 +1,104 @@
+package pmap
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	c := New("", 16*1024*1024)
+	defer c.Close()
+	a, ab := c.Namespace("a"), c.Namespace("ab")
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("k", i))
+		if err := a.Set(key, testValue(10, fmt.Sprint("a", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := ab.Set(key, testValue(10, fmt.Sprint("ab", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//A root key equal to a namespaced one is a different pair
+	c.Set(c.Hash([]byte("k0")), []byte("k0"), testValue(10, "root"))
+
+	if v, err := a.Get([]byte("k1")); err != nil || string(v) != string(testValue(10, "a1")) {
+		t.Fatal("wrong value", v, err)
+	}
+	if v, _ := c.Namespace("ab").Get([]byte("k1")); string(v) != string(testValue(10, "ab1")) {
+		t.Fatal("wrong value", v)
+	}
+	if v, _ := c.Namespace("b").Get([]byte("k1")); v != nil {
+		t.Fatal("key found in another namespace", v)
+	}
+	if err := a.Del([]byte("k1"), testValue(20, "")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := a.Get([]byte("k1")); v != nil {
+		t.Fatal("deleted key found", v)
+	}
+	if v, _ := ab.Get([]byte("k1")); v == nil {
+		t.Fatal("key deleted from another namespace")
+	}
+
+	pairs := make(map[string]string)
+	a.Iterate(func(key, value []byte) bool {
+		pairs[string(key)] = string(value)
+		return true
+	})
+	if len(pairs) != 99 || pairs["k0"] != string(testValue(10, "a0")) {
+		t.Fatal("wrong namespace pairs", len(pairs), pairs["k0"])
+	}
+
+	//Namespace checksums only depend on the namespace pairs
+	checksum := ab.Checksum()
+	other := New("", 16*1024*1024)
+	defer other.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("k", i))
+		other.Namespace("ab").Set(key, testValue(10, fmt.Sprint("other", i)))
+	}
+	if checksum == 0 || other.Namespace("ab").Checksum() != checksum || a.Checksum() == checksum {
+		t.Fatal("wrong namespace checksums")
+	}
+
+	n, err := c.DeleteNamespace("a", time.Unix(0, 30))
+	if err != nil || n != 99 {
+		t.Fatal("DeleteNamespace deleted", n, "keys", err)
+	}
+	if c.Len() != 101 || a.Checksum() != 0 || ab.Checksum() != checksum {
+		t.Fatal("wrong pairs after DeleteNamespace", c.Len())
+	}
+}
+
+func TestSyncNamespace(t *testing.T) {
+	c := NewSync("", 16*1024*1024)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(ns *Namespace) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprint("k", i))
+				if err := ns.Set(key, testValue(10, "value")); err != nil {
+					t.Error(err)
+					return
+				}
+				if v, err := ns.Get(key); err != nil || v == nil {
+					t.Error("wrong value", v, err)
+					return
+				}
+			}
+			ns.Checksum()
+		}(c.Namespace(name))
+	}
+	wg.Wait()
+	if n, err := c.DeleteNamespace("a", time.Unix(0, 20)); n != 1000 || err != nil {
+		t.Fatal("wrong number of deleted keys", n, err)
+	}
+	if c.Len() != 1000 {
+		t.Fatal("wrong number of pairs", c.Len())
+	}
+}
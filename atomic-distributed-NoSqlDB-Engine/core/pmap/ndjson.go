@@ -0,0 +1,98 @@
+package pmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+	NDJSON export
+
+	ExportNDJSON writes the live pairs as newline-delimited JSON, one object per pair:
+		{"key":"a2V5","value":"dmFsdWU=","timestamp":"2021-03-04T05:06:07.000000008Z"}
+	key and value are base64-encoded, value is the value body (the timestamp header is not included) and
+	timestamp is the decoded header in UTC. With Options.SequenceNumbers it holds the sequence number as
+	nanoseconds since Unix time, it is read back unchanged.
+
+	Expiring pairs are exported without their expiry (and expired pairs are not exported), the imported pairs
+	don't expire. Deletions are not included, like in snapshots.
+*/
+
+//A pair of an NDJSON export
+type ndjsonPair struct {
+	Key       []byte    `json:"key"`
+	Value     []byte    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//ExportNDJSON writes every live pair to w as a line of JSON, see ndjson.go.
+//The PMap must not be modified until it returns
+func (c *PMap) ExportNDJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) || c.expired(index) {
+			continue
+		}
+		body, err := c.body(index)
+		if err != nil {
+			return err
+		}
+		p := ndjsonPair{
+			Key:       c.st.key(index),
+			Value:     body,
+			Timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(c.st.val(index)))).UTC(),
+		}
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+//ImportNDJSON sets the pairs of an export written by ExportNDJSON, with the usual last-write-wins semantics.
+//Empty lines are skipped. It returns an error with the line number if a line is malformed or if its Set fails,
+//the pairs of the previous lines remain applied
+func ImportNDJSON(c *PMap, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if err := c.importNDJSONLine(line); err != nil {
+				return fmt.Errorf("NDJSON line %d: %w", n, err)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+//Sets the pair of an NDJSON line
+func (c *PMap) importNDJSONLine(line []byte) error {
+	var p ndjsonPair
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("more than one JSON value")
+	}
+	if p.Key == nil || p.Value == nil || p.Timestamp.IsZero() {
+		return errors.New("missing key, value or timestamp")
+	}
+	value := make([]byte, 8+len(p.Value))
+	binary.LittleEndian.PutUint64(value, uint64(p.Timestamp.UnixNano()))
+	copy(value[8:], p.Value)
+	return c.Set(c.hasher.Hash64(p.Key), p.Key, value)
+}
@@ -0,0 +1,67 @@
+package pmap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNDJSON(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.CloseAndDelete()
+	key := []byte("empty")
+	c.Set(c.Hash(key), key, testValue(7, ""))
+	var buf bytes.Buffer
+	if err := c.ExportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != c.Len() {
+		t.Fatal("exported", lines, "lines, expected", c.Len())
+	}
+	imported := New("", 1024*1024)
+	defer imported.CloseAndDelete()
+	if err := ImportNDJSON(imported, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Len() != c.Len() || imported.checksum.total() != c.checksum.total() {
+		t.Fatal("imported", imported.Len(), "pairs, checksum", imported.checksum.total(), "expected", c.Len(), c.checksum.total())
+	}
+	pairs := testPairs(imported)
+	for k, v := range testPairs(c) {
+		if pairs[k] != v {
+			t.Fatalf("imported %q = %q, expected %q", k, pairs[k], v)
+		}
+	}
+	//Last write wins
+	line := `{"key":"ZW1wdHk=","value":"b2xk","timestamp":"1970-01-01T00:00:00.000000006Z"}` + "\n"
+	if err := ImportNDJSON(imported, strings.NewReader(line)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := imported.Get(uint32(imported.Hash(key)), key); !bytes.Equal(v, testValue(7, "")) {
+		t.Fatal("an older imported pair overwrote", v)
+	}
+}
+
+func TestNDJSONMalformed(t *testing.T) {
+	valid := `{"key":"a2V5","value":"dmFsdWU=","timestamp":"1970-01-01T00:00:00.000000001Z"}`
+	for _, line := range []string{
+		`{"key":"a2V5","value":"dmFsdWU="`,
+		`{"key":"a2V5!","value":"dmFsdWU=","timestamp":"1970-01-01T00:00:00.000000001Z"}`,
+		`{"key":"a2V5","timestamp":"1970-01-01T00:00:00.000000001Z"}`,
+		`{"key":"a2V5","value":"dmFsdWU="}`,
+		`{"key":"a2V5","value":"dmFsdWU=","timestamp":"yesterday"}`,
+		`{"key":"a2V5","value":"dmFsdWU=","timestamp":"1970-01-01T00:00:00.000000001Z","ttl":1}`,
+		valid + " {}",
+	} {
+		c := New("", 1024*1024)
+		err := ImportNDJSON(c, strings.NewReader(valid+"\n\n"+line+"\n"+valid))
+		if err == nil || !strings.HasPrefix(err.Error(), "NDJSON line 3:") {
+			t.Error("malformed line", line, "returned", err)
+		}
+		//The valid line before it was applied
+		if c.Len() != 1 {
+			t.Error("the previous lines were not applied", c.Len())
+		}
+		c.CloseAndDelete()
+	}
+}
@@ -0,0 +1,75 @@
+package pmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Parallel iteration
+
+	ParallelIterate splits the store in offset ranges of similar length, one per worker. Records have variable
+	lengths: the range boundaries are found by walking the record headers, then each worker scans its range
+	like Iterate (with its own read-ahead) and calls foreach concurrently with the other workers.
+	The PMap is only read during the scan: hashmap lookups and store reads are safe from several goroutines
+	as long as nobody writes.
+*/
+
+//ParallelIterate calls foreach for each stored pair like Iterate, from workers goroutines (at least 1) that scan
+//different ranges of the store: pairs are visited in no particular order.
+//foreach is called concurrently, it must be goroutine-safe, and it must not modify the PMap.
+//It stops early when foreach returns an error, returning the first one
+func (c *PMap) ParallelIterate(workers int, foreach func(key, value []byte) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	bounds := c.segments(workers)
+	var (
+		wg       sync.WaitGroup
+		stopped  atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i+1 < len(bounds); i++ {
+		wg.Add(1)
+		go func(start, end uint64) {
+			defer wg.Done()
+			ra := c.newReadAhead()
+			if ra != nil {
+				ra.next = start
+			}
+			for index := start; index < end && !stopped.Load(); index += c.st.recordSize(index) {
+				ra.advance(index)
+				if !c.isPresent(index) {
+					continue
+				}
+				key := append([]byte(nil), c.st.key(index)...)
+				value, err := c.appendValue(nil, index)
+				if err == nil {
+					err = foreach(key, value)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					stopped.Store(true)
+				}
+			}
+		}(bounds[i], bounds[i+1])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+//Returns the boundaries of n store ranges of similar length: range i is [bounds[i], bounds[i+1]).
+//Boundaries are record indexes, there are less ranges if the store has less records
+func (c *PMap) segments(n int) []uint64 {
+	bounds := []uint64{c.st.first}
+	step := (c.st.length - c.st.first) / uint64(n)
+	next := c.st.first + step
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if index >= next && len(bounds) < n {
+			bounds = append(bounds, index)
+			next = index + step
+		}
+	}
+	return append(bounds, c.st.length)
+}
@@ -0,0 +1,72 @@
+package pmap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestParallelIterate(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(c.Hash(key), key, testValue(2, ""))
+	}
+	expected := testPairs(c)
+	for _, workers := range []int{0, 1, 3, 8, 5000} {
+		var mutex sync.Mutex
+		pairs := make(map[string]string)
+		err := c.ParallelIterate(workers, func(key, value []byte) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if _, ok := pairs[string(key)]; ok {
+				t.Error("pair visited twice", string(key))
+			}
+			pairs[string(key)] = string(value)
+			return nil
+		})
+		if err != nil || fmt.Sprint(pairs) != fmt.Sprint(expected) {
+			t.Fatal("ParallelIterate with", workers, "workers visited", len(pairs), "pairs", err)
+		}
+	}
+
+	//The first error stops every worker
+	errStop := errors.New("stop")
+	var visited atomic.Int64
+	err := c.ParallelIterate(4, func(key, value []byte) error {
+		visited.Add(1)
+		return errStop
+	})
+	if err != errStop || visited.Load() > 4 {
+		t.Fatal("ParallelIterate didn't stop", err, visited.Load())
+	}
+}
+
+//Time per iteration should drop with the number of workers up to GOMAXPROCS, with one CPU all runs take the same time
+func BenchmarkParallelIterate(b *testing.B) {
+	c := testFilled(b, 100000)
+	defer c.Close()
+	//An expensive per-pair function, like re-encrypting the value
+	foreach := func(key, value []byte) error {
+		h := uint64(0)
+		for i := 0; i < 200; i++ {
+			h = hashing.FNV1a64Seed(value, h)
+		}
+		if h == 0 {
+			return errors.New("unexpected hash")
+		}
+		return nil
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint("workers", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.ParallelIterate(workers, foreach)
+			}
+		})
+	}
+}
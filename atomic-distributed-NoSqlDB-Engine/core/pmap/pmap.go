@@ -5,15 +5,18 @@ package pmap
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/dv343/treeless/hashing"
 	"log"
+	"os"
 	"time"
-	"github.com/dv343/treeless/hashing"
 )
 
-//FilePerms i
+//FilePerms is the default permission of the files created by a PMap, see Options.FilePerms
 const FilePerms = 0700
 
 const defaultCheckSumInterval = time.Second
@@ -26,161 +29,793 @@ A PMap has some utility functions and 4 primitives: Get, Set, Del and CAS.
 Set, del and cas value parameters should contain an 8 byte long header with a timestamp.
 Get returns a similar value (header + real value).
 These timestamps have specific semantics described in each operation.
+By default timestamps are wall-clock times (nanoseconds elapsed since Unix time), with Options.SequenceNumbers
+they are logical sequence numbers instead, see sequence.go.
 
 They are composed by a hashmap and a list:
 -The hashmap is stored in memory (RAM-only). It is used to index key-value pairs.
-It uses 8 bytes per bucket and it is expanded at twice its size each time a load factor is reached.
+It uses 16 bytes per bucket and it is expanded at twice its size each time a load factor is reached.
 -The list is stored in a memory-mapped file, RAM vs disk usage is controlled by
 kernel. It uses an 8 byte long header.
 
-Note: this module is *not* thread-safe.
+Note: this module is *not* thread-safe, SyncPMap is a thread-safe wrapper.
 */
 type PMap struct {
-	hm       *hashmap
-	st       *store
-	checksum syncChecksum
-	path     string
+	hm                  *hashmap
+	st                  *store
+	checksum            syncChecksum
+	path                string
+	wal                 *wal
+	recovered           bool
+	audit               *auditLog
+	clock               Clock
+	index               *secondaryIndex
+	dedup               dedupStore
+	dedupValues         bool
+	noReadAhead         bool
+	sequence            bool
+	maxSequence         uint64
+	compactionThreshold float64
+	compactionInterval  time.Duration
+	tombstoneRetention  time.Duration
+	lastCompaction      time.Time
+	batch               *pmapSnapshot //Snapshot taken by ApplyBatch while it applies a batch
+	hasher              hashing.Hasher
+	hmInitialLog2Size   uint32
+	hmSizeLimit         uint32
+	hmLoadFactor        float64
+	hmMinLoadFactor     float64 //Negative if the hashmap is never shrunk
+	hmMaxAvgProbe       float64
+	collisions          uint64 //Different keys with the same hash found by Set and Open, see Stats
+	durability          Durability
+	syncer              periodicSync
+	bloom               *bloomFilter //Hashes of the written keys, nil if it is disabled, see bloom.go
+	bloomKeys           int
+	bloomFPRate         float64
+	shared              *Store           //Store shared with other indexes, nil if the PMap owns its store, see sharedstore.go
+	indexID             int              //Number of the index in the shared store
+	resolver            ConflictResolver //nil means last write wins, see conflict.go
+	maxKeySize          int
+	maxValueSize        int
+	compactOnClose      bool
+	closed              bool //Set by Close and CloseAndDelete, later calls do nothing
+	filePerms           os.FileMode
+	subscribers         []*subscriber //Change event subscribers, see cdc.go
+	codec               Codec
+	encryptionKey       []byte
+	aead                cipher.AEAD //nil without Options.EncryptionKey, see encryption.go
+	verifyReads         bool
+}
+
+//Options configures optional PMap features, its zero value gives the same PMap as New and Open
+type Options struct {
+	WAL                 bool             //Log Set, Del and CAS operations to a WAL (path + ".wal") before applying them to the store. It survives process crashes, not power loss, see wal.go
+	AuditCapacity       int              //Keep the last AuditCapacity mutations in memory, see AuditLog. 0 disables it
+	Clock               Clock            //Time source, nil means the system clock
+	Index               IndexFunc        //Maintain a secondary index with the index keys extracted by Index, see LookupByIndex
+	ReuseSpace          bool             //Reuse the store regions of overwritten and deleted pairs, see freelist.go. Not compatible with WAL
+	DedupValues         bool             //Store identical value bodies once, see dedup.go
+	NoReadAhead         bool             //Disable the read-ahead hints issued by Iterate, see readahead.go
+	SequenceNumbers     bool             //Timestamps are monotonic sequence numbers instead of wall-clock times, see sequence.go
+	CompactionThreshold float64          //Compact automatically when Deleted / Used exceeds it, 0 means 0.5, negative disables it
+	CompactionInterval  time.Duration    //Minimum time between automatic compactions, 0 means a minute
+	Checksums           bool             //Store a CRC32C with each record of a new store, see Verify. Open reads the format from the store
+	NoAutoGrow          bool             //Keep the store size fixed: Set fails with ErrStoreFull when it is full. The zero value grows file-backed stores, anonymous ones never grow
+	Hasher              hashing.Hasher   //Key hash function, nil means hashing.Default. Callers must provide hashes computed with it, see PMap.Hash
+	HashSeed            uint64           //Hash keys with hashing.FNV1a64Seed(key, HashSeed) instead, 0 means unseeded. Not compatible with Hasher
+	InitialLog2Size     uint32           //Log2 of the initial number of hashmap buckets, 0 means 16. Set it to hold the expected keys to avoid expansions
+	SizeLimit           uint32           //Maximum number of hashmap buckets, 0 means 64Mi
+	LoadFactor          float64          //Ratio of used hashmap buckets that triggers an expansion, in (0, 1). 0 means 0.7
+	Durability          Durability       //When the store is synced to disk, see durability.go. The zero value leaves it to the kernel
+	SyncInterval        time.Duration    //Period of the DurabilityPeriodic syncs, 0 means a second
+	BloomKeys           int              //Check a Bloom filter sized for BloomKeys keys before lookups, see bloom.go. 0 disables it
+	BloomFPRate         float64          //Target false-positive rate of the Bloom filter, in (0, 1). 0 means 0.01
+	Resolver            ConflictResolver //Resolves the conflicts of Set, Del and CAS, nil means last write wins. See conflict.go
+	MaxKeySize          int              //Longer keys are rejected with ErrKeyTooLarge, 0 means the maximum the store format holds (128MiB - 1)
+	MaxValueSize        int              //Longer values (header included) are rejected with ErrValueTooLarge, 0 means the maximum (2GiB - 1)
+	CompactOnClose      bool             //Close compacts the store if it has deleted bytes, see Close
+	FilePerms           os.FileMode      //Permission bits of the created files and of the missing directories of path, 0 means FilePerms
+	Populate            bool             //Page in the whole store at Open (MAP_POPULATE): a slower Open, but no page faults on the first accesses
+	Codec               Codec            //Compress the value bodies of the new pairs, see compress.go. The zero value stores them uncompressed
+	EncryptionKey       []byte           //Encrypt the value bodies of the new pairs with AES-GCM, a 16, 24 or 32 byte AES key. See encryption.go
+	VerifyReads         bool             //Get, GetInto, GetIfNewer and MultiGet check the record CRC, see verifyRead. It needs record checksums
+	MinLoadFactor       float64          //Del halves the hashmap when the ratio of live keys drops below it, down to its initial size. 0 means LoadFactor / 4, negative disables it. It must be under LoadFactor / 2
+	MaxAvgProbeLength   float64          //Set expands the hashmap before LoadFactor when the average probe length (see Stats) exceeds it, see hashmap.go. 0 disables it, else it must be over 1
+	TombstoneRetention  time.Duration    //Compact and CloneTo keep the tombstones deleted less than TombstoneRetention ago (by Clock), see purge.go. 0 keeps them all, negative drops them all
 }
 
-//New returns an initialized PMap stored in path with a maximum store size.
-//Set path to "" to make the PMap anonymous, it will use RAM for everything and it won't use the file system.
+//New returns an initialized PMap stored in path with an initial store size, the store grows when it is full.
+//Set path to "" to make the PMap anonymous, it will use RAM for everything and it won't use the file system,
+//size is the maximum store size of anonymous PMaps. Their store is an anonymous memory mapping (MAP_ANONYMOUS):
+//no file or file descriptor is ever created, compactions included, and Close and CloseAndDelete only unmap it.
+//Like any process memory its pages can still be swapped out.
 func New(path string, size uint64) *PMap {
+	c, err := NewWithOptions(path, size, Options{})
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+//NewWithOptions returns an initialized PMap like New does, enabling the features selected in opts
+func NewWithOptions(path string, size uint64, opts Options) (*PMap, error) {
+	if err := checkOptions(path, opts); err != nil {
+		return nil, err
+	}
+	if opts.VerifyReads && !opts.Checksums {
+		return nil, errVerifyReadsCRC
+	}
+	c := newPMap(path, opts)
+	var err error
+	if c.aead, err = newAEAD(opts.EncryptionKey); err != nil {
+		return nil, err
+	}
+	c.st = newStore(c.path, size, c.filePerms)
+	c.st.reuse = opts.ReuseSpace
+	c.st.grow = path != "" && !opts.NoAutoGrow
+	if opts.Checksums {
+		c.st.enableCRC()
+	}
+	if opts.WAL {
+		w, err := createWAL(walPath(path), c.filePerms)
+		if err != nil {
+			c.st.close()
+			return nil, err
+		}
+		c.wal = w
+	}
+	if opts.Index != nil {
+		//The store is empty, it can't fail
+		c.attachIndex(opts.Index)
+	}
+	c.checksum.SetInterval(defaultCheckSumInterval)
+	c.startPeriodicSync()
+	return c, nil
+}
+
+//Returns an error if opts selects incompatible features, shared by New and Open
+func checkOptions(path string, opts Options) error {
+	if opts.WAL && path == "" {
+		return errWALAnonymous
+	}
+	if opts.WAL && opts.ReuseSpace {
+		return errReuseSpaceWAL
+	}
+	if opts.Hasher != nil && opts.HashSeed != 0 {
+		return errors.New("HashSeed cannot be used with a Hasher")
+	}
+	if err := opts.Durability.check(); err != nil {
+		return err
+	}
+	if opts.SyncInterval < 0 {
+		return fmt.Errorf("SyncInterval %v is negative", opts.SyncInterval)
+	}
+	if err := checkBloomOptions(opts); err != nil {
+		return err
+	}
+	if opts.MaxKeySize < 0 || opts.MaxKeySize > maxKeySize {
+		return fmt.Errorf("MaxKeySize %d is not in [0, %d]", opts.MaxKeySize, maxKeySize)
+	}
+	if opts.MaxValueSize < 0 || opts.MaxValueSize > maxValueSize {
+		return fmt.Errorf("MaxValueSize %d is not in [0, %d]", opts.MaxValueSize, maxValueSize)
+	}
+	if err := opts.Codec.check(); err != nil {
+		return err
+	}
+	if opts.FilePerms&^os.ModePerm != 0 {
+		return fmt.Errorf("FilePerms %v has bits other than the permission ones", opts.FilePerms)
+	}
+	if opts.LoadFactor < 0 || opts.LoadFactor >= 1 {
+		return fmt.Errorf("LoadFactor %v is not in (0, 1)", opts.LoadFactor)
+	}
+	loadFactor := opts.LoadFactor
+	if loadFactor == 0 {
+		loadFactor = defaultHashMapMaxLoadFactor
+	}
+	if opts.MinLoadFactor >= loadFactor/2 {
+		return fmt.Errorf("MinLoadFactor %v is not under half the LoadFactor %v", opts.MinLoadFactor, loadFactor)
+	}
+	if opts.MaxAvgProbeLength != 0 && !(opts.MaxAvgProbeLength > 1) {
+		return fmt.Errorf("MaxAvgProbeLength %v is not over 1", opts.MaxAvgProbeLength)
+	}
+	log2Size, limit := opts.InitialLog2Size, opts.SizeLimit
+	if log2Size == 0 {
+		log2Size = defaultHashMapInitialLog2Size
+	}
+	if limit == 0 {
+		limit = defaultHashMapSizeLimit
+	}
+	if log2Size >= 32 || uint32(1)<<log2Size > limit {
+		return fmt.Errorf("InitialLog2Size %d exceeds the hashmap SizeLimit %d", log2Size, limit)
+	}
+	return nil
+}
+
+//Returns a PMap without store, shared by New and Open
+func newPMap(path string, opts Options) *PMap {
 	c := new(PMap)
 	c.path = path
-	c.hm = newHashMap(defaultHashMapInitialLog2Size, defaultHashMapSizeLimit)
-	c.st = newStore(c.path, size)
-	//c.checksum.SetInterval(defaultCheckSumInterval)
+	c.hmInitialLog2Size = opts.InitialLog2Size
+	if c.hmInitialLog2Size == 0 {
+		c.hmInitialLog2Size = defaultHashMapInitialLog2Size
+	}
+	c.hmSizeLimit = opts.SizeLimit
+	if c.hmSizeLimit == 0 {
+		c.hmSizeLimit = defaultHashMapSizeLimit
+	}
+	c.hmLoadFactor = opts.LoadFactor
+	if c.hmLoadFactor == 0 {
+		c.hmLoadFactor = defaultHashMapMaxLoadFactor
+	}
+	c.hmMinLoadFactor = opts.MinLoadFactor
+	if c.hmMinLoadFactor == 0 {
+		c.hmMinLoadFactor = c.hmLoadFactor / 4
+	}
+	c.hmMaxAvgProbe = opts.MaxAvgProbeLength
+	c.hm = c.emptyHashMap()
+	if opts.AuditCapacity > 0 {
+		c.audit = newAuditLog(opts.AuditCapacity)
+	}
+	c.dedupValues = opts.DedupValues
+	c.noReadAhead = opts.NoReadAhead
+	c.sequence = opts.SequenceNumbers
+	c.compactionThreshold = opts.CompactionThreshold
+	if c.compactionThreshold == 0 {
+		c.compactionThreshold = defaultCompactionThreshold
+	}
+	c.compactionInterval = opts.CompactionInterval
+	if c.compactionInterval == 0 {
+		c.compactionInterval = defaultCompactionInterval
+	}
+	c.tombstoneRetention = opts.TombstoneRetention
+	c.clock = opts.Clock
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	c.checksum.clock = c.clock
+	c.hasher = opts.Hasher
+	if opts.HashSeed != 0 {
+		c.hasher = hashing.SeededFNV1a{Seed: opts.HashSeed}
+	}
+	if c.hasher == nil {
+		c.hasher = hashing.Default
+	}
+	c.durability = opts.Durability
+	c.syncer.interval = opts.SyncInterval
+	if c.syncer.interval == 0 {
+		c.syncer.interval = defaultSyncInterval
+	}
+	if opts.BloomKeys > 0 {
+		c.bloomKeys = opts.BloomKeys
+		c.bloomFPRate = opts.BloomFPRate
+		if c.bloomFPRate == 0 {
+			c.bloomFPRate = defaultBloomFPRate
+		}
+		c.bloom = newBloomFilter(c.bloomKeys, c.bloomFPRate)
+	}
+	c.resolver = opts.Resolver
+	c.maxKeySize = opts.MaxKeySize
+	if c.maxKeySize == 0 {
+		c.maxKeySize = maxKeySize
+	}
+	c.maxValueSize = opts.MaxValueSize
+	if c.maxValueSize == 0 {
+		c.maxValueSize = maxValueSize
+	}
+	c.compactOnClose = opts.CompactOnClose
+	c.codec = opts.Codec
+	c.encryptionKey = opts.EncryptionKey
+	c.verifyReads = opts.VerifyReads
+	c.filePerms = opts.FilePerms
+	if c.filePerms == 0 {
+		c.filePerms = FilePerms
+	}
 	return c
 }
 
+//Returns an empty hashmap with the initial size, size limit and load factors of the PMap
+func (c *PMap) emptyHashMap() *hashmap {
+	m := newHashMap(c.hmInitialLog2Size, c.hmSizeLimit, c.hmLoadFactor)
+	m.minLoadFactor = c.hmMinLoadFactor
+	m.maxAvgProbe = c.hmMaxAvgProbe
+	return m
+}
+
 //Open opens a previous closed pmap returning a new pmap
-func Open(path string) *PMap {
-	c := new(PMap)
-	c.path = path
-	c.hm = newHashMap(defaultHashMapInitialLog2Size, defaultHashMapSizeLimit)
-	c.st = openStore(c.path)
-	//Restore every pair, introduce all pairs into the hashmap and calculate deleted bytes and length of the opened store
-	for index := uint64(0); ; {
-		if c.st.keyLen(index) <= 0 {
+//It returns an error if the store can't be opened or if it is corrupt, the error includes the offset of the corrupt record
+func Open(path string) (*PMap, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+//OpenWithOptions opens a previous closed pmap like Open does, enabling the features selected in opts
+//If the WAL is enabled and the PMap wasn't closed cleanly the store is recovered by replaying the WAL
+func OpenWithOptions(path string, opts Options) (*PMap, error) {
+	if err := checkOptions(path, opts); err != nil {
+		return nil, err
+	}
+	c := newPMap(path, opts)
+	var err error
+	if c.aead, err = newAEAD(opts.EncryptionKey); err != nil {
+		return nil, err
+	}
+	st, err := openStore(c.path, false, opts.Populate)
+	if err != nil {
+		return nil, err
+	}
+	if opts.VerifyReads && !st.crc {
+		st.close()
+		return nil, errVerifyReadsCRC
+	}
+	c.st = st
+	c.st.reuse = opts.ReuseSpace
+	c.st.grow = !opts.NoAutoGrow
+	if !opts.WAL {
+		if err := c.restoreStore(nil); err != nil {
+			c.st.close()
+			return nil, err
+		}
+	} else {
+		w, err := openWAL(walPath(path), c.filePerms)
+		if err != nil {
+			c.st.close()
+			return nil, err
+		}
+		if err := c.restoreStore(w); err != nil {
+			w.close()
+			c.st.close()
+			return nil, err
+		}
+		if err := c.replayWAL(w); err != nil {
+			w.close()
+			c.st.close()
+			return nil, err
+		}
+		c.wal = w
+		if err := c.checkpoint(); err != nil {
+			c.wal.close()
+			c.st.close()
+			return nil, err
+		}
+	}
+	if opts.Index != nil {
+		if err := c.attachIndex(opts.Index); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	c.checksum.SetInterval(defaultCheckSumInterval)
+	c.startPeriodicSync()
+	return c, nil
+}
+
+//Rebuilds the hashmap from the opened store
+//A clean shutdown footer is verified against the restored pairs, if it is missing or inconsistent
+//the PMap was not closed cleanly and it is recovered by a full scan (or from the WAL checkpoint if w is not nil)
+func (c *PMap) restoreStore(w *wal) error {
+	f, clean := c.st.readFooter()
+	//The footer is only valid until the first modification. Without a valid footer the footer area isn't
+	//cleared, the records of a footerless store can be there
+	if clean && !c.st.readOnly {
+		c.st.clearFooter()
+	}
+	if clean {
+		err := c.restore(f.length)
+		if err == nil && c.st.length == f.length && c.st.deleted == f.deleted && c.checksum.total() == f.checksum {
+			return nil
+		}
+		log.Println("Store footer mismatch, recovering", c.path)
+		c.hm = c.emptyHashMap()
+		c.checksum.reset()
+		c.st.length = c.st.first
+		c.st.deleted = 0
+		c.st.tombstones = 0
+		c.st.free = nil
+		c.dedup = dedupStore{}
+		c.maxSequence = 0
+	} else {
+		log.Println("Store was not closed cleanly, recovering", c.path)
+	}
+	c.recovered = true
+	if w != nil && w.checkpointed {
+		//Pairs written after the checkpoint are replayed from the WAL
+		if err := c.restore(w.checkpoint); err != nil {
+			return err
+		}
+		c.st.discardFrom(c.st.length)
+		return nil
+	}
+	if err := c.restore(c.st.size); err != nil {
+		return err
+	}
+	c.st.footerless = c.st.length > c.st.size-footerSize
+	return nil
+}
+
+//Restore every pair placed before limit, introduce all pairs into the hashmap and calculate deleted bytes and length of the opened store
+//It returns an error if a record is inconsistent
+func (c *PMap) restore(limit uint64) error {
+	owner := noOwner //Index that wrote the records of shared stores, see sharedstore.go
+	for index := c.st.first; index < limit; {
+		if !c.st.isRecord(index, limit) {
 			break
 		}
-		//if not 2 totallen => corrupt=> break
+		if err := c.st.checkRecord(index, limit); err != nil {
+			return err
+		}
+		if c.st.isFree(index) {
+			c.st.deleted += c.st.recordSize(index)
+			if c.st.reuse {
+				c.st.addFree(index)
+			}
+			index += c.st.recordSize(index)
+			c.st.length = index
+			continue
+		}
+		if c.st.isOwnerMark(index) {
+			if c.shared == nil {
+				return errSharedStoreFile
+			}
+			owner = int(binary.LittleEndian.Uint64(c.st.val(index)))
+		} else if c.st.isBlob(index) && c.shared == nil {
+			//The blobs of shared stores are registered by OpenStore
+			c.addBlob(hashing.FNV1a64(c.st.val(index)), index)
+		}
+		if c.st.isBlob(index) || c.shared != nil && owner != c.indexID {
+			index += c.st.recordSize(index)
+			c.st.length = index
+			continue
+		}
+		if c.st.isEncrypted(index) {
+			if err := c.checkEncrypted(index); err != nil {
+				return fmt.Errorf("Could not restore the pair at offset %d: %w", index, err)
+			}
+		}
 		key := c.st.key(index)
 		val := c.st.val(index)
-		c.restorePair(key, val, uint32(index))
+		if err := c.restorePair(key, val, index); err != nil {
+			return fmt.Errorf("Could not restore the pair at offset %d: %v", index, err)
+		}
 
 		if len(val) > 0 {
 		} else {
-			c.st.deleted += uint64(12 + len(key))
+			c.st.deleted += c.st.recordSize(index)
+			if !c.st.isFree(index) {
+				//Not released by restorePair
+				c.st.tombstones++
+			}
 		}
 
-		index += 12 + uint64(c.st.totalLen(index))
+		index += c.st.recordSize(index)
 		c.st.length = index
 	}
-	//c.checksum.SetInterval(defaultCheckSumInterval)
-	return c
+	return c.finishRestoreBlobs()
 }
 
 //This function is only used to restore the PMap after a DB close
-func (c *PMap) restorePair(key, value []byte, storeIndex uint32) error {
+func (c *PMap) restorePair(key, value []byte, storeIndex uint64) error {
+	if len(value) >= 8 {
+		c.observe(value[:8])
+	}
 	//Check for available space
-	if c.hm.numStoredKeys >= c.hm.numKeysToExpand {
-		err := c.hm.expand()
-		if err != nil {
-			return err
-		}
+	if err := c.hm.makeRoom(); err != nil {
+		return err
 	}
-	h64 := hashing.FNV1a64(key)
+	h64 := c.hasher.Hash64(key)
 	h := hashReMap(uint32(h64))
 	index := h & c.hm.sizeMask
-	col := 0
+	start := index
+	hasDeleted := false
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			//Empty bucket: put the pair
-			c.hm.setHash(index, h)
-			c.hm.setStoreIndex(index, storeIndex)
-			c.hm.numStoredKeys++
-			t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
-			//fmt.Println("Sum", value)
-			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
-			return nil
+			//Empty bucket: the key is not present
+			break
+		}
+		if storedHash == deletedBucket {
+			hasDeleted = true
 		}
 		if h == storedHash {
-			col++
-			if col > 2 {
-				fmt.Println("COL", col)
-			}
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
+			storedKey := c.st.key(stIndex)
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
 				//Last write wins
-				v := c.st.val(uint64(stIndex))
+				v := c.st.val(stIndex)
+				if c.st.reuse && len(value) > 0 && binary.LittleEndian.Uint64(v[:8]) > binary.LittleEndian.Uint64(value[:8]) {
+					//Reused regions don't follow the write order: the stored pair is newer,
+					//the older one was left by an interrupted overwrite
+					c.st.deleted += c.st.recordSize(storeIndex)
+					c.st.release(storeIndex)
+					return nil
+				}
 				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
 				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
 				//fmt.Println("Sub", v)
-				c.st.deleted += uint64(12 + len(key) + len(v))
+				c.st.deleted += c.st.recordSize(stIndex)
+				c.dropRef(stIndex, true)
+				if c.st.reuse {
+					c.st.release(stIndex)
+					if len(value) == 0 {
+						//Tombstones of stores written without space reuse
+						c.st.release(storeIndex)
+					}
+				}
 				if len(value) > 0 {
 					c.hm.setHash(index, h)
 					c.hm.setStoreIndex(index, storeIndex)
+					c.restoreRef(storeIndex)
 					c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
 					//fmt.Println("Sum2", value)
 				} else {
-					c.hm.setHash(index, deletedBucket)
+					c.hm.remove(index)
 				}
 				return nil
 			}
+			//Different key with the same hash
+			c.collisions++
 		}
 		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			if !hasDeleted {
+				//Every bucket was probed
+				return errHashMapFull
+			}
+			break
+		}
+	}
+	if len(value) == 0 {
+		//Tombstone of a pair that is not present, there is nothing to delete
+		if c.st.reuse {
+			c.st.release(storeIndex)
+		}
+		return nil
+	}
+	//Put the pair, see hashmap.insert
+	c.hm.insert(h, storeIndex)
+	if c.bloom != nil {
+		c.bloom.add(uint32(h64))
 	}
+	c.restoreRef(storeIndex)
+	t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+	//fmt.Println("Sum", value)
+	c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
+	return nil
 }
 
-//Checksum returns a time-stable checksum
+//Checksum returns a time-stable checksum: it only includes the pairs whose timestamp is older than a time bound
+//that is always older than now - interval (see SetChecksumInterval), recent writes don't change it.
+//Anti-entropy relies on it: replicas holding the same pairs return the same checksum while writes are propagated.
+//With Options.SequenceNumbers there are no time windows, it returns the checksum of every pair
 func (c *PMap) Checksum() uint64 {
-	return c.checksum.checksum()
+	if c.sequence {
+		return c.checksum.total()
+	}
+	return c.checksum.checksum(c.clock.Now())
+}
+
+//SetChecksumInterval sets the width of the Checksum time windows, the pairs written during the last interval
+//(up to three intervals) are excluded from it. It is a second by default, d <= 0 restores the default
+func (c *PMap) SetChecksumInterval(d time.Duration) {
+	c.checksum.SetInterval(d)
 }
 
-//Close closes a PMap. The hashmap is destroyed and the store is disk synced.
-//Close will panic if it is called more than one time.
+//Recovered returns true if Open didn't find the footer written by Close, which means the PMap was not
+//closed cleanly and its store was recovered by a full scan
+func (c *PMap) Recovered() bool {
+	return c.recovered
+}
+
+//Close closes a PMap. The hashmap is destroyed and the store is synced to disk with DurabilityOnClose
+//and DurabilityPeriodic, see Options.Durability. A footer is written to mark the shutdown as clean.
+//With Options.CompactOnClose the store is compacted first if it has deleted bytes, a failed compaction is logged
+//and the store is closed as it was (see Compact).
+//The channels of the change event subscribers are closed, see Subscribe.
+//Close is idempotent: calling it (or CloseAndDelete) again does nothing.
 func (c *PMap) Close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.compactOnClose && c.st.deleted > 0 && !c.st.readOnly && c.shared == nil {
+		if err := c.Compact(); err != nil {
+			log.Println("Compaction failed on close:", err, c.path)
+		}
+	}
+	if c.wal != nil {
+		if err := c.checkpoint(); err != nil {
+			log.Println("WAL checkpoint failed on close:", err)
+		}
+		c.wal.close()
+	}
+	if c.index != nil {
+		c.index.pm.Close()
+	}
+	c.checksum.stop()
+	c.stopPeriodicSync()
+	c.closeSubscribers()
+	if c.shared != nil {
+		c.shared.release()
+		return
+	}
+	if !c.st.readOnly && !c.st.footerless {
+		c.st.writeFooter(footer{length: c.st.length, deleted: c.st.deleted, checksum: c.checksum.total()})
+	}
+	c.syncOnClose()
 	c.st.close()
 }
 
 //CloseAndDelete closes the PMap and removes the associated file freeing disk space.
+//Like Close it does nothing if the PMap is already closed, the file is kept if it was closed by Close.
 func (c *PMap) CloseAndDelete() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.wal != nil {
+		c.wal.close()
+		os.Remove(walPath(c.path))
+	}
+	if c.index != nil {
+		c.index.pm.Close()
+	}
+	c.checksum.stop()
+	c.stopPeriodicSync()
+	c.closeSubscribers()
+	if c.shared != nil {
+		//The other indexes still use the file
+		c.shared.release()
+		return
+	}
 	c.st.close()
 	c.st.deleteStore()
 }
 
+//Clear removes every pair keeping the file, after it the PMap behaves like a new one of the same size
+//(the size reached by the store if it grew) and options: Used returns the store header size (0 without
+//Options.Checksums), the hashmap is back to its initial size and the checksum is 0.
+//The secondary index is cleared too and the WAL is checkpointed, cleared pairs are never replayed.
+//AppendOffset goes back to the start of the store, replication followers must start over.
+func (c *PMap) Clear() error {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	if c.shared != nil {
+		return errSharedStore
+	}
+	if err := c.st.clear(); err != nil {
+		return err
+	}
+	c.hm = c.emptyHashMap()
+	c.checksum.reset()
+	c.dedup = dedupStore{}
+	c.maxSequence = 0
+	c.collisions = 0
+	if c.bloom != nil {
+		c.rebuildBloom()
+	}
+	if c.index != nil {
+		if err := c.index.pm.Clear(); err != nil {
+			return err
+		}
+	}
+	if c.wal != nil {
+		return c.checkpoint()
+	}
+	return nil
+}
+
 //Deleted returns the number of bytes deleted
 func (c *PMap) Deleted() int {
 	return int(c.st.deleted)
 }
 
+//RecordCounts returns the number of live pairs (like Len) and the number of tombstones in the store.
+//Unlike Deleted they count records, not bytes: many small records weigh little in the deleted bytes ratio
+//but each tombstone is scanned by Open and Iterate until it is purged, see purge.go.
+//They are maintained by Set, Del, CAS, Compact and Open, they don't scan the store.
+//Stores shared by several indexes count the tombstones of every index
+func (c *PMap) RecordCounts() (live, tombstones int) {
+	return int(c.hm.numStoredKeys), int(c.st.tombstones)
+}
+
 //Used returns the number of bytes used
 func (c *PMap) Used() int {
 	return int(c.st.length)
 }
 
+//Hash returns the hash of key computed by the PMap Hasher (FNV1a64 by default).
+//h64 and h32 parameters must be computed with it: pairs are rehashed with it on Open
+func (c *PMap) Hash(key []byte) uint64 {
+	return c.hasher.Hash64(key)
+}
+
+//Len returns the number of live keys, tombstones excluded
+//It is maintained by Set, Del, CAS and Open, it doesn't iterate the store
+func (c *PMap) Len() int {
+	return int(c.hm.numStoredKeys)
+}
+
 //Size returns the size of the pmap
 func (c *PMap) Size() int {
 	return int(c.st.size)
 }
 
+//FreeSpace returns the number of bytes that new pairs can use before the store is full: its size minus the used
+//bytes and the footer. File-backed stores grow when they are full, unless Options.NoAutoGrow is set
+func (c *PMap) FreeSpace() int {
+	if c.st.length >= c.st.limit() {
+		return 0
+	}
+	return int(c.st.limit() - c.st.length)
+}
+
+//Utilization returns the ratio of the store size that is used, Used / Size
+func (c *PMap) Utilization() float64 {
+	return float64(c.st.length) / float64(c.st.size)
+}
+
+//LiveBytes returns the number of used bytes that hold live data, Used - Deleted: the size of the store after
+//a compaction (see Compact) that drops every tombstone
+func (c *PMap) LiveBytes() int {
+	return int(c.st.length - c.st.deleted)
+}
+
+//AppendOffset returns the current end of the store, every pair ever written is placed before it.
+//It only increases during the life of the PMap (and it is restored on Open), external replication
+//layers can use it as a durability position, see GuaranteeDurableUpTo.
+//With Options.ReuseSpace new pairs can be written on freed regions before the offset.
+func (c *PMap) AppendOffset() uint64 {
+	return c.st.length
+}
+
+//GuaranteeDurableUpTo syncs to disk the store region placed before offset, when it returns without error
+//every pair written before offset (as returned by AppendOffset) will be found after a crash.
+//Anonymous PMaps have nothing to sync.
+func (c *PMap) GuaranteeDurableUpTo(offset uint64) error {
+	if offset > c.st.length {
+		return errors.New("Error: offset is beyond the end of the store")
+	}
+	return c.st.sync(offset)
+}
+
+//Reserve prepares the PMap for a bulk load of numKeys new pairs of avgValueBytes bytes each (key plus value)
+//The hashmap is expanded at once so it won't be expanded during the load.
+//The store is grown at once too, if it can't grow Reserve returns an error, without modifying the PMap, if it
+//hasn't enough free space
+func (c *PMap) Reserve(numKeys uint64, avgValueBytes uint64) error {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	needed := numKeys * (c.st.overhead() + avgValueBytes)
+	if c.st.length+needed >= c.st.limit() {
+		if !c.st.grow {
+			return fmt.Errorf("%w: not enough space to reserve", ErrStoreFull)
+		}
+		if err := c.st.expand(c.st.length + needed + footerSize); err != nil {
+			return err
+		}
+	}
+	return c.hm.reserve(numKeys)
+}
+
 /*
 	Primitives
 */
 
-//Get returns the key's associated value or nil if it doesn't exists (or was deleted)
+//Get returns the key's associated value or nil if it doesn't exists (or was deleted or it expired, see SetWithTTL)
 //If the pair doesn't exist it will return (nil, nil), non-existance is not considered an error
 //The first 8 bytes contain the timestamp of the pair (nanoseconds elapsed since Unix time).
 //Returned value is a copy of the stored one
 func (c *PMap) Get(h32 uint32, key []byte) ([]byte, error) {
-	h := uint32(h32)
+	if c.bloom != nil && !c.bloom.mayContain(h32) {
+		return nil, nil
+	}
+	//Stored hashes are remapped, a key whose hash is a sentinel would match deleted buckets otherwise
+	h := hashReMap(h32)
 	//Search for the key by using open adressing with linear probing
 	index := h & c.hm.sizeMask
+	start := index
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
@@ -188,87 +823,282 @@ func (c *PMap) Get(h32 uint32, key []byte) ([]byte, error) {
 		} else if h == storedHash {
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
+			storedKey := c.st.key(stIndex)
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
-				v := c.st.val(uint64(stIndex))
+				if c.expired(stIndex) {
+					return nil, nil
+				}
+				if err := c.verifyRead(stIndex); err != nil {
+					return nil, err
+				}
 				//We need to copy the value, returning a memory mapped file slice is dangerous,
 				//the mutex wont be hold after this function returns
-				vc := make([]byte, len(v))
-				copy(vc, v)
-				return vc, nil
+				return c.appendValue(nil, stIndex)
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			//Every bucket was probed: wrapped chain of deleted or colliding buckets, the pair is not present
+			return nil, nil
+		}
+	}
+}
+
+//GetInto is Get for callers that reuse value buffers: the value is copied into dst (overwriting it),
+//which only grows when the value doesn't fit. It returns the populated slice and whether the key was found,
+//the slice is dst[:0] if it wasn't
+func (c *PMap) GetInto(h32 uint32, key, dst []byte) ([]byte, bool, error) {
+	stIndex, found := c.lookup(h32, key)
+	if !found || c.expired(stIndex) {
+		return dst[:0], false, nil
+	}
+	if err := c.verifyRead(stIndex); err != nil {
+		return dst[:0], false, err
+	}
+	value, err := c.appendValue(dst[:0], stIndex)
+	if err != nil {
+		return dst[:0], false, err
+	}
+	return value, true, nil
+}
+
+//Has returns true if the key exists (and wasn't deleted) like Get, without copying the value
+//Deleted buckets are not present, the probe continues past them
+func (c *PMap) Has(h32 uint32, key []byte) bool {
+	stIndex, found := c.lookup(h32, key)
+	return found && !c.expired(stIndex)
+}
+
+//GetTimestamp returns the timestamp of the pair like Get, reading only its header: the value is not copied.
+//found is false if the pair doesn't exist (or was deleted or it expired). With Options.SequenceNumbers the
+//timestamp holds the sequence number as nanoseconds since Unix time
+func (c *PMap) GetTimestamp(h32 uint32, key []byte) (timestamp time.Time, found bool) {
+	stIndex, found := c.lookup(h32, key)
+	if !found || c.expired(stIndex) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(c.st.val(stIndex)[:8]))), true
+}
+
+//GetIfNewer returns a copy of the value like Get, only if the pair timestamp is strictly after since:
+//replication peers skip the values they already have. found is false if the pair doesn't exist (or was deleted
+//or it expired) or if it isn't newer, the header is checked before copying the value
+func (c *PMap) GetIfNewer(h32 uint32, key []byte, since time.Time) (value []byte, found bool, err error) {
+	stIndex, found := c.lookup(h32, key)
+	if !found || c.expired(stIndex) {
+		return nil, false, nil
+	}
+	if int64(binary.LittleEndian.Uint64(c.st.val(stIndex)[:8])) <= since.UnixNano() {
+		return nil, false, nil
+	}
+	if err := c.verifyRead(stIndex); err != nil {
+		return nil, false, err
+	}
+	if value, err = c.appendValue(nil, stIndex); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+//A MultiGet key lookup, i is the position of the key
+type multiGetLookup struct {
+	h32 uint32
+	i   int
+}
+
+//MultiGet returns the values of keys, in the same order, like calling Get for each key (nil for missing keys).
+//Keys are hashed with the PMap Hasher. Lookups are grouped by hashmap region to improve cache locality.
+//Returned values are copies, like the ones returned by Get. With Options.VerifyReads a corrupt record fails the whole call
+func (c *PMap) MultiGet(keys [][]byte) ([][]byte, error) {
+	//Counting sort by the most significant bits of the first probed bucket, one group per key at most
+	groupsLog2 := uint32(0)
+	for groupsLog2 < c.hm.sizelog2 && 1<<(groupsLog2+1) <= len(keys) {
+		groupsLog2++
+	}
+	shift := c.hm.sizelog2 - groupsLog2
+	hashes := make([]uint32, len(keys))
+	starts := make([]int, 1<<groupsLog2+1)
+	for i, key := range keys {
+		hashes[i] = uint32(c.hasher.Hash64(key))
+		starts[(hashReMap(hashes[i])&c.hm.sizeMask)>>shift+1]++
+	}
+	for g := 1; g < len(starts); g++ {
+		starts[g] += starts[g-1]
+	}
+	lookups := make([]multiGetLookup, len(keys))
+	for i, h32 := range hashes {
+		g := (hashReMap(h32) & c.hm.sizeMask) >> shift
+		lookups[starts[g]] = multiGetLookup{h32: h32, i: i}
+		starts[g]++
+	}
+	values := make([][]byte, len(keys))
+	for _, l := range lookups {
+		if stIndex, found := c.lookup(l.h32, keys[l.i]); found && !c.expired(stIndex) {
+			if err := c.verifyRead(stIndex); err != nil {
+				return nil, err
+			}
+			value, err := c.appendValue(nil, stIndex)
+			if err != nil {
+				return nil, err
+			}
+			values[l.i] = value
+		}
+	}
+	return values, nil
+}
+
+//Largest key and value lengths held by the store length fields, see store.go
+const (
+	maxKeySize   = encryptedFlag - 1
+	maxValueSize = refFlag - 1
+)
+
+//Returns ErrKeyTooLarge or ErrValueTooLarge if the key or the value (header included) exceed the size limits
+func (c *PMap) checkSize(key, value []byte) error {
+	if len(key) > c.maxKeySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), c.maxKeySize)
 	}
+	if len(value) > c.maxValueSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(value), c.maxValueSize)
+	}
+	return nil
 }
 
 //Set sets the value of a pair if the pair doesn't exists or if
 //the already stored pair timestamp is before the provided timestamp.
 //The first 8 bytes of value should contain the timestamp of the pair (nanoseconds elapsed since Unix time).
 func (c *PMap) Set(h64 uint64, key, value []byte) error {
+	return c.set(h64, key, value, 0)
+}
+
+//Sets the pair like Set, the written pair expires at expiry if it isn't 0 (see ttl.go)
+func (c *PMap) set(h64 uint64, key, value []byte, expiry uint64) (err error) {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	defer func() {
+		if err == nil {
+			c.autoCompact()
+		}
+	}()
+	if c.audit != nil {
+		defer func() { c.audit.add(AuditSet, h64, value, 0, err) }()
+	}
 	if len(value) < 8 {
-		return errors.New(("Error: message value len < 8"))
+		return fmt.Errorf("%w: message value len < 8", ErrValueTooShort)
 	}
-	//Check for available space
-	if c.hm.numStoredKeys >= c.hm.numKeysToExpand {
-		err := c.hm.expand()
-		if err != nil {
+	if err := c.checkSize(key, value); err != nil {
+		return err
+	}
+	if c.index != nil {
+		//The index update must fit before the pair is changed: a failed update leaves both unchanged
+		prev, existed := c.lookup(uint32(h64), key)
+		if err := c.reserveIndex(key, prev, existed, c.index.fn(value[8:])); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				err = c.updateIndex(h64, key, prev, existed)
+			}
+		}()
+	}
+	//Check for available space, before any change: a failed Set leaves the PMap unchanged
+	if err := c.hm.makeRoom(); err != nil {
+		return err
+	}
+	if c.wal != nil {
+		//Recover replays the logged operations, the pair must fit in the store before it is logged
+		if err := c.st.reserve(c.putSize(key, value, expiry)); err != nil {
+			return err
+		}
+	}
+	c.observe(value[:8])
+	if c.wal != nil {
+		if err := c.logSet(h64, key, value, expiry); err != nil {
 			return err
 		}
 	}
 
 	h := hashReMap(uint32(h64))
 	index := h & c.hm.sizeMask
-	col := 0
+	start := index
+	hasDeleted := false
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			//Empty bucket: put the pair
-			storeIndex, err := c.st.put(key, value)
-			if err != nil {
-				return err
-			}
-			c.hm.setHash(index, h)
-			c.hm.setStoreIndex(index, storeIndex)
-			c.hm.numStoredKeys++
-			t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
-			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
-			return nil
+			//Empty bucket: the key is not present
+			break
+		}
+		if storedHash == deletedBucket {
+			hasDeleted = true
 		}
 
 		if h == storedHash {
-			col++
-			if col > 2 {
-				fmt.Println("COL", col)
-			}
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
+			storedKey := c.st.key(stIndex)
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
-				//Last write wins
-				v := c.st.val(uint64(stIndex))
-				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
+				//Last write wins, unless there is a resolver
+				v := c.st.val(stIndex)
+				oldTs := binary.LittleEndian.Uint64(v[:8])
+				oldT := time.Unix(0, int64(oldTs))
+				if c.resolver != nil {
+					winner, keep, err := c.resolve(key, stIndex, value)
+					if keep || err != nil {
+						return err
+					}
+					value = winner
+				}
 				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
-				if oldT.After(t) || oldT.Equal(t) {
+				if c.resolver == nil && (oldT.After(t) || oldT.Equal(t)) {
 					//Stored pair is newer than the provided pair
 					//fmt.Println("Discarded", key, value, t)
 					return nil
 				}
-				storeIndex, err := c.st.put(key, value)
+				//The store can grow: v is invalid after the put
+				storeIndex, err := c.putValue(key, value, expiry)
 				if err != nil {
 					return err
 				}
-				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
+				c.st.deleted += c.st.recordSize(stIndex)
+				c.dropRef(stIndex, false)
+				if c.st.reuse {
+					c.st.release(stIndex)
+				}
+				c.checksum.sub(h64^oldTs, t)
 				c.hm.setHash(index, h)
 				c.hm.setStoreIndex(index, storeIndex)
 				c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
+				c.publish(ChangeSet, key, value, value[:8])
 				return nil
 			}
+			//Different key with the same hash
+			c.collisions++
 		}
 		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			if !hasDeleted {
+				//Every bucket was probed
+				return errHashMapFull
+			}
+			break
+		}
+	}
+	//Put the pair, see hashmap.insert
+	storeIndex, err := c.putValue(key, value, expiry)
+	if err != nil {
+		return err
 	}
+	c.hm.insert(h, storeIndex)
+	if c.bloom != nil {
+		c.bloom.add(uint32(h64))
+	}
+	t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+	c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
+	c.publish(ChangeSet, key, value, value[:8])
+	return nil
 }
 
 //CAS (compare and swap) sets a pair value if 2 tests are passed.
@@ -281,14 +1111,44 @@ func (c *PMap) Set(h64 uint64, key, value []byte) error {
 //1. Stored value timestamp match the CAS timestamp, if the pair doesn't exists the CAS timestamp should be 0
 //2. Stored value hash matches the provided hash
 //It returns nil if the new value was written
-func (c *PMap) CAS(h64 uint64, key, value []byte) error {
+func (c *PMap) CAS(h64 uint64, key, value []byte) (err error) {
+	if c.st.readOnly {
+		return ErrReadOnly
+	}
+	if c.audit != nil {
+		defer func() { c.audit.add(AuditCAS, h64, value, 16, err) }()
+	}
 	if len(value) < 24 {
-		return errors.New("Error: CAS value len < 16")
+		return fmt.Errorf("%w: CAS value len < 24", ErrValueTooShort)
 	}
-	//Check for available space
-	if c.hm.numStoredKeys >= c.hm.numKeysToExpand {
-		err := c.hm.expand()
-		if err != nil {
+	if err := c.checkSize(key, value[16:]); err != nil {
+		return err
+	}
+	if c.index != nil {
+		//The index update must fit before the pair is changed: a failed update leaves both unchanged
+		prev, existed := c.lookup(uint32(h64), key)
+		if err := c.reserveIndex(key, prev, existed, c.index.fn(value[24:])); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				err = c.updateIndex(h64, key, prev, existed)
+			}
+		}()
+	}
+	//Check for available space, before any change: a failed CAS leaves the PMap unchanged
+	if err := c.hm.makeRoom(); err != nil {
+		return err
+	}
+	if c.wal != nil {
+		//Recover replays the logged operations, the pair must fit in the store before it is logged
+		if err := c.st.reserve(c.putSize(key, value[16:], 0)); err != nil {
+			return err
+		}
+	}
+	c.observe(value[16:24])
+	if c.wal != nil {
+		if err := c.logOp(walCAS, h64, key, value); err != nil {
 			return err
 		}
 	}
@@ -299,105 +1159,240 @@ func (c *PMap) CAS(h64 uint64, key, value []byte) error {
 	//fmt.Println(t.UnixNano())
 	h := hashReMap(uint32(h64))
 	index := h & c.hm.sizeMask
+	start := index
+	hasDeleted := false
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			//Empty bucket: put the pair
-			if !providedTime.Equal(time.Unix(0, 0)) && hv != hashing.FNV1a64(nil) {
-				return errors.New("CAS failed: empty pair: non-zero timestamp")
-			}
-			storeIndex, err := c.st.put(key, value[16:])
-			if err != nil {
-				return err
-			}
-			c.hm.setHash(index, h)
-			c.hm.setStoreIndex(index, storeIndex)
-			c.hm.numStoredKeys++
-			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[16:24]), t)
-			return nil
+			//Empty bucket: the key is not present
+			break
+		}
+		if storedHash == deletedBucket {
+			hasDeleted = true
 		}
 		if h == storedHash {
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
+			storedKey := c.st.key(stIndex)
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
-				v := c.st.val(uint64(stIndex))
+				v := c.st.val(stIndex)
 				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
-				if t.Equal(oldT) {
-					log.Println("Equal times!")
-				}
 				if oldT != providedTime {
-					return errors.New("CAS failed: timestamp mismatch")
+					return ErrCASTimestampMismatch
 				}
-				if hv != hashing.FNV1a64(v[8:]) {
-					log.Println("hash mismatch!")
-					return errors.New("CAS failed: hash mismatch")
+				body, err := c.body(stIndex)
+				if err != nil {
+					return err
 				}
-				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
-				storeIndex, err := c.st.put(key, value[16:])
+				if hv != hashing.FNV1a64(body) {
+					return ErrCASHashMismatch
+				}
+				newValue := value[16:]
+				if c.resolver != nil {
+					winner, keep, err := c.resolve(key, stIndex, newValue)
+					if keep || err != nil {
+						return err
+					}
+					newValue = winner
+					t = time.Unix(0, int64(binary.LittleEndian.Uint64(newValue[:8])))
+				}
+				//The store can grow: v is invalid after the put
+				oldTs := binary.LittleEndian.Uint64(v[:8])
+				storeIndex, err := c.putValue(key, newValue, 0)
 				if err != nil {
 					return err
 				}
+				c.checksum.sub(h64^oldTs, t)
+				c.st.deleted += c.st.recordSize(stIndex)
+				c.dropRef(stIndex, false)
+				if c.st.reuse {
+					c.st.release(stIndex)
+				}
 				c.hm.setHash(index, h)
 				c.hm.setStoreIndex(index, storeIndex)
-				c.checksum.sum(h64^binary.LittleEndian.Uint64(value[16:24]), t)
+				c.checksum.sum(h64^binary.LittleEndian.Uint64(newValue[:8]), t)
+				c.publish(ChangeCAS, key, newValue, newValue[:8])
 				return nil
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			if !hasDeleted {
+				//Every bucket was probed
+				return errHashMapFull
+			}
+			break
+		}
+	}
+	//Empty pair: put it, see hashmap.insert
+	if !providedTime.Equal(time.Unix(0, 0)) && hv != hashing.FNV1a64(nil) {
+		return fmt.Errorf("%w: empty pair: non-zero timestamp", ErrCASTimestampMismatch)
 	}
+	storeIndex, err := c.putValue(key, value[16:], 0)
+	if err != nil {
+		return err
+	}
+	c.hm.insert(h, storeIndex)
+	if c.bloom != nil {
+		c.bloom.add(uint32(h64))
+	}
+	c.checksum.sum(h64^binary.LittleEndian.Uint64(value[16:24]), t)
+	c.publish(ChangeCAS, key, value[16:], value[16:24])
+	return nil
 }
 
 //Del marks as deleted a pair, future read instructions won't see the old value.
 //However, it never frees the memory-mapped region associated with the deleted pair.
-//It "leaks". The only way to free those regions is to delete the entire PMap.
+//It "leaks". Those regions are freed by Compact, or reused with Options.ReuseSpace.
+//The hashmap is halved when the live keys drop below Options.MinLoadFactor.
 func (c *PMap) Del(h64 uint64, key, value []byte) error {
+	_, err := c.del(h64, key, value)
+	return err
+}
+
+//Deletes the pair like Del, deleted is true if the pair was removed
+func (c *PMap) del(h64 uint64, key, value []byte) (deleted bool, err error) {
+	if c.st.readOnly {
+		return false, ErrReadOnly
+	}
+	defer func() {
+		if err == nil {
+			c.hm.shrink()
+			c.autoCompact()
+		}
+	}()
+	if c.audit != nil {
+		defer func() { c.audit.add(AuditDel, h64, value, 0, err) }()
+	}
+	if len(value) < 8 {
+		return false, fmt.Errorf("%w: message value len < 8", ErrValueTooShort)
+	}
+	if err := c.checkSize(key, nil); err != nil {
+		return false, err
+	}
+	if c.index != nil {
+		//The index update must fit before the pair is changed: a failed update leaves both unchanged
+		prev, existed := c.lookup(uint32(h64), key)
+		if err := c.reserveIndex(key, prev, existed, nil); err != nil {
+			return false, err
+		}
+		defer func() {
+			if err == nil {
+				err = c.updateIndex(h64, key, prev, existed)
+			}
+		}()
+	}
+	if c.wal != nil {
+		//Recover replays the logged operations, the tombstone must fit in the store before it is logged
+		if err := c.st.reserve(c.st.overhead() + uint64(len(key)) + ttlSize); err != nil {
+			return false, err
+		}
+	}
+	c.observe(value[:8])
+	if c.wal != nil {
+		if err := c.logOp(walDel, h64, key, value); err != nil {
+			return false, err
+		}
+	}
 	h := hashReMap(uint32(h64))
 
 	//Search for the key by using open adressing with linear probing
 	index := h & c.hm.sizeMask
+	start := index
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			return nil
+			return false, nil
 		}
 		if h == storedHash {
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
+			storedKey := c.st.key(stIndex)
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
 
-				//Last write wins
-				v := c.st.val(uint64(stIndex))
+				//Last write wins, unless there is a resolver
+				v := c.st.val(stIndex)
 				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
 				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
-				if t.Before(oldT) {
+				if c.resolver != nil {
+					if _, keep, err := c.resolve(key, stIndex, value[:8]); keep || err != nil {
+						return false, err
+					}
+				} else if t.Before(oldT) {
 					//Stored pair is newer than the provided pair
-					return nil
+					return false, nil
 				}
-				c.st.deleted += uint64(12 + len(key) + len(v))
-				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
-				c.hm.setHash(index, deletedBucket)
-				//Tombstone
-				_, err := c.st.put(key, nil)
-				return err
+				oldTs := binary.LittleEndian.Uint64(v[:8])
+				if !c.st.reuse {
+					//Tombstone, with its deletion timestamp (see purge.go). It is written first: if the store
+					//is full the PMap is left unchanged. The store can grow: v is invalid after the put
+					if err := c.markOwner(); err != nil {
+						return false, err
+					}
+					tombstone, err := c.st.putExpiring(key, nil, c.tombstoneTime(value))
+					if err != nil {
+						return false, err
+					}
+					c.st.deleted += c.st.recordSize(tombstone)
+					c.st.tombstones++
+				}
+				c.st.deleted += c.st.recordSize(stIndex)
+				c.checksum.sub(h64^oldTs, t)
+				c.hm.remove(index)
+				c.dropRef(stIndex, false)
+				if c.st.reuse {
+					//The freed pair won't be found on Open, no tombstone is needed
+					c.st.release(stIndex)
+				}
+				c.publish(ChangeDel, key, nil, value[:8])
+				return true, nil
+			}
+		}
+		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			//Every bucket was probed
+			return false, nil
+		}
+	}
+}
+
+//Returns the store index of the pair associated with key, found is false if it doesn't exists (or was deleted)
+func (c *PMap) lookup(h32 uint32, key []byte) (storeIndex uint64, found bool) {
+	if c.bloom != nil && !c.bloom.mayContain(h32) {
+		return 0, false
+	}
+	h := hashReMap(h32)
+	index := h & c.hm.sizeMask
+	start := index
+	for {
+		storedHash := c.hm.getHash(index)
+		if storedHash == emptyBucket {
+			return 0, false
+		} else if h == storedHash {
+			stIndex := c.hm.getStoreIndex(index)
+			if bytes.Equal(c.st.key(stIndex), key) {
+				return stIndex, true
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			//Every bucket was probed
+			return 0, false
+		}
 	}
 }
 
+//Returns true if the pair stored at index is the current one for its key
 func (c *PMap) isPresent(index uint64) bool {
-	key := c.st.key(index)
-	h32 := uint32(hashing.FNV1a64(key))
-	value, err := c.Get(h32, key)
-	if value == nil || err != nil {
+	if c.st.isFree(index) || c.st.isBlob(index) {
 		return false
 	}
-	storeValue := c.st.val(index)
-	return bytes.Compare(value[0:8], storeValue[0:8]) == 0
+	key := c.st.key(index)
+	h32 := uint32(c.hasher.Hash64(key))
+	stIndex, found := c.lookup(h32, key)
+	return found && stIndex == index
 }
 
 //BackwardsIterate calls foreach for each stored pair in backwards direction, it will stop iterating if the call returns false
@@ -411,16 +1406,37 @@ func (c *PMap) BackwardsIterate(foreach func(key, value []byte) (Continue bool))
 	if prev < 0 {
 		return nil
 	}
-	index = uint64(prev)
+	return c.iterateBackwardsAt(uint64(prev), foreach)
+}
+
+//IterateBackwardsFrom calls foreach like BackwardsIterate, starting at the pair of key instead of the end of the store:
+//the pair of key is visited first, then the pairs stored before it, from the most recently stored one.
+//It returns ErrKeyNotFound if key doesn't exist (or was deleted or it expired)
+//It stops early if foreach returns false
+func (c *PMap) IterateBackwardsFrom(key []byte, foreach func(key, value []byte) (Continue bool)) error {
+	index, found := c.lookup(uint32(c.hasher.Hash64(key)), key)
+	if !found || c.expired(index) {
+		return ErrKeyNotFound
+	}
+	return c.iterateBackwardsAt(index, foreach)
+}
+
+//Calls foreach for the pair at index and each stored pair before it, in backwards direction
+func (c *PMap) iterateBackwardsAt(index uint64, foreach func(key, value []byte) (Continue bool)) error {
+	it := c.iterStore()
 	for index >= 0 {
 		if c.isPresent(index) {
 			key := c.st.key(index)
-			val := c.st.val(index)
 			kc := make([]byte, len(key))
-			vc := make([]byte, len(val))
 			copy(kc, key)
-			copy(vc, val)
-			ok := foreach(kc, vc)
+			value, err := c.appendValue(nil, index)
+			if err != nil {
+				return err
+			}
+			ok := foreach(kc, value)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
 			if !ok {
 				break
 			}
@@ -435,22 +1451,193 @@ func (c *PMap) BackwardsIterate(foreach func(key, value []byte) (Continue bool))
 }
 
 //BackwardsIterate calls foreach for each stored pair, it will stop iterating if the call returns false
+//Upcoming store regions are read ahead, unless Options.NoReadAhead is set
+//A compaction (see Compact), even an automatic one run by a Set or a Del of foreach, invalidates the iteration:
+//it stops and returns errIterationInvalidated
 //It stops early if foreach returns false
 func (c *PMap) Iterate(foreach func(key, value []byte) (Continue bool)) error {
-	for index := uint64(0); index < c.st.length; {
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	for index := c.st.first; index < c.st.length; {
+		ra.advance(index)
+		if c.isPresent(index) {
+			key := c.st.key(index)
+			kc := make([]byte, len(key))
+			copy(kc, key)
+			value, err := c.appendValue(nil, index)
+			if err != nil {
+				return err
+			}
+			ok := foreach(kc, value)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//Number of records scanned by IterateContext between context checks
+const iterateContextCheckInterval = 4096
+
+//IterateContext calls foreach for each stored pair like Iterate, it stops early if foreach returns an error or if ctx is done.
+//It returns the error returned by foreach or ctx.Err(), ctx is checked every few thousand records
+func (c *PMap) IterateContext(ctx context.Context, foreach func(key, value []byte) error) error {
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	n := 0
+	for index := c.st.first; index < c.st.length; {
+		if n%iterateContextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		n++
+		ra.advance(index)
 		if c.isPresent(index) {
 			key := c.st.key(index)
-			val := c.st.val(index)
 			kc := make([]byte, len(key))
-			vc := make([]byte, len(val))
 			copy(kc, key)
-			copy(vc, val)
+			value, err := c.appendValue(nil, index)
+			if err != nil {
+				return err
+			}
+			if err := foreach(kc, value); err != nil {
+				return err
+			}
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//IterateReuse calls foreach for each stored pair like Iterate, but it reuses the same key and value buffers
+//between calls instead of allocating new copies.
+//Key and value are only valid during the foreach call, foreach must copy them to retain them
+//It stops early if foreach returns false
+func (c *PMap) IterateReuse(foreach func(key, value []byte) (Continue bool)) error {
+	var kc, vc []byte
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	for index := c.st.first; index < c.st.length; {
+		ra.advance(index)
+		if c.isPresent(index) {
+			kc = append(kc[:0], c.st.key(index)...)
+			var err error
+			if vc, err = c.appendValue(vc[:0], index); err != nil {
+				return err
+			}
 			ok := foreach(kc, vc)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//IterateKeys calls foreach for each stored key like Iterate, only keys are copied out of the store
+//It stops early if foreach returns false
+func (c *PMap) IterateKeys(foreach func(key []byte) (Continue bool)) error {
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	for index := c.st.first; index < c.st.length; {
+		ra.advance(index)
+		if c.isPresent(index) {
+			key := c.st.key(index)
+			kc := make([]byte, len(key))
+			copy(kc, key)
+			ok := foreach(kc)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//IterateProject calls foreach for each stored pair like Iterate, but instead of the full value it only copies and
+//passes value[8+offset : 8+offset+length], the fragment placed at offset after the timestamp header.
+//Pairs with values too short to contain the fragment are skipped
+//It stops early if foreach returns false
+func (c *PMap) IterateProject(offset, length int, foreach func(key, fragment []byte) (Continue bool)) error {
+	if offset < 0 || length < 0 {
+		return errors.New("Error: negative projection offset or length")
+	}
+	end := offset + length
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	for index := c.st.first; index < c.st.length; {
+		ra.advance(index)
+		if !c.isPresent(index) {
+			index += c.st.recordSize(index)
+			continue
+		}
+		body, err := c.body(index)
+		if err != nil {
+			return err
+		}
+		if len(body) >= end {
+			key := c.st.key(index)
+			kc := make([]byte, len(key))
+			fc := make([]byte, length)
+			copy(kc, key)
+			copy(fc, body[offset:end])
+			ok := foreach(kc, fc)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
 			if !ok {
 				break
 			}
 		}
-		index += 12 + uint64(c.st.totalLen(index))
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//RawScan calls foreach for every physical pair of the store in store order, including overwritten pairs and tombstones.
+//Regions freed by Options.ReuseSpace and deduplicated value blobs are skipped, the raw value of a pair
+//whose value is deduplicated by Options.DedupValues is its blob reference.
+//offset is the store index of the pair and rawValue its stored value (timestamp header included, empty for tombstones).
+//It is intended for debugging and forensic tools, use Iterate to get live pairs
+//It stops early if foreach returns false
+func (c *PMap) RawScan(foreach func(offset uint64, key, rawValue []byte, isTombstone bool) (Continue bool)) error {
+	it := c.iterStore()
+	for index := c.st.first; index < c.st.length; {
+		if c.st.isFree(index) || c.st.isBlob(index) {
+			index += c.st.recordSize(index)
+			continue
+		}
+		key := c.st.key(index)
+		val := c.st.val(index)
+		kc := make([]byte, len(key))
+		vc := make([]byte, len(val))
+		copy(kc, key)
+		copy(vc, val)
+		ok := foreach(index, kc, vc, len(val) == 0)
+		if err := c.checkIter(it); err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		index += c.st.recordSize(index)
 	}
 	return nil
 }
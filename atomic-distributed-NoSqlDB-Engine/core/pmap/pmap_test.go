@@ -0,0 +1,1121 @@
+package pmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Returns a value with the timestamp header set to t
+func testValue(t uint64, body string) []byte {
+	v := make([]byte, 8+len(body))
+	binary.LittleEndian.PutUint64(v, t)
+	copy(v[8:], body)
+	return v
+}
+
+//testClock is a manually controlled Clock, it is read by the checksum background goroutine
+type testClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.set(c.Now().Add(d))
+}
+
+//Returns an anonymous PMap filled with n pairs
+func testFilled(tb testing.TB, n int) *PMap {
+	c := New("", 64*1024*1024)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return c
+}
+
+//Opens the PMap stored in path, failing the test on error
+func testOpen(tb testing.TB, path string) *PMap {
+	c, err := Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestIterateReuse(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	key := []byte("key7")
+	c.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+
+	expected := make(map[string][]byte)
+	c.Iterate(func(key, value []byte) bool {
+		expected[string(key)] = value
+		return true
+	})
+	got := make(map[string][]byte)
+	c.IterateReuse(func(key, value []byte) bool {
+		got[string(key)] = append([]byte(nil), value...)
+		return true
+	})
+	if len(got) != 999 || len(got) != len(expected) {
+		t.Fatal("IterateReuse found", len(got), "pairs, Iterate found", len(expected))
+	}
+	for k, v := range expected {
+		if !bytes.Equal(got[k], v) {
+			t.Fatalf("key %s: got %v, expected %v", k, got[k], v)
+		}
+	}
+}
+
+func TestIterateProject(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	//Value i has i bytes after the header: 0, 1, 2...
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		body := make([]byte, i)
+		for j := range body {
+			body[j] = byte(j)
+		}
+		c.Set(hashing.FNV1a64(key), key, append(testValue(1, ""), body...))
+	}
+	seen := 0
+	err := c.IterateProject(5, 3, func(key, fragment []byte) bool {
+		seen++
+		var i int
+		fmt.Sscanf(string(key), "key%d", &i)
+		if i < 8 {
+			t.Errorf("%s: value too short to be projected", key)
+		}
+		if !bytes.Equal(fragment, []byte{5, 6, 7}) {
+			t.Errorf("%s: fragment %v", key, fragment)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != 12 {
+		t.Fatal("projected", seen, "pairs, expected 12")
+	}
+	if c.IterateProject(-1, 3, func(key, fragment []byte) bool { return true }) == nil {
+		t.Fatal("negative offset accepted")
+	}
+}
+
+func TestChecksumClock(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	c, err := NewWithOptions("", 1024*1024, Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("k")
+	h := hashing.FNV1a64(key)
+	ts := clock.now.Add(time.Second / 2)
+	c.Set(h, key, testValue(uint64(ts.UnixNano()), "v"))
+	expected := h ^ uint64(ts.UnixNano())
+	//A pair is only included in the checksum once its timestamp is stable, a few seconds old
+	clock.set(ts)
+	if c.Checksum() != 0 {
+		t.Fatal("checksum includes a pair written now")
+	}
+	clock.advance(2 * time.Second)
+	if c.Checksum() != 0 {
+		t.Fatal("checksum includes a pair written 2 seconds ago")
+	}
+	clock.advance(2 * time.Second)
+	if c.Checksum() != expected {
+		t.Fatal("checksum doesn't include a pair written 4 seconds ago")
+	}
+	clock.advance(time.Hour)
+	if c.Checksum() != expected {
+		t.Fatal("checksum changed without writes")
+	}
+}
+
+func TestChecksumInterval(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	c := New("", 1024*1024)
+	c.SetChecksumInterval(10 * time.Millisecond)
+	key := []byte("k")
+	h := hashing.FNV1a64(key)
+	ts := c.clock.Now()
+	c.Set(h, key, testValue(uint64(ts.UnixNano()), "v"))
+	expected := h ^ uint64(ts.UnixNano())
+	//The background goroutine moves the windows forward, without calls to Checksum
+	testEventually(t, "the checksum windows were not moved forward", func() bool {
+		c.checksum.mutex.Lock()
+		defer c.checksum.mutex.Unlock()
+		return c.checksum.oldChecksum == expected
+	})
+	if c.Checksum() != expected {
+		t.Fatal("checksum doesn't include a stable pair")
+	}
+	c.Close()
+	testEventually(t, "Close leaked the checksum goroutine", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+}
+
+//Fails if cond doesn't become true in a few seconds
+func testEventually(t *testing.T, msg string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	key := []byte("key7")
+	c.Del(hashing.FNV1a64(key), key, testValue(uint64(time.Now().UnixNano()), ""))
+	keys := [][]byte{[]byte("key500"), []byte("missing"), []byte("key0"), key, []byte("key999"), []byte("key0")}
+	values, err := c.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		expected, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if !bytes.Equal(values[i], expected) || (values[i] == nil) != (expected == nil) {
+			t.Fatalf("key %s: MultiGet returned %v, Get %v", key, values[i], expected)
+		}
+	}
+	if values[1] != nil {
+		t.Fatal("MultiGet found a missing key")
+	}
+	//Values are copies
+	values[0][8] ^= 1
+	if v, _ := c.Get(uint32(hashing.FNV1a64(keys[0])), keys[0]); bytes.Equal(v, values[0]) {
+		t.Fatal("MultiGet returned a slice of the store")
+	}
+}
+
+func TestLen(t *testing.T) {
+	for _, opts := range []Options{{}, {ReuseSpace: true}} {
+		path := filepath.Join(t.TempDir(), fmt.Sprint("pmap", opts.ReuseSpace))
+		c, err := NewWithOptions(path, 1024*1024, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(c *PMap) {
+			count := 0
+			c.Iterate(func(key, value []byte) bool {
+				count++
+				return true
+			})
+			if c.Len() != count {
+				t.Fatalf("%+v: Len %d, Iterate found %d pairs", opts, c.Len(), count)
+			}
+		}
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprint("key", i%300))
+			c.Set(hashing.FNV1a64(key), key, testValue(uint64(i+1), "value"))
+			if i%3 == 0 {
+				key = []byte(fmt.Sprint("key", i%200))
+				c.Del(hashing.FNV1a64(key), key, testValue(uint64(i+1), ""))
+			}
+			//Deleting a missing key
+			key = []byte(fmt.Sprint("missing", i))
+			c.Del(hashing.FNV1a64(key), key, testValue(uint64(i+1), ""))
+		}
+		check(c)
+		if c.Len() == 0 || c.Len() == 300 {
+			t.Fatal("unexpected number of keys", c.Len())
+		}
+		c.Close()
+		c = testOpen(t, path)
+		check(c)
+		//Crash
+		c.st.close()
+		c = testOpen(t, path)
+		check(c)
+		c.Close()
+	}
+}
+
+//Hashes keys with a seeded FNV1a64
+type testHasher struct{}
+
+func (testHasher) Hash64(b []byte) uint64 {
+	return hashing.FNV1a64(append([]byte("seed"), b...))
+}
+
+func TestHasher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	opts := Options{Hasher: testHasher{}}
+	c, err := NewWithOptions(path, 1024*1024, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum := c.checksum.total()
+	c.Close()
+
+	c, err = OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Recovered() || c.checksum.total() != checksum || c.Len() != 100 {
+		t.Fatal("pairs were restored with a different hash", c.Recovered(), c.Len())
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if v, _ := c.Get(uint32(testHasher{}.Hash64(key)), key); string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatal("wrong value", string(key), v)
+		}
+	}
+	if len(testPairs(c)) != 100 {
+		t.Fatal("Iterate doesn't use the PMap Hasher")
+	}
+}
+
+func TestHas(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	c.hm = newHashMap(8, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	//Colliding keys: the probe chain of the last one crosses the deleted bucket of the first one
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	for _, key := range keys {
+		if err := c.Set(7, key, testValue(1, "v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Del(7, keys[0], testValue(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	if c.hm.getHash(hashReMap(7)&c.hm.sizeMask) != deletedBucket {
+		t.Fatal("Del didn't leave a deleted bucket")
+	}
+	if c.Has(7, keys[0]) {
+		t.Fatal("a deleted key is present")
+	}
+	if !c.Has(7, keys[2]) {
+		t.Fatal("Has stopped probing on a deleted bucket")
+	}
+	if c.Has(7, []byte("d")) || c.Has(8, keys[1]) {
+		t.Fatal("a missing key is present")
+	}
+	key := []byte("tombstone")
+	c.Set(9, key, testValue(1, "v"))
+	c.Del(9, key, testValue(2, ""))
+	if c.Has(9, key) {
+		t.Fatal("a tombstone is present")
+	}
+	if v, _ := c.Get(9, key); v != nil {
+		t.Fatal("Get and Has disagree on tombstones", v)
+	}
+}
+
+//Returns n keys of a PMap filled by testFilled, in random order
+func benchmarkMultiGetKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint("key", (i*7919)%n))
+	}
+	return keys
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	c := testFilled(b, 100000)
+	defer c.Close()
+	keys := benchmarkMultiGetKeys(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.MultiGet(keys)
+	}
+}
+
+func BenchmarkMultiGetLoop(b *testing.B) {
+	c := testFilled(b, 100000)
+	defer c.Close()
+	keys := benchmarkMultiGetKeys(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			c.Get(uint32(hashing.FNV1a64(key)), key)
+		}
+	}
+}
+
+func TestRawScan(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	a, b := []byte("a"), []byte("b")
+	c.Set(hashing.FNV1a64(a), a, testValue(1, "a1"))
+	c.Set(hashing.FNV1a64(b), b, testValue(1, "b1"))
+	c.Set(hashing.FNV1a64(a), a, testValue(2, "a2"))
+	c.Del(hashing.FNV1a64(b), b, testValue(2, ""))
+
+	type record struct {
+		key, value string
+		tombstone  bool
+	}
+	expected := []record{{"a", "a1", false}, {"b", "b1", false}, {"a", "a2", false}, {"b", "", true}}
+	var got []record
+	var offsets []uint64
+	c.RawScan(func(offset uint64, key, rawValue []byte, isTombstone bool) bool {
+		r := record{key: string(key), tombstone: isTombstone}
+		if !isTombstone {
+			r.value = string(rawValue[8:])
+		}
+		got = append(got, r)
+		offsets = append(offsets, offset)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatal("RawScan records:", got, "expected:", expected)
+	}
+	if offsets[0] != 0 || offsets[1] != 12+1+10 {
+		t.Fatal("RawScan offsets:", offsets)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	const n = 200000
+	c := New("", 64*1024*1024)
+	defer c.Close()
+	if err := c.Reserve(n, 20); err != nil {
+		t.Fatal(err)
+	}
+	size := c.hm.size
+	if size <= 1<<defaultHashMapInitialLog2Size {
+		t.Fatal("hashmap not expanded by Reserve")
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(1, "value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.hm.size != size {
+		t.Fatal("hashmap expanded during the load after Reserve", size, c.hm.size)
+	}
+	if c.Reserve(64*1024*1024, 20) == nil {
+		t.Fatal("Reserve accepted more than the store can hold")
+	}
+	if c.hm.size != size {
+		t.Fatal("failed Reserve modified the hashmap")
+	}
+}
+
+func benchmarkBulkLoad(b *testing.B, reserve bool) {
+	const n = 100000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint("key", i))
+	}
+	value := testValue(1, "value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := New("", 16*1024*1024)
+		b.StartTimer()
+		if reserve {
+			c.Reserve(n, 20)
+		}
+		for _, key := range keys {
+			c.Set(hashing.FNV1a64(key), key, value)
+		}
+		b.StopTimer()
+		c.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	benchmarkBulkLoad(b, false)
+}
+
+func BenchmarkBulkLoadReserve(b *testing.B) {
+	benchmarkBulkLoad(b, true)
+}
+
+func TestGetWrappedDeletedChain(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	//A tiny hashmap whose every bucket is a tombstone: probing never finds an empty bucket
+	c.hm = newHashMap(4, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	for i := uint32(0); i < c.hm.size; i++ {
+		c.hm.setHash(i, deletedBucket)
+	}
+	c.hm.numDeletedKeys = c.hm.size
+	key := []byte("missing")
+	h := hashing.FNV1a64(key)
+	done := make(chan bool)
+	go func() {
+		v, err := c.Get(uint32(h), key)
+		if v != nil || err != nil {
+			t.Error("Get of a missing key returned", v, err)
+		}
+		if _, found := c.lookup(uint32(h), key); found {
+			t.Error("lookup found a missing key")
+		}
+		if err := c.Del(h, key, testValue(1, "")); err != nil {
+			t.Error("Del of a missing key returned", err)
+		}
+		//Set frees the deleted buckets
+		if err := c.Set(h, key, testValue(1, "v")); err != nil {
+			t.Error("Set in a hashmap full of deleted buckets returned", err)
+		}
+		if v, _ := c.Get(uint32(h), key); string(v[8:]) != "v" {
+			t.Error("Get after freeing the deleted buckets returned", v)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("probing a wrapped chain of deleted buckets didn't terminate")
+	}
+}
+
+//Keys whose hashes are the emptyBucket and deletedBucket sentinels, or collide with them after remapping
+func TestHashReMapSentinels(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	hashes := []uint64{emptyBucket, deletedBucket, 2, 3, 1<<32 | deletedBucket}
+	key := func(i int) []byte { return []byte(fmt.Sprint("key", i)) }
+	check := func(deleted int) {
+		for i, h := range hashes {
+			v, err := c.Get(uint32(h), key(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == deleted {
+				if v != nil {
+					t.Fatalf("deleted key %d with hash %d found: %v", i, h, v)
+				}
+			} else if string(v[8:]) != fmt.Sprint("value", i) {
+				t.Fatalf("key %d with hash %d: got %v", i, h, v)
+			}
+		}
+	}
+	for i, h := range hashes {
+		if err := c.Set(h, key(i), testValue(1, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(-1)
+	//The deleted bucket of a key whose hash is deletedBucket must not be taken as a live pair
+	if err := c.Del(hashes[1], key(1), testValue(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	check(1)
+	if _, found := c.lookup(uint32(hashes[1]), key(1)); found {
+		t.Fatal("lookup found a deleted key")
+	}
+	//CAS on a key whose hash is emptyBucket, and recreation of the deleted one
+	cas := func(oldTs, newTs uint64, old, body string) []byte {
+		v := make([]byte, 24, 24+len(body))
+		binary.LittleEndian.PutUint64(v, oldTs)
+		binary.LittleEndian.PutUint64(v[8:], hashing.FNV1a64([]byte(old)))
+		binary.LittleEndian.PutUint64(v[16:], newTs)
+		return append(v, body...)
+	}
+	if err := c.CAS(hashes[0], key(0), cas(1, 3, "value0", "value0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CAS(hashes[1], key(1), cas(0, 3, "", "value1")); err != nil {
+		t.Fatal(err)
+	}
+	check(-1)
+	//The recreated key reuses its deleted bucket
+	if c.hm.numStoredKeys != uint32(len(hashes)) {
+		t.Fatal("unexpected number of stored keys", c.hm.numStoredKeys)
+	}
+}
+
+func TestSetReusesDeletedBuckets(t *testing.T) {
+	c := New("", 16*1024*1024)
+	defer c.Close()
+	const n = 10000
+	for round := uint64(0); round < 20; round++ {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(2*round+1, "v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round == 0 {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Del(hashing.FNV1a64(key), key, testValue(2*round+2, "")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c.hm.size != 1<<defaultHashMapInitialLog2Size || c.hm.numStoredKeys+c.hm.numDeletedKeys > n {
+		t.Fatal("hashmap grew to", c.hm.size, "buckets,", c.hm.numStoredKeys, "stored keys", c.hm.numDeletedKeys, "deleted")
+	}
+}
+
+func TestNumStoredKeysTracksLiveKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 4*1024*1024)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(hashing.FNV1a64(key), key, testValue(1, "v"))
+	}
+	for i := 0; i < n; i += 2 {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+	}
+	//Deleting a missing or an already deleted key doesn't change the counters
+	key := []byte("key0")
+	c.Del(hashing.FNV1a64(key), key, testValue(3, ""))
+	if c.hm.numStoredKeys != n/2 || c.hm.numDeletedKeys != n/2 {
+		t.Fatal(c.hm.numStoredKeys, "stored keys,", c.hm.numDeletedKeys, "deleted")
+	}
+	c.Close()
+	c = testOpen(t, path)
+	if c.hm.numStoredKeys != n/2 || c.hm.numDeletedKeys != n/2 {
+		t.Fatal("reopened:", c.hm.numStoredKeys, "stored keys,", c.hm.numDeletedKeys, "deleted")
+	}
+	c.Close()
+
+	//Deleted buckets are freed when they fill the hashmap
+	c = New("", 4*1024*1024)
+	defer c.Close()
+	c.hm = newHashMap(8, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("other", i))
+		c.Set(hashing.FNV1a64(key), key, testValue(1, "v"))
+		c.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+	}
+	if c.hm.size != 1<<8 || c.hm.numStoredKeys != 0 || c.hm.numDeletedKeys >= c.hm.numKeysToExpand {
+		t.Fatal("hashmap grew to", c.hm.size, "buckets,", c.hm.numStoredKeys, "stored keys", c.hm.numDeletedKeys, "deleted")
+	}
+}
+
+func BenchmarkIterate(b *testing.B) {
+	c := testFilled(b, 10000)
+	defer c.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Iterate(func(key, value []byte) bool { return true })
+	}
+}
+
+func BenchmarkIterateReuse(b *testing.B) {
+	c := testFilled(b, 10000)
+	defer c.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.IterateReuse(func(key, value []byte) bool { return true })
+	}
+}
+
+func TestHashSeed(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{HashSeed: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("key")
+	if c.Hash(key) != hashing.FNV1a64Seed(key, 42) {
+		t.Fatal("the PMap doesn't hash with the seed")
+	}
+	if _, err := NewWithOptions("", 1024*1024, Options{HashSeed: 42, Hasher: testHasher{}}); err == nil {
+		t.Fatal("HashSeed accepted with a Hasher")
+	}
+}
+
+func TestHashMapOptions(t *testing.T) {
+	c := New("", 1024*1024)
+	if c.hm.size != 1<<defaultHashMapInitialLog2Size || c.hm.sizeLimit != defaultHashMapSizeLimit ||
+		c.hm.numKeysToExpand != uint32(float64(c.hm.size)*defaultHashMapMaxLoadFactor) {
+		t.Fatal("New doesn't use the default hashmap settings")
+	}
+	c.Close()
+
+	c, err := NewWithOptions("", 1024*1024, Options{InitialLog2Size: 10, SizeLimit: 1 << 12, LoadFactor: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.hm.size != 1<<10 || c.hm.numKeysToExpand != 512 {
+		t.Fatal("wrong hashmap size", c.hm.size, c.hm.numKeysToExpand)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.hm.size != 1<<11 || c.hm.numKeysToExpand != 1024 {
+		t.Fatal("the expanded hashmap doesn't keep the load factor", c.hm.size, c.hm.numKeysToExpand)
+	}
+	if c.Reserve(2000, 16) == nil {
+		t.Fatal("the hashmap was expanded beyond SizeLimit")
+	}
+
+	for _, opts := range []Options{{LoadFactor: 1}, {LoadFactor: -0.5}, {InitialLog2Size: 32}, {InitialLog2Size: 13, SizeLimit: 1 << 12}} {
+		if _, err := NewWithOptions("", 1024*1024, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	c.hm = newHashMap(4, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	//Keys a, b and c share their ideal bucket, d is placed after them
+	for i, h := range []uint64{2, 2 + 16, 2 + 32, 3} {
+		key := []byte{'a' + byte(i)}
+		if err := c.Set(h, key, testValue(1, "v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := []byte("a")
+	c.Del(2, key, testValue(2, ""))
+	s := c.Stats()
+	if s.LiveKeys != 3 || s.Tombstones != 1 || s.HashMapSize != 16 || s.StoreSize != 1024*1024 ||
+		s.UsedBytes != c.Used() || s.DeletedBytes != c.Deleted() {
+		t.Fatalf("wrong occupancy %+v", s)
+	}
+	//Probe lengths of b, c and d: 2, 3 and 3
+	if s.MaxProbeLength != 3 || s.AvgProbeLength != 8.0/3 {
+		t.Fatalf("wrong probe lengths %+v", s)
+	}
+
+	//e collides with b, f with e and b
+	c.Set(2+16, []byte("e"), testValue(1, "v"))
+	c.Set(2+16, []byte("f"), testValue(1, "v"))
+	c.Set(2+16, []byte("b"), testValue(3, "v"))
+	if s := c.Stats(); s.HashCollisions != 1+2+1 {
+		t.Fatal("wrong number of collisions", s.HashCollisions)
+	}
+}
+
+func TestProbeLength(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	c.hm = newHashMap(4, defaultHashMapSizeLimit, defaultHashMapMaxLoadFactor)
+	//Keys a, b and c share their ideal bucket, d is placed after them
+	for i, h := range []uint64{2, 2 + 16, 2 + 32, 3} {
+		key := []byte{'a' + byte(i)}
+		if err := c.Set(h, key, testValue(1, "v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Del(2, []byte("a"), testValue(2, ""))
+	for _, p := range []struct {
+		h32   uint32
+		key   string
+		n     int
+		found bool
+	}{
+		{2 + 16, "b", 2, true},
+		{2 + 32, "c", 3, true},
+		{3, "d", 3, true},
+		{2, "a", 5, false},      //Deleted: every bucket of the chain, up to the empty one
+		{2 + 16, "z", 5, false}, //Same hash as b
+		{7, "z", 1, false},
+	} {
+		if n, found := c.ProbeLength(p.h32, []byte(p.key)); n != p.n || found != p.found {
+			t.Fatalf("key %s: probe length %d, %v, expected %d, %v", p.key, n, found, p.n, p.found)
+		}
+	}
+
+	//The probe lengths of the live keys are the ones of Stats
+	c = testFilled(t, 10000)
+	defer c.Close()
+	total, max := 0, 0
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		n, found := c.ProbeLength(uint32(hashing.FNV1a64(key)), key)
+		if !found {
+			t.Fatal("key not found", i)
+		}
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	if s := c.Stats(); float64(total)/10000 != s.AvgProbeLength || max != s.MaxProbeLength {
+		t.Fatalf("probe lengths: average %v, max %d, Stats %+v", float64(total)/10000, max, s)
+	}
+}
+
+func TestIterateContext(t *testing.T) {
+	c := testFilled(t, 10000)
+	defer c.Close()
+	n := 0
+	if err := c.IterateContext(context.Background(), func(key, value []byte) error { n++; return nil }); err != nil || n != 10000 {
+		t.Fatal("IterateContext visited", n, "pairs", err)
+	}
+
+	errStop := errors.New("stop")
+	n = 0
+	err := c.IterateContext(context.Background(), func(key, value []byte) error {
+		n++
+		if n == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 10 {
+		t.Fatal("the foreach error was not returned", err, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n = 0
+	err = c.IterateContext(ctx, func(key, value []byte) error {
+		n++
+		if n == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || n > 10+iterateContextCheckInterval {
+		t.Fatal("the cancellation was not detected", err, n)
+	}
+}
+
+func TestIterateKeys(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	key := []byte("key7")
+	c.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+	key = []byte("key8")
+	c.Set(hashing.FNV1a64(key), key, testValue(3, "overwritten"))
+
+	expected := testPairs(c)
+	got := make(map[string]bool)
+	c.IterateKeys(func(key []byte) bool {
+		if got[string(key)] {
+			t.Fatal("key visited twice", string(key))
+		}
+		got[string(key)] = true
+		return true
+	})
+	if len(got) != 999 || len(got) != len(expected) {
+		t.Fatal("IterateKeys found", len(got), "keys, Iterate found", len(expected))
+	}
+	for k := range expected {
+		if !got[k] {
+			t.Fatal("key not visited", k)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	c := New("", 4096)
+	defer c.Close()
+	key := []byte("key")
+	h := c.Hash(key)
+	if err := c.Set(h, key, []byte("short")); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("Set:", err)
+	}
+	if err := c.Del(h, key, []byte("short")); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("Del:", err)
+	}
+	if err := c.CAS(h, key, make([]byte, 16)); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("CAS:", err)
+	}
+	c.Set(h, key, testValue(1, "a"))
+	cas := make([]byte, 24)
+	binary.LittleEndian.PutUint64(cas, 2)
+	binary.LittleEndian.PutUint64(cas[16:], 3)
+	if err := c.CAS(h, key, cas); !errors.Is(err, ErrCASTimestampMismatch) {
+		t.Fatal("CAS with a wrong timestamp:", err)
+	}
+	binary.LittleEndian.PutUint64(cas, 1)
+	if err := c.CAS(h, key, cas); !errors.Is(err, ErrCASHashMismatch) {
+		t.Fatal("CAS with a wrong hash:", err)
+	}
+	err := c.Set(h, key, testValue(2, string(make([]byte, 8192))))
+	if !errors.Is(err, ErrStoreFull) {
+		t.Fatal("Set on a full store:", err)
+	}
+	if !errors.Is(c.Reserve(1000, 100), ErrStoreFull) {
+		t.Fatal("Reserve on a full store")
+	}
+}
+
+func TestClear(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 1000)
+	for round := 0; round < 2; round++ {
+		if err := c.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if c.Used() != 0 || c.Deleted() != 0 || c.Len() != 0 || c.checksum.total() != 0 || c.hm.size != 1<<defaultHashMapInitialLog2Size {
+			t.Fatal("the PMap was not cleared", c.Used(), c.Deleted(), c.Len(), c.hm.size)
+		}
+		if len(testPairs(c)) != 0 {
+			t.Fatal("Iterate found pairs after Clear")
+		}
+		for i := 500; i < 600; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(c.Hash(key), key, testValue(1, fmt.Sprint("new", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	used, checksum := c.Used(), c.checksum.total()
+	//A crash doesn't resurrect the cleared pairs
+	c.st.close()
+	c = testOpen(t, path)
+	defer c.Close()
+	if c.Used() != used || c.checksum.total() != checksum || c.Len() != 100 {
+		t.Fatal("wrong store after reopening", c.Used(), c.Len())
+	}
+	for k, v := range testPairs(c) {
+		if !strings.HasPrefix(v[8:], "new") {
+			t.Fatal("stale key survived Clear", k, v)
+		}
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	key := []byte("key7")
+	h32 := uint32(c.Hash(key))
+	buf := make([]byte, 0, 64)
+	v, found, err := c.GetInto(h32, key, buf)
+	if !found || err != nil || string(v) != string(testValue(1, "value7")) || &v[0] != &buf[:1][0] {
+		t.Fatal("GetInto returned", v, found, err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { c.GetInto(h32, key, buf) }); allocs != 0 {
+		t.Fatal("GetInto allocated with a large enough buffer", allocs)
+	}
+	//Small buffers grow
+	if v, found, _ := c.GetInto(h32, key, make([]byte, 2)); !found || string(v) != string(testValue(1, "value7")) {
+		t.Fatal("GetInto with a small buffer returned", v, found)
+	}
+	missing := []byte("missing")
+	if v, found, err := c.GetInto(uint32(c.Hash(missing)), missing, buf); found || err != nil || len(v) != 0 {
+		t.Fatal("GetInto of an absent key returned", v, found, err)
+	}
+}
+
+func TestGetTimestamp(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	key := []byte("key7")
+	h32 := uint32(c.Hash(key))
+	if ts, found := c.GetTimestamp(h32, key); !found || ts.UnixNano() != 1 {
+		t.Fatal("GetTimestamp returned", ts, found)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { c.GetTimestamp(h32, key) }); allocs != 0 {
+		t.Fatal("GetTimestamp allocated", allocs)
+	}
+	c.Del(c.Hash(key), key, testValue(2, ""))
+	if ts, found := c.GetTimestamp(h32, key); found {
+		t.Fatal("GetTimestamp of a deleted key returned", ts)
+	}
+	//Pairs that reference a deduplicated body have the same header
+	d, _ := NewWithOptions("", 1024*1024, Options{DedupValues: true})
+	defer d.Close()
+	d.Set(d.Hash(key), key, testValue(5, "a deduplicated value"))
+	if ts, found := d.GetTimestamp(uint32(d.Hash(key)), key); !found || ts.UnixNano() != 5 {
+		t.Fatal("GetTimestamp of a reference returned", ts, found)
+	}
+}
+
+func TestGetIfNewer(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	key := []byte("key7")
+	h32 := uint32(c.Hash(key))
+	if v, found, err := c.GetIfNewer(h32, key, time.Unix(0, 0)); !found || err != nil || string(v) != string(testValue(1, "value7")) {
+		t.Fatal("GetIfNewer of a newer pair returned", v, found, err)
+	}
+	//The timestamp must be strictly after since
+	for _, since := range []int64{1, 2} {
+		if v, found, err := c.GetIfNewer(h32, key, time.Unix(0, since)); found || err != nil || v != nil {
+			t.Fatal("GetIfNewer of an older pair returned", v, found, err)
+		}
+	}
+	missing := []byte("missing")
+	if v, found, _ := c.GetIfNewer(uint32(c.Hash(missing)), missing, time.Unix(0, 0)); found || v != nil {
+		t.Fatal("GetIfNewer of an absent key returned", v, found)
+	}
+}
+
+func TestIterateBackwardsFrom(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	//Overwritten and deleted pairs are skipped
+	c.Set(c.Hash([]byte("key48")), []byte("key48"), testValue(2, "newer"))
+	c.Del(c.Hash([]byte("key47")), []byte("key47"), testValue(2, ""))
+	var keys []string
+	err := c.IterateBackwardsFrom([]byte("key50"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 4
+	})
+	if err != nil || fmt.Sprint(keys) != "[key50 key49 key46 key45]" {
+		t.Fatal("IterateBackwardsFrom visited", keys, err)
+	}
+	keys = nil
+	c.IterateBackwardsFrom([]byte("key1"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if fmt.Sprint(keys) != "[key1 key0]" {
+		t.Fatal("IterateBackwardsFrom visited", keys)
+	}
+	for _, key := range []string{"missing", "key47"} {
+		err := c.IterateBackwardsFrom([]byte(key), func(key, value []byte) bool { return true })
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatal("wrong error for", key, err)
+		}
+	}
+}
+
+func TestMaxSizes(t *testing.T) {
+	if _, err := NewWithOptions("", 1024*1024, Options{MaxKeySize: maxKeySize + 1}); err == nil {
+		t.Fatal("MaxKeySize larger than the store format accepted")
+	}
+	if _, err := NewWithOptions("", 1024*1024, Options{MaxValueSize: -1}); err == nil {
+		t.Fatal("negative MaxValueSize accepted")
+	}
+	c, err := NewWithOptions("", 1024*1024, Options{MaxKeySize: 16, MaxValueSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte(strings.Repeat("k", 16))
+	if err := c.Set(c.Hash(key), key, testValue(1, strings.Repeat("v", 24))); err != nil {
+		t.Fatal("boundary-sized pair rejected", err)
+	}
+	long := []byte(strings.Repeat("k", 17))
+	if err := c.Set(c.Hash(long), long, testValue(1, "v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatal("Set of a long key returned", err)
+	}
+	if err := c.Set(c.Hash(key), key, testValue(2, strings.Repeat("v", 25))); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("Set of a long value returned", err)
+	}
+	if err := c.Del(c.Hash(long), long, testValue(2, "")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatal("Del of a long key returned", err)
+	}
+	cas := make([]byte, 16)
+	binary.LittleEndian.PutUint64(cas, 1)
+	binary.LittleEndian.PutUint64(cas[8:], hashing.FNV1a64([]byte(strings.Repeat("v", 24))))
+	if err := c.CAS(c.Hash(key), key, append(cas, testValue(2, strings.Repeat("v", 25))...)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("CAS of a long value returned", err)
+	}
+	//Rejected writes don't touch the store
+	if v, _ := c.Get(uint32(c.Hash(key)), key); string(v) != string(testValue(1, strings.Repeat("v", 24))) || c.Len() != 1 {
+		t.Fatal("a rejected write modified the PMap", v, c.Len())
+	}
+	if err := c.CAS(c.Hash(key), key, append(cas, testValue(2, strings.Repeat("w", 24))...)); err != nil {
+		t.Fatal("boundary-sized CAS rejected", err)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{WAL: true, Index: func(v []byte) []byte { return v }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c.Close()
+	c.CloseAndDelete()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("CloseAndDelete of a closed PMap deleted the file", err)
+	}
+	c, err = Open(path)
+	if err != nil || c.Recovered() {
+		t.Fatal("the store was not closed cleanly", err)
+	}
+	c.CloseAndDelete()
+	c.CloseAndDelete()
+	c.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("the file was not deleted", err)
+	}
+	s := OpenStore("", 1024*1024)
+	index := NewIndex(s)
+	s.Close()
+	s.Close()
+	index.Close()
+	index.Close()
+	if s.st.file != nil {
+		t.Fatal("the shared store was not unmapped")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	c := New("", 64*1024)
+	defer c.Close()
+	if c.FreeSpace() != c.Size()-footerSize || c.Utilization() != 0 || c.LiveBytes() != 0 {
+		t.Fatal("wrong capacity of an empty PMap", c.FreeSpace(), c.Utilization(), c.LiveBytes())
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Set(c.Hash(key), key, testValue(1, "value"))
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(c.Hash(key), key, testValue(2, ""))
+	}
+	if c.FreeSpace()+c.Used()+footerSize != c.Size() || c.Utilization() != float64(c.Used())/float64(c.Size()) {
+		t.Fatal("wrong free space", c.FreeSpace(), c.Utilization())
+	}
+	live := c.LiveBytes()
+	if live != c.Used()-c.Deleted() {
+		t.Fatal("wrong live bytes", live)
+	}
+	c.Compact()
+	if c.Used() != live+c.Deleted() {
+		t.Fatal("LiveBytes differs from the compacted size", live, c.Used())
+	}
+	//The store is full when FreeSpace can't hold a record
+	for i := 0; c.FreeSpace() > 0; i++ {
+		key := []byte(fmt.Sprint("filler", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, "value")); err != nil {
+			if !errors.Is(err, ErrStoreFull) || c.FreeSpace() >= int(c.st.overhead())+len(key)+13 {
+				t.Fatal("store full with free space", c.FreeSpace(), err)
+			}
+			break
+		}
+	}
+}
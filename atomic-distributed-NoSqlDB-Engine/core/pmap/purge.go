@@ -0,0 +1,98 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+	Tombstone purge
+
+	Del appends a tombstone (unless Options.ReuseSpace is set): Open and Repair delete the previous pairs of its key
+	when they scan it, and ReplicateTo sends it to the followers as a delete. Tombstones carry their deletion
+	timestamp, the one provided to Del, in the expiry slot of the record (see ttl.go), it costs 8 bytes.
+	Tombstones without a timestamp (deleted with a zero timestamp or with Options.SequenceNumbers, or written
+	before the tombstones had one) are never purged.
+
+	PurgeTombstones frees the tombstones deleted before a cutoff. A freed tombstone no longer deletes anything,
+	every previous record of its key is freed with it, before it: Open never resurrects the purged keys, even after
+	a crash in the middle of the purge. Replication and anti-entropy rely on the tombstones to propagate deletions,
+	the cutoff must leave enough time to propagate them to every replica: a replica that didn't get the deletion
+	before the purge keeps the key.
+
+	The freed records stay counted in Deleted like every free region, Compact reclaims their space and
+	Options.ReuseSpace reuses it. The deleted hashmap buckets are freed too.
+
+	Compact copies the tombstones deleted less than Options.TombstoneRetention ago (every tombstone by default)
+	whose key wasn't set again, the older ones are dropped: the retention must be long enough to propagate the
+	deletions too. Tombstones without a timestamp can't be purged, Compact always drops them.
+	Tombstones aren't included in the checksum, it is not changed.
+*/
+
+var errPurgeSequence = errors.New("PurgeTombstones cannot be used with SequenceNumbers")
+
+//Returns the deletion timestamp stored on the tombstone written by Del with value, 0 if it has none
+func (c *PMap) tombstoneTime(value []byte) uint64 {
+	if c.sequence {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(value[:8])
+}
+
+//PurgeTombstones frees the tombstones whose deletion timestamp is older than olderThan, and the previous
+//records of their keys, and returns the number of freed tombstones. See purge.go
+func (c *PMap) PurgeTombstones(olderThan time.Time) (int, error) {
+	if c.st.readOnly {
+		return 0, ErrReadOnly
+	}
+	if c.shared != nil {
+		return 0, errSharedStore
+	}
+	if c.sequence {
+		return 0, errPurgeSequence
+	}
+	cutoff := uint64(olderThan.UnixNano())
+	//Store index of the last purged tombstone of each key
+	last := make(map[string]uint64)
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if c.st.isFree(index) || c.st.isBlob(index) || c.st.valLen(index) > 0 {
+			continue
+		}
+		if t := c.st.expiry(index); t != 0 && t < cutoff {
+			last[string(c.st.key(index))] = index
+		}
+	}
+	if len(last) == 0 {
+		return 0, nil
+	}
+	var tombstones []uint64
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if c.st.isFree(index) || c.st.isBlob(index) {
+			continue
+		}
+		if t, ok := last[string(c.st.key(index))]; !ok || index > t || c.isPresent(index) {
+			continue
+		}
+		if c.st.valLen(index) == 0 {
+			tombstones = append(tombstones, index)
+			continue
+		}
+		c.st.release(index)
+	}
+	//The tombstones are freed once the pairs they delete are freed on disk
+	if err := c.st.sync(c.st.length); err != nil {
+		return 0, err
+	}
+	for _, index := range tombstones {
+		c.st.release(index)
+	}
+	c.st.tombstones -= uint64(len(tombstones))
+	if c.hm.numDeletedKeys > 0 {
+		//Rehashing at the same size frees the deleted buckets
+		if err := c.hm.resize(c.hm.sizelog2); err != nil {
+			return len(tombstones), err
+		}
+	}
+	return len(tombstones), nil
+}
@@ -0,0 +1,164 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Sets key0 to key99 twice and deletes key0 to key49, the first half at timestamp 10 and the second one at 20.
+//"untimed" is deleted with a zero timestamp
+func testTombstones(t *testing.T, c *PMap) {
+	for ts := uint64(1); ts <= 2; ts++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(ts, fmt.Sprint("value", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Del(hashing.FNV1a64(key), key, testValue(uint64(10+10*(i/25)), "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := []byte("untimed")
+	c.Set(hashing.FNV1a64(key), key, testValue(0, "value"))
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(0, "")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Checks that key0 to key49 and untimed are deleted and that the other keys have their value
+func testCheckTombstones(t *testing.T, c *PMap, tombstones int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		v, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if (i < 50) != (v == nil) || v != nil && string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatalf("key %d: %v", i, v)
+		}
+	}
+	if c.Has(uint32(hashing.FNV1a64([]byte("untimed"))), []byte("untimed")) {
+		t.Fatal("untimed key resurrected")
+	}
+	testCheckRecordCounts(t, c, 50, tombstones)
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 1024*1024)
+	testTombstones(t, c)
+	testCheckTombstones(t, c, 51)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	n, err := c.PurgeTombstones(time.Unix(0, 15))
+	if err != nil || n != 25 {
+		t.Fatal("purged", n, err)
+	}
+	testCheckTombstones(t, c, 26)
+	if c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum {
+		t.Fatal("purge changed used", c.Used(), "deleted", c.Deleted(), "or checksum", c.checksum.total())
+	}
+	if s := c.Stats(); s.Tombstones != 0 {
+		t.Fatal("deleted hashmap buckets", s.Tombstones)
+	}
+	//Nothing left before the cutoff
+	if n, err := c.PurgeTombstones(time.Unix(0, 15)); err != nil || n != 0 {
+		t.Fatal("purged again", n, err)
+	}
+
+	//The purged keys are not resurrected by Open
+	c.Close()
+	c = testOpen(t, path)
+	testCheckTombstones(t, c, 26)
+	if c.Deleted() != deleted || c.checksum.total() != checksum {
+		t.Fatal("reopened: deleted", c.Deleted(), "checksum", c.checksum.total())
+	}
+	c.st.close()
+	c = testOpen(t, path)
+	if !c.Recovered() {
+		t.Fatal("not recovered")
+	}
+	testCheckTombstones(t, c, 26)
+
+	//Purged keys can be set and deleted again
+	key := []byte("key0")
+	if err := c.Set(hashing.FNV1a64(key), key, testValue(30, "value0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(30, "")); err != nil {
+		t.Fatal(err)
+	}
+	//Tombstones without timestamp are never purged
+	if n, err := c.PurgeTombstones(time.Now()); err != nil || n != 26 {
+		t.Fatal("purged", n, err)
+	}
+	testCheckTombstones(t, c, 1)
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	testCheckTombstones(t, c, 0)
+	c.CloseAndDelete()
+}
+
+func TestCompactTombstoneRetention(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 25)}
+	for _, tc := range []struct {
+		retention  time.Duration
+		tombstones int
+	}{{0, 50}, {10, 25}, {-1, 0}} {
+		path := filepath.Join(t.TempDir(), "pmap")
+		c, err := NewWithOptions(path, 1024*1024, Options{Clock: clock, TombstoneRetention: tc.retention})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testTombstones(t, c)
+		//The untimed tombstone is always dropped
+		if err := c.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		testCheckTombstones(t, c, tc.tombstones)
+		c.Close()
+		c = testOpen(t, path)
+		testCheckTombstones(t, c, tc.tombstones)
+		//The kept tombstones are reclaimed by a purge and the next compaction
+		if n, err := c.PurgeTombstones(time.Unix(0, 25)); err != nil || n != tc.tombstones {
+			t.Fatal("purged", n, err)
+		}
+		if err := c.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		testCheckTombstones(t, c, 0)
+		if c.Deleted() != 0 {
+			t.Fatal("deleted bytes left", c.Deleted())
+		}
+		c.CloseAndDelete()
+	}
+}
+
+func TestPurgeTombstonesUnsupported(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{SequenceNumbers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.PurgeTombstones(time.Now()); err != errPurgeSequence {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pmap")
+	c = New(path, 1024*1024)
+	testTombstones(t, c)
+	c.Close()
+	ro, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err := ro.PurgeTombstones(time.Now()); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package pmap
+
+import (
+	"os"
+
+	"launchpad.net/gommap"
+)
+
+/*
+	The store is advised as MADV_RANDOM (see mmapAdviseFlags), the kernel won't read ahead on page faults.
+	Sequential iterations issue their own read-ahead hints: the next window of the store is advised
+	as MADV_WILLNEED when half of the previous one is consumed, doubling the window up to readAheadMaxWindow
+	while the iteration keeps going.
+*/
+
+const (
+	readAheadMinWindow = 64 * 1024
+	readAheadMaxWindow = 4 * 1024 * 1024
+)
+
+var pageSize = uint64(os.Getpagesize())
+
+//readAhead issues the read-ahead hints of a sequential iteration over st
+type readAhead struct {
+	st     *store
+	next   uint64 //End of the advised region
+	window uint64 //Size of the next advised window
+}
+
+//Returns the read-ahead of a new iteration, nil if it is disabled
+func (c *PMap) newReadAhead() *readAhead {
+	if c.noReadAhead {
+		return nil
+	}
+	return &readAhead{st: c.st, window: readAheadMinWindow}
+}
+
+//Advances the iteration to index, advising the next window if needed
+func (r *readAhead) advance(index uint64) {
+	if r == nil || index+r.window/2 < r.next || r.next >= r.st.length {
+		return
+	}
+	start := r.next &^ (pageSize - 1)
+	end := r.next + r.window
+	if end > r.st.length {
+		end = r.st.length
+	}
+	//Hints are best-effort, errors are ignored
+	r.st.file[start:end].Advise(gommap.MADV_WILLNEED)
+	r.next = end
+	if r.window < readAheadMaxWindow {
+		r.window *= 2
+	}
+}
@@ -0,0 +1,81 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+	"launchpad.net/gommap"
+)
+
+//Fills a file-backed PMap with n pairs of 100 bytes long values
+func testFilledLarge(tb testing.TB, opts Options, n int) *PMap {
+	if runtime.GOOS != "linux" {
+		tb.Skip("read-ahead hints are only checked on linux")
+	}
+	path := filepath.Join(tb.TempDir(), "pmap")
+	c, err := NewWithOptions(path, uint64(n)*200+1024*1024, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	body := string(bytes.Repeat([]byte("v"), 100))
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(1, body)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestIterateReadAhead(t *testing.T) {
+	c := testFilledLarge(t, Options{}, 100000)
+	defer c.CloseAndDelete()
+	expected := make(map[string][]byte)
+	c.noReadAhead = true
+	c.Iterate(func(key, value []byte) bool {
+		expected[string(key)] = value
+		return true
+	})
+	c.noReadAhead = false
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		if !bytes.Equal(expected[string(key)], value) {
+			t.Fatalf("key %s: got %v, expected %v", key, value, expected[string(key)])
+		}
+		return true
+	})
+	if count != len(expected) || count != 100000 {
+		t.Fatal("Iterate found", count, "pairs, expected", len(expected))
+	}
+	//The whole store was advised, in growing windows
+	ra := c.newReadAhead()
+	for index := uint64(0); index < c.st.length; index += pageSize {
+		ra.advance(index)
+	}
+	if ra.next != c.st.length || ra.window != readAheadMaxWindow {
+		t.Fatal("read-ahead stopped at", ra.next, "of", c.st.length, "window", ra.window)
+	}
+}
+
+//Rough timing of a cold store iteration: the pages are dropped from the mapping before each iteration
+func BenchmarkIterateCold(b *testing.B) {
+	for _, noReadAhead := range []bool{false, true} {
+		b.Run(fmt.Sprint("NoReadAhead=", noReadAhead), func(b *testing.B) {
+			c := testFilledLarge(b, Options{NoReadAhead: noReadAhead}, 200000)
+			defer c.CloseAndDelete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c.st.file.Sync(gommap.MS_SYNC)
+				c.st.file.Advise(gommap.MADV_DONTNEED)
+				b.StartTimer()
+				c.Iterate(func(key, value []byte) bool { return true })
+			}
+		})
+	}
+}
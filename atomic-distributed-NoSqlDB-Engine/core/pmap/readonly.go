@@ -0,0 +1,22 @@
+package pmap
+
+//OpenReadOnly opens a previous closed pmap like Open does, mapping its store read-only (PROT_READ):
+//the pages can be shared with other processes and the store is never written.
+//Get, Has, MultiGet, Len, Checksum and the iterations work as usual, the operations that modify the PMap
+//(Set, Del, CAS and the ones built on them, Compact...) return ErrReadOnly.
+//A store that was not closed cleanly is recovered in memory only, its file is left untouched.
+//Close doesn't write the footer nor sync the store
+func OpenReadOnly(path string) (*PMap, error) {
+	c := newPMap(path, Options{})
+	st, err := openStore(c.path, true, false)
+	if err != nil {
+		return nil, err
+	}
+	c.st = st
+	if err := c.restoreStore(nil); err != nil {
+		c.st.close()
+		return nil, err
+	}
+	c.checksum.SetInterval(defaultCheckSumInterval)
+	return c, nil
+}
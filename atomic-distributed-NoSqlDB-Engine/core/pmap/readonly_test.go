@@ -0,0 +1,60 @@
+package pmap
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 100)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	pairs := testPairs(c)
+	c.Close()
+
+	c, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+	if c.Len() != 99 {
+		t.Fatal("wrong length", c.Len())
+	}
+	c.SetChecksumInterval(10 * time.Millisecond)
+	testEventually(t, "the read-only checksum doesn't include the stable pairs", func() bool {
+		return c.Checksum() == checksum
+	})
+	key := []byte("key1")
+	if !c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("Has failed on a read-only PMap")
+	}
+	if got := testPairs(c); len(got) != len(pairs) {
+		t.Fatal("Iterate returned", len(got), "pairs, expected", len(pairs))
+	}
+	if err := c.Set(c.Hash(key), key, testValue(2, "new")); !errors.Is(err, ErrReadOnly) {
+		t.Fatal("Set on a read-only PMap:", err)
+	}
+	if err := c.Del(c.Hash(key), key, testValue(2, "")); !errors.Is(err, ErrReadOnly) {
+		t.Fatal("Del on a read-only PMap:", err)
+	}
+	if err := c.CAS(c.Hash(key), key, make([]byte, 24)); !errors.Is(err, ErrReadOnly) {
+		t.Fatal("CAS on a read-only PMap:", err)
+	}
+	if err := c.Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Fatal("Compact on a read-only PMap:", err)
+	}
+	//The footer is kept, the next Open sees the store closed cleanly
+	if _, ok := c.st.readFooter(); !ok {
+		t.Fatal("OpenReadOnly cleared the footer")
+	}
+	c.Close()
+
+	c = testOpen(t, path)
+	defer c.Close()
+	if c.Recovered() {
+		t.Fatal("the store was modified by the read-only PMap")
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+}
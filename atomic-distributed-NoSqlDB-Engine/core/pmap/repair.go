@@ -0,0 +1,104 @@
+package pmap
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+	Repair salvages the pairs of a store that Open rejects as corrupt.
+
+	The damaged store is mapped read-only and scanned in order: every record is checked like Open and
+	Verify do (bounds, lengths and its CRC in stores with record checksums), the scan stops at the first
+	record that fails. The records before it are applied to a new PMap (path + ".repaired") in store order:
+	pairs are set with their timestamp (and expiry) and tombstones delete their key, giving the state the
+	damaged store had when the corrupt record was written. The new store is compacted at the end.
+	The damaged file is never modified, it is kept for forensics.
+*/
+
+//Repair builds a new PMap, stored in path + ".repaired", with the valid pairs of the damaged store located
+//at path: those placed before its first corrupt record. It returns the new PMap and the number of salvaged
+//(live) pairs. The new PMap keeps the record format of the damaged one and uses the default Options,
+//the damaged file is left untouched.
+func Repair(path string) (*PMap, int, error) {
+	st, err := openStore(path, true, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer st.close()
+	src := newPMap(path, Options{})
+	src.st = st
+	c, err := NewWithOptions(path+".repaired", st.size, Options{Checksums: st.crc, FilePerms: st.perm})
+	if err != nil {
+		return nil, 0, err
+	}
+	//The records of footerless stores reach the end of the file, see store.go
+	limit := st.size
+	for index := st.first; index < limit && st.isRecord(index, limit); index += st.recordSize(index) {
+		if err := st.checkRepairRecord(index, limit); err != nil {
+			log.Println("Repair stopped:", err, path)
+			break
+		}
+		if st.isFree(index) || st.isBlob(index) {
+			continue
+		}
+		if st.isEncrypted(index) {
+			c.CloseAndDelete()
+			return nil, 0, fmt.Errorf("%w: encrypted stores can't be repaired", ErrNoEncryptionKey)
+		}
+		if err := c.repairRecord(src, index); err != nil {
+			c.CloseAndDelete()
+			return nil, 0, err
+		}
+	}
+	if err := c.Compact(); err != nil {
+		c.CloseAndDelete()
+		return nil, 0, err
+	}
+	return c, c.Len(), nil
+}
+
+//Returns an error if the record at index is corrupt: its lengths are inconsistent, its CRC doesn't match
+//or it references a blob that is not placed before it
+func (st *store) checkRepairRecord(index, limit uint64) error {
+	if err := st.checkRecord(index, limit); err != nil {
+		return err
+	}
+	if st.isFree(index) {
+		return nil
+	}
+	if st.crc && st.recordCRC(index) != st.storedCRC(index) {
+		return fmt.Errorf("Corrupt store record at offset %d: CRC mismatch", index)
+	}
+	if st.isRef(index) {
+		if blob := st.refBlob(index); blob < st.first || blob >= index || !st.isBlob(blob) {
+			return fmt.Errorf("Corrupt store record at offset %d: reference to a missing blob", index)
+		}
+	}
+	if st.isCompressed(index) && !st.isEncrypted(index) {
+		if _, err := decompress(st.val(index)[8:]); err != nil {
+			return fmt.Errorf("Corrupt store record at offset %d: %v", index, err)
+		}
+	}
+	return nil
+}
+
+//Applies the record at index of the damaged PMap src to c
+func (c *PMap) repairRecord(src *PMap, index uint64) error {
+	key := src.st.key(index)
+	h64 := c.Hash(key)
+	if src.st.valLen(index) > 0 {
+		value, err := src.appendValue(nil, index)
+		if err != nil {
+			return err
+		}
+		return c.set(h64, key, value, src.st.expiry(index))
+	}
+	//Tombstone: the key was deleted after its last pair, whatever the timestamp of the deletion
+	stIndex, found := c.lookup(uint32(h64), key)
+	if !found {
+		return nil
+	}
+	header := append([]byte(nil), c.st.val(stIndex)[:8]...)
+	return c.Del(h64, key, header)
+}
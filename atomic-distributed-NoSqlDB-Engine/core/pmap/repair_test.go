@@ -0,0 +1,68 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		t.Run(fmt.Sprint("Checksums=", checksums), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			c, err := NewWithOptions(path, 1024*1024, Options{Checksums: checksums})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var corrupt uint64
+			for i := 0; i < 100; i++ {
+				if i == 60 {
+					corrupt = c.st.length
+				}
+				key := []byte(fmt.Sprint("key", i%80))
+				if err := c.Set(c.Hash(key), key, testValue(uint64(i+1), fmt.Sprint("value", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key := []byte("key1")
+			c.Del(c.Hash(key), key, testValue(200, ""))
+			if checksums {
+				//A bit-flip in the value of the 61st pair
+				c.st.val(corrupt)[10] ^= 1
+			} else {
+				c.st.setValLen(corrupt, 3)
+			}
+			c.Close()
+			if !checksums {
+				if _, err := Open(path); err == nil {
+					t.Fatal("corrupt store opened")
+				}
+			}
+			damaged, _ := ioutil.ReadFile(path)
+
+			c, salvaged, err := Repair(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			//The 60 pairs written before the corrupt one
+			if salvaged != 60 || c.Len() != 60 || c.Deleted() != 0 {
+				t.Fatal("salvaged", salvaged, "pairs, Deleted", c.Deleted())
+			}
+			for i := 0; i < 60; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				if v, _ := c.Get(uint32(c.Hash(key)), key); string(v) != string(testValue(uint64(i+1), fmt.Sprint("value", i))) {
+					t.Fatal("wrong salvaged value", string(key), v)
+				}
+			}
+			if now, _ := ioutil.ReadFile(path); !bytes.Equal(now, damaged) {
+				t.Fatal("Repair modified the damaged store")
+			}
+			if err := c.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
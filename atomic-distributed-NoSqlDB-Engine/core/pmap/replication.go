@@ -0,0 +1,184 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+/*
+	Replication streams the pairs needed to bring a follower PMap up to date with a leader PMap.
+
+	Since the store is append-only, everything written after a store offset (see AppendOffset) is placed
+	after it: ReplicateTo sends the live pairs placed after sinceOffset, and a delete for each tombstone
+	placed after it whose key is still deleted. The stream ends with the leader checksum and append offset,
+	ReplicateFrom verifies the checksum and returns the offset to use on the next catch-up.
+
+	Followers apply the pairs with the usual timestamp semantics, so the replication is idempotent.
+	Deletes remove the follower pair whatever its timestamp (the stream doesn't carry the deletion timestamps):
+	followers must only be written through replication.
+	With Options.ReuseSpace pairs are written before the append offset and there are no tombstones,
+	only full replications (sinceOffset = 0) are supported.
+*/
+
+/*
+Binary structure of the replication stream
+
+The stream is a sequence of chunks, each one represented with the WAL record framing:
+	4 bytes: payload len
+	4 bytes: CRC32 (IEEE) of the payload
+	Payload: a sequence of operations, each one represented this way:
+		1 byte: operation
+		Set & Del:
+			4 bytes: key len
+			4 bytes: value len (0 for Del)
+			Key len bytes: key
+			Value len bytes: value
+		End (only as the last operation of the last chunk):
+			8 bytes: leader checksum of every pair
+			8 bytes: leader append offset
+*/
+
+const replChunkSize = 64 * 1024
+
+const (
+	replSet = iota + 1
+	replDel
+	replEnd
+)
+
+var errReplicationStream = errors.New("Replication stream corrupted")
+
+//ReplicateTo writes to w the replication stream that brings up to date a follower which already has
+//every pair placed before sinceOffset. sinceOffset is 0 for a full replication or an append offset of
+//a previous replication (returned by the follower ReplicateFrom).
+func (c *PMap) ReplicateTo(w io.Writer, sinceOffset uint64) error {
+	if sinceOffset > c.st.length {
+		return errors.New("Error: offset is beyond the end of the store")
+	}
+	if sinceOffset > 0 && c.st.reuse {
+		return errors.New("Error: incremental replication is not supported with ReuseSpace")
+	}
+	if sinceOffset < c.st.first {
+		//The store header is not a pair
+		sinceOffset = c.st.first
+	}
+	chunk := make([]byte, 0, replChunkSize)
+	for index := sinceOffset; index < c.st.length; index += c.st.recordSize(index) {
+		if c.st.isFree(index) || c.st.isBlob(index) {
+			continue
+		}
+		var op byte
+		var value []byte
+		key := c.st.key(index)
+		if c.isPresent(index) {
+			op = replSet
+			var err error
+			if value, err = c.appendValue(nil, index); err != nil {
+				return err
+			}
+		} else if c.st.valLen(index) == 0 {
+			if _, found := c.lookup(uint32(c.hasher.Hash64(key)), key); found {
+				//Set again after the deletion
+				continue
+			}
+			op = replDel
+		} else {
+			//Overwritten pair
+			continue
+		}
+		chunk = append(chunk, op, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(chunk[len(chunk)-8:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(chunk[len(chunk)-4:], uint32(len(value)))
+		chunk = append(append(chunk, key...), value...)
+		if len(chunk) >= replChunkSize {
+			if err := replWriteChunk(w, chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	end := make([]byte, 17)
+	end[0] = replEnd
+	binary.LittleEndian.PutUint64(end[1:], c.checksum.total())
+	binary.LittleEndian.PutUint64(end[9:], c.st.length)
+	return replWriteChunk(w, append(chunk, end...))
+}
+
+func replWriteChunk(w io.Writer, payload []byte) error {
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+//ReplicateFrom applies a replication stream written by the leader ReplicateTo.
+//It returns the leader append offset, to be used as sinceOffset on the next replication.
+//It returns an error if the stream is corrupted or if the follower checksum doesn't match the leader one
+//after applying it; the pairs of the valid chunks read before the error remain applied.
+func (c *PMap) ReplicateFrom(r io.Reader) (uint64, error) {
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return 0, errReplicationStream
+		}
+		for len(payload) > 0 {
+			if payload[0] == replEnd {
+				if len(payload) != 17 {
+					return 0, errReplicationStream
+				}
+				if c.checksum.total() != binary.LittleEndian.Uint64(payload[1:]) {
+					return 0, errors.New("Replication checksum mismatch")
+				}
+				return binary.LittleEndian.Uint64(payload[9:]), nil
+			}
+			if len(payload) < 9 {
+				return 0, errReplicationStream
+			}
+			op := payload[0]
+			keyLen := uint64(binary.LittleEndian.Uint32(payload[1:]))
+			valLen := uint64(binary.LittleEndian.Uint32(payload[5:]))
+			if keyLen+valLen > uint64(len(payload)-9) {
+				return 0, errReplicationStream
+			}
+			key := payload[9 : 9+keyLen]
+			value := payload[9+keyLen : 9+keyLen+valLen]
+			payload = payload[9+keyLen+valLen:]
+			h64 := c.hasher.Hash64(key)
+			var err error
+			switch op {
+			case replSet:
+				err = c.Set(h64, key, value)
+			case replDel:
+				//Delete with the timestamp of the stored pair, it is deleted whatever its timestamp
+				v, _ := c.Get(uint32(h64), key)
+				if v != nil {
+					err = c.Del(h64, key, v[:8])
+				}
+			default:
+				return 0, errReplicationStream
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package pmap
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func testReplicate(t *testing.T, leader, follower *PMap, since uint64) uint64 {
+	var stream bytes.Buffer
+	if err := leader.ReplicateTo(&stream, since); err != nil {
+		t.Fatal(err)
+	}
+	offset, err := follower.ReplicateFrom(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != leader.AppendOffset() {
+		t.Fatal("ReplicateFrom returned offset", offset, "expected", leader.AppendOffset())
+	}
+	return offset
+}
+
+func testSamePairs(t *testing.T, leader, follower *PMap) {
+	if leader.checksum.total() != follower.checksum.total() {
+		t.Fatal("checksum mismatch", leader.checksum.total(), follower.checksum.total())
+	}
+	n := 0
+	leader.Iterate(func(key, value []byte) bool {
+		n++
+		v, _ := follower.Get(uint32(hashing.FNV1a64(key)), key)
+		if !bytes.Equal(v, value) {
+			t.Fatalf("key %s: follower has %v, leader %v", key, v, value)
+		}
+		return true
+	})
+	m := 0
+	follower.Iterate(func(key, value []byte) bool {
+		m++
+		return true
+	})
+	if n != m {
+		t.Fatal("leader has", n, "pairs, follower", m)
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	leader := New("", 4*1024*1024)
+	defer leader.Close()
+	follower := New("", 4*1024*1024)
+	defer follower.Close()
+	set := func(i, ts int, body string) {
+		key := []byte(fmt.Sprint("key", i))
+		if err := leader.Set(hashing.FNV1a64(key), key, testValue(uint64(ts), body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		set(i, 1, fmt.Sprint("value", i))
+	}
+	offset := testReplicate(t, leader, follower, 0)
+	testSamePairs(t, leader, follower)
+
+	//The follower falls behind: overwrites, deletes, a deleted and recreated key and new keys
+	for i := 0; i < 5000; i += 3 {
+		set(i, 2, fmt.Sprint("new value", i))
+	}
+	for i := 1; i < 5000; i += 7 {
+		key := []byte(fmt.Sprint("key", i))
+		leader.Del(hashing.FNV1a64(key), key, testValue(3, ""))
+	}
+	set(1, 4, "recreated")
+	for i := 5000; i < 6000; i++ {
+		set(i, 1, fmt.Sprint("value", i))
+	}
+	var stream bytes.Buffer
+	leader.ReplicateTo(&stream, offset)
+	var full bytes.Buffer
+	leader.ReplicateTo(&full, 0)
+	if stream.Len() >= full.Len() {
+		t.Fatal("delta of", stream.Len(), "bytes, full replication of", full.Len())
+	}
+	offset = testReplicate(t, leader, follower, offset)
+	testSamePairs(t, leader, follower)
+
+	//Nothing new: the delta is empty
+	testReplicate(t, leader, follower, offset)
+	testSamePairs(t, leader, follower)
+}
+
+func TestReplicationCorruptedStream(t *testing.T) {
+	leader := testFilled(t, 100)
+	defer leader.Close()
+	var stream bytes.Buffer
+	if err := leader.ReplicateTo(&stream, 0); err != nil {
+		t.Fatal(err)
+	}
+	b := stream.Bytes()
+	b[len(b)/2]++
+	follower := New("", 1024*1024)
+	defer follower.Close()
+	if _, err := follower.ReplicateFrom(bytes.NewReader(b)); err != errReplicationStream {
+		t.Fatal("corrupted stream accepted:", err)
+	}
+	if _, err := follower.ReplicateFrom(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Fatal("truncated stream accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+/*
+	Read-modify-write primitives
+
+	They are built on lookup and Set: the stored pair is read in place (without copying it) and the new
+	value is written by Set, so they keep its last-write-wins semantics, WAL, audit log, index and
+	checksum maintenance. The second probe finds the bucket already in cache.
+	Touch is the exception, it rewrites the timestamp header of the stored pair in place.
+*/
+
+var errNotCounter = errors.New("Error: stored value is not a counter")
+
+//Increment adds delta to the counter stored in key and returns its new total.
+//A counter value is the 8 byte timestamp header followed by a little-endian int64, absent counters start from zero.
+//Like Set, the new value is only written if the stored pair is older than timestamp, otherwise the stored
+//total is returned unchanged. It returns an error if the stored value is not a counter
+func (c *PMap) Increment(h64 uint64, key []byte, delta int64, timestamp time.Time) (int64, error) {
+	var total int64
+	if stIndex, found := c.lookup(uint32(h64), key); found {
+		body, err := c.body(stIndex)
+		if err != nil {
+			return 0, err
+		}
+		if len(body) != 8 {
+			return 0, errNotCounter
+		}
+		total = int64(binary.LittleEndian.Uint64(body))
+		if int64(binary.LittleEndian.Uint64(c.st.val(stIndex))) >= timestamp.UnixNano() {
+			//Stored pair is newer than the provided timestamp
+			return total, nil
+		}
+	}
+	total += delta
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, uint64(timestamp.UnixNano()))
+	binary.LittleEndian.PutUint64(value[8:], uint64(total))
+	if err := c.Set(h64, key, value); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+//GetSet sets the value of a pair like Set and returns a copy of the value stored before the write,
+//nil if the key was absent. If the stored pair is newer than value nothing is written and the stored value is returned
+func (c *PMap) GetSet(h64 uint64, key, value []byte) ([]byte, error) {
+	if len(value) < 8 {
+		return nil, fmt.Errorf("%w: message value len < 8", ErrValueTooShort)
+	}
+	var prev []byte
+	if stIndex, found := c.lookup(uint32(h64), key); found {
+		var err error
+		if prev, err = c.appendValue(nil, stIndex); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Set(h64, key, value); err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+//SetIfAbsent writes the pair like Set only if the key doesn't exist, deleted keys are absent.
+//It returns true if the pair was written, false if the key was already present
+func (c *PMap) SetIfAbsent(h64 uint64, key, value []byte) (bool, error) {
+	if _, found := c.lookup(uint32(h64), key); found {
+		return false, nil
+	}
+	if err := c.Set(h64, key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//CompareAndDelete deletes the pair like Del only if the FNV1a64 hash of its stored value body (the value
+//without the timestamp header, like CAS) is expectedHash and the pair is not newer than timestamp.
+//It returns true if the pair was deleted, false if it doesn't exist or a test failed
+func (c *PMap) CompareAndDelete(h64 uint64, key []byte, expectedHash uint64, timestamp time.Time) (bool, error) {
+	stIndex, found := c.lookup(uint32(h64), key)
+	if !found {
+		return false, nil
+	}
+	body, err := c.body(stIndex)
+	if err != nil {
+		return false, err
+	}
+	if hashing.FNV1a64(body) != expectedHash || int64(binary.LittleEndian.Uint64(c.st.val(stIndex))) > timestamp.UnixNano() {
+		return false, nil
+	}
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(timestamp.UnixNano()))
+	if err := c.Del(h64, key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Touch sets the timestamp of a pair to timestamp without rewriting its value, for TTL and LRU schemes.
+//Like Set it is only applied if the stored pair is older than timestamp, it returns true if the pair was
+//touched and false if the key is absent or the stored pair is not older.
+//The timestamp header is rewritten in place (and the record checksum, see Options.Checksums), the pair is
+//not moved so AppendOffset doesn't change: replication followers don't get the new timestamp until the pair
+//is written again. It is logged to the WAL as a Set of the touched value.
+func (c *PMap) Touch(h64 uint64, key []byte, timestamp time.Time) (touched bool, err error) {
+	if c.st.readOnly {
+		return false, ErrReadOnly
+	}
+	stIndex, found := c.lookup(uint32(h64), key)
+	if !found {
+		return false, nil
+	}
+	header := c.st.val(stIndex)[:8]
+	oldTs := binary.LittleEndian.Uint64(header)
+	if int64(oldTs) >= timestamp.UnixNano() {
+		//Stored pair is newer than the provided timestamp
+		return false, nil
+	}
+	newHeader := make([]byte, 8)
+	binary.LittleEndian.PutUint64(newHeader, uint64(timestamp.UnixNano()))
+	if c.audit != nil {
+		defer func() { c.audit.add(AuditTouch, h64, newHeader, 0, err) }()
+	}
+	if c.wal != nil {
+		body, err := c.body(stIndex)
+		if err != nil {
+			return false, err
+		}
+		if err := c.logOp(walSet, h64, key, append(newHeader, body...)); err != nil {
+			return false, err
+		}
+	}
+	c.observe(newHeader)
+	copy(header, newHeader)
+	if c.st.crc {
+		c.st.updateCRC(stIndex)
+	}
+	c.checksum.sub(h64^oldTs, timestamp)
+	c.checksum.sum(h64^binary.LittleEndian.Uint64(newHeader), timestamp)
+	return true, nil
+}
@@ -0,0 +1,149 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestIncrement(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	key := []byte("counter")
+	h := c.Hash(key)
+	for i, expected := range []int64{5, 3, 10} {
+		delta := []int64{5, -2, 7}[i]
+		total, err := c.Increment(h, key, delta, time.Unix(0, int64(i+1)))
+		if err != nil || total != expected {
+			t.Fatal("Increment returned", total, err, "expected", expected)
+		}
+	}
+	v, _ := c.Get(uint32(h), key)
+	if len(v) != 16 || binary.LittleEndian.Uint64(v) != 3 || binary.LittleEndian.Uint64(v[8:]) != 10 {
+		t.Fatal("wrong stored counter", v)
+	}
+	//Stale increment: the newer stored total is kept
+	if total, err := c.Increment(h, key, 100, time.Unix(0, 2)); err != nil || total != 10 {
+		t.Fatal("stale Increment returned", total, err)
+	}
+	if c.Len() != 1 {
+		t.Fatal("wrong number of keys", c.Len())
+	}
+
+	key = []byte("string")
+	c.Set(c.Hash(key), key, testValue(1, "not a counter"))
+	if _, err := c.Increment(c.Hash(key), key, 1, time.Unix(0, 2)); err != errNotCounter {
+		t.Fatal("expected errNotCounter, got", err)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	key := []byte("key")
+	h := c.Hash(key)
+	if prev, err := c.GetSet(h, key, testValue(2, "first")); err != nil || prev != nil {
+		t.Fatal("GetSet of an absent key returned", prev, err)
+	}
+	if prev, err := c.GetSet(h, key, testValue(3, "second")); err != nil || !bytes.Equal(prev, testValue(2, "first")) {
+		t.Fatal("GetSet returned", prev, err)
+	}
+	//Stale write: the newer stored value is returned and kept
+	if prev, err := c.GetSet(h, key, testValue(1, "stale")); err != nil || !bytes.Equal(prev, testValue(3, "second")) {
+		t.Fatal("stale GetSet returned", prev, err)
+	}
+	if v, _ := c.Get(uint32(h), key); !bytes.Equal(v, testValue(3, "second")) {
+		t.Fatal("stale GetSet overwrote the value", v)
+	}
+	if _, err := c.GetSet(h, key, []byte("short")); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("value without timestamp accepted")
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	key := []byte("lock")
+	h := c.Hash(key)
+	if ok, err := c.SetIfAbsent(h, key, testValue(1, "owner1")); err != nil || !ok {
+		t.Fatal("SetIfAbsent of an absent key returned", ok, err)
+	}
+	if ok, err := c.SetIfAbsent(h, key, testValue(2, "owner2")); err != nil || ok {
+		t.Fatal("SetIfAbsent of a present key returned", ok, err)
+	}
+	if v, _ := c.Get(uint32(h), key); !bytes.Equal(v, testValue(1, "owner1")) {
+		t.Fatal("the present pair was overwritten", v)
+	}
+	c.Del(h, key, testValue(3, ""))
+	if ok, err := c.SetIfAbsent(h, key, testValue(4, "owner2")); err != nil || !ok {
+		t.Fatal("SetIfAbsent of a deleted key returned", ok, err)
+	}
+	if _, err := c.SetIfAbsent(c.Hash([]byte("k")), []byte("k"), []byte("short")); !errors.Is(err, ErrValueTooShort) {
+		t.Fatal("value without timestamp accepted")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	c := New("", 1024*1024)
+	defer c.Close()
+	key := []byte("lock")
+	h := c.Hash(key)
+	c.Set(h, key, testValue(5, "owner1"))
+	checksum := c.checksum.total()
+	for _, test := range []struct {
+		owner string
+		ts    int64
+	}{{"owner2", 10}, {"owner1", 4}} {
+		if ok, err := c.CompareAndDelete(h, key, hashing.FNV1a64([]byte(test.owner)), time.Unix(0, test.ts)); ok || err != nil {
+			t.Fatal("CompareAndDelete with a failed test returned", ok, err, test)
+		}
+	}
+	if !c.Has(uint32(h), key) || c.checksum.total() != checksum {
+		t.Fatal("the pair was deleted")
+	}
+	deleted := c.Deleted()
+	if ok, err := c.CompareAndDelete(h, key, hashing.FNV1a64([]byte("owner1")), time.Unix(0, 10)); !ok || err != nil {
+		t.Fatal("CompareAndDelete returned", ok, err)
+	}
+	if c.Has(uint32(h), key) || c.Len() != 0 || c.checksum.total() != 0 || c.Deleted() <= deleted {
+		t.Fatal("the pair was not deleted", c.Len(), c.checksum.total(), c.Deleted())
+	}
+	if ok, err := c.CompareAndDelete(h, key, hashing.FNV1a64([]byte("owner1")), time.Unix(0, 11)); ok || err != nil {
+		t.Fatal("CompareAndDelete of an absent key returned", ok, err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c, err := NewWithOptions("", 1024*1024, Options{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := []byte("session")
+	h := c.Hash(key)
+	if ok, err := c.Touch(h, key, time.Unix(0, 10)); ok || err != nil {
+		t.Fatal("Touch of an absent key returned", ok, err)
+	}
+	c.Set(h, key, testValue(5, "data"))
+	if ok, err := c.Touch(h, key, time.Unix(0, 5)); ok || err != nil {
+		t.Fatal("Touch with an older timestamp returned", ok, err)
+	}
+	used := c.Used()
+	if ok, err := c.Touch(h, key, time.Unix(0, 20)); !ok || err != nil {
+		t.Fatal("Touch returned", ok, err)
+	}
+	if v, _ := c.Get(uint32(h), key); string(v) != string(testValue(20, "data")) || c.Used() != used {
+		t.Fatal("the pair was not touched in place", v, c.Used())
+	}
+	//The checksum and the record CRC match a pair written with the new timestamp
+	if c.checksum.total() != h^20 {
+		t.Fatal("wrong checksum after Touch", c.checksum.total())
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package pmap
+
+import "math/rand"
+
+/*
+	Key sampling
+
+	Every live key has exactly one hashmap bucket, sampling random buckets samples live keys uniformly whatever
+	their insertion order; deleted and empty buckets are skipped. When live keys are sparse (a large or mostly
+	deleted hashmap, or many expired keys) random probing would take more tries than the buckets, and when
+	the sample is large most random tries would hit already sampled keys; in both cases every bucket is
+	visited once and the keys are reservoir sampled instead.
+*/
+
+//SampleKeys returns copies of up to n distinct live keys chosen at random, every live key has the same probability.
+//It returns every live key (in hashmap order) if there are n or less.
+//Samples are approximate statistics: repeated calls return independent samples that may overlap
+func (c *PMap) SampleKeys(n int) [][]byte {
+	live := int(c.hm.numStoredKeys)
+	if n <= 0 || live == 0 {
+		return nil
+	}
+	if n > live/2 {
+		return c.reservoirSample(n)
+	}
+	size := int(c.hm.size)
+	keys := make([][]byte, 0, n)
+	seen := make(map[uint32]bool, n)
+	for tries := 0; len(keys) < n; tries++ {
+		if tries == size {
+			return c.reservoirSample(n)
+		}
+		bucket := uint32(rand.Intn(size))
+		if c.hm.getHash(bucket) <= deletedBucket || seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		if index := c.hm.getStoreIndex(bucket); !c.expired(index) {
+			keys = append(keys, append([]byte(nil), c.st.key(index)...))
+		}
+	}
+	return keys
+}
+
+//Returns n live keys sampled uniformly by visiting every bucket once (Algorithm R), or every live key
+func (c *PMap) reservoirSample(n int) [][]byte {
+	var keys [][]byte
+	seen := 0
+	for bucket := uint32(0); bucket < c.hm.size; bucket++ {
+		if c.hm.getHash(bucket) <= deletedBucket {
+			continue
+		}
+		index := c.hm.getStoreIndex(bucket)
+		if c.expired(index) {
+			continue
+		}
+		seen++
+		if len(keys) < n {
+			keys = append(keys, append([]byte(nil), c.st.key(index)...))
+		} else if r := rand.Intn(seen); r < n {
+			keys[r] = append([]byte(nil), c.st.key(index)...)
+		}
+	}
+	return keys
+}
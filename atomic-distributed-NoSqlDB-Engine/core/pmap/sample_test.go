@@ -0,0 +1,60 @@
+package pmap
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSampleKeys(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		c.Del(c.Hash(key), key, testValue(2, ""))
+	}
+	if keys := c.SampleKeys(1000); len(keys) != 500 {
+		t.Fatal("SampleKeys didn't return every live key", len(keys))
+	}
+	//Only live keys are sampled, and early keys are as likely as late ones
+	counts := make(map[string]int)
+	const rounds, n = 2000, 10
+	for r := 0; r < rounds; r++ {
+		keys := c.SampleKeys(n)
+		distinct := make(map[string]bool)
+		for _, k := range keys {
+			var i int
+			fmt.Sscanf(string(k), "key%d", &i)
+			if i < 500 {
+				t.Fatal("deleted key sampled", string(k))
+			}
+			distinct[string(k)] = true
+			counts[string(k)]++
+		}
+		if len(keys) != n || len(distinct) != n {
+			t.Fatal("wrong sample", len(keys), len(distinct))
+		}
+	}
+	early, late := 0, 0
+	for k, count := range counts {
+		var i int
+		fmt.Sscanf(k, "key%d", &i)
+		if i < 750 {
+			early += count
+		} else {
+			late += count
+		}
+	}
+	if math.Abs(float64(early-late)) > 0.1*rounds*n {
+		t.Fatal("biased sample", early, late)
+	}
+	//Large samples are reservoir sampled
+	if keys := c.SampleKeys(400); len(keys) != 400 {
+		t.Fatal("wrong large sample", len(keys))
+	}
+	empty := New("", 1024*1024)
+	defer empty.Close()
+	if keys := empty.SampleKeys(10); keys != nil {
+		t.Fatal("sampled an empty PMap", keys)
+	}
+}
@@ -0,0 +1,114 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+	Prefix operations and paginated scans
+
+	The store is ordered by insertion, not by key: prefix operations scan every record of the store,
+	their cost depends on the store length, not on the number of matching keys.
+	Scan cursors are store indexes, like the ones used by Iterate.
+*/
+
+//DeleteRange deletes every live key starting with prefix, like calling Del on each of them with timestamp,
+//and returns the number of deleted keys. Keys whose stored pair is newer than timestamp are kept
+func (c *PMap) DeleteRange(prefix []byte, timestamp time.Time) (int, error) {
+	//Del writes tombstones and can compact the store, keys are collected first
+	var keys [][]byte
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if bytes.HasPrefix(c.st.key(index), prefix) && c.isPresent(index) {
+			keys = append(keys, append([]byte(nil), c.st.key(index)...))
+		}
+	}
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(timestamp.UnixNano()))
+	n := 0
+	for _, key := range keys {
+		h64 := c.hasher.Hash64(key)
+		if err := c.Del(h64, key, value); err != nil {
+			return n, err
+		}
+		if !c.Has(uint32(h64), key) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+//ScanPrefix calls foreach for each stored pair whose key starts with prefix, with copies of the key and the value
+//like Iterate. Pairs are visited in store order (roughly insertion order), not in lexicographic order
+//It stops early if foreach returns false
+func (c *PMap) ScanPrefix(prefix []byte, foreach func(key, value []byte) (Continue bool)) error {
+	it := c.iterStore()
+	ra := c.newReadAhead()
+	for index := c.st.first; index < c.st.length; {
+		ra.advance(index)
+		if key := c.st.key(index); bytes.HasPrefix(key, prefix) && c.isPresent(index) {
+			kc := make([]byte, len(key))
+			copy(kc, key)
+			value, err := c.appendValue(nil, index)
+			if err != nil {
+				return err
+			}
+			ok := foreach(kc, value)
+			if err := c.checkIter(it); err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	return nil
+}
+
+//ScanFrom calls foreach for at most limit stored pairs like Iterate, starting at the store index startIndex
+//(0 means the beginning of the store), and returns the store index to resume from, 0 when the store is exhausted.
+//If foreach returns false ScanFrom stops and the cursor points after the last visited pair.
+//Cursors stay valid while the PMap is modified, pairs written after the cursor was returned may or may not be
+//visited, but a compaction (see Compact) or an Open invalidates them
+func (c *PMap) ScanFrom(startIndex uint64, limit int, foreach func(key, value []byte) (Continue bool)) (nextIndex uint64, err error) {
+	if limit <= 0 {
+		return 0, errors.New("Error: non-positive scan limit")
+	}
+	if startIndex < c.st.first {
+		startIndex = c.st.first
+	}
+	if startIndex > c.st.length {
+		return 0, errors.New("Error: scan cursor is beyond the end of the store")
+	}
+	n := 0
+	index := startIndex
+	it := c.iterStore()
+	for index < c.st.length && n < limit {
+		if c.isPresent(index) {
+			n++
+			key := c.st.key(index)
+			kc := make([]byte, len(key))
+			copy(kc, key)
+			value, err := c.appendValue(nil, index)
+			if err != nil {
+				return 0, err
+			}
+			ok := foreach(kc, value)
+			if err := c.checkIter(it); err != nil {
+				return 0, err
+			}
+			if !ok {
+				index += c.st.recordSize(index)
+				break
+			}
+		}
+		index += c.st.recordSize(index)
+	}
+	if index >= c.st.length {
+		return 0, nil
+	}
+	return index, nil
+}
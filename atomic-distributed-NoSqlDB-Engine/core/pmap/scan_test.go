@@ -0,0 +1,141 @@
+package pmap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Returns a PMap with n keys under each prefix
+func testPrefixed(t *testing.T, n int, prefixes ...string) *PMap {
+	c := New("", 16*1024*1024)
+	for i := 0; i < n; i++ {
+		for _, p := range prefixes {
+			key := []byte(fmt.Sprint(p, i))
+			if err := c.Set(c.Hash(key), key, testValue(10, fmt.Sprint("value", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return c
+}
+
+func TestDeleteRange(t *testing.T) {
+	c := testPrefixed(t, 100, "tenant1/", "tenant2/", "tenant10/")
+	defer c.Close()
+	//A newer pair survives
+	key := []byte("tenant1/0")
+	c.Set(c.Hash(key), key, testValue(30, "newer"))
+	checksum := c.checksum.total()
+	deleted := c.Deleted()
+
+	n, err := c.DeleteRange([]byte("tenant1/"), time.Unix(0, 20))
+	if err != nil || n != 99 {
+		t.Fatal("DeleteRange deleted", n, "keys", err)
+	}
+	pairs := testPairs(c)
+	if len(pairs) != 201 || c.Len() != 201 || pairs["tenant1/0"] != string(testValue(30, "newer")) {
+		t.Fatal("wrong remaining pairs", len(pairs), c.Len())
+	}
+	for k := range pairs {
+		if strings.HasPrefix(k, "tenant1/") && k != "tenant1/0" {
+			t.Fatal("key not deleted", k)
+		}
+	}
+	if c.Deleted() <= deleted || c.checksum.total() == checksum {
+		t.Fatal("deleted bytes and checksum were not updated")
+	}
+	for i := 1; i < 100; i++ {
+		key := []byte(fmt.Sprint("tenant1/", i))
+		checksum -= c.Hash(key) ^ 10
+	}
+	if c.checksum.total() != checksum {
+		t.Fatal("wrong checksum")
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	c := testPrefixed(t, 100, "user/", "users/", "group/")
+	defer c.Close()
+	key := []byte("user/7")
+	c.Del(c.Hash(key), key, testValue(20, ""))
+	found := make(map[string]string)
+	err := c.ScanPrefix([]byte("user/"), func(key, value []byte) bool {
+		found[string(key)] = string(value[8:])
+		return true
+	})
+	if err != nil || len(found) != 99 {
+		t.Fatal("ScanPrefix found", len(found), "pairs", err)
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := found[fmt.Sprint("user/", i)]; ok != (i != 7) || (ok && v != fmt.Sprint("value", i)) {
+			t.Fatal("wrong pair", i, v, ok)
+		}
+	}
+	n := 0
+	c.ScanPrefix([]byte("group/"), func(key, value []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatal("ScanPrefix didn't stop early", n)
+	}
+}
+
+func TestScanFrom(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	key := []byte("key7")
+	c.Del(c.Hash(key), key, testValue(2, ""))
+	expected := testPairs(c)
+
+	got := make(map[string]string)
+	cursor, pages := uint64(0), 0
+	for {
+		n := 0
+		next, err := c.ScanFrom(cursor, 100, func(key, value []byte) bool {
+			if _, ok := got[string(key)]; ok {
+				t.Fatal("pair visited twice", string(key))
+			}
+			got[string(key)] = string(value)
+			n++
+			return true
+		})
+		if err != nil || n > 100 {
+			t.Fatal("ScanFrom visited", n, "pairs", err)
+		}
+		pages++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if pages != 10 || len(got) != len(expected) {
+		t.Fatal("ScanFrom found", len(got), "pairs in", pages, "pages, expected", len(expected))
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Fatal("wrong pair", k)
+		}
+	}
+
+	//Early stop: the cursor points after the last visited pair
+	var last string
+	next, _ := c.ScanFrom(0, 100, func(key, value []byte) bool {
+		last = string(key)
+		return false
+	})
+	c.ScanFrom(next, 1, func(key, value []byte) bool {
+		if string(key) == last {
+			t.Fatal("the stopped pair was visited again")
+		}
+		return true
+	})
+	if _, err := c.ScanFrom(0, 0, func(key, value []byte) bool { return true }); err == nil {
+		t.Fatal("zero limit accepted")
+	}
+	if _, err := c.ScanFrom(uint64(c.Used()+1), 1, func(key, value []byte) bool { return true }); err == nil {
+		t.Fatal("cursor beyond the end of the store accepted")
+	}
+}
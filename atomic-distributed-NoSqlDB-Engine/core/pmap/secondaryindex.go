@@ -0,0 +1,49 @@
+package pmap
+
+import "time"
+
+/*
+	A SecondaryIndex is a secondary index maintained by the caller, over a PMap of its own: it maps field values,
+	extracted by the application from its records, to the list of primary keys of the records that have them.
+	The index pairs have the field values as keys and the structure of the automatic index values, they are
+	updated by the automatic index code (see index.go).
+
+	Unlike Options.Index nothing is automatic: the caller adds the entry of a record when it sets it, and removes
+	the entry of the previous field value when it changes the field or deletes the record, otherwise lookups
+	return stale primary keys. In exchange the index can be file-backed, it persists without rebuilds on Open,
+	and one PMap can have several indexes.
+
+	Add and Remove rewrite the whole list of the field value, they cost O(primary keys sharing the value) and
+	append a pair to the index store every time: enable auto-compaction on the index PMap (see
+	SetCompactionThreshold) or compact it. The timestamp of each index pair is the newest of the timestamps
+	provided to Add and Remove, incremented when needed so that every update wins over the stored list.
+*/
+
+//A SecondaryIndex maps field values to primary keys, see secondaryindex.go
+//Like PMap it is *not* thread-safe
+type SecondaryIndex struct {
+	index secondaryIndex
+}
+
+//NewSecondaryIndex returns a SecondaryIndex stored in pm, which must only be written through the index.
+//pm is owned by the caller, it can be opened again to reopen the index
+func NewSecondaryIndex(pm *PMap) *SecondaryIndex {
+	return &SecondaryIndex{index: secondaryIndex{pm: pm}}
+}
+
+//Add adds primaryKey to the primary keys of fieldValue, it does nothing if it is already there.
+//A nil fieldValue is not indexed, like a nil index key of an IndexFunc
+func (idx *SecondaryIndex) Add(primaryKey, fieldValue []byte, ts time.Time) error {
+	return idx.index.add(fieldValue, primaryKey, uint64(ts.UnixNano()))
+}
+
+//Remove removes primaryKey from the primary keys of fieldValue, it does nothing if it is not there.
+//The index pair of fieldValue is deleted with its last primary key
+func (idx *SecondaryIndex) Remove(primaryKey, fieldValue []byte, ts time.Time) error {
+	return idx.index.remove(fieldValue, primaryKey, uint64(ts.UnixNano()))
+}
+
+//Lookup returns the primary keys of fieldValue, in the order they were added. It returns nil if there is none
+func (idx *SecondaryIndex) Lookup(fieldValue []byte) ([][]byte, error) {
+	return idx.index.lookup(fieldValue)
+}
@@ -0,0 +1,35 @@
+package pmap
+
+import "encoding/binary"
+
+/*
+	Timestamp modes
+
+	Wall-clock mode (default): the 8 byte header of each value is a time, nanoseconds elapsed since Unix time.
+	Last-write-wins depends on synchronized clocks: a writer whose clock goes back in time sees its writes
+	discarded until the clock catches up with the stored timestamps.
+	Checksum only includes pairs older than a time window, so replicas can compare checksums while they
+	receive recent writes.
+
+	Sequence mode (Options.SequenceNumbers): the header is a logical sequence number, it must be monotonically
+	increasing for each key. It is provided by the caller or obtained from NextSequence, conflicts are
+	resolved exactly like in wall-clock mode (the higher number wins) but they don't depend on any clock.
+	Sequence numbers are compared as signed integers, they must be lower than 2^63.
+	Checksum includes every pair, there are no time windows.
+*/
+
+//Records a value header, keeping the highest sequence number seen
+func (c *PMap) observe(header []byte) {
+	if s := binary.LittleEndian.Uint64(header); s > c.maxSequence {
+		c.maxSequence = s
+	}
+}
+
+//NextSequence returns a sequence number greater than any one seen by the PMap: every Set, Del and CAS
+//header and every stored pair (the maximum is restored on Open). It is meant for Options.SequenceNumbers,
+//writes using it win over every previous one regardless of the system clock.
+//Each call returns a new sequence number.
+func (c *PMap) NextSequence() uint64 {
+	c.maxSequence++
+	return c.maxSequence
+}
@@ -0,0 +1,79 @@
+package pmap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+func TestSequenceNumbersLastWriteWins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{SequenceNumbers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("k")
+	h := hashing.FNV1a64(key)
+	get := func() string {
+		v, _ := c.Get(uint32(h), key)
+		if v == nil {
+			return ""
+		}
+		return string(v[8:])
+	}
+	c.Set(h, key, testValue(5, "five"))
+	c.Set(h, key, testValue(3, "three"))
+	if get() != "five" {
+		t.Fatal("older sequence number won:", get())
+	}
+	c.Del(h, key, testValue(4, ""))
+	if get() != "five" {
+		t.Fatal("older delete won")
+	}
+	c.Set(h, key, testValue(c.NextSequence(), "next"))
+	if get() != "next" {
+		t.Fatal("NextSequence lost:", get())
+	}
+	seq := c.NextSequence()
+	c.Close()
+
+	//The maximum is restored on Open
+	c, err = OpenWithOptions(path, Options{SequenceNumbers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if next := c.NextSequence(); next < seq {
+		t.Fatal("NextSequence went back from", seq, "to", next)
+	}
+	if c.Checksum() != c.checksum.total() {
+		t.Fatal("Checksum is windowed in sequence mode")
+	}
+}
+
+func TestSequenceNumbersClockRegression(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	for _, sequence := range []bool{false, true} {
+		c, err := NewWithOptions("", 1024*1024, Options{SequenceNumbers: sequence, Clock: clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewTypedMap(c, typedTestCodec)
+		m.Set("user", typedTestUser{Name: "first"})
+		//Another TypedMap writing with a clock that went back in time
+		clock.advance(-time.Hour)
+		other := NewTypedMap(c, typedTestCodec)
+		other.Set("user", typedTestUser{Name: "second"})
+		u, _, _ := m.Get("user")
+		if sequence && u.Name != "second" {
+			t.Fatal("clock regression lost a write with sequence numbers:", u.Name)
+		}
+		if !sequence && u.Name != "first" {
+			t.Fatal("wall-clock mode accepted a write from the past:", u.Name)
+		}
+		clock.advance(time.Hour)
+		c.Close()
+	}
+}
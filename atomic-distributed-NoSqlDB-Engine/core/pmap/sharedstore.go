@@ -0,0 +1,171 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+/*
+	Shared stores
+
+	Several PMaps (indexes) can be composed over one store: each index has its own RAM hashmap, checksum and
+	options, and appends its pairs to the shared store. Shared indexes deduplicate values with a blob table
+	shared by every index of the store (see dedup.go): a value body written through several indexes, like
+	a record indexed by its primary key and by a secondary key, is stored once and referenced by each of them.
+
+	Indexes are numbered in the order NewIndex creates them. The records of an index are preceded by an owner
+	mark when the previous record was written by another index: a blob record (see dedup.go) whose 8 byte value
+	is the index number, deduplicated bodies are longer than dedupMinBody and blobs are never 8 bytes long.
+	OpenStore reads an existing store and its blobs, and each NewIndex restores the pairs written by the index
+	with its number: the indexes must be created in the same order every time the store is opened.
+	Open doesn't read shared stores, the keyspaces of their indexes would be mixed: it fails with
+	errSharedStoreFile.
+	Shared indexes don't compact (the store indexes of the other indexes would be invalidated), Compact and
+	Clear fail with errSharedStore. Blobs are never freed, the other indexes may not be restored yet.
+
+	The store is reference counted: OpenStore and each NewIndex hold a reference, released by Store.Close and
+	PMap.Close. The last release syncs the store and unmaps it.
+*/
+
+var (
+	errSharedStore     = errors.New("Error: the store is shared by several indexes")
+	errSharedStoreFile = errors.New("Error: the store is shared by several indexes, open it with OpenStore")
+)
+
+const (
+	ownerMarkSize = 8  //Value length of the owner marks
+	noOwner       = -1 //Owner of a store whose last record is unknown
+)
+
+//A Store is a store shared by several PMap indexes, see NewIndex
+//Like PMap, Store and its indexes are *not* thread-safe
+type Store struct {
+	st      *store
+	dedup   dedupStore //Blob table shared by the indexes
+	refs    int        //OpenStore reference plus one per open index
+	closed  bool       //Set by Close, the OpenStore reference was released
+	indexes int        //Number of indexes created, the number of the next one
+	owner   int        //Number of the index that wrote the last record, see markOwner
+}
+
+//OpenStore returns the store located at path, or a new one with an initial size like New if there is no file,
+//it grows when it is full. The pairs of an existing store are restored by NewIndex, see sharedstore.go.
+//Set path to "" to use an anonymous store, size is its maximum size.
+//It panics if the existing store can't be read
+func OpenStore(path string, size uint64) *Store {
+	s := &Store{
+		dedup: dedupStore{blobs: make(map[uint64]uint64), refs: make(map[uint64]int)},
+		refs:  1,
+		owner: noOwner,
+	}
+	if _, err := os.Stat(path); path == "" || os.IsNotExist(err) {
+		s.st = newStore(path, size, FilePerms)
+	} else {
+		st, err := openStore(path, false, false)
+		if err != nil {
+			panic(err)
+		}
+		s.st = st
+		if err := s.restore(); err != nil {
+			st.close()
+			panic(err)
+		}
+	}
+	s.st.grow = path != ""
+	return s
+}
+
+//Finds the end of an existing store and registers its blobs, the pairs are restored by each NewIndex
+func (s *Store) restore() error {
+	st := s.st
+	for index := st.first; index < st.size; {
+		if !st.isRecord(index, st.size) {
+			break
+		}
+		if err := st.checkRecord(index, st.size); err != nil {
+			return err
+		}
+		if st.isBlob(index) && !st.isOwnerMark(index) {
+			s.dedup.blobs[hashing.FNV1a64(st.val(index))] = index
+		}
+		index += st.recordSize(index)
+		st.length = index
+	}
+	return nil
+}
+
+func (st *store) isOwnerMark(index uint64) bool {
+	return st.isBlob(index) && st.valLen(index) == ownerMarkSize
+}
+
+//Writes an owner mark before a record of c if the last record of its shared store was written by another index
+func (c *PMap) markOwner() error {
+	if c.shared == nil || c.shared.owner == c.indexID {
+		return nil
+	}
+	mark := make([]byte, ownerMarkSize)
+	binary.LittleEndian.PutUint64(mark, uint64(c.indexID))
+	index, err := c.st.put(nil, mark)
+	if err != nil {
+		return err
+	}
+	c.st.setKeyLen(index, blobFlag)
+	c.shared.owner = c.indexID
+	return nil
+}
+
+//NewIndex returns a PMap that stores its pairs in s, with its own hashmap. The pairs the index with its number
+//wrote to an existing store are restored (see sharedstore.go), it panics if they can't be.
+//It holds a reference to s until it is closed
+func NewIndex(s *Store) *PMap {
+	if s.refs <= 0 {
+		panic("Already closed")
+	}
+	c := newPMap(s.st.path, Options{})
+	c.st = s.st
+	c.shared = s
+	c.indexID = s.indexes
+	//The maps are shared, see addBlob
+	c.dedup = s.dedup
+	c.dedupValues = true
+	c.compactionThreshold = -1
+	c.checksum.SetInterval(defaultCheckSumInterval)
+	if s.st.length > s.st.first {
+		if err := c.restore(s.st.length); err != nil {
+			panic(err)
+		}
+	}
+	s.indexes++
+	s.refs++
+	return c
+}
+
+//Used returns the number of bytes used by the pairs of every index
+func (s *Store) Used() int {
+	return int(s.st.length)
+}
+
+//Close releases the OpenStore reference, the store is unmapped when its indexes are closed too.
+//Calling it again does nothing
+func (s *Store) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.release()
+}
+
+//Releases a reference, the last one syncs the store and unmaps it
+func (s *Store) release() {
+	if s.refs <= 0 {
+		panic("Already closed")
+	}
+	s.refs--
+	if s.refs == 0 {
+		s.st.sync(s.st.length)
+		s.st.close()
+	}
+}
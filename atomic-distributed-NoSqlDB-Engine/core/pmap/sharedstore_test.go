@@ -0,0 +1,108 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	s := OpenStore(path, 1024*1024)
+	byID, byEmail := NewIndex(s), NewIndex(s)
+	for i := 0; i < 100; i++ {
+		value := testValue(10, fmt.Sprint("a long user record ", i))
+		id, email := []byte(fmt.Sprint("id", i)), []byte(fmt.Sprint("user", i, "@example.com"))
+		if err := byID.Set(byID.Hash(id), id, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := byEmail.Set(byEmail.Hash(email), email, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if byID.Len() != 100 || byEmail.Len() != 100 || len(testPairs(byID)) != 100 {
+		t.Fatal("wrong index lengths", byID.Len(), byEmail.Len())
+	}
+	if v, _ := byID.Get(uint32(byID.Hash([]byte("user1@example.com"))), []byte("user1@example.com")); v != nil {
+		t.Fatal("key found in another index")
+	}
+	email := []byte("user1@example.com")
+	if v, _ := byEmail.Get(uint32(byEmail.Hash(email)), email); string(v) != string(testValue(10, "a long user record 1")) {
+		t.Fatal("wrong value", v)
+	}
+	//Each value body is stored once
+	if n := len(s.dedup.blobs); n != 100 {
+		t.Fatal("wrong number of blobs", n)
+	}
+	//Deleting the pair from one index keeps the blob of the other
+	id := []byte("id1")
+	byID.Del(byID.Hash(id), id, testValue(20, ""))
+	if v, _ := byEmail.Get(uint32(byEmail.Hash(email)), email); string(v) != string(testValue(10, "a long user record 1")) {
+		t.Fatal("shared value freed", v)
+	}
+	if byID.Compact() != errSharedStore || byID.Clear() != errSharedStore {
+		t.Fatal("shared indexes must not compact")
+	}
+
+	//The store is unmapped by the last release
+	byID.Close()
+	s.Close()
+	if s.st.file == nil {
+		t.Fatal("store unmapped with an open index")
+	}
+	byEmail.Close()
+	if s.st.file != nil {
+		t.Fatal("store not unmapped")
+	}
+	//Open would mix the keyspaces of the indexes
+	if _, err := Open(path); err != errSharedStoreFile {
+		t.Fatal("Open read a shared store", err)
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	s := OpenStore(path, 1024*1024)
+	byID, byEmail := NewIndex(s), NewIndex(s)
+	for i := 0; i < 100; i++ {
+		value := testValue(10, fmt.Sprint("a long user record ", i))
+		id, email := []byte(fmt.Sprint("id", i)), []byte(fmt.Sprint("user", i, "@example.com"))
+		if err := byID.Set(byID.Hash(id), id, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := byEmail.Set(byEmail.Hash(email), email, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := []byte("id1")
+	byID.Del(byID.Hash(id), id, testValue(20, ""))
+	ids, emails := testPairs(byID), testPairs(byEmail)
+	byID.Close()
+	byEmail.Close()
+	s.Close()
+
+	//Each index restores its own pairs, the blobs are still shared
+	s = OpenStore(path, 1024*1024)
+	defer s.Close()
+	byID, byEmail = NewIndex(s), NewIndex(s)
+	defer byID.Close()
+	defer byEmail.Close()
+	if fmt.Sprint(testPairs(byID)) != fmt.Sprint(ids) || fmt.Sprint(testPairs(byEmail)) != fmt.Sprint(emails) {
+		t.Fatal("wrong restored pairs", byID.Len(), byEmail.Len())
+	}
+	if byID.Len() != 99 || byEmail.Len() != 100 {
+		t.Fatal("wrong index lengths", byID.Len(), byEmail.Len())
+	}
+	used := s.Used()
+	email := []byte("user100@example.com")
+	if err := byEmail.Set(byEmail.Hash(email), email, testValue(10, "a long user record 50")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := byEmail.Get(uint32(byEmail.Hash(email)), email); string(v) != string(testValue(10, "a long user record 50")) {
+		t.Fatal("wrong value", v)
+	}
+	//The body is deduplicated with the restored blob: an owner mark and a reference
+	if n := len(s.dedup.blobs); n != 100 || s.Used() >= used+100 {
+		t.Fatal("the restored blob was not reused", n, s.Used()-used)
+	}
+}
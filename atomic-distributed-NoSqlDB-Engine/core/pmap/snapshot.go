@@ -0,0 +1,173 @@
+package pmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+/*
+	A snapshot is a compacted copy of the live pairs of a PMap, it doesn't include deleted nor overwritten pairs.
+
+Binary structure of a snapshot
+
+	8 bytes: snapshotMagic
+	8 bytes: number of pairs
+	8 bytes: checksum of the pairs, the sum of hash ^ timestamp like the PMap checksum
+	Each pair is represented this way:
+		4 bytes: key len
+		4 bytes: value len
+		Key len bytes: key
+		Value len bytes: value (timestamp header included)
+
+	The checksum uses the hashes of the snapshot PMap Hasher, snapshots must be restored with the same one.
+
+	Incremental snapshots (SnapshotSince) only hold the live pairs whose timestamp is newer than a time,
+	ApplySnapshot applies them over an existing PMap with last-write-wins, so applying them is idempotent and
+	applying them out of order converges to the same pairs.
+	Timestamps are assigned by writers, not by the PMap: a writer whose clock is skewed behind can write a pair
+	with a timestamp older than since after the previous incremental snapshot was taken, and that pair is
+	missed by every following incremental snapshot. Last-write-wins doesn't lose newer pairs because of it,
+	but replicas stay diverged until a full snapshot is applied. Taking since with a margin larger than the
+	maximum clock skew (and the Checksum interval), and falling back to a full snapshot when the time-stable
+	checksums differ, makes replicas converge.
+	Deletions are not included: deleted keys are absent from snapshots.
+*/
+
+const snapshotMagic = 0x746f6e5370614d50 //"PMapSnot"
+
+const snapshotHeaderSize = 24
+
+var errSnapshotCorrupted = errors.New("Snapshot corrupted")
+
+//Snapshot writes to w a snapshot of every live pair, see Restore.
+//The PMap must not be modified until it returns
+func (c *PMap) Snapshot(w io.Writer) error {
+	return c.writeSnapshot(w, uint64(c.hm.numStoredKeys), c.checksum.total(), func(index uint64) bool { return true })
+}
+
+//SnapshotSince writes to w an incremental snapshot of the live pairs whose timestamp is newer than since,
+//see ApplySnapshot. The PMap must not be modified until it returns
+func (c *PMap) SnapshotSince(w io.Writer, since time.Time) error {
+	newer := func(index uint64) bool {
+		return int64(binary.LittleEndian.Uint64(c.st.val(index))) > since.UnixNano()
+	}
+	count, checksum := uint64(0), uint64(0)
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if c.isPresent(index) && newer(index) {
+			count++
+			checksum += c.hasher.Hash64(c.st.key(index)) ^ binary.LittleEndian.Uint64(c.st.val(index))
+		}
+	}
+	return c.writeSnapshot(w, count, checksum, newer)
+}
+
+//Writes a snapshot of the live pairs accepted by include, count and checksum must be the ones of those pairs
+func (c *PMap) writeSnapshot(w io.Writer, count, checksum uint64, include func(index uint64) bool) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, snapshotHeaderSize)
+	binary.LittleEndian.PutUint64(header, snapshotMagic)
+	binary.LittleEndian.PutUint64(header[8:], count)
+	binary.LittleEndian.PutUint64(header[16:], checksum)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	var value []byte
+	lens := make([]byte, 8)
+	for index := c.st.first; index < c.st.length; index += c.st.recordSize(index) {
+		if !c.isPresent(index) || !include(index) {
+			continue
+		}
+		key := c.st.key(index)
+		var err error
+		if value, err = c.appendValue(value[:0], index); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(lens, uint32(len(key)))
+		binary.LittleEndian.PutUint32(lens[4:], uint32(len(value)))
+		bw.Write(lens)
+		bw.Write(key)
+		if _, err := bw.Write(value); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+//Restore returns a new PMap stored in path with a maximum store size, like New, holding the pairs
+//of a snapshot written by Snapshot. It returns an error, and deletes the new PMap, if the snapshot is corrupted
+//or if the restored checksum doesn't match the snapshot one
+func Restore(path string, size uint64, r io.Reader) (*PMap, error) {
+	c, err := NewWithOptions(path, size, Options{})
+	if err != nil {
+		return nil, err
+	}
+	count, checksum, err := c.readSnapshot(r)
+	if err == nil && (uint64(c.hm.numStoredKeys) != count || c.checksum.total() != checksum) {
+		err = errors.New("Snapshot checksum mismatch")
+	}
+	if err != nil {
+		c.CloseAndDelete()
+		return nil, err
+	}
+	return c, nil
+}
+
+//ApplySnapshot sets the pairs of a snapshot written by Snapshot or SnapshotSince, with the usual
+//last-write-wins semantics, and returns the number of pairs of the snapshot.
+//It returns an error if the snapshot is corrupted, the pairs read before the error remain applied
+func (c *PMap) ApplySnapshot(r io.Reader) (int, error) {
+	count, _, err := c.readSnapshot(r)
+	return int(count), err
+}
+
+//Reads a snapshot setting its pairs, it returns the number of pairs and the checksum of the snapshot header
+//The read pairs are checked against them
+func (c *PMap) readSnapshot(r io.Reader) (count, checksum uint64, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint64(header) != snapshotMagic {
+		return 0, 0, errSnapshotCorrupted
+	}
+	count = binary.LittleEndian.Uint64(header[8:])
+	checksum = binary.LittleEndian.Uint64(header[16:])
+	sum := uint64(0)
+	lens := make([]byte, 8)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, lens); err != nil {
+			return 0, 0, unexpectedEOF(err)
+		}
+		keyLen := binary.LittleEndian.Uint32(lens)
+		valLen := binary.LittleEndian.Uint32(lens[4:])
+		if keyLen >= blobFlag || valLen >= refFlag || valLen < 8 {
+			return 0, 0, errSnapshotCorrupted
+		}
+		pair := make([]byte, keyLen+valLen)
+		if _, err := io.ReadFull(br, pair); err != nil {
+			return 0, 0, unexpectedEOF(err)
+		}
+		key, value := pair[:keyLen], pair[keyLen:]
+		h64 := c.hasher.Hash64(key)
+		sum += h64 ^ binary.LittleEndian.Uint64(value)
+		if err := c.Set(h64, key, value); err != nil {
+			return 0, 0, err
+		}
+	}
+	if sum != checksum {
+		return 0, 0, errSnapshotCorrupted
+	}
+	return count, checksum, nil
+}
+
+//Returns io.ErrUnexpectedEOF instead of io.EOF, a truncated stream is not a clean end
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package pmap
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c := testFilled(t, 1000)
+	defer c.Close()
+	key := []byte("key7")
+	c.Del(c.Hash(key), key, testValue(2, ""))
+	key = []byte("key8")
+	c.Set(c.Hash(key), key, testValue(3, "overwritten"))
+	expected := testPairs(c)
+
+	var buf bytes.Buffer
+	if err := c.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	path := filepath.Join(t.TempDir(), "restored")
+	r, err := Restore(path, 1024*1024, bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pairs := testPairs(r)
+	if len(pairs) != len(expected) || r.Len() != 999 || r.Deleted() != 0 || r.checksum.total() != c.checksum.total() {
+		t.Fatal("wrong restored PMap", len(pairs), r.Len(), r.Deleted())
+	}
+	for k, v := range expected {
+		if pairs[k] != v {
+			t.Fatal("wrong restored pair", k)
+		}
+	}
+
+	//Corrupted key, truncated snapshot and wrong magic
+	corrupted := append([]byte(nil), snapshot...)
+	corrupted[snapshotHeaderSize+8] ^= 1
+	for name, s := range map[string][]byte{"corrupted": corrupted, "truncated": snapshot[:len(snapshot)-1], "magic": snapshot[1:]} {
+		path := filepath.Join(t.TempDir(), name)
+		if _, err := Restore(path, 1024*1024, bytes.NewReader(s)); err == nil {
+			t.Fatal(name, "snapshot restored")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatal(name, "snapshot PMap was not deleted")
+		}
+	}
+}
+
+func TestSnapshotSince(t *testing.T) {
+	c := testFilled(t, 100)
+	defer c.Close()
+	replica := testFilled(t, 100)
+	defer replica.Close()
+	//Newer pairs, a stale pair, and a pair that is newer on the replica
+	for i, k := range []string{"key1", "key2", "new"} {
+		key := []byte(k)
+		c.Set(c.Hash(key), key, testValue(10+uint64(i), "updated"))
+	}
+	key := []byte("key3")
+	replica.Set(replica.Hash(key), key, testValue(20, "replica"))
+	c.Set(c.Hash(key), key, testValue(15, "primary"))
+
+	var buf bytes.Buffer
+	if err := c.SnapshotSince(&buf, time.Unix(0, 5)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := replica.ApplySnapshot(&buf)
+	if err != nil || n != 4 {
+		t.Fatal("ApplySnapshot applied", n, "pairs", err)
+	}
+	pairs := testPairs(replica)
+	if len(pairs) != 101 || pairs["new"] != string(testValue(12, "updated")) || pairs["key1"] != string(testValue(10, "updated")) ||
+		pairs["key3"] != string(testValue(20, "replica")) || pairs["key4"] != string(testValue(1, "value4")) {
+		t.Fatal("wrong merged pairs", len(pairs))
+	}
+}
@@ -0,0 +1,75 @@
+package pmap
+
+import "bytes"
+
+//Stats holds the occupancy and the hashmap probing metrics of a PMap, see PMap.Stats
+type Stats struct {
+	LiveKeys       int     //Number of live keys, like Len
+	Tombstones     int     //Number of deleted hashmap buckets, they lengthen the probe chains until they are reused
+	DeletedBytes   int     //Store bytes used by deleted and overwritten pairs, like Deleted
+	UsedBytes      int     //Store bytes used, like Used
+	StoreSize      int     //Maximum store size, like Size
+	HashMapSize    int     //Number of hashmap buckets
+	AvgProbeLength float64 //Average number of buckets probed to find a live key
+	MaxProbeLength int     //Maximum number of buckets probed to find a live key
+	HashCollisions uint64  //Different keys with the same 32-bit hash found by Set and Open since the PMap was opened
+}
+
+//Stats returns the current Stats of the PMap.
+//The probe lengths are computed by walking the hashmap once, it costs O(HashMapSize)
+func (c *PMap) Stats() Stats {
+	s := Stats{
+		LiveKeys:       int(c.hm.numStoredKeys),
+		Tombstones:     int(c.hm.numDeletedKeys),
+		DeletedBytes:   int(c.st.deleted),
+		UsedBytes:      int(c.st.length),
+		StoreSize:      int(c.st.size),
+		HashMapSize:    int(c.hm.size),
+		HashCollisions: c.collisions,
+	}
+	total := 0
+	for i := uint32(0); i < c.hm.size; i++ {
+		h := c.hm.getHash(i)
+		if h <= deletedBucket {
+			continue
+		}
+		//Displacement from the ideal bucket, the probe visits it too
+		probe := int(c.hm.probeDistance(i, h)) + 1
+		total += probe
+		if probe > s.MaxProbeLength {
+			s.MaxProbeLength = probe
+		}
+	}
+	if s.LiveKeys > 0 {
+		s.AvgProbeLength = float64(total) / float64(s.LiveKeys)
+	}
+	return s
+}
+
+//ProbeLength returns the number of buckets examined by Get to find the key, like the probe lengths of Stats,
+//and whether it was found. For absent keys it is the number of buckets examined to find that the key is missing,
+//0 if the bloom filter (see Options.BloomKeys) rejected it. Expired pairs are absent, like in Get
+func (c *PMap) ProbeLength(h32 uint32, key []byte) (int, bool) {
+	if c.bloom != nil && !c.bloom.mayContain(h32) {
+		return 0, false
+	}
+	h := hashReMap(h32)
+	index := h & c.hm.sizeMask
+	start := index
+	for probes := 1; ; probes++ {
+		storedHash := c.hm.getHash(index)
+		if storedHash == emptyBucket {
+			return probes, false
+		} else if h == storedHash {
+			stIndex := c.hm.getStoreIndex(index)
+			if bytes.Equal(c.st.key(stIndex), key) {
+				return probes, !c.expired(stIndex)
+			}
+		}
+		index = (index + 1) & c.hm.sizeMask
+		if index == start {
+			//Every bucket was probed
+			return probes, false
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"launchpad.net/gommap"
 )
@@ -15,7 +17,11 @@ import (
 	It manages additions and deletions, but it is indexed by store ids.
 	An additional data structure is needed to perform fast key-value look-ups.
 
-	deleted pairs are never freed.
+	deleted pairs are never freed, unless space reuse is enabled (see freelist.go).
+
+	File-backed stores grow when they are full (unless Options.NoAutoGrow is set): the file size is doubled and
+	the file is mapped again. Slices of the old mapping are invalid after it, the PMap never returns them
+	(Get, Iterate... return copies) and it must not hold them across a put.
 */
 
 /*
@@ -24,21 +30,55 @@ Binary structure of the store
 The store is composed of key-value pairs.
 Each pair is represented this way:
 	4 bytes:
-		1  bit (MSB)	is the pair present?
-		31 bits			key length
-	4 bytes: value len
+		1  bit (MSB)	is the region free? (only used with space reuse)
+		1  bit			is it a deduplicated value blob? (see dedup.go)
+		1  bit			does the pair expire? (see ttl.go) Set on tombstones with a deletion timestamp (see purge.go)
+		1  bit			is the value body compressed? (see compress.go)
+		1  bit			is the value body encrypted? (see encryption.go)
+		27 bits			key length
+	4 bytes:
+		1  bit (MSB)	does the value reference a blob? (see dedup.go)
+		31 bits			value length
 	Key len   bytes: key
 	Value len bytes: value
-Metadata is not saved on the memory-mapped file.
+	8  bytes: expiry (only in expiring pairs, see ttl.go), or deletion timestamp (only in timestamped tombstones)
+	4  bytes: CRC32C of key, value and expiry (only in stores with record checksums, see crc.go)
+	4  bytes: key len + value len (+ 8 in expiring pairs)
+Metadata is not saved on the memory-mapped file, except for the store header and the footer.
+
+Stores with record checksums start with a store header (storeHeaderSize bytes) that holds the format version,
+pairs are placed after it. Legacy stores have no header, their first pair is placed at index 0 (see crc.go).
+
+The last footerSize bytes of the file are reserved to the footer, written on a clean close:
+	8 bytes: footerMagic
+	8 bytes: length
+	8 bytes: deleted
+	8 bytes: checksum of every pair
+Stores written before the footer existed may have records in the footer area, up to the end of the file.
+Open finds them when there is no valid footer, those stores are footerless: the records can use the whole
+file and Close writes no footer until the store grows or it is cleared.
 */
 
 //store stores a list of pairs, in an *unordered* way
 type store struct {
-	deleted uint64      //deleted number of bytes
-	length  uint64      //Total length, index of new items
-	size    uint64      //Allocated size, it remains constant, the store cannot expand itself
-	osFile  *os.File    //OS mapped file located at Path
-	file    gommap.MMap //Memory mapped file located at Path
+	deleted    uint64      //deleted number of bytes
+	tombstones uint64      //Number of tombstone records, see PMap.RecordCounts
+	clears     uint64      //Number of clear calls, cursors are invalidated by them
+	length     uint64      //Total length, index of new items
+	size       uint64      //Allocated size, it only changes when the store grows
+	osFile     *os.File    //OS mapped file located at Path
+	file       gommap.MMap //Memory mapped file located at Path
+	path       string      //File path, "" for anonymous stores
+	reuse      bool        //Reuse the regions of overwritten and deleted pairs
+	free       freeList    //Free regions, only used with reuse
+	crc        bool        //Records have a CRC32C, see crc.go
+	first      uint64      //Index of the first pair, after the store header
+	grow       bool        //Grow the store when it is full, only for file-backed stores
+	readOnly   bool        //The file is mapped read-only, see OpenReadOnly
+	perm       os.FileMode //Permission bits of the file
+	populate   bool        //Map the file with MAP_POPULATE, see Options.Populate
+	footerless bool        //The records reach the footer area, there is no room for a footer
+	mapMutex   sync.Mutex  //Held while the file is remapped, the periodic sync uses the mapping concurrently
 }
 
 const (
@@ -52,65 +92,110 @@ const (
 var mmapAdviseFlags = gommap.MADV_RANDOM
 
 //Creates a new Store, set path to "" to create an anonymous memory-mapped region (not FS backed)
-func newStore(path string, size uint64) *store {
+//The file is created with the permission bits perm, like the missing directories of path (see dirPerms)
+func newStore(path string, size uint64, perm os.FileMode) *store {
+	st, err := createStore(path, size, perm)
+	if err != nil {
+		panic(err)
+	}
+	return st
+}
+
+//Creates a new Store like newStore, returning an error instead of panicking
+func createStore(path string, size uint64, perm os.FileMode) (*store, error) {
 	var err error
 	st := new(store)
 	st.size = size
+	st.path = path
+	st.perm = perm
 	if path != "" {
-		st.osFile, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FilePerms)
+		if err := os.MkdirAll(filepath.Dir(path), dirPerms(perm)); err != nil {
+			return nil, err
+		}
+		st.osFile, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
 		if err != nil {
 			w, _ := os.Getwd()
 			fmt.Println(w)
-			panic(err)
+			return nil, err
 		}
 		err = st.osFile.Truncate(int64(st.size))
 		if err != nil {
-			panic(err)
+			st.osFile.Close()
+			return nil, err
 		}
 		st.file, err = gommap.Map(st.osFile.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
 		if err != nil {
-			panic(err)
+			st.osFile.Close()
+			return nil, err
 		}
 	} else {
 		st.file, err = gommap.MapRegion(0, 0, int64(st.size), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED|gommap.MAP_ANONYMOUS)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 	st.file.Advise(mmapAdviseFlags)
-	if err != nil {
-		panic(err)
+	return st, nil
+}
+
+//Returns the flags of the file mappings
+func (st *store) mapFlags() gommap.MapFlags {
+	if st.populate {
+		return gommap.MAP_SHARED | gommap.MAP_POPULATE
 	}
-	return st
+	return gommap.MAP_SHARED
 }
 
-func openStore(path string) *store {
+//Returns the permission bits of the directories that hold files created with perm:
+//directories are searchable by whoever can read the files
+func dirPerms(perm os.FileMode) os.FileMode {
+	return perm | (perm&0444)>>2
+}
+
+//Opens the store located at path, read-only stores are mapped with PROT_READ and must never be written
+//With populate the whole file is paged in by the mapping (MAP_POPULATE), and again each time the store grows
+func openStore(path string, readOnly, populate bool) (*store, error) {
 	st := new(store)
+	st.path = path
+	st.readOnly = readOnly
+	st.populate = populate
+	flag, prot := os.O_RDWR, gommap.PROT_READ|gommap.PROT_WRITE
+	if readOnly {
+		flag, prot = os.O_RDONLY, gommap.PROT_READ
+	}
 	var err error
-	st.osFile, err = os.OpenFile(path, os.O_RDWR, FilePerms)
+	st.osFile, err = os.OpenFile(path, flag, FilePerms)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	fi, err := st.osFile.Stat()
 	if err != nil {
-		panic("Could not obtain stat")
+		st.osFile.Close()
+		return nil, errors.New("Could not obtain stat")
 	}
 	st.size = uint64(fi.Size())
-	st.file, err = gommap.Map(st.osFile.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	st.perm = fi.Mode().Perm()
+	if st.size < footerSize {
+		st.osFile.Close()
+		return nil, fmt.Errorf("Corrupt store: file size %d is too small", st.size)
+	}
+	st.file, err = gommap.Map(st.osFile.Fd(), prot, st.mapFlags())
 	if err != nil {
-		panic(err)
+		st.osFile.Close()
+		return nil, err
 	}
 	st.file.Advise(mmapAdviseFlags)
-	if err != nil {
-		panic(err)
+	if err := st.readHeader(); err != nil {
+		st.close()
+		return nil, err
 	}
-	return st
+	return st, nil
 }
 
-//Close the store unmmaping the file and syncing to disk
+//Close the store unmmaping the file and syncing to disk, closing a closed store does nothing
 func (st *store) close() {
 	if st.file == nil {
-		panic("Already closed")
+		return
 	}
 	err := st.file.UnsafeUnmap()
 	if err != nil {
@@ -125,13 +210,55 @@ func (st *store) close() {
 	}
 }
 
+//Syncs to disk the first length bytes of the store
+func (st *store) sync(length uint64) error {
+	if st.osFile == nil || st.readOnly || length == 0 {
+		return nil
+	}
+	return st.file[:length].Sync(gommap.MS_SYNC)
+}
+
+//Syncs to disk the whole mapping, footer included. It can be called concurrently with the store writers
+func (st *store) syncMapping() error {
+	if st.osFile == nil || st.readOnly {
+		return nil
+	}
+	st.mapMutex.Lock()
+	defer st.mapMutex.Unlock()
+	return st.file.Sync(gommap.MS_SYNC)
+}
+
+//Empties the store keeping its size and format. File-backed stores are truncated to the store header and
+//extended again, the kernel releases the disk blocks and the mapping reads zeros; anonymous stores are zeroed
+func (st *store) clear() error {
+	if st.osFile != nil {
+		st.mapMutex.Lock()
+		defer st.mapMutex.Unlock()
+		if err := st.osFile.Truncate(int64(st.first)); err != nil {
+			return err
+		}
+		if err := st.osFile.Truncate(int64(st.size)); err != nil {
+			return err
+		}
+	} else {
+		zero(st.file[st.first:])
+	}
+	st.length = st.first
+	st.deleted = 0
+	st.tombstones = 0
+	st.free = nil
+	st.footerless = false
+	st.clears++
+	return nil
+}
+
 //Close the store and delete associated files
 func (st *store) deleteStore() {
 	if st.file != nil {
 		panic("Not closed")
 	}
-	if st.osFile != nil {
-		os.Remove(st.osFile.Name())
+	if st.path != "" {
+		os.Remove(st.path)
 	}
 }
 
@@ -139,12 +266,32 @@ func (st *store) deleteStore() {
 	Store access utility functions
 */
 func (st *store) keyLen(index uint64) uint32 {
-	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:]) &^ (freeFlag | blobFlag | ttlFlag | compressedFlag | encryptedFlag)
+}
+func (st *store) isFree(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&freeFlag != 0
+}
+
+//Returns true if there is a pair or a free region at index, false at the end of the store (limit).
+//The records of footerless stores can end less than a length word before the end of the file
+func (st *store) isRecord(index, limit uint64) bool {
+	return limit-index >= 4 && binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:]) != 0
+}
+
+//Returns the end of the area available to the records, the footer area is reserved unless the store is footerless
+func (st *store) limit() uint64 {
+	if st.footerless {
+		return st.size
+	}
+	return st.size - footerSize
 }
 func (st *store) valLen(index uint64) uint32 {
-	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:])
+	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:]) &^ refFlag
 }
 func (st *store) totalLen(index uint64) uint32 {
+	if st.isExpiring(index) {
+		return st.keyLen(index) + st.valLen(index) + ttlSize
+	}
 	return st.keyLen(index) + st.valLen(index)
 }
 func (st *store) setKeyLen(index uint64, x uint32) {
@@ -154,9 +301,37 @@ func (st *store) setValLen(index uint64, x uint32) {
 	binary.LittleEndian.PutUint32(st.file[index+headerValueOffset:], x)
 }
 
+//Returns an error if the record at index doesn't fit before limit or if its lengths are inconsistent
+func (st *store) checkRecord(index, limit uint64) error {
+	if limit-index < st.overhead() {
+		return fmt.Errorf("Corrupt store record at offset %d: truncated header", index)
+	}
+	if size := st.recordSize(index); size > limit-index {
+		return fmt.Errorf("Corrupt store record at offset %d: record length %d exceeds the store end %d", index, size, limit)
+	}
+	if st.isFree(index) || st.isBlob(index) {
+		return nil
+	}
+	if st.isRef(index) && st.valLen(index) != 16 {
+		return fmt.Errorf("Corrupt store record at offset %d: blob reference of %d bytes", index, st.valLen(index))
+	}
+	if st.isEncrypted(index) && (st.isRef(index) || st.valLen(index) < 8+sealSize) {
+		return fmt.Errorf("Corrupt store record at offset %d: invalid encrypted body", index)
+	}
+	//The codec of encrypted bodies is checked once they are decrypted, see checkEncrypted
+	if st.isCompressed(index) && !st.isEncrypted(index) &&
+		(st.isRef(index) || st.valLen(index) < 9 || Codec(st.val(index)[8]).check() != nil) {
+		return fmt.Errorf("Corrupt store record at offset %d: invalid compressed body", index)
+	}
+	if n := st.valLen(index); n > 0 && n < 8 {
+		return fmt.Errorf("Corrupt store record at offset %d: value of %d bytes has no timestamp", index, n)
+	}
+	return nil
+}
+
 func (st *store) prev(index uint64) int64 {
-	if int64(index)-4 > 0 {
-		return int64(index) - 12 - int64(binary.LittleEndian.Uint32(st.file[index-4:index]))
+	if int64(index)-4 > int64(st.first) {
+		return int64(index) - int64(st.overhead()) - int64(binary.LittleEndian.Uint32(st.file[index-4:index]))
 	}
 	return -1
 }
@@ -167,27 +342,152 @@ func (st *store) key(index uint64) []byte {
 }
 
 //Returns a slice to the selected value
-func (st *store) val(index uint64) []byte { //TODO use uint32 instead of uint64
-	return st.file[index+headerSize+uint64(st.keyLen(index)) : index+headerSize+uint64(st.totalLen(index))]
+func (st *store) val(index uint64) []byte {
+	start := index + headerSize + uint64(st.keyLen(index))
+	return st.file[start : start+uint64(st.valLen(index))]
 }
 
 //Inserts a new pair at the end of the store, it can fail (with a returning error) if the store size limit is reached
-func (st *store) put(key, val []byte) (uint32, error) {
-	size := uint64(4 + 4 + 4 + len(key) + len(val))
+func (st *store) put(key, val []byte) (uint64, error) {
+	return st.putExpiring(key, val, 0)
+}
+
+//Inserts a new pair like put, the pair expires at expiry (nanoseconds since Unix time), 0 means never
+func (st *store) putExpiring(key, val []byte, expiry uint64) (uint64, error) {
+	if len(key) > maxKeySize {
+		return 0, ErrKeyTooLarge
+	}
+	if len(val) > maxValueSize {
+		return 0, ErrValueTooLarge
+	}
+	size := st.overhead() + uint64(len(key)+len(val))
+	if expiry != 0 {
+		size += ttlSize
+	}
 	//Cache-alignment
 	//if size <= 64 && st.length%64 >= 32 && (64-st.length%64) < size {
 	//st.length += 64 - st.length%64
 	//}
-	for st.length+size >= st.size {
-		log.Println("store size limit reached: denied put operation", st.length, st.size, size)
-		return 0, errors.New("store size limit reached: denied put operation")
+	if st.reuse {
+		if index, ok := st.takeFree(size); ok {
+			st.write(index, key, val, expiry)
+			return index, nil
+		}
+	}
+	if err := st.reserve(size); err != nil {
+		return 0, err
 	}
 	index := st.length
 	st.length += size
-	st.setKeyLen(index, uint32(len(key)))
+	st.write(index, key, val, expiry)
+	return index, nil
+}
+
+//Makes room for size bytes at the end of the store, growing it if needed.
+//It returns ErrStoreFull if they don't fit and the store can't grow
+func (st *store) reserve(size uint64) error {
+	if st.length+size < st.limit() {
+		return nil
+	}
+	if !st.grow {
+		log.Println("store size limit reached: denied put operation", st.length, st.size, size)
+		return fmt.Errorf("%w: denied put operation", ErrStoreFull)
+	}
+	return st.expand(st.length + size + footerSize)
+}
+
+//Doubles the size of the store until it is greater than minSize, the file is truncated to the new size
+//and mapped again. Slices of the old mapping are invalid after it
+func (st *store) expand(minSize uint64) error {
+	if st.osFile == nil {
+		return fmt.Errorf("%w: anonymous stores can't grow", ErrStoreFull)
+	}
+	size := st.size
+	for size <= minSize {
+		size *= 2
+	}
+	if err := st.osFile.Truncate(int64(size)); err != nil {
+		return err
+	}
+	file, err := gommap.Map(st.osFile.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, st.mapFlags())
+	if err != nil {
+		st.osFile.Truncate(int64(st.size))
+		return err
+	}
+	file.Advise(mmapAdviseFlags)
+	st.mapMutex.Lock()
+	defer st.mapMutex.Unlock()
+	if err := st.file.UnsafeUnmap(); err != nil {
+		panic(err)
+	}
+	st.file = file
+	st.size = size
+	//The records end before the new footer area
+	st.footerless = false
+	return nil
+}
+
+//Writes a pair at index, expiring at expiry if it isn't 0
+func (st *store) write(index uint64, key, val []byte, expiry uint64) {
+	if expiry != 0 {
+		st.setKeyLen(index, uint32(len(key))|ttlFlag)
+	} else {
+		st.setKeyLen(index, uint32(len(key)))
+	}
 	st.setValLen(index, uint32(len(val)))
 	copy(st.key(index), key)
 	copy(st.val(index), val)
-	binary.LittleEndian.PutUint32(st.file[int(index)+8+len(key)+len(val):], uint32(len(key)+len(val)))
-	return uint32(index), nil
+	end := index + headerSize + uint64(len(key)+len(val))
+	if expiry != 0 {
+		binary.LittleEndian.PutUint64(st.file[end:], expiry)
+		end += ttlSize
+	}
+	if st.crc {
+		binary.LittleEndian.PutUint32(st.file[end:], st.recordCRC(index))
+		end += crcSize
+	}
+	binary.LittleEndian.PutUint32(st.file[end:], st.totalLen(index))
+}
+
+/*
+	Footer
+*/
+
+const footerSize = 32
+
+const footerMagic = 0x746f6f4670614d50 //"PMapFoot"
+
+type footer struct {
+	length, deleted, checksum uint64
+}
+
+//Returns the footer and true if the store has a valid footer
+func (st *store) readFooter() (footer, bool) {
+	if st.size < footerSize {
+		return footer{}, false
+	}
+	b := st.file[st.size-footerSize:]
+	f := footer{
+		length:   binary.LittleEndian.Uint64(b[8:]),
+		deleted:  binary.LittleEndian.Uint64(b[16:]),
+		checksum: binary.LittleEndian.Uint64(b[24:]),
+	}
+	if binary.LittleEndian.Uint64(b) != footerMagic || f.length > st.size-footerSize || f.deleted > f.length {
+		return footer{}, false
+	}
+	return f, true
+}
+
+func (st *store) writeFooter(f footer) {
+	b := st.file[st.size-footerSize:]
+	binary.LittleEndian.PutUint64(b, footerMagic)
+	binary.LittleEndian.PutUint64(b[8:], f.length)
+	binary.LittleEndian.PutUint64(b[16:], f.deleted)
+	binary.LittleEndian.PutUint64(b[24:], f.checksum)
+}
+
+func (st *store) clearFooter() {
+	if st.size >= footerSize {
+		zero(st.file[st.size-footerSize:])
+	}
 }
@@ -0,0 +1,518 @@
+package pmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Fills a file-backed PMap with n pairs, deleting one of them
+func testFilledFile(t *testing.T, path string, n int) *PMap {
+	c := New(path, 1024*1024)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := []byte("key0")
+	if err := c.Del(hashing.FNV1a64(key), key, testValue(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testCheckReopened(t *testing.T, c *PMap, n int, used, deleted int, checksum uint64) {
+	if c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum {
+		t.Fatalf("reopened store: used %d, deleted %d, checksum %d, expected %d %d %d",
+			c.Used(), c.Deleted(), c.checksum.total(), used, deleted, checksum)
+	}
+	for i := 1; i < n; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		v, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatal("wrong value", key, v)
+		}
+	}
+}
+
+func TestFooterCleanClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 100)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+
+	c = testOpen(t, path)
+	if c.Recovered() {
+		t.Fatal("clean close was not detected")
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+	//The footer is cleared once opened, a crash from now on must be detected
+	if _, ok := c.st.readFooter(); ok {
+		t.Fatal("footer still present after Open")
+	}
+	c.Close()
+}
+
+func TestFooterUncleanShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 100)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	//Crash: the store is released without writing the footer
+	c.st.close()
+
+	c = testOpen(t, path)
+	if !c.Recovered() {
+		t.Fatal("unclean shutdown was not detected")
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+	c.Close()
+}
+
+func TestFooterMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 100)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.st.writeFooter(footer{length: c.st.length, deleted: c.st.deleted, checksum: checksum + 1})
+	c.st.close()
+
+	c = testOpen(t, path)
+	if !c.Recovered() {
+		t.Fatal("inconsistent footer was trusted")
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+	c.Close()
+}
+
+func TestFooterlessStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 4096, Options{NoAutoGrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Stores written before the footer existed were filled up to the end of the file
+	c.st.footerless = true
+	expected := make(map[string]string)
+	for i := 0; ; i++ {
+		key := []byte(fmt.Sprint(i))
+		value := testValue(1, "")
+		if err := c.Set(c.Hash(key), key, value); err != nil {
+			break
+		}
+		expected[string(key)] = string(value)
+	}
+	if c.st.length <= c.st.size-footerSize {
+		t.Fatal("the records don't reach the footer area", c.st.length, c.st.size)
+	}
+	c.st.close()
+
+	check := func(c *PMap) {
+		t.Helper()
+		got := testPairs(c)
+		if len(got) != len(expected) {
+			t.Fatal("wrong number of pairs", len(got), len(expected))
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Fatalf("%s: got %q, expected %q", k, got[k], v)
+			}
+		}
+	}
+	c = testOpen(t, path)
+	if !c.Recovered() || !c.st.footerless || c.FreeSpace() != int(c.st.size-c.st.length) {
+		t.Fatal("footerless store not detected", c.Recovered(), c.st.footerless, c.FreeSpace())
+	}
+	check(c)
+	//Close doesn't write a footer over the last records
+	c.Close()
+	c = testOpen(t, path)
+	check(c)
+
+	//Growing makes room for the footer
+	key := []byte("grown")
+	if err := c.Set(c.Hash(key), key, testValue(1, "value")); err != nil {
+		t.Fatal(err)
+	}
+	expected[string(key)] = string(testValue(1, "value"))
+	if c.st.footerless {
+		t.Fatal("the grown store is still footerless")
+	}
+	c.Close()
+	c = testOpen(t, path)
+	defer c.Close()
+	if c.Recovered() {
+		t.Fatal("the footer of the grown store was not written")
+	}
+	check(c)
+}
+
+func TestStoreLargerThan4GB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sparse 5GB store")
+	}
+	//The file is sparse, only the touched pages are allocated
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 5<<30)
+	//Two filler pairs of almost 2GB move the end of the store past 4GB without writing their values
+	for _, filler := range []string{"filler1", "filler2"} {
+		index := c.st.length
+		c.st.setKeyLen(index, uint32(len(filler)))
+		c.st.setValLen(index, 1<<31-1)
+		copy(c.st.key(index), filler)
+		binary.LittleEndian.PutUint32(c.st.file[index+8+uint64(c.st.totalLen(index)):], c.st.totalLen(index))
+		c.st.length += 12 + uint64(c.st.totalLen(index))
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+		stIndex, _ := c.lookup(uint32(hashing.FNV1a64(key)), key)
+		if stIndex <= math.MaxUint32 {
+			t.Fatal("pair stored before 4GB at", stIndex)
+		}
+	}
+	c.Close()
+
+	c = testOpen(t, path)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		v, _ := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatal("wrong value after reopening", string(key), v)
+		}
+	}
+}
+
+func TestGuaranteeDurableUpTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 1024*1024)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := testValue(1, fmt.Sprint("value", i))
+		offset := c.AppendOffset()
+		if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+			t.Fatal(err)
+		}
+		if c.AppendOffset() != offset+uint64(12+len(key)+len(value)) {
+			t.Fatalf("AppendOffset went from %d to %d", offset, c.AppendOffset())
+		}
+	}
+	offset := c.AppendOffset()
+	if err := c.GuaranteeDurableUpTo(offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.GuaranteeDurableUpTo(offset + 1); err == nil {
+		t.Fatal("GuaranteeDurableUpTo accepted an offset beyond the end of the store")
+	}
+	//Crash: the store is released without writing the footer
+	c.st.close()
+
+	c = testOpen(t, path)
+	defer c.Close()
+	if c.AppendOffset() != offset {
+		t.Fatalf("AppendOffset %d after recovering, expected %d", c.AppendOffset(), offset)
+	}
+	testCheckReopened(t, c, 100, int(offset), 0, c.checksum.total())
+}
+
+func TestOpenCorruptStore(t *testing.T) {
+	corruptions := map[string]func(c *PMap, last uint64){
+		"value length past the end of the store": func(c *PMap, last uint64) {
+			c.st.setValLen(last, uint32(c.st.size))
+		},
+		"value without timestamp": func(c *PMap, last uint64) {
+			c.st.setValLen(last, 3)
+		},
+		"record ending one byte past the end of the store": func(c *PMap, last uint64) {
+			//Without a footer the records can reach the end of the file, see TestFooterlessStore
+			c.st.setValLen(last, uint32(c.st.size-last-12-uint64(c.st.keyLen(last))+1))
+		},
+	}
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			c := testFilledFile(t, path, 10)
+			last := uint64(c.st.prev(c.st.length))
+			corrupt(c, last)
+			//Crash: the store is released without writing the footer
+			c.st.close()
+			c, err := Open(path)
+			if err == nil {
+				c.Close()
+				t.Fatal("corrupt store opened")
+			}
+			if !strings.Contains(err.Error(), fmt.Sprint("offset ", last, ":")) {
+				t.Fatal("error doesn't report the corrupt record offset", last, ":", err)
+			}
+		})
+	}
+}
+
+func TestStoreAutoGrow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := New(path, 64*1024)
+	key := []byte("first")
+	c.Set(c.Hash(key), key, testValue(1, "first value"))
+	first, _ := c.Get(uint32(c.Hash(key)), key)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.Set(c.Hash(key), key, testValue(2, fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Size() <= 64*1024 || c.Size()&(c.Size()-1) != 0 {
+		t.Fatal("the store didn't grow", c.Size())
+	}
+	//Values returned before the store grew are copies
+	if string(first) != string(testValue(1, "first value")) {
+		t.Fatal("Get value changed after the store grew", first)
+	}
+	//Overwrites read the old pair before growing
+	key = []byte("key0")
+	if err := c.Reserve(20000, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(c.Hash(key), key, testValue(3, "updated")); err != nil {
+		t.Fatal(err)
+	}
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+
+	c = testOpen(t, path)
+	defer c.Close()
+	testCheckReopened(t, c, 10000, used, deleted, checksum)
+	if v, _ := c.Get(uint32(c.Hash(key)), key); string(v) != string(testValue(3, "updated")) {
+		t.Fatal("wrong value after reopening", v)
+	}
+
+	fixed, err := NewWithOptions(filepath.Join(t.TempDir(), "fixed"), 4096, Options{NoAutoGrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixed.Close()
+	if err := fixed.Set(c.Hash(key), key, testValue(1, string(make([]byte, 8192)))); !errors.Is(err, ErrStoreFull) {
+		t.Fatal("the fixed store grew", err)
+	}
+}
+
+func TestStoreFullLeavesNoState(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprint("WAL=", wal), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			c, err := NewWithOptions(path, 64*1024, Options{NoAutoGrow: true, WAL: wal})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				key := []byte(fmt.Sprint("key", i))
+				if err := c.Set(c.Hash(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			//Fill the store with the smallest records, not even a tombstone of a key longer than them fits
+			for i := 0; ; i++ {
+				key := []byte(fmt.Sprint(i))
+				if err := c.Set(c.Hash(key), key, testValue(1, "")); err != nil {
+					if !errors.Is(err, ErrStoreFull) {
+						t.Fatal(err)
+					}
+					break
+				}
+			}
+			pairs, used, deleted, checksum := testPairs(c), c.Used(), c.Deleted(), c.checksum.total()
+			live, tombstones := c.RecordCounts()
+			check := func(op string, err error) {
+				t.Helper()
+				if !errors.Is(err, ErrStoreFull) {
+					t.Fatal(op, "didn't fail with ErrStoreFull", err)
+				}
+				l, ts := c.RecordCounts()
+				if c.Len() != len(pairs) || c.Used() != used || c.Deleted() != deleted || c.checksum.total() != checksum ||
+					l != live || ts != tombstones {
+					t.Fatal(op, "changed the PMap", c.Len(), c.Used(), c.Deleted(), l, ts)
+				}
+				if got := testPairs(c); len(got) != len(pairs) || got["key1"] != pairs["key1"] || got["key5"] != pairs["key5"] {
+					t.Fatal(op, "changed the pairs")
+				}
+			}
+			large := string(make([]byte, 1024))
+			key, newKey := []byte("key1"), []byte("new key")
+			check("Set", c.Set(c.Hash(key), key, testValue(2, large)))
+			check("Set of a new key", c.Set(c.Hash(newKey), newKey, testValue(2, large)))
+			check("CAS", c.CAS(c.Hash(key), key, testCASValue(1, "value1", 2, large)))
+			check("CAS of a new key", c.CAS(c.Hash(newKey), newKey, testCASValue(0, "", 2, large)))
+			key = []byte("key5")
+			check("Del", c.Del(c.Hash(key), key, testValue(2, "")))
+			if !wal {
+				c.Close()
+				return
+			}
+			//The failed operations weren't logged, they aren't replayed
+			walTestCrash(c)
+			c, err = OpenWithOptions(path, Options{NoAutoGrow: true, WAL: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			got := testPairs(c)
+			for k, v := range pairs {
+				if got[k] != v {
+					t.Fatalf("%s: got %q after recovering, expected %q", k, got[k], v)
+				}
+			}
+			if len(got) != len(pairs) {
+				t.Fatal("wrong number of pairs after recovering", len(got), len(pairs))
+			}
+		})
+	}
+}
+
+func TestFilePerms(t *testing.T) {
+	if _, err := NewWithOptions("", 1024, Options{FilePerms: os.ModeDir | 0700}); err == nil {
+		t.Fatal("FilePerms with a mode bit accepted")
+	}
+	//Group-readable files in a missing directory
+	path := filepath.Join(t.TempDir(), "chunks", "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{FilePerms: 0640, WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	c.Set(c.Hash(key), key, testValue(1, "value"))
+	c.Del(c.Hash(key), key, testValue(2, ""))
+	c.Compact()
+	c.Close()
+	for p, perm := range map[string]os.FileMode{path: 0640, walPath(path): 0640, filepath.Dir(path): 0750} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != perm {
+			t.Fatal("wrong permission of", p, fi.Mode().Perm())
+		}
+	}
+	//Reopened stores keep their permission when they are compacted
+	c, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(c.Hash(key), key, testValue(3, "value"))
+	c.Set(c.Hash(key), key, testValue(4, "value"))
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+		t.Fatal("the compaction changed the permission", fi.Mode().Perm())
+	}
+}
+
+func TestAnonymousStore(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, opts := range []Options{{}, {DedupValues: true, Checksums: true, CompactOnClose: true}} {
+		c, err := NewWithOptions("", 1024*1024, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.st.osFile != nil {
+			t.Fatal("anonymous store with a file")
+		}
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			c.Set(c.Hash(key), key, testValue(1, "a value to deduplicate"))
+			c.Del(c.Hash(key), key, testValue(2, ""))
+		}
+		if err := c.Compact(); err != nil || c.st.osFile != nil {
+			t.Fatal("the compaction of an anonymous store used a file", err)
+		}
+		c.CloseAndDelete()
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Fatal("anonymous PMaps created files", entries, err)
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c := testFilledFile(t, path, 100)
+	used, deleted, checksum := c.Used(), c.Deleted(), c.checksum.total()
+	c.Close()
+	c, err := OpenWithOptions(path, Options{Populate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseAndDelete()
+	if !c.st.populate {
+		t.Fatal("the store wasn't populated")
+	}
+	testCheckReopened(t, c, 100, used, deleted, checksum)
+	//The store is populated again when it grows
+	size := c.st.size
+	body := string(bytes.Repeat([]byte("v"), 4096))
+	for i := 0; c.st.size == size; i++ {
+		key := []byte(fmt.Sprint("grow", i))
+		if err := c.Set(c.Hash(key), key, testValue(1, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.st.populate {
+		t.Fatal("the grown store wasn't populated")
+	}
+	for i := 1; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if v, _ := c.Get(uint32(c.Hash(key)), key); string(v[8:]) != fmt.Sprint("value", i) {
+			t.Fatal("wrong value", key, v)
+		}
+	}
+}
+
+//First-access latency after Open: every value is read once, the store is opened again before each round
+func BenchmarkGetAfterOpen(b *testing.B) {
+	const n = 10000
+	path := filepath.Join(b.TempDir(), "pmap")
+	c := New(path, n*5000)
+	body := string(bytes.Repeat([]byte("v"), 4000))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint("key", i))
+		c.Set(c.Hash(keys[i]), keys[i], testValue(1, body))
+	}
+	c.Close()
+	for _, populate := range []bool{false, true} {
+		b.Run(fmt.Sprint("Populate=", populate), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c, err := OpenWithOptions(path, Options{Populate: populate})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				for _, key := range keys {
+					c.Get(uint32(c.Hash(key)), key)
+				}
+				b.StopTimer()
+				c.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
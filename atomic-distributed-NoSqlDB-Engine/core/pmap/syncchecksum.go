@@ -1,27 +1,90 @@
 package pmap
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
+/*
+A syncChecksum is the sum of the pair checksums (hash ^ timestamp) split in three time windows of interval width.
+
+Replicas receive the same pairs at slightly different times, a checksum of every pair would differ while
+recent writes are being propagated. The time-stable checksum only includes pairs whose timestamp is older
+than oldTime, the start of the medium window, which is always older than now - interval: replicas that hold
+the same pairs older than that return the same checksum, regardless of the most recent writes.
+
+Windows are moved forward when a pair newer than the new window is summed and periodically by a background
+goroutine, started by SetInterval and stopped by stop. Without it the checksum of an idle PMap would lag behind.
+
+Unlike the rest of the PMap it is thread-safe, it is shared with the background goroutine.
+*/
 type syncChecksum struct {
+	checksumWindows
+	interval    time.Duration
+	clock       Clock
+	mutex       sync.Mutex
+	stopRefresh chan struct{}
+	refreshDone chan struct{}
+}
+
+//checksumWindows holds the sums and the bounds of the time windows
+type checksumWindows struct {
 	newChecksum, mediumChecksum, oldChecksum uint64
 	newTime, mediumTime, oldTime             time.Time
 }
 
-func (s *syncChecksum) checksum() uint64 {
-	s.sum(0, time.Now())
+func (s *syncChecksum) checksum(now time.Time) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(0, now)
 	return s.oldChecksum
 }
 
+//Returns the checksum of every pair, regardless of its time
+func (s *syncChecksum) total() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.newChecksum
+}
+
+//Clears the sums, keeping the interval
+func (s *syncChecksum) reset() {
+	s.setWindows(checksumWindows{})
+}
+
+//Returns a copy of the time windows
+func (s *syncChecksum) windows() checksumWindows {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.checksumWindows
+}
+
+func (s *syncChecksum) setWindows(w checksumWindows) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checksumWindows = w
+}
+
 func (s *syncChecksum) sub(el uint64, t time.Time) {
 	s.sum(-el, t)
 }
 
 func (s *syncChecksum) sum(el uint64, t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(el, t)
+}
+
+func (s *syncChecksum) add(el uint64, t time.Time) {
 	if t.After(s.newTime) {
 		//Move forward the time
+		interval := s.interval
+		if interval <= 0 {
+			interval = defaultCheckSumInterval
+		}
 		s.oldTime = s.mediumTime
 		s.mediumTime = s.newTime
-		s.newTime = time.Unix(t.Unix()+1, 0)
+		s.newTime = t.Truncate(interval).Add(interval)
 		s.oldChecksum = s.mediumChecksum
 		s.mediumChecksum = s.newChecksum
 	}
@@ -33,3 +96,43 @@ func (s *syncChecksum) sum(el uint64, t time.Time) {
 		s.oldChecksum += el
 	}
 }
+
+//SetInterval sets the width of the time windows and (re)starts the background goroutine that moves them forward
+//using s.clock, d <= 0 means defaultCheckSumInterval
+func (s *syncChecksum) SetInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultCheckSumInterval
+	}
+	s.stop()
+	s.mutex.Lock()
+	s.interval = d
+	s.mutex.Unlock()
+	s.stopRefresh = make(chan struct{})
+	s.refreshDone = make(chan struct{})
+	go s.refresh(d, s.stopRefresh, s.refreshDone)
+}
+
+func (s *syncChecksum) refresh(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checksum(s.clock.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Stops the background goroutine and waits for it, if it is running
+func (s *syncChecksum) stop() {
+	if s.stopRefresh == nil {
+		return
+	}
+	close(s.stopRefresh)
+	<-s.refreshDone
+	s.stopRefresh = nil
+	s.refreshDone = nil
+}
@@ -0,0 +1,612 @@
+package pmap
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+A SyncPMap is a thread-safe PMap, its methods wrap the PMap ones under a lock.
+Get, GetInto, GetTimestamp, GetIfNewer, Has, MultiGet, the iterations (Iterate, BackwardsIterate, IterateBackwardsFrom,
+IterateContext, IterateKeys, IterateProject, IterateReuse, ParallelIterate, RawScan, ScanFrom, ScanPrefix), the Next
+method of Cursor, the statistics (Len, Size, Used, Deleted, LiveBytes, FreeSpace, Utilization, AppendOffset,
+RecordCounts, ProbeLength, SampleKeys, Stats, AuditLog), the checksums (Checksum, ChunkChecksum, MerkleTree,
+MerkleBucketKeys), the exports (CloneTo, ExportNDJSON, ReplicateTo, Snapshot, SnapshotSince), LookupByIndex, Verify
+and GuaranteeDurableUpTo take a read lock. The callbacks of the iterations run under it: they must not call the
+write locked methods (it would deadlock) and they block writers.
+Set, Del, CAS, MultiCAS, BulkSet, ApplyBatch, Compact, Reserve, ReplicateFrom, NextSequence, Subscribe, Increment,
+GetSet, SetIfAbsent, CompareAndDelete, Touch, SetWithTTL, ExpireNow, SetCompactionThreshold, SetCompactionInterval,
+SetChecksumInterval, DeleteRange, ApplySnapshot, Merge, Sync, Clear, DeleteNamespace and PurgeTombstones take
+the write lock.
+The methods of the handles returned by Namespace take the same locks as the SyncPMap ones.
+Hash and Recovered don't lock, they don't change after Open. Every exported PMap method has its SyncPMap wrapper,
+the wrapped PMap is never reachable without the lock.
+StartExpirySweeper runs ExpireNow in the background, Close and CloseAndDelete stop it.
+*/
+type SyncPMap struct {
+	pm        *PMap
+	mutex     sync.RWMutex
+	stopSweep chan struct{}
+	sweepDone chan struct{}
+}
+
+//NewSync returns an initialized SyncPMap like New does
+func NewSync(path string, size uint64) *SyncPMap {
+	return &SyncPMap{pm: New(path, size)}
+}
+
+//Get is PMap.Get under a read lock
+func (c *SyncPMap) Get(h32 uint32, key []byte) ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Get(h32, key)
+}
+
+//GetInto is PMap.GetInto under a read lock
+func (c *SyncPMap) GetInto(h32 uint32, key, dst []byte) ([]byte, bool, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.GetInto(h32, key, dst)
+}
+
+//GetTimestamp is PMap.GetTimestamp under a read lock
+func (c *SyncPMap) GetTimestamp(h32 uint32, key []byte) (time.Time, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.GetTimestamp(h32, key)
+}
+
+//GetIfNewer is PMap.GetIfNewer under a read lock
+func (c *SyncPMap) GetIfNewer(h32 uint32, key []byte, since time.Time) ([]byte, bool, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.GetIfNewer(h32, key, since)
+}
+
+//Set is PMap.Set under the write lock
+func (c *SyncPMap) Set(h64 uint64, key, value []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Set(h64, key, value)
+}
+
+//Del is PMap.Del under the write lock
+func (c *SyncPMap) Del(h64 uint64, key, value []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Del(h64, key, value)
+}
+
+//CAS is PMap.CAS under the write lock
+func (c *SyncPMap) CAS(h64 uint64, key, value []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.CAS(h64, key, value)
+}
+
+//MultiCAS is PMap.MultiCAS under the write lock, held while every operation is applied
+func (c *SyncPMap) MultiCAS(ops []CASOp) ([]error, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.MultiCAS(ops)
+}
+
+//BulkSet is PMap.BulkSet under the write lock, held while every pair is set
+func (c *SyncPMap) BulkSet(pairs []KV) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.BulkSet(pairs)
+}
+
+//Subscribe is PMap.Subscribe under the write lock, the returned function unsubscribes under the write lock too
+func (c *SyncPMap) Subscribe() (<-chan ChangeEvent, func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	events, unsubscribe := c.pm.Subscribe()
+	return events, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		unsubscribe()
+	}
+}
+
+//Iterate is PMap.Iterate holding a read lock during the whole iteration.
+//foreach runs under the lock: it must not call Set, Del nor CAS (it would deadlock) and it blocks writers.
+func (c *SyncPMap) Iterate(foreach func(key, value []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Iterate(foreach)
+}
+
+//BackwardsIterate is PMap.BackwardsIterate holding a read lock during the whole iteration.
+//foreach runs under the lock: it must not call Set, Del nor CAS (it would deadlock) and it blocks writers.
+func (c *SyncPMap) BackwardsIterate(foreach func(key, value []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.BackwardsIterate(foreach)
+}
+
+//Cursor is PMap.Cursor under a read lock, the Next method of the returned cursor takes the read lock too
+func (c *SyncPMap) Cursor() *Cursor {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	cur := c.pm.Cursor()
+	cur.mutex = &c.mutex
+	return cur
+}
+
+//AppendOffset is PMap.AppendOffset under a read lock
+func (c *SyncPMap) AppendOffset() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.AppendOffset()
+}
+
+//AuditLog is PMap.AuditLog under a read lock
+func (c *SyncPMap) AuditLog() []AuditEntry {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.AuditLog()
+}
+
+//Checksum is PMap.Checksum under a read lock
+func (c *SyncPMap) Checksum() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Checksum()
+}
+
+//ChunkChecksum is PMap.ChunkChecksum under a read lock
+func (c *SyncPMap) ChunkChecksum(chunkID, numChunks int) uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ChunkChecksum(chunkID, numChunks)
+}
+
+//CloneTo is PMap.CloneTo under a read lock, held while the pairs are copied
+func (c *SyncPMap) CloneTo(path string, size uint64) (*PMap, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.CloneTo(path, size)
+}
+
+//Deleted is PMap.Deleted under a read lock
+func (c *SyncPMap) Deleted() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Deleted()
+}
+
+//ExportNDJSON is PMap.ExportNDJSON under a read lock, held while the pairs are written
+func (c *SyncPMap) ExportNDJSON(w io.Writer) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ExportNDJSON(w)
+}
+
+//FreeSpace is PMap.FreeSpace under a read lock
+func (c *SyncPMap) FreeSpace() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.FreeSpace()
+}
+
+//GuaranteeDurableUpTo is PMap.GuaranteeDurableUpTo under a read lock
+func (c *SyncPMap) GuaranteeDurableUpTo(offset uint64) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.GuaranteeDurableUpTo(offset)
+}
+
+//Has is PMap.Has under a read lock
+func (c *SyncPMap) Has(h32 uint32, key []byte) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Has(h32, key)
+}
+
+//IterateBackwardsFrom is PMap.IterateBackwardsFrom holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) IterateBackwardsFrom(key []byte, foreach func(key, value []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.IterateBackwardsFrom(key, foreach)
+}
+
+//IterateContext is PMap.IterateContext holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) IterateContext(ctx context.Context, foreach func(key, value []byte) error) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.IterateContext(ctx, foreach)
+}
+
+//IterateKeys is PMap.IterateKeys holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) IterateKeys(foreach func(key []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.IterateKeys(foreach)
+}
+
+//IterateProject is PMap.IterateProject holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) IterateProject(offset, length int, foreach func(key, fragment []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.IterateProject(offset, length, foreach)
+}
+
+//IterateReuse is PMap.IterateReuse holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) IterateReuse(foreach func(key, value []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.IterateReuse(foreach)
+}
+
+//Len is PMap.Len under a read lock
+func (c *SyncPMap) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Len()
+}
+
+//LiveBytes is PMap.LiveBytes under a read lock
+func (c *SyncPMap) LiveBytes() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.LiveBytes()
+}
+
+//LookupByIndex is PMap.LookupByIndex under a read lock
+func (c *SyncPMap) LookupByIndex(indexKey []byte) ([][]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.LookupByIndex(indexKey)
+}
+
+//MerkleBucketKeys is PMap.MerkleBucketKeys under a read lock
+func (c *SyncPMap) MerkleBucketKeys(fanout, bucket int) [][]byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.MerkleBucketKeys(fanout, bucket)
+}
+
+//MerkleTree is PMap.MerkleTree under a read lock, held while the tree is built
+func (c *SyncPMap) MerkleTree(fanout int) *MerkleNode {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.MerkleTree(fanout)
+}
+
+//MultiGet is PMap.MultiGet under a read lock
+func (c *SyncPMap) MultiGet(keys [][]byte) ([][]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.MultiGet(keys)
+}
+
+//ParallelIterate is PMap.ParallelIterate holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) ParallelIterate(workers int, foreach func(key, value []byte) error) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ParallelIterate(workers, foreach)
+}
+
+//ProbeLength is PMap.ProbeLength under a read lock
+func (c *SyncPMap) ProbeLength(h32 uint32, key []byte) (int, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ProbeLength(h32, key)
+}
+
+//RawScan is PMap.RawScan holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) RawScan(foreach func(offset uint64, key, rawValue []byte, isTombstone bool) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.RawScan(foreach)
+}
+
+//RecordCounts is PMap.RecordCounts under a read lock
+func (c *SyncPMap) RecordCounts() (live, tombstones int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.RecordCounts()
+}
+
+//ReplicateTo is PMap.ReplicateTo under a read lock, held while the stream is written
+func (c *SyncPMap) ReplicateTo(w io.Writer, sinceOffset uint64) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ReplicateTo(w, sinceOffset)
+}
+
+//SampleKeys is PMap.SampleKeys under a read lock
+func (c *SyncPMap) SampleKeys(n int) [][]byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.SampleKeys(n)
+}
+
+//ScanFrom is PMap.ScanFrom holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) ScanFrom(startIndex uint64, limit int, foreach func(key, value []byte) (Continue bool)) (nextIndex uint64, err error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ScanFrom(startIndex, limit, foreach)
+}
+
+//ScanPrefix is PMap.ScanPrefix holding a read lock during the whole scan, its callback runs under the lock like in Iterate
+func (c *SyncPMap) ScanPrefix(prefix []byte, foreach func(key, value []byte) (Continue bool)) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.ScanPrefix(prefix, foreach)
+}
+
+//Size is PMap.Size under a read lock
+func (c *SyncPMap) Size() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Size()
+}
+
+//Snapshot is PMap.Snapshot under a read lock, held while the snapshot is written
+func (c *SyncPMap) Snapshot(w io.Writer) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Snapshot(w)
+}
+
+//SnapshotSince is PMap.SnapshotSince under a read lock, held while the snapshot is written
+func (c *SyncPMap) SnapshotSince(w io.Writer, since time.Time) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.SnapshotSince(w, since)
+}
+
+//Stats is PMap.Stats under a read lock
+func (c *SyncPMap) Stats() Stats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Stats()
+}
+
+//Used is PMap.Used under a read lock
+func (c *SyncPMap) Used() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Used()
+}
+
+//Utilization is PMap.Utilization under a read lock
+func (c *SyncPMap) Utilization() float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Utilization()
+}
+
+//Verify is PMap.Verify under a read lock, held while the store is checked
+func (c *SyncPMap) Verify() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pm.Verify()
+}
+
+//Increment is PMap.Increment under the write lock
+func (c *SyncPMap) Increment(h64 uint64, key []byte, delta int64, timestamp time.Time) (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Increment(h64, key, delta, timestamp)
+}
+
+//GetSet is PMap.GetSet under the write lock
+func (c *SyncPMap) GetSet(h64 uint64, key, value []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.GetSet(h64, key, value)
+}
+
+//SetIfAbsent is PMap.SetIfAbsent under the write lock
+func (c *SyncPMap) SetIfAbsent(h64 uint64, key, value []byte) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.SetIfAbsent(h64, key, value)
+}
+
+//CompareAndDelete is PMap.CompareAndDelete under the write lock
+func (c *SyncPMap) CompareAndDelete(h64 uint64, key []byte, expectedHash uint64, timestamp time.Time) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.CompareAndDelete(h64, key, expectedHash, timestamp)
+}
+
+//Touch is PMap.Touch under the write lock
+func (c *SyncPMap) Touch(h64 uint64, key []byte, timestamp time.Time) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Touch(h64, key, timestamp)
+}
+
+//SetWithTTL is PMap.SetWithTTL under the write lock
+func (c *SyncPMap) SetWithTTL(h64 uint64, key, value []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.SetWithTTL(h64, key, value, ttl)
+}
+
+//ExpireNow is PMap.ExpireNow under the write lock
+func (c *SyncPMap) ExpireNow() (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.ExpireNow()
+}
+
+//SetCompactionThreshold is PMap.SetCompactionThreshold under the write lock
+func (c *SyncPMap) SetCompactionThreshold(ratio float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pm.SetCompactionThreshold(ratio)
+}
+
+//SetCompactionInterval is PMap.SetCompactionInterval under the write lock
+func (c *SyncPMap) SetCompactionInterval(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pm.SetCompactionInterval(d)
+}
+
+//SetChecksumInterval is PMap.SetChecksumInterval under the write lock, Close stops the goroutine it restarts
+func (c *SyncPMap) SetChecksumInterval(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pm.SetChecksumInterval(d)
+}
+
+//ApplyBatch is PMap.ApplyBatch under the write lock, held until the batch is applied or rolled back
+func (c *SyncPMap) ApplyBatch(b *WriteBatch) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.ApplyBatch(b)
+}
+
+//Compact is PMap.Compact under the write lock
+func (c *SyncPMap) Compact() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Compact()
+}
+
+//Reserve is PMap.Reserve under the write lock
+func (c *SyncPMap) Reserve(numKeys uint64, avgValueBytes uint64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Reserve(numKeys, avgValueBytes)
+}
+
+//ReplicateFrom is PMap.ReplicateFrom under the write lock, held while the whole stream is applied
+func (c *SyncPMap) ReplicateFrom(r io.Reader) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.ReplicateFrom(r)
+}
+
+//NextSequence is PMap.NextSequence under the write lock
+func (c *SyncPMap) NextSequence() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.NextSequence()
+}
+
+//DeleteRange is PMap.DeleteRange under the write lock, held while every key is deleted
+func (c *SyncPMap) DeleteRange(prefix []byte, timestamp time.Time) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.DeleteRange(prefix, timestamp)
+}
+
+//ApplySnapshot is PMap.ApplySnapshot under the write lock, held while the whole snapshot is applied
+func (c *SyncPMap) ApplySnapshot(r io.Reader) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.ApplySnapshot(r)
+}
+
+//Merge is PMap.Merge under the write lock of c, other isn't locked and must not be modified until it returns
+func (c *SyncPMap) Merge(other *PMap) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Merge(other)
+}
+
+//Sync is PMap.Sync under the write lock, the WAL checkpoint truncates the log
+func (c *SyncPMap) Sync() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Sync()
+}
+
+//Clear is PMap.Clear under the write lock
+func (c *SyncPMap) Clear() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.Clear()
+}
+
+//Namespace returns a handle to the namespace name like PMap.Namespace, its methods take the SyncPMap locks
+func (c *SyncPMap) Namespace(name string) *Namespace {
+	return &Namespace{c: c, name: name, prefix: namespacePrefix(name)}
+}
+
+//DeleteNamespace is PMap.DeleteNamespace under the write lock, held while every key is deleted
+func (c *SyncPMap) DeleteNamespace(name string, timestamp time.Time) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.DeleteNamespace(name, timestamp)
+}
+
+//PurgeTombstones is PMap.PurgeTombstones under the write lock
+func (c *SyncPMap) PurgeTombstones(olderThan time.Time) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pm.PurgeTombstones(olderThan)
+}
+
+//Hash is PMap.Hash, it doesn't lock: the Hasher doesn't change after Open
+func (c *SyncPMap) Hash(key []byte) uint64 {
+	return c.pm.Hash(key)
+}
+
+//Recovered is PMap.Recovered, it doesn't lock: it doesn't change after Open
+func (c *SyncPMap) Recovered() bool {
+	return c.pm.Recovered()
+}
+
+//StartExpirySweeper starts a background goroutine that removes the expired pairs (see PMap.ExpireNow)
+//every interval, restarting it if it is running. Close and CloseAndDelete stop it
+func (c *SyncPMap) StartExpirySweeper(interval time.Duration) {
+	c.stopExpirySweeper()
+	c.stopSweep = make(chan struct{})
+	c.sweepDone = make(chan struct{})
+	go c.sweep(interval, c.stopSweep, c.sweepDone)
+}
+
+func (c *SyncPMap) sweep(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.ExpireNow(); err != nil {
+				log.Println("Expiry sweep failed:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Stops the expiry sweeper and waits for it, if it is running
+func (c *SyncPMap) stopExpirySweeper() {
+	if c.stopSweep == nil {
+		return
+	}
+	close(c.stopSweep)
+	<-c.sweepDone
+	c.stopSweep = nil
+	c.sweepDone = nil
+}
+
+//Close stops the expiry sweeper and closes the PMap under the write lock
+func (c *SyncPMap) Close() {
+	c.stopExpirySweeper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pm.Close()
+}
+
+//CloseAndDelete stops the expiry sweeper and closes and deletes the PMap under the write lock
+func (c *SyncPMap) CloseAndDelete() {
+	c.stopExpirySweeper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pm.CloseAndDelete()
+}
@@ -0,0 +1,122 @@
+package pmap
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Every exported PMap method must have its SyncPMap wrapper, with the same signature
+func TestSyncPMapWrapsEveryMethod(t *testing.T) {
+	pm, sync := reflect.TypeOf(&PMap{}), reflect.TypeOf(&SyncPMap{})
+	for i := 0; i < pm.NumMethod(); i++ {
+		m := pm.Method(i)
+		w, ok := sync.MethodByName(m.Name)
+		if !ok {
+			t.Error("SyncPMap doesn't wrap", m.Name)
+			continue
+		}
+		//The receivers differ
+		same := m.Type.NumIn() == w.Type.NumIn() && m.Type.NumOut() == w.Type.NumOut() && m.Type.IsVariadic() == w.Type.IsVariadic()
+		for j := 1; same && j < m.Type.NumIn(); j++ {
+			same = m.Type.In(j) == w.Type.In(j)
+		}
+		for j := 0; same && j < m.Type.NumOut(); j++ {
+			same = m.Type.Out(j) == w.Type.Out(j)
+		}
+		if !same {
+			t.Error("SyncPMap wraps", m.Name, "with another signature:", w.Type, m.Type)
+		}
+	}
+}
+
+func TestSyncPMapConcurrentAccess(t *testing.T) {
+	c := NewSync("", 16*1024*1024)
+	defer c.Close()
+	const writers, n = 4, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprint("key", w, "-", i))
+				if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprint("key", w, "-", i))
+				if v, err := c.Get(uint32(hashing.FNV1a64(key)), key); err != nil || (v != nil && string(v[8:]) != fmt.Sprint("value", i)) {
+					t.Error("Get returned", v, err)
+					return
+				}
+				if i%500 == 0 {
+					c.Iterate(func(key, value []byte) bool { return true })
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if count != writers*n {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, writers*n)
+	}
+}
+
+func TestSyncPMapBatchAndCompact(t *testing.T) {
+	c := NewSync("", 16*1024*1024)
+	defer c.Close()
+	const n = 2000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprint("key", i))
+			if err := c.Set(hashing.FNV1a64(key), key, testValue(1, fmt.Sprint("value", i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n/100; i++ {
+			var b WriteBatch
+			for j := 0; j < 100; j++ {
+				key := []byte(fmt.Sprint("batch", i*100+j))
+				b.Set(hashing.FNV1a64(key), key, testValue(1, "value"))
+				b.Del(hashing.FNV1a64(key), key, testValue(2, ""))
+			}
+			if err := c.ApplyBatch(&b); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := c.Compact(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if count != n {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, n)
+	}
+}
@@ -0,0 +1,105 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+	Expiring pairs (SetWithTTL) are pairs with an expiry time: the timestamp of their value plus the TTL.
+
+	The expiry is stored on the record, after the value, and the pair is flagged on the key length word
+	(see the store binary structure). It costs 8 bytes per expiring pair, pairs written without TTL keep
+	the same record layout, and it halves the maximum key length (see maxKeySize). Expiring pairs are never
+	deduplicated (see dedup.go).
+
+	Get, Has and MultiGet treat an expired pair as absent as soon as it expires, the iterations return it
+	until it is removed. ExpireNow removes the expired pairs by deleting them with their expiry as the
+	tombstone timestamp, SyncPMap.StartExpirySweeper runs it in the background (a PMap is not thread-safe,
+	it can't run its own sweeper).
+	Set, CAS and the other writes replace the pair and its expiry, Compact and the WAL keep the expiry.
+	Snapshots, Merge and ReplicateTo carry the values without their expiry: the destination pairs never
+	expire, replication followers get the deletion once the leader removes the expired pair.
+*/
+
+const ttlFlag = 1 << 29 //Set on the key length word of pairs that expire
+
+const ttlSize = 8
+
+var errTTLSequence = errors.New("SetWithTTL cannot be used with SequenceNumbers")
+
+func (st *store) isExpiring(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&ttlFlag != 0
+}
+
+//Returns the expiry of the pair at index (nanoseconds since Unix time), 0 if it doesn't expire
+func (st *store) expiry(index uint64) uint64 {
+	if !st.isExpiring(index) {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(st.file[index+headerSize+uint64(st.keyLen(index))+uint64(st.valLen(index)):])
+}
+
+//Returns true if the pair at index has expired
+func (c *PMap) expired(index uint64) bool {
+	e := c.st.expiry(index)
+	return e != 0 && int64(e) <= c.clock.Now().UnixNano()
+}
+
+//SetWithTTL sets the pair like Set, the pair expires ttl after its timestamp (the first 8 bytes of value).
+//Expired pairs are absent for Get, Has and MultiGet and they are removed by ExpireNow.
+//It can't be used with Options.SequenceNumbers, the timestamps are not times
+func (c *PMap) SetWithTTL(h64 uint64, key, value []byte, ttl time.Duration) error {
+	if c.sequence {
+		return errTTLSequence
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("TTL %v is not positive", ttl)
+	}
+	if len(value) < 8 {
+		return fmt.Errorf("%w: message value len < 8", ErrValueTooShort)
+	}
+	return c.set(h64, key, value, binary.LittleEndian.Uint64(value)+uint64(ttl))
+}
+
+//An expired pair found by ExpireNow
+type expiredPair struct {
+	key    []byte
+	expiry uint64
+}
+
+//ExpireNow deletes every expired pair, using its expiry as the tombstone timestamp, and returns how
+//many were deleted: a pair whose timestamp is newer than its expiry (or kept by the Resolver) is not.
+//It returns an error if a deletion fails, the pairs deleted before remain deleted
+func (c *PMap) ExpireNow() (int, error) {
+	if c.st.readOnly {
+		return 0, ErrReadOnly
+	}
+	now := c.clock.Now().UnixNano()
+	var pairs []expiredPair
+	for i := uint32(0); i < c.hm.size; i++ {
+		if c.hm.getHash(i) <= deletedBucket {
+			continue
+		}
+		stIndex := c.hm.getStoreIndex(i)
+		if e := c.st.expiry(stIndex); e != 0 && int64(e) <= now {
+			pairs = append(pairs, expiredPair{key: append([]byte(nil), c.st.key(stIndex)...), expiry: e})
+		}
+	}
+	//Del can grow or compact the store, the keys are copies
+	tombstone := make([]byte, 8)
+	n := 0
+	for _, p := range pairs {
+		binary.LittleEndian.PutUint64(tombstone, p.expiry)
+		deleted, err := c.del(c.hasher.Hash64(p.key), p.key, tombstone)
+		if deleted {
+			n++
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,139 @@
+package pmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 1000)}
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{Clock: clock, WAL: true, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if i%2 == 0 {
+			err = c.SetWithTTL(c.Hash(key), key, testValue(1000, "expiring"), time.Microsecond)
+		} else {
+			err = c.Set(c.Hash(key), key, testValue(1000, "permanent"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetWithTTL(0, []byte("k"), testValue(1, ""), 0); err == nil {
+		t.Fatal("SetWithTTL accepted a zero TTL")
+	}
+	//Compaction keeps the expiry
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key0")
+	if v, _ := c.Get(uint32(c.Hash(key)), key); string(v) != string(testValue(1000, "expiring")) {
+		t.Fatal("expiring pair missing before its expiry", v)
+	}
+	clock.set(time.Unix(0, 2000))
+	if v, _ := c.Get(uint32(c.Hash(key)), key); v != nil || c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("expired pair is present", v)
+	}
+	if values, _ := c.MultiGet([][]byte{key, []byte("key1")}); values[0] != nil || values[1] == nil {
+		t.Fatal("wrong MultiGet of an expired pair", values)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.ExpireNow(); n != 10 || err != nil || c.Len() != 10 {
+		t.Fatal("ExpireNow returned", n, err, c.Len())
+	}
+	if n, _ := c.ExpireNow(); n != 0 {
+		t.Fatal("expired pairs were removed twice", n)
+	}
+
+	//The WAL replays the expiry
+	key = []byte("replayed")
+	if err := c.SetWithTTL(c.Hash(key), key, testValue(3000, "v"), time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	walTestCrash(c)
+	clock.set(time.Unix(0, 4000))
+	c, err = Recover(path, Options{Clock: clock, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Len() != 11 || c.Has(uint32(c.Hash(key)), key) {
+		t.Fatal("wrong pairs after recovering", c.Len())
+	}
+	for k, v := range testPairs(c) {
+		if k != string(key) && v[8:] != "permanent" {
+			t.Fatal("expired pair recovered", k, v)
+		}
+	}
+}
+
+func TestExpireNowCount(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 1000)}
+	c, err := NewWithOptions("", 1024*1024, Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//The tombstone of the newer pair is older than it, its deletion is discarded
+	for i, ts := range []uint64{500, 5000} {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.SetWithTTL(c.Hash(key), key, testValue(ts, "v"), time.Microsecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.set(time.Unix(0, 3000))
+	if n, err := c.ExpireNow(); n != 1 || err != nil || c.Len() != 1 {
+		t.Fatal("ExpireNow returned", n, err, c.Len())
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	c := NewSync("", 1024*1024)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.SetWithTTL(c.Hash(key), key, testValue(uint64(time.Now().UnixNano()), "v"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.StartExpirySweeper(time.Millisecond)
+	testEventually(t, "the sweeper didn't remove the expired pairs", func() bool {
+		return c.Len() == 0
+	})
+	c.Close()
+	testEventually(t, "Close leaked the sweeper goroutine", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+}
+
+func TestExpirySweeperConcurrentReads(t *testing.T) {
+	c := NewSync("", 1024*1024)
+	defer c.Close()
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint("key", i))
+		if err := c.SetWithTTL(c.Hash(keys[i]), keys[i], testValue(uint64(time.Now().UnixNano()), "v"), 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//The readers are locked too, the race detector checks them against the sweeper writes
+	c.StartExpirySweeper(time.Millisecond)
+	testEventually(t, "the sweeper didn't remove the expired pairs", func() bool {
+		for _, key := range keys {
+			c.Has(uint32(c.Hash(key)), key)
+		}
+		c.MultiGet(keys)
+		c.IterateKeys(func(key []byte) bool { return true })
+		c.Stats()
+		return c.Len() == 0
+	})
+}
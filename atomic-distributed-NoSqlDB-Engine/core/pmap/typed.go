@@ -0,0 +1,115 @@
+package pmap
+
+import "encoding/binary"
+
+//TypedCodec holds the functions used by a TypedMap to convert keys and values from and to bytes
+type TypedCodec[K comparable, V any] struct {
+	EncodeKey   func(key K) []byte
+	DecodeKey   func(b []byte) (K, error)
+	EncodeValue func(value V) ([]byte, error)
+	DecodeValue func(b []byte) (V, error)
+	//Hash returns the hash of a key, it is optional (the PMap Hasher hash of the encoded key is used if it is nil).
+	//It must return the same value as PMap.Hash(EncodeKey(key)), the PMap uses that hash on Open and Iterate,
+	//it is useful to provide a cheaper or cached equivalent.
+	Hash func(key K) uint64
+}
+
+/*
+A TypedMap is a PMap wrapper that stores typed keys and values.
+
+The timestamp header is handled internally: writes are timestamped with the current time of the PMap clock
+(strictly increasing for the same TypedMap), or with the next sequence number if the PMap uses
+Options.SequenceNumbers; reads strip it.
+
+Note: like PMap, TypedMap is *not* thread-safe.
+*/
+type TypedMap[K comparable, V any] struct {
+	pm    *PMap
+	codec TypedCodec[K, V]
+	last  int64 //Last used timestamp
+}
+
+//NewTypedMap returns a TypedMap that stores its pairs in pm
+func NewTypedMap[K comparable, V any](pm *PMap, codec TypedCodec[K, V]) *TypedMap[K, V] {
+	return &TypedMap[K, V]{pm: pm, codec: codec}
+}
+
+//PMap returns the underlying PMap
+func (m *TypedMap[K, V]) PMap() *PMap {
+	return m.pm
+}
+
+func (m *TypedMap[K, V]) hash(key K, k []byte) uint64 {
+	if m.codec.Hash != nil {
+		return m.codec.Hash(key)
+	}
+	return m.pm.Hash(k)
+}
+
+//Returns a value header with a timestamp newer than any previous one
+//With Options.SequenceNumbers the header is the next PMap sequence number
+func (m *TypedMap[K, V]) header(size int) []byte {
+	var t int64
+	if m.pm.sequence {
+		t = int64(m.pm.NextSequence())
+	} else {
+		t = m.pm.clock.Now().UnixNano()
+		if t <= m.last {
+			t = m.last + 1
+		}
+		m.last = t
+	}
+	b := make([]byte, 8, 8+size)
+	binary.LittleEndian.PutUint64(b, uint64(t))
+	return b
+}
+
+//Get returns the value associated with key, found is false if the pair doesn't exist (or was deleted)
+func (m *TypedMap[K, V]) Get(key K) (value V, found bool, err error) {
+	k := m.codec.EncodeKey(key)
+	v, err := m.pm.Get(uint32(m.hash(key, k)), k)
+	if err != nil || v == nil {
+		return value, false, err
+	}
+	value, err = m.codec.DecodeValue(v[8:])
+	return value, err == nil, err
+}
+
+//Set sets the value associated with key
+func (m *TypedMap[K, V]) Set(key K, value V) error {
+	k := m.codec.EncodeKey(key)
+	v, err := m.codec.EncodeValue(value)
+	if err != nil {
+		return err
+	}
+	return m.pm.Set(m.hash(key, k), k, append(m.header(len(v)), v...))
+}
+
+//Del deletes the pair associated with key
+func (m *TypedMap[K, V]) Del(key K) error {
+	k := m.codec.EncodeKey(key)
+	return m.pm.Del(m.hash(key, k), k, m.header(0))
+}
+
+//Iterate calls foreach for each stored pair, it stops early if foreach returns false
+//It returns the first decoding error found, if any
+func (m *TypedMap[K, V]) Iterate(foreach func(key K, value V) (Continue bool)) error {
+	var err error
+	iterErr := m.pm.Iterate(func(k, v []byte) bool {
+		var key K
+		var value V
+		key, err = m.codec.DecodeKey(k)
+		if err != nil {
+			return false
+		}
+		value, err = m.codec.DecodeValue(v[8:])
+		if err != nil {
+			return false
+		}
+		return foreach(key, value)
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package pmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+type typedTestUser struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+var typedTestCodec = TypedCodec[string, typedTestUser]{
+	EncodeKey: func(key string) []byte { return []byte(key) },
+	DecodeKey: func(b []byte) (string, error) { return string(b), nil },
+	EncodeValue: func(value typedTestUser) ([]byte, error) {
+		return json.Marshal(value)
+	},
+	DecodeValue: func(b []byte) (typedTestUser, error) {
+		var u typedTestUser
+		err := json.Unmarshal(b, &u)
+		return u, err
+	},
+}
+
+func TestTypedMapRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	m := NewTypedMap(New(path, 1024*1024), typedTestCodec)
+	users := make(map[string]typedTestUser)
+	for i := 0; i < 100; i++ {
+		u := typedTestUser{Name: fmt.Sprint("user", i), Age: i, Tags: []string{"a", fmt.Sprint(i)}}
+		users[u.Name] = u
+		if err := m.Set(u.Name, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Overwrites and deletes issued right after a write are applied
+	u := typedTestUser{Name: "user0", Age: 1000}
+	users[u.Name] = u
+	if err := m.Set(u.Name, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Del("user1"); err != nil {
+		t.Fatal(err)
+	}
+	delete(users, "user1")
+	m.PMap().Close()
+
+	m = NewTypedMap(testOpen(t, path), typedTestCodec)
+	defer m.PMap().Close()
+	for name, expected := range users {
+		got, found, err := m.Get(name)
+		if err != nil || !found {
+			t.Fatal(name, found, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("%s: got %v, expected %v", name, got, expected)
+		}
+	}
+	if _, found, _ := m.Get("user1"); found {
+		t.Fatal("deleted user found")
+	}
+	count := 0
+	err := m.Iterate(func(name string, u typedTestUser) bool {
+		count++
+		if fmt.Sprint(users[name]) != fmt.Sprint(u) {
+			t.Errorf("%s: iterated %v, expected %v", name, u, users[name])
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(users) {
+		t.Fatalf("iterated %d pairs, expected %d", count, len(users))
+	}
+}
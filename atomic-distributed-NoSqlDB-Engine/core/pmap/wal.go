@@ -0,0 +1,318 @@
+package pmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+
+	"launchpad.net/gommap"
+)
+
+/*
+	The WAL (write-ahead log) is an optional append-only file placed next to the store (path + ".wal").
+
+	Set, Del and CAS append an operation record to the WAL before touching the store,
+	so an operation is either fully present in the WAL or not present at all.
+	Every walCheckpointInterval operations the store is synced to disk and the WAL is
+	truncated to a single checkpoint record holding the store length at that moment.
+
+	On Open the store is only trusted up to the last checkpoint, anything written after it
+	is discarded and the WAL operations are replayed on top, recovering from partial
+	store writes caused by a crash. Recover does the same for callers that don't enable Options.WAL
+	themselves, and Sync checkpoints explicitly. A replayed operation that fails (other than a CAS whose
+	precondition failed, it failed the same way when it was logged) makes Open fail with its error.
+
+	The operation records are written to the page cache of the WAL file, only the checkpoints sync it to disk:
+	the WAL survives crashes of the process, not power loss nor crashes of the machine, which can lose the
+	operations logged after the last checkpoint. Call Sync when they must be durable.
+*/
+
+/*
+Binary structure of the WAL
+
+The WAL is a sequence of records, each one represented this way:
+	4 bytes: payload len
+	4 bytes: CRC32 (IEEE) of the payload
+	Payload:
+		1 byte: operation
+		Checkpoint: 8 bytes: store length
+		Set, Del, CAS & SetWithTTL:
+			8 bytes: key hash (h64)
+			4 bytes: key len
+			Key len bytes: key
+			Remaining bytes: value (followed by the 8 bytes expiry in SetWithTTL)
+A record with a bad CRC or a truncated record ends the WAL, it was being written during a crash.
+*/
+
+const walCheckpointInterval = 4096
+
+const walHeaderSize = 8
+
+const (
+	walCheckpoint = iota + 1
+	walSet
+	walDel
+	walCAS
+	walSetTTL
+)
+
+type wal struct {
+	file          *os.File
+	offset        int64    //Append position
+	opsSinceCheck int      //Operations appended after the last checkpoint
+	checkpointed  bool     //A checkpoint record was found on open
+	checkpoint    uint64   //Store length of the last checkpoint
+	pending       []walRec //Operations found after the last checkpoint on open, pending to be replayed
+}
+
+type walRec struct {
+	op         byte
+	h64        uint64
+	key, value []byte
+}
+
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+//Creates an empty WAL at path with the permission bits perm, checkpointed at store length 0
+func createWAL(path string, perm os.FileMode) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{file: f}
+	if err := w.writeCheckpoint(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//Opens an existing WAL (or creates it with the permission bits perm if it doesn't exist) and reads its records
+func openWAL(path string, perm os.FileMode) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &wal{file: f}
+	for offset := 0; ; {
+		payload, next := walNextRecord(buffer, offset)
+		if payload == nil {
+			//Discard the torn tail, if any
+			w.offset = int64(offset)
+			break
+		}
+		if payload[0] == walCheckpoint {
+			w.checkpointed = true
+			w.checkpoint = binary.LittleEndian.Uint64(payload[1:9])
+			w.pending = w.pending[:0]
+		} else {
+			w.pending = append(w.pending, walDecode(payload))
+		}
+		offset = next
+	}
+	if err := f.Truncate(w.offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//Returns the payload of the record at offset and the offset of the next record,
+//payload is nil if there isn't a valid record at offset
+func walNextRecord(buffer []byte, offset int) ([]byte, int) {
+	if len(buffer)-offset < walHeaderSize {
+		return nil, offset
+	}
+	n := int(binary.LittleEndian.Uint32(buffer[offset:]))
+	sum := binary.LittleEndian.Uint32(buffer[offset+4:])
+	start := offset + walHeaderSize
+	if n < 1 || n > len(buffer)-start {
+		return nil, offset
+	}
+	payload := buffer[start : start+n]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, offset
+	}
+	switch payload[0] {
+	case walCheckpoint:
+		if n != 9 {
+			return nil, offset
+		}
+	case walSet, walDel, walCAS:
+		if n < 13 || int(binary.LittleEndian.Uint32(payload[9:13])) > n-13 {
+			return nil, offset
+		}
+	case walSetTTL:
+		if n < 13+ttlSize || int(binary.LittleEndian.Uint32(payload[9:13])) > n-13-ttlSize {
+			return nil, offset
+		}
+	default:
+		return nil, offset
+	}
+	return payload, start + n
+}
+
+func walDecode(payload []byte) walRec {
+	keyLen := int(binary.LittleEndian.Uint32(payload[9:13]))
+	return walRec{
+		op:    payload[0],
+		h64:   binary.LittleEndian.Uint64(payload[1:9]),
+		key:   payload[13 : 13+keyLen],
+		value: payload[13+keyLen:],
+	}
+}
+
+func (w *wal) write(payload []byte) error {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+	n, err := w.file.WriteAt(record, w.offset)
+	w.offset += int64(n)
+	return err
+}
+
+//Appends an operation record
+func (w *wal) append(op byte, h64 uint64, key, value []byte) error {
+	payload := make([]byte, 13+len(key)+len(value))
+	payload[0] = op
+	binary.LittleEndian.PutUint64(payload[1:], h64)
+	binary.LittleEndian.PutUint32(payload[9:], uint32(len(key)))
+	copy(payload[13:], key)
+	copy(payload[13+len(key):], value)
+	w.opsSinceCheck++
+	return w.write(payload)
+}
+
+//Truncates the WAL to a single checkpoint record, the store must be synced before calling it
+func (w *wal) writeCheckpoint(length uint64) error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.offset = 0
+	payload := make([]byte, 9)
+	payload[0] = walCheckpoint
+	binary.LittleEndian.PutUint64(payload[1:], length)
+	if err := w.write(payload); err != nil {
+		return err
+	}
+	w.opsSinceCheck = 0
+	w.checkpointed = true
+	w.checkpoint = length
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+/*
+	PMap WAL integration
+*/
+
+//Appends an operation to the WAL, checkpointing first if it is due
+func (c *PMap) logOp(op byte, h64 uint64, key, value []byte) error {
+	if c.wal.opsSinceCheck >= walCheckpointInterval {
+		if err := c.checkpoint(); err != nil {
+			return err
+		}
+	}
+	return c.wal.append(op, h64, key, value)
+}
+
+//Logs a Set, or a SetWithTTL if expiry isn't 0
+func (c *PMap) logSet(h64 uint64, key, value []byte, expiry uint64) error {
+	if expiry == 0 {
+		return c.logOp(walSet, h64, key, value)
+	}
+	logged := make([]byte, len(value)+ttlSize)
+	copy(logged, value)
+	binary.LittleEndian.PutUint64(logged[len(value):], expiry)
+	return c.logOp(walSetTTL, h64, key, logged)
+}
+
+//Syncs the store to disk and truncates the WAL
+func (c *PMap) checkpoint() error {
+	if err := c.st.file.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return c.wal.writeCheckpoint(c.st.length)
+}
+
+//Replays the operations found after the last checkpoint, the WAL must not be attached yet.
+//Failed CAS preconditions are expected, replaying a CAS over the checkpointed store gives the result it originally
+//had. Any other error stops the replay and is returned
+func (c *PMap) replayWAL(w *wal) error {
+	for i, r := range w.pending {
+		var err error
+		switch r.op {
+		case walSet:
+			err = c.Set(r.h64, r.key, r.value)
+		case walDel:
+			err = c.Del(r.h64, r.key, r.value)
+		case walCAS:
+			err = c.CAS(r.h64, r.key, r.value)
+			if errors.Is(err, ErrCASTimestampMismatch) || errors.Is(err, ErrCASHashMismatch) {
+				err = nil
+			}
+		case walSetTTL:
+			n := len(r.value) - ttlSize
+			err = c.set(r.h64, r.key, r.value[:n], binary.LittleEndian.Uint64(r.value[n:]))
+		}
+		if err != nil {
+			return fmt.Errorf("WAL replay of operation %d: %w", i, err)
+		}
+	}
+	w.pending = nil
+	return nil
+}
+
+var errWALAnonymous = errors.New("WAL needs a file-backed PMap")
+
+var errNoWAL = errors.New("The PMap has no WAL to recover from")
+
+//Recover opens the PMap stored in path after an unclean shutdown with opts, replaying the WAL operations that
+//are not reflected in the store (those written after the last checkpoint). opts.WAL is set, the WAL stays enabled.
+//opts must be the Options the PMap was written with (Hasher, HashSeed, Codec, EncryptionKey...): the replayed
+//operations are applied with them.
+//It returns an error if the PMap wasn't created with Options.WAL, use Open to recover it by a full scan
+func Recover(path string, opts Options) (*PMap, error) {
+	if _, err := os.Stat(walPath(path)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoWAL
+		}
+		return nil, err
+	}
+	opts.WAL = true
+	return OpenWithOptions(path, opts)
+}
+
+//Zeroes any data placed after index, it could contain a partially written pair
+func (st *store) discardFrom(index uint64) {
+	end := index
+	for end+headerSize <= st.size && st.keyLen(end) > 0 {
+		end += st.recordSize(end)
+	}
+	//The header at end can still be half-written
+	end += headerSize
+	if end > st.size {
+		end = st.size
+	}
+	zero(st.file[index:end])
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,218 @@
+package pmap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dv343/treeless/hashing"
+)
+
+//Simulates a crash: the store and the WAL are released without checkpointing nor syncing
+func walTestCrash(c *PMap) {
+	c.wal.close()
+	c.st.close()
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	for _, n := range []int{100, walCheckpointInterval + 100} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pmap")
+			c, err := NewWithOptions(path, 16*1024*1024, Options{WAL: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make(map[string][]byte)
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprint("key", i%(n/2)))
+				value := testValue(uint64(i+1), fmt.Sprint("value", i))
+				if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[string(key)] = value
+			}
+			delKey := []byte("key1")
+			if err := c.Del(hashing.FNV1a64(delKey), delKey, testValue(uint64(n+1), "")); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, string(delKey))
+
+			//The next Set reaches the WAL but the process dies while writing the pair to the store
+			key := []byte("crashed")
+			value := testValue(uint64(n+2), "crashed value")
+			if err := c.wal.append(walSet, hashing.FNV1a64(key), key, value); err != nil {
+				t.Fatal(err)
+			}
+			c.st.setKeyLen(c.st.length, uint32(len(key)))
+			c.st.setValLen(c.st.length, uint32(len(value)))
+			expected[string(key)] = value
+			walTestCrash(c)
+
+			c, err = OpenWithOptions(path, Options{WAL: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			walTestCheck(t, c, expected)
+			c.Close()
+
+			//After recovering the store is consistent by itself
+			c = testOpen(t, path)
+			walTestCheck(t, c, expected)
+			c.Close()
+		})
+	}
+}
+
+func walTestCheck(t *testing.T, c *PMap, expected map[string][]byte) {
+	for k, v := range expected {
+		key := []byte(k)
+		got, err := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, v) {
+			t.Fatalf("key %s: got %v, expected %v", k, got, v)
+		}
+	}
+	count := 0
+	c.Iterate(func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if count != len(expected) {
+		t.Fatalf("Iterate found %d pairs, expected %d", count, len(expected))
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 1024*1024, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("a")
+	if err := c.Set(hashing.FNV1a64(key), key, testValue(1, "first")); err != nil {
+		t.Fatal(err)
+	}
+	//A torn WAL append must be ignored, its operation never touched the store
+	offset := c.wal.offset
+	c.wal.append(walSet, hashing.FNV1a64(key), key, testValue(2, "second"))
+	c.wal.file.Truncate(offset + 5)
+	walTestCrash(c)
+
+	c, err = OpenWithOptions(path, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	walTestCheck(t, c, map[string][]byte{"a": testValue(1, "first")})
+}
+
+func TestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	if _, err := Recover(path, Options{}); err != errNoWAL {
+		t.Fatal("Recover without a WAL:", err)
+	}
+	c, err := NewWithOptions(path, 1024*1024, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := testValue(uint64(i+1), fmt.Sprint("value", i))
+		if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = value
+	}
+	//Sync checkpoints, the WAL only keeps the operations written after it
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.wal.pending) != 0 || c.wal.offset != walHeaderSize+9 {
+		t.Fatal("Sync didn't truncate the WAL", c.wal.offset)
+	}
+	key := []byte("after sync")
+	value := testValue(200, "value")
+	if err := c.Set(hashing.FNV1a64(key), key, value); err != nil {
+		t.Fatal(err)
+	}
+	expected[string(key)] = value
+	walTestCrash(c)
+
+	c, err = Recover(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Recovered() {
+		t.Fatal("the crash was not detected")
+	}
+	walTestCheck(t, c, expected)
+}
+
+func TestRecoverWithOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	opts := Options{WAL: true, HashSeed: 7}
+	c, err := NewWithOptions(path, 1024*1024, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		value := testValue(uint64(i+1), fmt.Sprint("value", i))
+		if err := c.Set(c.Hash(key), key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = value
+		if i == 4 {
+			if err := c.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	walTestCrash(c)
+
+	//The restored and the replayed pairs must both be hashed with the seed
+	c, err = Recover(path, Options{HashSeed: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for k, v := range expected {
+		key := []byte(k)
+		got, err := c.Get(uint32(c.Hash(key)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, v) {
+			t.Fatalf("key %s: got %v, expected %v", k, got, v)
+		}
+	}
+}
+
+func TestWALReplayError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pmap")
+	c, err := NewWithOptions(path, 64*1024, Options{WAL: true, NoAutoGrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Log operations that don't fit in the store without applying them
+	body := string(make([]byte, 16*1024))
+	for i := 0; i < 8; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		if err := c.wal.append(walSet, hashing.FNV1a64(key), key, testValue(1, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walTestCrash(c)
+
+	_, err = OpenWithOptions(path, Options{WAL: true, NoAutoGrow: true})
+	if !errors.Is(err, ErrStoreFull) {
+		t.Fatal("the replay must fail with ErrStoreFull:", err)
+	}
+}
@@ -0,0 +1,30 @@
+package hashing
+
+//Digest computes FNV1a64 incrementally, it implements io.Writer.
+//Writing several slices gives the hash of their concatenation, without concatenating them
+type Digest struct {
+	h uint64
+}
+
+//NewDigest returns a Digest of no bytes, Sum64 returns FNV1a64(nil)
+func NewDigest() *Digest {
+	d := new(Digest)
+	d.Reset()
+	return d
+}
+
+//Reset discards the written bytes, the Digest can be reused
+func (d *Digest) Reset() {
+	d.h = offset64
+}
+
+//Write adds b to the hashed bytes, it never fails
+func (d *Digest) Write(b []byte) (int, error) {
+	d.h = FNV1a64Seed(b, d.h)
+	return len(b), nil
+}
+
+//Sum64 returns the FNV1a64 hash of the bytes written since the last Reset
+func (d *Digest) Sum64() uint64 {
+	return d.h
+}
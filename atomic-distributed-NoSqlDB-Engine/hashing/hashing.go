@@ -1,13 +1,48 @@
 package hashing
 
+import "math/bits"
+
 const (
 	offset64 = 14695981039346656037
 	prime64  = 1099511628211
 )
 
+//Hasher computes the 64-bit hash of keys
+type Hasher interface {
+	Hash64(b []byte) uint64
+}
+
+//FNV1a is the Hasher of FNV1a64, the default one
+type FNV1a struct{}
+
+//Hash64 returns FNV1a64(b)
+func (FNV1a) Hash64(b []byte) uint64 {
+	return FNV1a64(b)
+}
+
+//Default is the Hasher used when none is provided
+var Default Hasher = FNV1a{}
+
+//SeededFNV1a is the Hasher of FNV1a64Seed with a fixed seed.
+//Tables indexed by hashers with different seeds have independent collision patterns
+type SeededFNV1a struct {
+	Seed uint64
+}
+
+//Hash64 returns FNV1a64Seed(b, h.Seed)
+func (h SeededFNV1a) Hash64(b []byte) uint64 {
+	return FNV1a64Seed(b, h.Seed)
+}
+
 //FNV1a64 computes the FNV1a64 hash of b
 func FNV1a64(b []byte) uint64 {
-	h := uint64(offset64)
+	return FNV1a64Seed(b, offset64)
+}
+
+//FNV1a64Seed computes the FNV1a64 hash of b starting from seed instead of the FNV offset basis,
+//FNV1a64Seed(b, 14695981039346656037) is FNV1a64(b)
+func FNV1a64Seed(b []byte, seed uint64) uint64 {
+	h := seed
 	for _, c := range b {
 		h ^= uint64(c)
 		h *= prime64
@@ -16,7 +51,90 @@ func FNV1a64(b []byte) uint64 {
 }
 
 //GetChunkID returns the associated chunkID of a key b
+//Changing numChunks remaps almost every key (all but about 1/numChunks of them), use JumpChunkID
+//to move only the keys of the new chunks
 func GetChunkID(b []byte, numChunks int) int {
-	h := FNV1a64(b)
+	return GetChunkIDWithHasher(Default, b, numChunks)
+}
+
+//GetChunkIDWithHasher returns the associated chunkID of a key b hashed with hasher,
+//it must be the Hasher of the chunk PMaps
+func GetChunkIDWithHasher(hasher Hasher, b []byte, numChunks int) int {
+	h := hasher.Hash64(b)
 	return int((h >> 32) % uint64(numChunks))
 }
+
+//GetReplicaChunks returns the replica set of a key b: its GetChunkID chunk followed by the next replicas-1 chunks,
+//wrapping around numChunks. The chunks are distinct, replicas is clamped to numChunks
+func GetReplicaChunks(b []byte, numChunks, replicas int) []int {
+	return GetReplicaChunksWithHasher(Default, b, numChunks, replicas)
+}
+
+//GetReplicaChunksWithHasher returns the GetReplicaChunks of a key b hashed with hasher
+func GetReplicaChunksWithHasher(hasher Hasher, b []byte, numChunks, replicas int) []int {
+	if replicas > numChunks {
+		replicas = numChunks
+	}
+	if replicas <= 0 {
+		return nil
+	}
+	primary := GetChunkIDWithHasher(hasher, b, numChunks)
+	chunks := make([]int, replicas)
+	for i := range chunks {
+		chunks[i] = (primary + i) % numChunks
+	}
+	return chunks
+}
+
+//GetChunkIDWeighted returns the associated chunkID of a key b, a chunk i is selected with probability
+//weights[i] / sum(weights): heavier chunks (bigger nodes) receive more keys. Chunks with weight 0 receive none.
+//It panics if a weight is negative or if every weight is 0. Changing any weight remaps keys of every chunk
+func GetChunkIDWeighted(b []byte, weights []int) int {
+	return GetChunkIDWeightedWithHasher(Default, b, weights)
+}
+
+//GetChunkIDWeightedWithHasher returns the GetChunkIDWeighted of a key b hashed with hasher
+func GetChunkIDWeightedWithHasher(hasher Hasher, b []byte, weights []int) int {
+	var total uint64
+	for _, w := range weights {
+		if w < 0 {
+			panic("negative chunk weight")
+		}
+		total += uint64(w)
+	}
+	if total == 0 {
+		panic("every chunk weight is 0")
+	}
+	//hash * total / 2^64 is uniform in [0, total)
+	x, _ := bits.Mul64(hasher.Hash64(b), total)
+	for i, w := range weights {
+		if x < uint64(w) {
+			return i
+		}
+		x -= uint64(w)
+	}
+	panic("unreachable")
+}
+
+//JumpChunkID returns the associated chunkID of a key b using jump consistent hashing (Lamping and Veach).
+//Growing numChunks from N to N+1 only moves about 1/(N+1) of the keys, all of them to the new chunk.
+//It is not compatible with GetChunkID, every node of a DB must use the same function
+func JumpChunkID(b []byte, numChunks int) int {
+	return JumpChunkIDWithHasher(Default, b, numChunks)
+}
+
+//JumpChunkIDWithHasher returns the JumpChunkID of a key b hashed with hasher
+func JumpChunkIDWithHasher(hasher Hasher, b []byte, numChunks int) int {
+	return jumpHash(hasher.Hash64(b), numChunks)
+}
+
+//Jump consistent hash of key in [0, n)
+func jumpHash(key uint64, n int) int {
+	bucket, j := int64(-1), int64(0)
+	for j < int64(n) {
+		bucket = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(bucket+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(bucket)
+}
@@ -0,0 +1,265 @@
+package hashing
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestDefaultHasher(t *testing.T) {
+	for _, key := range []string{"", "a", "key0", "a longer key with several words"} {
+		if Default.Hash64([]byte(key)) != FNV1a64([]byte(key)) {
+			t.Fatal("the default Hasher is not FNV1a64", key)
+		}
+		if GetChunkIDWithHasher(Default, []byte(key), 8) != GetChunkID([]byte(key), 8) {
+			t.Fatal("GetChunkID doesn't use the default Hasher", key)
+		}
+	}
+	//Offset basis and a known vector
+	if FNV1a64(nil) != 0xcbf29ce484222325 || FNV1a64([]byte("a")) != 0xaf63dc4c8601ec8c {
+		t.Fatal("FNV1a64 changed")
+	}
+}
+
+func TestXXH64(t *testing.T) {
+	//Reference vectors, the last one has a 32 byte stripe, a 8 byte lane, a 4 byte word and single bytes
+	vectors := []struct {
+		in   string
+		seed uint64
+		out  uint64
+	}{
+		{"", 0, 0xef46db3751d8e999},
+		{"", 2654435761, 0xac75fda2929b17ef},
+		{"a", 0, 0xd24ec4f1a98c6e5b},
+		{"as", 0, 0x1c330fb2d66be179},
+		{"asd", 0, 0x631c37ce72a97393},
+		{"asdf", 0, 0x415872f599cea71e},
+		{"abc", 0, 0x44bc2cf5ad770999},
+		{"Call me Ishmael. Some years ago--never mind how long precisely-", 0, 0x02a2e85470d6fd96},
+	}
+	for _, v := range vectors {
+		if h := XXH64([]byte(v.in), v.seed); h != v.out {
+			t.Errorf("XXH64(%q, %d) = %#x, expected %#x", v.in, v.seed, h, v.out)
+		}
+	}
+	var hasher Hasher = XXHash64{Seed: 2654435761}
+	if hasher.Hash64(nil) != 0xac75fda2929b17ef {
+		t.Fatal("XXHash64 doesn't use its seed")
+	}
+}
+
+func benchmarkHash(b *testing.B, hash func([]byte) uint64) {
+	key := make([]byte, 4096)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	b.SetBytes(int64(len(key)))
+	for i := 0; i < b.N; i++ {
+		hash(key)
+	}
+}
+
+func BenchmarkFNV1a64(b *testing.B) {
+	benchmarkHash(b, FNV1a64)
+}
+
+func BenchmarkXXH64(b *testing.B) {
+	benchmarkHash(b, func(key []byte) uint64 { return XXH64(key, 0) })
+}
+
+//Returns the fraction of numKeys keys whose chunk changes when numChunks is increased by one
+func testMovedKeys(t *testing.T, chunkID func([]byte, int) int, numKeys, numChunks int, onlyToNew bool) float64 {
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		before, after := chunkID(key, numChunks), chunkID(key, numChunks+1)
+		if before < 0 || before >= numChunks || after < 0 || after > numChunks {
+			t.Fatal("chunk out of range", before, after)
+		}
+		if before != after {
+			moved++
+			if onlyToNew && after != numChunks {
+				t.Fatal("key moved between old chunks", string(key), before, after)
+			}
+		}
+	}
+	return float64(moved) / float64(numKeys)
+}
+
+func TestJumpChunkID(t *testing.T) {
+	const numKeys = 100000
+	for _, n := range []int{1, 7, 16, 100} {
+		theory := 1 / float64(n+1)
+		jump := testMovedKeys(t, JumpChunkID, numKeys, n, true)
+		if math.Abs(jump-theory) > 0.1*theory+0.002 {
+			t.Errorf("%d => %d chunks: jump moved %.4f of the keys, expected %.4f", n, n+1, jump, theory)
+		}
+		modulo := testMovedKeys(t, GetChunkID, numKeys, n, false)
+		t.Logf("%d => %d chunks: jump moved %.4f, GetChunkID moved %.4f", n, n+1, jump, modulo)
+	}
+	if JumpChunkID([]byte("key"), 1) != 0 {
+		t.Fatal("a single chunk must hold every key")
+	}
+}
+
+func TestGetReplicaChunks(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		chunks := GetReplicaChunks(key, 5, 3)
+		if len(chunks) != 3 || chunks[0] != GetChunkID(key, 5) {
+			t.Fatal("wrong replica set", chunks)
+		}
+		seen := make(map[int]bool)
+		for j, c := range chunks {
+			if c < 0 || c >= 5 || seen[c] {
+				t.Fatal("invalid or repeated chunk", chunks)
+			}
+			seen[c] = true
+			if c != GetReplicaChunks(key, 5, 3)[j] {
+				t.Fatal("the replica set is not deterministic", chunks)
+			}
+		}
+	}
+	//Replicas are clamped to the number of chunks
+	if chunks := GetReplicaChunks([]byte("key"), 3, 5); len(chunks) != 3 {
+		t.Fatal("wrong clamped replica set", chunks)
+	}
+	if chunks := GetReplicaChunks([]byte("key"), 3, 0); len(chunks) != 0 {
+		t.Fatal("wrong empty replica set", chunks)
+	}
+}
+
+func TestGetChunkIDWeighted(t *testing.T) {
+	weights := []int{1, 2, 0, 5}
+	const numKeys = 400000
+	counts := make([]int, len(weights))
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		id := GetChunkIDWeighted(key, weights)
+		if id != GetChunkIDWeighted(key, weights) {
+			t.Fatal("the mapping is not deterministic", string(key))
+		}
+		counts[id]++
+	}
+	for i, w := range weights {
+		expected := float64(numKeys) * float64(w) / 8
+		if math.Abs(float64(counts[i])-expected) > 0.02*numKeys {
+			t.Errorf("chunk %d with weight %d has %d keys, expected about %.0f", i, w, counts[i], expected)
+		}
+	}
+	if counts[2] != 0 {
+		t.Fatal("a chunk with weight 0 received keys")
+	}
+	//Equal weights distribute keys like numChunks equal chunks
+	equal := make([]int, 4)
+	for i := 0; i < numKeys; i++ {
+		equal[GetChunkIDWeighted([]byte(fmt.Sprint("key", i)), []int{3, 3, 3, 3})]++
+	}
+	for i, n := range equal {
+		if math.Abs(float64(n)-numKeys/4) > 0.02*numKeys {
+			t.Errorf("chunk %d has %d keys with equal weights", i, n)
+		}
+	}
+}
+
+//Returns the node of each of numKeys keys
+func testLocate(r *Ring, numKeys int) []string {
+	nodes := make([]string, numKeys)
+	for i := range nodes {
+		nodes[i] = r.Locate([]byte(fmt.Sprint("key", i)))
+	}
+	return nodes
+}
+
+func TestRing(t *testing.T) {
+	const numKeys, vnodes = 100000, 200
+	var r Ring
+	if r.Locate([]byte("key")) != "" {
+		t.Fatal("empty ring located a key")
+	}
+	for i := 0; i < 4; i++ {
+		r.AddNode(fmt.Sprint("node", i), vnodes)
+	}
+	before := testLocate(&r, numKeys)
+	counts := make(map[string]int)
+	for _, n := range before {
+		counts[n]++
+	}
+	for n, c := range counts {
+		if math.Abs(float64(c)-numKeys/4) > 0.25*numKeys/4 {
+			t.Errorf("node %s has %d keys, expected about %d", n, c, numKeys/4)
+		}
+	}
+
+	//Adding a node only moves keys to it, about 1/5 of them
+	r.AddNode("node4", vnodes)
+	after := testLocate(&r, numKeys)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			if after[i] != "node4" {
+				t.Fatal("key moved between old nodes", before[i], after[i])
+			}
+			moved++
+		}
+	}
+	if f := float64(moved) / numKeys; math.Abs(f-0.2) > 0.05 {
+		t.Errorf("adding a node moved %.4f of the keys, expected about 0.2", f)
+	}
+
+	//Removing a node only moves its keys, and the ring only depends on its nodes
+	r.RemoveNode("node1")
+	removed := testLocate(&r, numKeys)
+	for i := range after {
+		if after[i] != removed[i] && after[i] != "node1" {
+			t.Fatal("key of a remaining node moved", after[i], removed[i])
+		}
+		if removed[i] == "node1" {
+			t.Fatal("key located on a removed node")
+		}
+	}
+	r.AddNode("node1", vnodes)
+	r.RemoveNode("node4")
+	for i, n := range testLocate(&r, numKeys) {
+		if n != before[i] {
+			t.Fatal("the ring is not deterministic", i, n, before[i])
+		}
+	}
+	if r.Nodes() != 4 {
+		t.Fatal("wrong number of nodes", r.Nodes())
+	}
+}
+
+func TestFNV1a64Seed(t *testing.T) {
+	key := []byte("key0")
+	if FNV1a64Seed(key, offset64) != FNV1a64(key) {
+		t.Fatal("FNV1a64Seed with the offset basis is not FNV1a64")
+	}
+	h1, h2 := FNV1a64Seed(key, 1), FNV1a64Seed(key, 2)
+	if h1 == FNV1a64(key) || h1 == h2 {
+		t.Fatal("seeds don't change the hash", h1, h2)
+	}
+	if FNV1a64Seed(key, 1) != h1 || (SeededFNV1a{Seed: 2}).Hash64(key) != h2 {
+		t.Fatal("FNV1a64Seed is not deterministic")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	a, b := []byte("a key assembled "), []byte("from two buffers")
+	d := NewDigest()
+	if d.Sum64() != FNV1a64(nil) {
+		t.Fatal("new Digest is not empty")
+	}
+	var w io.Writer = d
+	w.Write(a)
+	w.Write(b)
+	if d.Sum64() != FNV1a64(append(a, b...)) {
+		t.Fatal("Digest of the parts differs from FNV1a64 of the concatenation")
+	}
+	d.Reset()
+	d.Write(b)
+	if d.Sum64() != FNV1a64(b) {
+		t.Fatal("Reset didn't discard the written bytes")
+	}
+}
@@ -0,0 +1,93 @@
+package hashing
+
+import (
+	"sort"
+	"strconv"
+)
+
+//Ring is a consistent hash ring: each node is placed on the ring at several points (virtual nodes) and a key
+//belongs to the first virtual node found clockwise from its hash.
+//Adding or removing a node only moves the keys of the ring arcs it gains or loses, about 1/N of them.
+//Virtual node i of a node is placed at the mixed FNV1a64 hash of "id#i", every process builds the same ring
+//from the same nodes. Its zero value is an empty ring.
+//Ring is *not* thread-safe
+type Ring struct {
+	points []ringPoint    //Virtual nodes sorted by hash
+	nodes  map[string]int //Node id => number of virtual nodes
+}
+
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+//FNV1a64 hashes of strings that only differ in their last bytes are close to each other, the splitmix64
+//finalizer spreads them over the ring
+func ringHash(b []byte) uint64 {
+	h := FNV1a64(b)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+//Returns true if point a goes before point b, equal hashes are ordered by id to keep the ring deterministic
+func (a ringPoint) less(b ringPoint) bool {
+	return a.hash < b.hash || a.hash == b.hash && a.id < b.id
+}
+
+//AddNode adds the node id with vnodes virtual nodes, more virtual nodes give a more even key distribution
+//(and a node with more virtual nodes than the others receives more keys). Adding an existing node replaces
+//its virtual nodes
+func (r *Ring) AddNode(id string, vnodes int) {
+	r.RemoveNode(id)
+	if vnodes <= 0 {
+		return
+	}
+	if r.nodes == nil {
+		r.nodes = make(map[string]int)
+	}
+	r.nodes[id] = vnodes
+	name := []byte(id + "#")
+	for i := 0; i < vnodes; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(strconv.AppendInt(name, int64(i), 10)), id: id})
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].less(r.points[j]) })
+}
+
+//RemoveNode removes the node id and its virtual nodes, its keys move to the nodes that follow them on the ring
+func (r *Ring) RemoveNode(id string) {
+	if _, ok := r.nodes[id]; !ok {
+		return
+	}
+	delete(r.nodes, id)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.id != id {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+//Nodes returns the number of nodes of the ring
+func (r *Ring) Nodes() int {
+	return len(r.nodes)
+}
+
+//Locate returns the node that holds key: the node of the first virtual node clockwise from the key hash.
+//It returns "" if the ring is empty
+func (r *Ring) Locate(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		//Wrap around
+		i = 0
+	}
+	return r.points[i].id
+}